@@ -1,4 +1,3 @@
-
 package aether
 
 import (
@@ -6,6 +5,7 @@ import (
 	"log"
 	"time"
 
+	"github.com/google/uuid"
 	"github.com/gorilla/websocket"
 )
 
@@ -22,16 +22,52 @@ type Client struct {
 	conn  *websocket.Conn
 	send  chan []byte
 	Topic *Topic // This remains for API consistency, but hub is the primary.
+
+	userID    string   // Authenticated identity stamped onto every envelope.
+	apps      []string // Apps the client may act for; nil for any. See Envelope.BindAppID.
+	sessionID string   // Identifies this connection in envelope metadata.
+}
+
+// NewClient creates a new client acting on behalf of userID and, when apps
+// is not nil, only the apps listed in it.
+func NewClient(conn *websocket.Conn, hubTopic *Topic, userID string, apps []string) *Client {
+	return &Client{
+		hub:       hubTopic,
+		conn:      conn,
+		Topic:     hubTopic, // The primary topic for this connection
+		send:      make(chan []byte, 256),
+		userID:    userID,
+		apps:      apps,
+		sessionID: uuid.New().String(),
+	}
 }
 
-// NewClient creates a new client.
-func NewClient(conn *websocket.Conn, hubTopic *Topic) *Client {
+// NewLocalClient creates a client for a subscriber inside the broker process,
+// which reads messages from Messages instead of a websocket.
+func NewLocalClient(userID string) *Client {
 	return &Client{
-		hub:   hubTopic,
-		conn:  conn,
-		Topic: hubTopic, // The primary topic for this connection
-		send:  make(chan []byte, 256),
+		send:   make(chan []byte, 256),
+		userID: userID,
+	}
+}
+
+// Messages returns the channel a local client receives messages on. Topics
+// close it when the client is unsubscribed or falls too far behind.
+func (c *Client) Messages() <-chan []byte {
+	return c.send
+}
+
+// accepts reports whether the client receives envelopes addressed to user
+// and session. Envelopes without a user go to everyone. Local clients have no
+// session and receive everything addressed to their user.
+func (c *Client) accepts(user, session string) bool {
+	if user == "" {
+		return true
+	}
+	if c.userID != user {
+		return false
 	}
+	return session == "" || c.sessionID == "" || c.sessionID == session
 }
 
 // ReadPump pumps messages from the websocket connection to the hub.
@@ -40,6 +76,7 @@ func (c *Client) ReadPump() {
 	defer func() {
 		c.hub.Unsubscribe(c)
 		c.conn.Close()
+		c.closeSession()
 	}()
 	c.conn.SetReadLimit(maxMessageSize)
 	c.conn.SetReadDeadline(time.Now().Add(pongWait))
@@ -59,6 +96,29 @@ func (c *Client) ReadPump() {
 			continue
 		}
 		// The client now sends a clean envelope, so env.Payload is what we need.
+		if err := env.SetUserID(c.userID); err != nil {
+			log.Printf("invalid envelope metadata: %v", err)
+			continue
+		}
+		if err := env.SetSessionID(c.sessionID); err != nil {
+			log.Printf("invalid envelope metadata: %v", err)
+			continue
+		}
+		if err := env.BindAppID(c.apps); err != nil {
+			log.Printf("invalid envelope metadata: %v", err)
+			continue
+		}
+		if IsSystemTopic(env.Topic) {
+			log.Printf("dropping client message to system topic %s", env.Topic)
+			continue
+		}
+
+		// Control messages let the client follow topics created at runtime,
+		// such as the per-watch topics returned by vfs:watch.
+		if env.Topic == "bus:subscribe" || env.Topic == "bus:unsubscribe" {
+			c.handleSubscription(&env)
+			continue
+		}
 
 		// Dynamic Topic Publishing: Get the topic from the envelope and publish.
 		targetTopic := c.hub.broker.GetTopic(env.Topic)
@@ -70,6 +130,40 @@ func (c *Client) ReadPump() {
 	}
 }
 
+// closeSession tells the broker's session handlers that the client's
+// session has ended, so that what it started can be cleaned up.
+func (c *Client) closeSession() {
+	c.hub.broker.sessionClosed(c.userID, c.sessionID)
+}
+
+// handleSubscription subscribes the client to, or detaches it from, the topic
+// named in the control envelope's payload. Clients may only subscribe to
+// existing private topics of their user, such as the topics of their
+// vfs:watch watches.
+func (c *Client) handleSubscription(env *Envelope) {
+	var req struct {
+		Topic string `json:"topic"`
+	}
+	if err := json.Unmarshal(env.Payload, &req); err != nil || req.Topic == "" {
+		log.Printf("invalid %s request: missing topic", env.Topic)
+		return
+	}
+	topic, ok := c.hub.broker.lookupTopic(req.Topic)
+	if !ok {
+		log.Printf("%s request for unknown topic %s", env.Topic, req.Topic)
+		return
+	}
+	if env.Topic == "bus:unsubscribe" {
+		topic.Detach(c)
+		return
+	}
+	if owner := c.hub.broker.topicOwner(topic); owner == "" || owner != c.userID {
+		log.Printf("refusing %s's subscription to topic %s", c.userID, req.Topic)
+		return
+	}
+	topic.Subscribe(c)
+}
+
 // WritePump pumps messages from the hub to the websocket connection.
 func (c *Client) WritePump() {
 	ticker := time.NewTicker(pingPeriod)
@@ -1,8 +1,8 @@
-
 package aether
 
 import (
 	"encoding/json"
+	"strings"
 	"time"
 )
 
@@ -22,3 +22,81 @@ type Envelope struct {
 func (e *Envelope) Bytes() ([]byte, error) {
 	return json.Marshal(e)
 }
+
+// SetUserID records the authenticated user in the envelope's metadata,
+// replacing any value the sender supplied so identities cannot be spoofed.
+func (e *Envelope) SetUserID(userID string) error {
+	return e.setMeta("userId", userID)
+}
+
+// SetSessionID records the bus session the envelope arrived on, replacing
+// any value the sender supplied.
+func (e *Envelope) SetSessionID(sessionID string) error {
+	return e.setMeta("sessionId", sessionID)
+}
+
+// BindAppID restricts the app in the envelope's metadata to apps, the ones
+// its sender may act for. A claimed app outside apps is replaced with none,
+// or with the only app when the sender is bound to one. A nil apps leaves
+// the claim as it is.
+func (e *Envelope) BindAppID(apps []string) error {
+	if apps == nil {
+		return nil
+	}
+	if len(apps) == 1 {
+		return e.setMeta("appId", apps[0])
+	}
+	var meta struct {
+		AppId string `json:"appId"`
+	}
+	if len(e.Meta) > 0 {
+		if err := json.Unmarshal(e.Meta, &meta); err != nil {
+			return err
+		}
+	}
+	for _, app := range apps {
+		if app == meta.AppId {
+			return nil
+		}
+	}
+	return e.setMeta("appId", "")
+}
+
+func (e *Envelope) setMeta(key, value string) error {
+	meta := make(map[string]interface{})
+	if len(e.Meta) > 0 {
+		if err := json.Unmarshal(e.Meta, &meta); err != nil {
+			return err
+		}
+	}
+	meta[key] = value
+	raw, err := json.Marshal(meta)
+	if err != nil {
+		return err
+	}
+	e.Meta = raw
+	return nil
+}
+
+// recipient returns the user and session an envelope is delivered to, taken
+// from the userId and sessionId in its metadata. Replies copy the request's
+// metadata, so they only reach the session that asked. Either is empty when
+// the envelope is not addressed that narrowly.
+func (e *Envelope) recipient() (user, session string, err error) {
+	var meta struct {
+		UserId    string `json:"userId"`
+		SessionId string `json:"sessionId"`
+	}
+	if len(e.Meta) > 0 {
+		if err := json.Unmarshal(e.Meta, &meta); err != nil {
+			return "", "", err
+		}
+	}
+	return meta.UserId, meta.SessionId, nil
+}
+
+// IsSystemTopic reports whether only the broker itself may publish to
+// topic. Messages from clients and guests to such topics are dropped.
+func IsSystemTopic(topic string) bool {
+	return strings.HasPrefix(topic, "session:")
+}
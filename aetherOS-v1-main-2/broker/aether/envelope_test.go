@@ -0,0 +1,50 @@
+package aether
+
+import (
+	"encoding/json"
+	"testing"
+)
+
+func TestBindAppID(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    string
+		apps    []string
+		want    string
+		wantErr bool
+	}{
+		{"any app", `{"appId":"admin.tool"}`, nil, "admin.tool", false},
+		{"allowed app", `{"appId":"notes"}`, []string{"notes", "files"}, "notes", false},
+		{"other app", `{"appId":"admin.tool"}`, []string{"notes", "files"}, "", false},
+		{"no apps", `{"appId":"notes"}`, []string{}, "", false},
+		{"bound to one", `{"appId":"admin.tool"}`, []string{"notes"}, "notes", false},
+		{"no claim", ``, []string{"notes"}, "notes", false},
+		{"malformed meta", `[1]`, []string{"notes", "files"}, "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			env := &Envelope{Meta: json.RawMessage(tt.meta)}
+			err := env.BindAppID(tt.apps)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("want an error for malformed metadata")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var meta struct {
+				AppId string `json:"appId"`
+			}
+			if len(env.Meta) > 0 {
+				if err := json.Unmarshal(env.Meta, &meta); err != nil {
+					t.Fatal(err)
+				}
+			}
+			if meta.AppId != tt.want {
+				t.Errorf("appId = %q, want %q", meta.AppId, tt.want)
+			}
+		})
+	}
+}
@@ -9,8 +9,14 @@ import (
 type Broker struct {
 	topics map[string]*Topic
 	mu     sync.RWMutex
+
+	sessionMu       sync.RWMutex
+	sessionHandlers []SessionHandler
 }
 
+// SessionHandler is called with the user and ID of a client session that has ended.
+type SessionHandler func(userID, sessionID string)
+
 // NewBroker creates a new broker.
 func NewBroker() *Broker {
 	return &Broker{
@@ -44,3 +50,57 @@ func (b *Broker) GetTopic(name string) *Topic {
 	}
 	return b.topics[name]
 }
+
+// OpenPrivateTopic returns the topic name, creating it if needed, and makes
+// owner the only user whose clients may follow it with bus:subscribe.
+func (b *Broker) OpenPrivateTopic(name, owner string) *Topic {
+	topic := b.GetTopic(name)
+	b.mu.Lock()
+	topic.owner = owner
+	b.mu.Unlock()
+	return topic
+}
+
+// lookupTopic returns the topic name if it exists, without creating it.
+func (b *Broker) lookupTopic(name string) (*Topic, bool) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	topic, ok := b.topics[name]
+	return topic, ok
+}
+
+// topicOwner returns the user a private topic belongs to, or "".
+func (b *Broker) topicOwner(topic *Topic) string {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return topic.owner
+}
+
+// CloseTopic removes the topic name and stops its event loop. Its clients
+// are dropped without closing their send channels.
+func (b *Broker) CloseTopic(name string) {
+	b.mu.Lock()
+	topic, ok := b.topics[name]
+	delete(b.topics, name)
+	b.mu.Unlock()
+	if ok {
+		close(topic.done)
+	}
+}
+
+// OnSessionClosed registers fn to be called when a client session ends.
+func (b *Broker) OnSessionClosed(fn SessionHandler) {
+	b.sessionMu.Lock()
+	defer b.sessionMu.Unlock()
+	b.sessionHandlers = append(b.sessionHandlers, fn)
+}
+
+// sessionClosed calls the session handlers for an ended session.
+func (b *Broker) sessionClosed(userID, sessionID string) {
+	b.sessionMu.RLock()
+	handlers := append([]SessionHandler(nil), b.sessionHandlers...)
+	b.sessionMu.RUnlock()
+	for _, fn := range handlers {
+		fn(userID, sessionID)
+	}
+}
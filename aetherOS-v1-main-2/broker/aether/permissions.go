@@ -1,4 +1,3 @@
-
 package aether
 
 import (
@@ -7,6 +6,7 @@ import (
 	"io/ioutil"
 	"log"
 	"os"
+	"path"
 	"path/filepath"
 	"sync"
 )
@@ -108,6 +108,52 @@ func (pm *PermissionManager) HasPermission(appID string, requiredPermission stri
 	return false
 }
 
+// HasScopedPermission checks if an app has a permission for a given scope,
+// such as a bus topic. A permission set to true covers every scope; one set
+// to a pattern or a list of patterns covers the scopes matching one of them,
+// as path.Match does.
+func (pm *PermissionManager) HasScopedPermission(appID, requiredPermission, scope string) bool {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	manifest, ok := pm.manifests[appID]
+	if !ok {
+		log.Printf("Permission check failed: No manifest found for app ID '%s'", appID)
+		return false
+	}
+
+	var patterns []interface{}
+	switch value := manifest.Permissions[requiredPermission].(type) {
+	case bool:
+		if value {
+			return true
+		}
+	case string:
+		patterns = []interface{}{value}
+	case []interface{}:
+		patterns = value
+	}
+	for _, pattern := range patterns {
+		if p, ok := pattern.(string); ok {
+			if matched, _ := path.Match(p, scope); matched {
+				return true
+			}
+		}
+	}
+
+	log.Printf("Permission denied for app '%s': missing required permission '%s' for '%s'", appID, requiredPermission, scope)
+	return false
+}
+
+// GetManifest returns the manifest of a given app.
+func (pm *PermissionManager) GetManifest(appID string) (*AppManifest, bool) {
+	pm.mu.RLock()
+	defer pm.mu.RUnlock()
+
+	manifest, ok := pm.manifests[appID]
+	return manifest, ok
+}
+
 // GetPermissions returns all permissions for a given app.
 func (pm *PermissionManager) GetPermissions(appID string) map[string]interface{} {
 	pm.mu.RLock()
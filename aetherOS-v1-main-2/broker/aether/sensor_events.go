@@ -1,7 +1,13 @@
 
 package aether
 
-import "time"
+import (
+	"encoding/json"
+	"log"
+	"time"
+
+	"github.com/google/uuid"
+)
 
 // SensorEvent represents a generic event captured by a kernel sensor.
 type SensorEvent struct {
@@ -18,3 +24,34 @@ type VfsEvent struct {
 	Error     string `json:"error,omitempty"`
 	Size      int64  `json:"size,omitempty"`
 }
+
+// PublishVfsTelemetry reports a VFS operation on telemetry:vfs. An operation
+// that failed with err is reported as unsuccessful.
+func PublishVfsTelemetry(b *Broker, operation, key string, err error, size int64) {
+	vfsEvent := VfsEvent{
+		Operation: operation,
+		Path:      key,
+		Success:   err == nil,
+		Size:      size,
+	}
+	if err != nil {
+		vfsEvent.Error = err.Error()
+	}
+	payloadBytes, marshalErr := json.Marshal(SensorEvent{
+		Type:      "vfs",
+		Timestamp: time.Now(),
+		Payload:   vfsEvent,
+	})
+	if marshalErr != nil {
+		log.Printf("VFS Telemetry: Failed to marshal sensor event: %v", marshalErr)
+		return
+	}
+	b.GetTopic("telemetry:vfs").Publish(&Envelope{
+		ID:          uuid.New().String(),
+		Topic:       "telemetry:vfs",
+		Type:        "sensor_event",
+		ContentType: "application/json",
+		Payload:     payloadBytes,
+		CreatedAt:   time.Now(),
+	})
+}
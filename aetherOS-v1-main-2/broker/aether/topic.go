@@ -1,6 +1,9 @@
 package aether
 
-import "log"
+import (
+	"log"
+	"strings"
+)
 
 // Topic manages a single topic, including subscriptions and message broadcasting.
 type Topic struct {
@@ -10,8 +13,11 @@ type Topic struct {
 	broadcast     chan *Envelope
 	subscribe     chan *Client
 	unsubscribe   chan *Client
+	detach        chan *Client
 	history       []*Envelope
 	historyMaxLen int
+	owner         string        // For private topics, the user allowed to follow it; guarded by broker.mu.
+	done          chan struct{} // Closed when the topic is removed from the broker.
 }
 
 // NewTopic creates a new topic.
@@ -23,8 +29,10 @@ func NewTopic(name string, broker *Broker) *Topic {
 		broadcast:     make(chan *Envelope),
 		subscribe:     make(chan *Client),
 		unsubscribe:   make(chan *Client),
+		detach:        make(chan *Client),
 		history:       make([]*Envelope, 0),
 		historyMaxLen: 100, // keep last 100 messages
+		done:          make(chan struct{}),
 	}
 }
 
@@ -38,11 +46,16 @@ func (t *Topic) GetBroadcastChan() chan *Envelope {
 func (t *Topic) Run() {
 	for {
 		select {
+		case <-t.done:
+			return
 		case client := <-t.subscribe:
 			t.clients[client] = true
 			log.Printf("client subscribed to topic %s", t.name)
 			// send history
 			for _, env := range t.history {
+				if user, session, err := env.recipient(); err != nil || !client.accepts(user, session) {
+					continue
+				}
 				bytes, err := env.Bytes()
 				if err != nil {
 					log.Printf("failed to serialize history envelope: %v", err)
@@ -62,13 +75,26 @@ func (t *Topic) Run() {
 				close(client.send)
 				log.Printf("client unsubscribed from topic %s", t.name)
 			}
+		case client := <-t.detach:
+			// Unlike unsubscribe, the client's send channel stays open because
+			// it is shared with the other topics the client follows.
+			delete(t.clients, client)
 		case envelope := <-t.broadcast:
-			// add to history
-			if len(t.history) >= t.historyMaxLen {
-				// remove oldest
-				t.history = t.history[1:]
+			// add to history; replies are only for whoever asked, so they
+			// are not replayed to later subscribers.
+			if !isReplyTopic(t.name) {
+				if len(t.history) >= t.historyMaxLen {
+					// remove oldest
+					t.history = t.history[1:]
+				}
+				t.history = append(t.history, envelope)
+			}
+			user, session, err := envelope.recipient()
+			if err != nil {
+				// Metadata that cannot be read cannot be attributed to anyone.
+				log.Printf("dropping envelope with invalid metadata on topic %s: %v", t.name, err)
+				continue
 			}
-			t.history = append(t.history, envelope)
 
 			bytes, err := envelope.Bytes()
 			if err != nil {
@@ -77,6 +103,9 @@ func (t *Topic) Run() {
 			}
 
 			for client := range t.clients {
+				if !client.accepts(user, session) {
+					continue
+				}
 				select {
 				case client.send <- bytes:
 				default:
@@ -88,17 +117,41 @@ func (t *Topic) Run() {
 	}
 }
 
-// Publish broadcasts a message to all subscribed clients.
+// isReplyTopic reports whether a topic carries the replies to requests.
+func isReplyTopic(name string) bool {
+	return strings.HasSuffix(name, ":result") || strings.HasSuffix(name, ":error")
+}
+
+// Publish broadcasts a message to the subscribed clients it is addressed to;
+// see Envelope.recipient.
+// Once the topic is closed, messages are dropped.
 func (t *Topic) Publish(env *Envelope) {
-	t.broadcast <- env
+	select {
+	case t.broadcast <- env:
+	case <-t.done:
+	}
 }
 
 // Subscribe adds a new client to the topic.
 func (t *Topic) Subscribe(client *Client) {
-	t.subscribe <- client
+	select {
+	case t.subscribe <- client:
+	case <-t.done:
+	}
 }
 
 // Unsubscribe removes a client from the topic.
 func (t *Topic) Unsubscribe(client *Client) {
-	t.unsubscribe <- client
+	select {
+	case t.unsubscribe <- client:
+	case <-t.done:
+	}
+}
+
+// Detach removes a client from the topic without closing its send channel.
+func (t *Topic) Detach(client *Client) {
+	select {
+	case t.detach <- client:
+	case <-t.done:
+	}
 }
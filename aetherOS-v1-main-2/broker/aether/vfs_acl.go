@@ -0,0 +1,728 @@
+package aether
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+)
+
+// Access levels granted on a path, from weakest to strongest. Admin also
+// allows sharing the path with others.
+const (
+	AccessRead  = "read"
+	AccessWrite = "write"
+	AccessAdmin = "admin"
+)
+
+const (
+	// aclDirName is the top-level folder holding the ACL and share link table.
+	aclDirName = ".acl"
+	// aclObjectName is the object, under aclDirName, the table is stored in.
+	aclObjectName = "acl.json"
+
+	// ShareRoot is the virtual folder share links are opened under: the
+	// target of a link with token T is reachable as ShareRoot/T.
+	ShareRoot = "/share"
+
+	// MaxShareLinkTTL bounds how long a share link stays valid.
+	MaxShareLinkTTL = 30 * 24 * time.Hour
+)
+
+// accessRank orders access levels; unknown levels rank below read.
+func accessRank(access string) int {
+	switch access {
+	case AccessRead:
+		return 1
+	case AccessWrite:
+		return 2
+	case AccessAdmin:
+		return 3
+	}
+	return 0
+}
+
+// Grant gives a user, or every member of a group, access to a file or folder
+// and everything below it.
+type Grant struct {
+	Path      string    `json:"path"` // Absolute virtual path.
+	User      string    `json:"user,omitempty"`
+	Group     string    `json:"group,omitempty"`
+	Access    string    `json:"access"`
+	GrantedBy string    `json:"grantedBy,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires,omitempty"` // Zero for grants that never expire.
+}
+
+func (g *Grant) expired(now time.Time) bool {
+	return !g.Expires.IsZero() && now.After(g.Expires)
+}
+
+// ShareLink gives whoever holds its token access to a file or folder until
+// it expires.
+type ShareLink struct {
+	Token     string    `json:"token"`
+	Path      string    `json:"path"`   // Absolute virtual path of the shared item.
+	Access    string    `json:"access"` // AccessRead or AccessWrite.
+	CreatedBy string    `json:"createdBy,omitempty"`
+	Created   time.Time `json:"created"`
+	Expires   time.Time `json:"expires"`
+}
+
+// SharePath returns the virtual path the link's target is reachable at.
+func (l *ShareLink) SharePath() string {
+	return path.Join(ShareRoot, l.Token)
+}
+
+// aclTable is the persisted set of grants, share links and group memberships.
+type aclTable struct {
+	Grants      []*Grant               `json:"grants"`
+	Links       map[string]*ShareLink  `json:"links"`
+	Groups      map[string][]string    `json:"groups"`
+	GroupOwners map[string]string      `json:"groupOwners,omitempty"` // The user who created each group.
+	Trashed     map[string]*trashedACL `json:"trashed,omitempty"`     // Keyed by the storage key of the trash entry.
+}
+
+// trashedACL holds the grants and share links of a trashed item until it is
+// restored or purged. They are kept apart from the live ones so they give no
+// access to the item while it sits in the trash.
+type trashedACL struct {
+	Grants []*Grant     `json:"grants,omitempty"`
+	Links  []*ShareLink `json:"links,omitempty"`
+}
+
+// aclStore caches the ACL table. It is loaded from storage on first use and
+// written back after every change. It has its own lock so path resolution,
+// which runs before any VFS operation, never waits on vfs.mu.
+type aclStore struct {
+	mu     sync.RWMutex
+	loaded bool
+	table  aclTable
+	admins map[string]bool // Users who administer the VFS itself; not persisted.
+}
+
+// isSystemKey reports whether a storage key belongs to the VFS's own
+// bookkeeping rather than to users: the trash and the ACL table.
+func isSystemKey(name string) bool {
+	for _, dir := range []string{trashDirName, aclDirName} {
+		if name == dir || strings.HasPrefix(name, dir+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+// loadACL reads the ACL table from storage if it has not been read yet.
+// Callers must hold vfs.acl.mu for writing.
+func (vfs *VFSModule) loadACL(ctx context.Context) error {
+	if vfs.acl.loaded {
+		return nil
+	}
+	table := aclTable{}
+	rc, _, err := vfs.root.Open(ctx, path.Join(aclDirName, aclObjectName), 0, -1)
+	if err == nil {
+		data, readErr := AetherReadAll(rc)
+		rc.Close()
+		if readErr != nil {
+			return fmt.Errorf("failed to read ACL table: %w", readErr)
+		}
+		if err := json.Unmarshal(data, &table); err != nil {
+			return fmt.Errorf("failed to decode ACL table: %w", err)
+		}
+	} else if err != storage.ErrObjectNotExist {
+		return fmt.Errorf("failed to open ACL table: %w", err)
+	}
+	if table.Links == nil {
+		table.Links = make(map[string]*ShareLink)
+	}
+	if table.Groups == nil {
+		table.Groups = make(map[string][]string)
+	}
+	if table.Trashed == nil {
+		table.Trashed = make(map[string]*trashedACL)
+	}
+	if table.GroupOwners == nil {
+		table.GroupOwners = make(map[string]string)
+	}
+	vfs.acl.table = table
+	vfs.acl.loaded = true
+	return nil
+}
+
+// saveACL drops expired entries and writes the ACL table back to storage.
+// Callers must hold vfs.acl.mu for writing.
+func (vfs *VFSModule) saveACL(ctx context.Context) error {
+	now := time.Now()
+	grants := vfs.acl.table.Grants[:0]
+	for _, g := range vfs.acl.table.Grants {
+		if !g.expired(now) {
+			grants = append(grants, g)
+		}
+	}
+	vfs.acl.table.Grants = grants
+	for token, link := range vfs.acl.table.Links {
+		if now.After(link.Expires) {
+			delete(vfs.acl.table.Links, token)
+		}
+	}
+
+	data, err := json.Marshal(&vfs.acl.table)
+	if err != nil {
+		return err
+	}
+	if _, err := vfs.root.Write(ctx, path.Join(aclDirName, aclObjectName), data, nil, nil); err != nil {
+		return fmt.Errorf("failed to save ACL table: %w", err)
+	}
+	return nil
+}
+
+// withACL runs fn with the ACL table loaded and locked for reading.
+func (vfs *VFSModule) withACL(fn func(table *aclTable)) error {
+	vfs.acl.mu.RLock()
+	if vfs.acl.loaded {
+		defer vfs.acl.mu.RUnlock()
+		fn(&vfs.acl.table)
+		return nil
+	}
+	vfs.acl.mu.RUnlock()
+
+	vfs.acl.mu.Lock()
+	defer vfs.acl.mu.Unlock()
+	if err := vfs.loadACL(context.Background()); err != nil {
+		return err
+	}
+	fn(&vfs.acl.table)
+	return nil
+}
+
+// errACLUnchanged tells updateACL that fn left the table as it was.
+var errACLUnchanged = errors.New("ACL table unchanged")
+
+// updateACL runs fn with the ACL table loaded and locked for writing, and
+// saves the table if fn succeeds. fn may return errACLUnchanged to skip saving.
+func (vfs *VFSModule) updateACL(fn func(table *aclTable) error) error {
+	vfs.acl.mu.Lock()
+	defer vfs.acl.mu.Unlock()
+	ctx := context.Background()
+	if err := vfs.loadACL(ctx); err != nil {
+		return err
+	}
+	if err := fn(&vfs.acl.table); err != nil {
+		if err == errACLUnchanged {
+			return nil
+		}
+		return err
+	}
+	return vfs.saveACL(ctx)
+}
+
+// Access returns the strongest access user has to the storage key name
+// through owning it or through ACL grants, or "" if they have none. Users
+// administer everything in their own home. Access through mounts is not
+// included; see Resolve.
+func (vfs *VFSModule) Access(user, name string) string {
+	var access string
+	if err := vfs.withACL(func(table *aclTable) { access = table.access(user, name) }); err != nil {
+		log.Printf("VFS: ACL check for %s failed: %v", VirtualPath(name), err)
+		return ""
+	}
+	return access
+}
+
+// access is Access for callers holding vfs.acl.mu.
+func (table *aclTable) access(user, name string) string {
+	name = strings.Trim(name, "/")
+	home := strings.TrimPrefix(HomeDir(user), "/")
+	if name == home || strings.HasPrefix(name, home+"/") {
+		return AccessAdmin
+	}
+
+	best := ""
+	now := time.Now()
+	for _, g := range table.Grants {
+		key := strings.Trim(g.Path, "/")
+		if name != key && !strings.HasPrefix(name, key+"/") {
+			continue
+		}
+		if g.expired(now) || accessRank(g.Access) <= accessRank(best) {
+			continue
+		}
+		if g.User == user || (g.Group != "" && inGroup(table, g.Group, user)) {
+			best = g.Access
+		}
+	}
+	return best
+}
+
+// Readers lists the users the ACL lets read the storage key name: the owner
+// of the home it is in and every user granted access to it, directly or
+// through a group. Mounts outside the homes may be readable by users it does
+// not list.
+func (vfs *VFSModule) Readers(name string) []string {
+	name = strings.Trim(name, "/")
+	seen := make(map[string]bool)
+	var users []string
+	add := func(user string) {
+		if user != "" && !seen[user] {
+			seen[user] = true
+			users = append(users, user)
+		}
+	}
+	if rest := strings.TrimPrefix(name, strings.TrimPrefix(HomeRoot, "/")+"/"); rest != name {
+		add(strings.SplitN(rest, "/", 2)[0])
+	}
+	now := time.Now()
+	err := vfs.withACL(func(table *aclTable) {
+		for _, g := range table.Grants {
+			key := strings.Trim(g.Path, "/")
+			if g.expired(now) || (name != key && !strings.HasPrefix(name, key+"/")) {
+				continue
+			}
+			add(g.User)
+			if g.Group != "" {
+				for _, member := range table.Groups[g.Group] {
+					add(member)
+				}
+			}
+		}
+	})
+	if err != nil {
+		log.Printf("VFS: listing readers of %s failed: %v", VirtualPath(name), err)
+	}
+	return users
+}
+
+func inGroup(table *aclTable, group, user string) bool {
+	for _, member := range table.Groups[group] {
+		if member == user {
+			return true
+		}
+	}
+	return false
+}
+
+// SetAdmins sets the users who administer the VFS itself, for example by
+// changing the mount table. It gives them no extra access to files.
+func (vfs *VFSModule) SetAdmins(users []string) {
+	admins := make(map[string]bool)
+	for _, u := range users {
+		if u = strings.TrimSpace(u); ValidName(u) {
+			admins[u] = true
+		}
+	}
+	vfs.acl.mu.Lock()
+	defer vfs.acl.mu.Unlock()
+	vfs.acl.admins = admins
+}
+
+// IsAdmin reports whether user administers the VFS.
+func (vfs *VFSModule) IsAdmin(user string) bool {
+	vfs.acl.mu.RLock()
+	defer vfs.acl.mu.RUnlock()
+	return vfs.acl.admins[user]
+}
+
+// Admins lists the users who administer the VFS, in order.
+func (vfs *VFSModule) Admins() []string {
+	vfs.acl.mu.RLock()
+	defer vfs.acl.mu.RUnlock()
+	users := make([]string, 0, len(vfs.acl.admins))
+	for u := range vfs.acl.admins {
+		users = append(users, u)
+	}
+	sort.Strings(users)
+	return users
+}
+
+// checkAdmin returns an error unless by may administer the storage key name.
+// An empty by acts as the system, which may administer anything.
+func (vfs *VFSModule) checkAdmin(by, name string) error {
+	if by == "" || vfs.Access(by, name) == AccessAdmin {
+		return nil
+	}
+	return fmt.Errorf("permission denied: sharing %s requires admin access", VirtualPath(name))
+}
+
+// Share grants a user or group access to the file or folder at the storage
+// key name, replacing any earlier grant to them on the same path. The caller,
+// by, must have admin access to it. A zero expiry never expires.
+func (vfs *VFSModule) Share(by, name string, grant Grant) (*Grant, error) {
+	name = strings.Trim(name, "/")
+	if accessRank(grant.Access) == 0 {
+		return nil, fmt.Errorf("invalid access level: %q", grant.Access)
+	}
+	if (grant.User == "") == (grant.Group == "") {
+		return nil, fmt.Errorf("share with exactly one user or group")
+	}
+	if (grant.User != "" && !ValidName(grant.User)) || (grant.Group != "" && !ValidName(grant.Group)) {
+		return nil, fmt.Errorf("invalid user or group name")
+	}
+	if err := vfs.checkAdmin(by, name); err != nil {
+		return nil, err
+	}
+	if err := vfs.requireExists(name); err != nil {
+		return nil, err
+	}
+
+	g := &Grant{
+		Path:      VirtualPath(name),
+		User:      grant.User,
+		Group:     grant.Group,
+		Access:    grant.Access,
+		GrantedBy: by,
+		Created:   time.Now(),
+		Expires:   grant.Expires,
+	}
+	err := vfs.updateACL(func(table *aclTable) error {
+		table.Grants = removeGrants(table.Grants, g.Path, g.User, g.Group)
+		table.Grants = append(table.Grants, g)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return g, nil
+}
+
+// Unshare removes the grant to a user or group on the storage key name. The
+// caller, by, must have admin access to it.
+func (vfs *VFSModule) Unshare(by, name, user, group string) error {
+	name = strings.Trim(name, "/")
+	if err := vfs.checkAdmin(by, name); err != nil {
+		return err
+	}
+	return vfs.updateACL(func(table *aclTable) error {
+		before := len(table.Grants)
+		table.Grants = removeGrants(table.Grants, VirtualPath(name), user, group)
+		if len(table.Grants) == before {
+			return fmt.Errorf("%s is not shared with that user or group", VirtualPath(name))
+		}
+		return nil
+	})
+}
+
+func removeGrants(grants []*Grant, p, user, group string) []*Grant {
+	kept := grants[:0]
+	for _, g := range grants {
+		if g.Path == p && g.User == user && g.Group == group {
+			continue
+		}
+		kept = append(kept, g)
+	}
+	return kept
+}
+
+// CreateShareLink creates a link giving read or write access to the file or
+// folder at the storage key name for ttl. The caller, by, must have admin
+// access to it.
+func (vfs *VFSModule) CreateShareLink(by, name, access string, ttl time.Duration) (*ShareLink, error) {
+	name = strings.Trim(name, "/")
+	if access != AccessRead && access != AccessWrite {
+		return nil, fmt.Errorf("share links give %q or %q access", AccessRead, AccessWrite)
+	}
+	if ttl <= 0 || ttl > MaxShareLinkTTL {
+		return nil, fmt.Errorf("share link lifetime must be between 0 and %s", MaxShareLinkTTL)
+	}
+	if err := vfs.checkAdmin(by, name); err != nil {
+		return nil, err
+	}
+	if err := vfs.requireExists(name); err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	link := &ShareLink{
+		Token:     strings.ReplaceAll(uuid.New().String(), "-", ""),
+		Path:      VirtualPath(name),
+		Access:    access,
+		CreatedBy: by,
+		Created:   now,
+		Expires:   now.Add(ttl),
+	}
+	err := vfs.updateACL(func(table *aclTable) error {
+		table.Links[link.Token] = link
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return link, nil
+}
+
+// RevokeShareLink deletes a share link. The caller, by, must have admin
+// access to the shared item.
+func (vfs *VFSModule) RevokeShareLink(by, token string) error {
+	return vfs.updateACL(func(table *aclTable) error {
+		link, ok := table.Links[token]
+		if !ok {
+			return fmt.Errorf("unknown share link")
+		}
+		if by != "" && table.access(by, link.Path) != AccessAdmin {
+			return fmt.Errorf("permission denied: revoking a link to %s requires admin access", link.Path)
+		}
+		delete(table.Links, token)
+		return nil
+	})
+}
+
+// Shares lists the grants and live share links on the storage key name and
+// everything below it. The caller, by, must have admin access to it.
+func (vfs *VFSModule) Shares(by, name string) ([]*Grant, []*ShareLink, error) {
+	name = strings.Trim(name, "/")
+	if err := vfs.checkAdmin(by, name); err != nil {
+		return nil, nil, err
+	}
+	var grants []*Grant
+	var links []*ShareLink
+	now := time.Now()
+	under := func(p string) bool {
+		key := strings.Trim(p, "/")
+		return key == name || strings.HasPrefix(key, name+"/")
+	}
+	err := vfs.withACL(func(table *aclTable) {
+		for _, g := range table.Grants {
+			if under(g.Path) && !g.expired(now) {
+				grants = append(grants, g)
+			}
+		}
+		for _, l := range table.Links {
+			if under(l.Path) && now.Before(l.Expires) {
+				links = append(links, l)
+			}
+		}
+	})
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Path < grants[j].Path })
+	sort.Slice(links, func(i, j int) bool { return links[i].Created.Before(links[j].Created) })
+	return grants, links, err
+}
+
+// SharedWith lists the live grants to user, directly or through a group.
+func (vfs *VFSModule) SharedWith(user string) ([]*Grant, error) {
+	var grants []*Grant
+	now := time.Now()
+	err := vfs.withACL(func(table *aclTable) {
+		for _, g := range table.Grants {
+			if !g.expired(now) && (g.User == user || (g.Group != "" && inGroup(table, g.Group, user))) {
+				grants = append(grants, g)
+			}
+		}
+	})
+	sort.Slice(grants, func(i, j int) bool { return grants[i].Path < grants[j].Path })
+	return grants, err
+}
+
+// SetGroupMembers replaces the members of a group. An empty list deletes it.
+// The caller, by, becomes the owner of a group it creates; changing an
+// existing group needs its owner or a VFS administrator. A group without an
+// owner, such as one that only appears in grants so far, may be changed by
+// whoever administers every path granted to it. An empty by acts as the system.
+func (vfs *VFSModule) SetGroupMembers(by, group string, users []string) error {
+	if !ValidName(group) {
+		return fmt.Errorf("invalid group name: %q", group)
+	}
+	for _, u := range users {
+		if !ValidName(u) {
+			return fmt.Errorf("invalid user id: %q", u)
+		}
+	}
+	return vfs.updateACL(func(table *aclTable) error {
+		if err := vfs.checkGroupOwner(table, by, group); err != nil {
+			return err
+		}
+		if len(users) == 0 {
+			delete(table.Groups, group)
+			delete(table.GroupOwners, group)
+			return nil
+		}
+		table.Groups[group] = append([]string(nil), users...)
+		if table.GroupOwners[group] == "" && by != "" {
+			table.GroupOwners[group] = by
+		}
+		return nil
+	})
+}
+
+// checkGroupOwner returns an error unless by may change the members of
+// group, as described at SetGroupMembers. Callers must hold vfs.acl.mu.
+func (vfs *VFSModule) checkGroupOwner(table *aclTable, by, group string) error {
+	if by == "" || vfs.acl.admins[by] {
+		return nil
+	}
+	if owner := table.GroupOwners[group]; owner != "" {
+		if owner != by {
+			return fmt.Errorf("permission denied: group %s belongs to %s", group, owner)
+		}
+		return nil
+	}
+	if _, exists := table.Groups[group]; exists {
+		return fmt.Errorf("permission denied: group %s has no owner and can only be changed by an administrator", group)
+	}
+	for _, g := range table.Grants {
+		if g.Group == group && table.access(by, g.Path) != AccessAdmin {
+			return fmt.Errorf("permission denied: group %s has access to %s, which you do not administer", group, g.Path)
+		}
+	}
+	return nil
+}
+
+// resolveShareLink maps a path under ShareRoot to the storage key it reaches
+// through the share link named by its first segment, checking the link's
+// expiry and access level.
+func (vfs *VFSModule) resolveShareLink(clean string, write bool) (string, error) {
+	rest := strings.TrimPrefix(strings.TrimPrefix(clean, ShareRoot), "/")
+	token, sub, _ := strings.Cut(rest, "/")
+	var link *ShareLink
+	if err := vfs.withACL(func(table *aclTable) { link = table.Links[token] }); err != nil {
+		return "", err
+	}
+	if token == "" || link == nil || time.Now().After(link.Expires) {
+		return "", fmt.Errorf("permission denied: unknown or expired share link")
+	}
+	if write && link.Access != AccessWrite {
+		return "", fmt.Errorf("permission denied: share link is read-only")
+	}
+	return strings.TrimPrefix(path.Join(link.Path, sub), "/"), nil
+}
+
+// requireExists returns an error unless a file or folder exists at the
+// storage key name.
+func (vfs *VFSModule) requireExists(name string) error {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	_, _, err := vfs.matchObjects(context.Background(), name)
+	return err
+}
+
+// moveACL makes the grants and share links on the storage key from, and on
+// anything under it, apply at to instead. An empty to drops them. Callers must
+// hold vfs.mu, so the ACL changes in step with the objects it covers.
+func (vfs *VFSModule) moveACL(from, to string) {
+	from = VirtualPath(from)
+	rewrite := func(p string) (string, bool) {
+		if p != from && !strings.HasPrefix(p, from+"/") {
+			return p, false
+		}
+		if to == "" {
+			return "", true
+		}
+		return VirtualPath(to) + strings.TrimPrefix(p, from), true
+	}
+
+	err := vfs.updateACL(func(table *aclTable) error {
+		changed := false
+		grants := table.Grants[:0]
+		for _, g := range table.Grants {
+			if p, ok := rewrite(g.Path); ok {
+				changed = true
+				if p == "" {
+					continue
+				}
+				g.Path = p
+			}
+			grants = append(grants, g)
+		}
+		table.Grants = grants
+		for token, l := range table.Links {
+			if p, ok := rewrite(l.Path); ok {
+				changed = true
+				if p == "" {
+					delete(table.Links, token)
+					continue
+				}
+				l.Path = p
+			}
+		}
+		if !changed {
+			return errACLUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("VFS: failed to move ACLs from %s: %v", from, err)
+	}
+}
+
+// trashACL sets aside the grants and share links on the storage key name, and
+// on anything under it, with the trash entry stored at entryRoot. Callers must
+// hold vfs.mu.
+func (vfs *VFSModule) trashACL(entryRoot, name string) {
+	name = VirtualPath(name)
+	under := func(p string) bool { return p == name || strings.HasPrefix(p, name+"/") }
+
+	err := vfs.updateACL(func(table *aclTable) error {
+		held := &trashedACL{}
+		grants := table.Grants[:0]
+		for _, g := range table.Grants {
+			if under(g.Path) {
+				held.Grants = append(held.Grants, g)
+				continue
+			}
+			grants = append(grants, g)
+		}
+		table.Grants = grants
+		for token, l := range table.Links {
+			if under(l.Path) {
+				held.Links = append(held.Links, l)
+				delete(table.Links, token)
+			}
+		}
+		if len(held.Grants) == 0 && len(held.Links) == 0 {
+			return errACLUnchanged
+		}
+		table.Trashed[entryRoot] = held
+		return nil
+	})
+	if err != nil {
+		log.Printf("VFS: failed to set aside ACLs of %s: %v", name, err)
+	}
+}
+
+// untrashACL puts back the grants and share links set aside with the trash
+// entry stored at entryRoot. Callers must hold vfs.mu.
+func (vfs *VFSModule) untrashACL(entryRoot string) {
+	err := vfs.updateACL(func(table *aclTable) error {
+		held, ok := table.Trashed[entryRoot]
+		if !ok {
+			return errACLUnchanged
+		}
+		delete(table.Trashed, entryRoot)
+		table.Grants = append(table.Grants, held.Grants...)
+		for _, l := range held.Links {
+			table.Links[l.Token] = l
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("VFS: failed to restore ACLs of trash entry %s: %v", entryRoot, err)
+	}
+}
+
+// purgeTrashACL drops the grants and share links set aside with the trash
+// entries stored at or under root. Callers must hold vfs.mu.
+func (vfs *VFSModule) purgeTrashACL(root string) {
+	err := vfs.updateACL(func(table *aclTable) error {
+		changed := false
+		for key := range table.Trashed {
+			if key == root || strings.HasPrefix(key, root+"/") {
+				delete(table.Trashed, key)
+				changed = true
+			}
+		}
+		if !changed {
+			return errACLUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		log.Printf("VFS: failed to drop ACLs of trash entries under %s: %v", root, err)
+	}
+}
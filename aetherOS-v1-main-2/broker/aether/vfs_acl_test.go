@@ -0,0 +1,228 @@
+package aether
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReaders(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{
+		"home/alice/docs/plan.txt": "plan",
+		"home/alice/notes.txt":     "notes",
+	})
+	if _, err := vfs.Share("alice", "home/alice/docs", Grant{User: "bob", Access: AccessRead}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := vfs.Share("alice", "home/alice/docs/plan.txt", Grant{Group: "team", Access: AccessWrite}); err != nil {
+		t.Fatal(err)
+	}
+	if err := vfs.SetGroupMembers("", "team", []string{"carol", "bob"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		key  string
+		want string
+	}{
+		{"owner only", "home/alice/notes.txt", "alice"},
+		{"shared folder", "home/alice/docs", "alice bob"},
+		{"inside shared folder", "/home/alice/docs/plan.txt/", "alice bob carol"},
+		{"outside homes", "tmp/x", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := strings.Join(vfs.Readers(tt.key), " "); got != tt.want {
+				t.Errorf("Readers(%s) = %q, want %q", tt.key, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestACLFollowsTrash(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{"home/alice/docs/plan.txt": "plan"})
+	if _, err := vfs.Share("alice", "home/alice/docs", Grant{User: "bob", Access: AccessRead}); err != nil {
+		t.Fatal(err)
+	}
+	link, err := vfs.CreateShareLink("alice", "home/alice/docs", AccessRead, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	opts := WriteOptions{User: "alice"}
+	restore := func(t *testing.T) {
+		entries, err := vfs.ListTrash("alice")
+		if err != nil || len(entries) != 1 {
+			t.Fatalf("ListTrash = %v, %v", entries, err)
+		}
+		if _, err := vfs.RestoreTrash("alice", entries[0].ID); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		path   string // Where the shared folder is afterwards, or "" if it is gone.
+	}{
+		{"trashed", func(t *testing.T) {
+			if _, err := vfs.Delete("home/alice/docs", opts); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+		{"restored", restore, "home/alice/docs"},
+		{"moved", func(t *testing.T) {
+			if err := vfs.Move("home/alice/docs", "home/alice/old", opts); err != nil {
+				t.Fatal(err)
+			}
+		}, "home/alice/old"},
+		{"trashed in a batch", func(t *testing.T) {
+			if _, err := vfs.Batch([]BatchOp{{Op: BatchDelete, Path: "home/alice/old"}}, opts); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+		{"restored again", restore, "home/alice/old"},
+		{"batch rolled back", func(t *testing.T) {
+			ops := []BatchOp{
+				{Op: BatchDelete, Path: "home/alice/old"},
+				{Op: BatchDelete, Path: "home/alice/missing"},
+			}
+			if _, err := vfs.Batch(ops, opts); err == nil {
+				t.Fatal("batch deleting a missing file succeeded")
+			}
+		}, "home/alice/old"},
+		{"trash emptied", func(t *testing.T) {
+			if _, err := vfs.Delete("home/alice/old", opts); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := vfs.EmptyTrash("alice", nil); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change(t)
+			want := ""
+			if tt.path != "" {
+				want = AccessRead
+			}
+			for _, p := range []string{"home/alice/docs", "home/alice/old"} {
+				access := ""
+				if p == tt.path {
+					access = want
+				}
+				if got := vfs.Access("bob", p+"/plan.txt"); got != access {
+					t.Errorf("bob's access to %s = %q, want %q", p, got, access)
+				}
+			}
+			key, err := vfs.resolveShareLink(link.SharePath()+"/plan.txt", false)
+			if want := tt.path + "/plan.txt"; tt.path != "" && (err != nil || key != want) {
+				t.Errorf("share link resolves to %q, %v, want %q", key, err, want)
+			} else if tt.path == "" && err == nil {
+				t.Errorf("share link to a trashed folder resolves to %q", key)
+			}
+		})
+	}
+	if err := vfs.withACL(func(table *aclTable) {
+		if len(table.Trashed) != 0 {
+			t.Errorf("emptied trash left ACLs behind: %v", table.Trashed)
+		}
+	}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestShareAccess(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{
+		"home/alice/docs/plan.txt": "plan",
+		"home/alice/notes.txt":     "notes",
+	})
+	share := func(grant Grant) {
+		if _, err := vfs.Share("alice", "home/alice/docs", grant); err != nil {
+			t.Fatal(err)
+		}
+	}
+	share(Grant{User: "bob", Access: AccessRead})
+	share(Grant{Group: "team", Access: AccessWrite})
+	share(Grant{User: "dave", Access: AccessAdmin})
+	share(Grant{User: "eve", Access: AccessWrite, Expires: time.Now().Add(-time.Minute)})
+	if err := vfs.SetGroupMembers("", "team", []string{"carol"}); err != nil {
+		t.Fatal(err)
+	}
+	link := func(access string, ttl time.Duration) string {
+		l, err := vfs.CreateShareLink("alice", "home/alice/docs", access, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return l.SharePath()
+	}
+	readLink, writeLink, expiredLink := link(AccessRead, time.Hour), link(AccessWrite, time.Hour), link(AccessRead, time.Nanosecond)
+	revokedLink := link(AccessRead, time.Hour)
+	if err := vfs.RevokeShareLink("bob", strings.TrimPrefix(revokedLink, ShareRoot+"/")); err == nil {
+		t.Error("bob revoked a link without admin access")
+	}
+	if err := vfs.RevokeShareLink("alice", strings.TrimPrefix(revokedLink, ShareRoot+"/")); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		user  string
+		path  string
+		write bool
+		want  string // Storage key, or "" if the path is refused.
+	}{
+		{"user grant read", "bob", "/home/alice/docs/plan.txt", false, "home/alice/docs/plan.txt"},
+		{"user grant write", "bob", "/home/alice/docs/plan.txt", true, ""},
+		{"group grant write", "carol", "/home/alice/docs/new.txt", true, "home/alice/docs/new.txt"},
+		{"admin grant write", "dave", "/home/alice/docs/plan.txt", true, "home/alice/docs/plan.txt"},
+		{"expired grant", "eve", "/home/alice/docs/plan.txt", false, ""},
+		{"outside grant", "carol", "/home/alice/notes.txt", false, ""},
+		{"no grant", "mallory", "/home/alice/docs/plan.txt", false, ""},
+		{"read link", "mallory", readLink + "/plan.txt", false, "home/alice/docs/plan.txt"},
+		{"read link root", "mallory", readLink, false, "home/alice/docs"},
+		{"read link write", "mallory", readLink + "/plan.txt", true, ""},
+		{"write link", "mallory", writeLink + "/new.txt", true, "home/alice/docs/new.txt"},
+		{"climb out of link", "mallory", readLink + "/../../home/alice/notes.txt", false, ""},
+		{"climb out of link target", "mallory", readLink + "/sub/../../notes.txt", false, ""},
+		{"expired link", "mallory", expiredLink + "/plan.txt", false, ""},
+		{"revoked link", "mallory", revokedLink + "/plan.txt", false, ""},
+		{"unknown link", "mallory", ShareRoot + "/0123456789abcdef/plan.txt", false, ""},
+		{"share root", "mallory", ShareRoot, false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _, err := vfs.Resolve(tt.user, tt.path, tt.write)
+			if tt.want == "" && err == nil {
+				t.Errorf("Resolve(%q, %q, %v) = %q, want it refused", tt.user, tt.path, tt.write, key)
+			}
+			if tt.want != "" && (err != nil || key != tt.want) {
+				t.Errorf("Resolve(%q, %q, %v) = %q, %v, want %q", tt.user, tt.path, tt.write, key, err, tt.want)
+			}
+		})
+	}
+
+	sharers := []struct {
+		user string
+		ok   bool
+	}{
+		{"alice", true},
+		{"dave", true},
+		{"carol", false},
+		{"bob", false},
+	}
+	for _, s := range sharers {
+		_, err := vfs.Share(s.user, "home/alice/docs/plan.txt", Grant{User: "frank", Access: AccessRead})
+		if (err == nil) != s.ok {
+			t.Errorf("Share by %s = %v, want ok %v", s.user, err, s.ok)
+		}
+		_, err = vfs.CreateShareLink(s.user, "home/alice/docs/plan.txt", AccessRead, time.Hour)
+		if (err == nil) != s.ok {
+			t.Errorf("CreateShareLink by %s = %v, want ok %v", s.user, err, s.ok)
+		}
+	}
+}
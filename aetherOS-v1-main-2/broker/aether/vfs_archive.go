@@ -0,0 +1,464 @@
+package aether
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"context"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Supported archive formats.
+const (
+	ArchiveZip   = "zip"
+	ArchiveTarGz = "tar.gz"
+)
+
+// ArchiveLimits bound the work done creating or extracting an archive. Zero
+// fields are unlimited.
+type ArchiveLimits struct {
+	MaxEntries    int   // Files and folders.
+	MaxFileBytes  int64 // Uncompressed size of a single file.
+	MaxTotalBytes int64 // Uncompressed size of all files together.
+}
+
+// DefaultArchiveLimits apply when no limits are given. Extraction holds the
+// unpacked files in memory so it can write them as one batch, and a zip
+// archive is read whole since its directory is at the end, so MaxTotalBytes
+// also bounds the memory an extraction can use. Tar.gz archives are streamed.
+var DefaultArchiveLimits = ArchiveLimits{
+	MaxEntries:    10000,
+	MaxFileBytes:  32 << 20,
+	MaxTotalBytes: 64 << 20,
+}
+
+// ArchiveStats summarizes an archive that was created or extracted.
+type ArchiveStats struct {
+	Files   int   `json:"files"`
+	Folders int   `json:"folders"`
+	Bytes   int64 `json:"bytes"`             // Uncompressed size of the files.
+	Skipped int   `json:"skipped,omitempty"` // Entries such as symlinks that were not extracted.
+}
+
+// ExtractOptions control ExtractArchive.
+type ExtractOptions struct {
+	Format    string        // ArchiveZip or ArchiveTarGz; detected from the archive's name if empty.
+	Overwrite bool          // Replace existing files instead of failing.
+	Limits    ArchiveLimits // DefaultArchiveLimits if zero.
+	Write     WriteOptions  // Who the extracted files are written for.
+}
+
+// ExtractProgress reports how far an extraction has got. Archives are first
+// unpacked in memory, then written to the VFS.
+type ExtractProgress struct {
+	Phase        string `json:"phase"` // "unpacking" or "writing".
+	Entries      int    `json:"entries"`
+	TotalEntries int    `json:"totalEntries,omitempty"` // Known once unpacking is done.
+	Bytes        int64  `json:"bytes"`
+}
+
+// ArchiveFormat returns the format to use for an archive named name. An
+// explicit format is validated; otherwise it is taken from the extension.
+func ArchiveFormat(name, format string) (string, error) {
+	switch format {
+	case ArchiveZip, ArchiveTarGz:
+		return format, nil
+	case "tgz":
+		return ArchiveTarGz, nil
+	case "":
+	default:
+		return "", fmt.Errorf("unsupported archive format: %q", format)
+	}
+
+	lower := strings.ToLower(name)
+	switch {
+	case strings.HasSuffix(lower, ".zip"):
+		return ArchiveZip, nil
+	case strings.HasSuffix(lower, ".tar.gz"), strings.HasSuffix(lower, ".tgz"):
+		return ArchiveTarGz, nil
+	}
+	return "", fmt.Errorf("cannot tell the archive format of %s; use zip or tar.gz", name)
+}
+
+// CreateArchive packs the directory at dir into an archive written to w.
+// Entries are named relative to the directory's parent, so unpacking the
+// archive recreates the directory itself.
+func (vfs *VFSModule) CreateArchive(dir, format string, limits ArchiveLimits, w io.Writer) (*ArchiveStats, error) {
+	var aw archiveWriter
+	switch format {
+	case ArchiveZip:
+		aw = &zipArchiveWriter{zw: zip.NewWriter(w)}
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(w)
+		aw = &tarArchiveWriter{gz: gz, tw: tar.NewWriter(gz)}
+	default:
+		return nil, fmt.Errorf("unsupported archive format: %q", format)
+	}
+
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	ctx := context.Background()
+
+	cleanDir := strings.Trim(dir, "/")
+	if cleanDir == "" {
+		return nil, fmt.Errorf("refusing to archive the root directory")
+	}
+	base := path.Dir(cleanDir)
+	if base == "." {
+		base = ""
+	} else {
+		base += "/"
+	}
+
+	stats := &ArchiveStats{}
+	entries, objects := 0, 0
+	seenDirs := make(map[string]bool)
+	countEntry := func() error {
+		entries++
+		if limits.MaxEntries > 0 && entries > limits.MaxEntries {
+			return fmt.Errorf("%s has more than %d entries", VirtualPath(cleanDir), limits.MaxEntries)
+		}
+		return nil
+	}
+
+	if err := countEntry(); err != nil {
+		return nil, err
+	}
+	if err := aw.addDir(path.Base(cleanDir), time.Now()); err != nil {
+		return nil, err
+	}
+	stats.Folders++
+
+	err := vfs.eachObject(ctx, cleanDir, -1, func(attrs *storage.ObjectAttrs, dirs []string, isFile bool) error {
+		objects++
+		for _, d := range dirs {
+			if seenDirs[d] {
+				continue
+			}
+			seenDirs[d] = true
+			if err := countEntry(); err != nil {
+				return err
+			}
+			if err := aw.addDir(strings.TrimPrefix(d, base), attrs.Updated); err != nil {
+				return err
+			}
+			stats.Folders++
+		}
+		if !isFile {
+			return nil
+		}
+
+		if err := countEntry(); err != nil {
+			return err
+		}
+		if limits.MaxFileBytes > 0 && attrs.Size > limits.MaxFileBytes {
+			return fmt.Errorf("%s is larger than the %d byte file limit", VirtualPath(attrs.Name), limits.MaxFileBytes)
+		}
+		if limits.MaxTotalBytes > 0 && stats.Bytes+attrs.Size > limits.MaxTotalBytes {
+			return fmt.Errorf("%s is larger than the %d byte archive limit", VirtualPath(cleanDir), limits.MaxTotalBytes)
+		}
+		rc, _, err := vfs.openObject(ctx, attrs.Name)
+		if err != nil {
+			return err
+		}
+		defer rc.Close()
+		if err := aw.addFile(strings.TrimPrefix(attrs.Name, base), attrs.Size, attrs.Updated, rc); err != nil {
+			return fmt.Errorf("failed to archive %s: %w", attrs.Name, err)
+		}
+		stats.Files++
+		stats.Bytes += attrs.Size
+		return nil
+	})
+	if err != nil {
+		aw.Close()
+		return nil, err
+	}
+	if objects == 0 {
+		aw.Close()
+		return nil, fmt.Errorf("no such directory: %s", cleanDir)
+	}
+	if err := aw.Close(); err != nil {
+		return nil, fmt.Errorf("failed to finish archive: %w", err)
+	}
+	return stats, nil
+}
+
+// archiveWriter adds entries to an archive being created.
+type archiveWriter interface {
+	addDir(name string, modTime time.Time) error
+	addFile(name string, size int64, modTime time.Time, r io.Reader) error
+	Close() error
+}
+
+type zipArchiveWriter struct {
+	zw *zip.Writer
+}
+
+func (a *zipArchiveWriter) addDir(name string, modTime time.Time) error {
+	_, err := a.zw.CreateHeader(&zip.FileHeader{Name: name + "/", Modified: modTime})
+	return err
+}
+
+func (a *zipArchiveWriter) addFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	w, err := a.zw.CreateHeader(&zip.FileHeader{Name: name, Method: zip.Deflate, Modified: modTime})
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	return err
+}
+
+func (a *zipArchiveWriter) Close() error {
+	return a.zw.Close()
+}
+
+type tarArchiveWriter struct {
+	gz *gzip.Writer
+	tw *tar.Writer
+}
+
+func (a *tarArchiveWriter) addDir(name string, modTime time.Time) error {
+	return a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeDir, Name: name + "/", Mode: 0755, ModTime: modTime})
+}
+
+func (a *tarArchiveWriter) addFile(name string, size int64, modTime time.Time, r io.Reader) error {
+	if err := a.tw.WriteHeader(&tar.Header{Typeflag: tar.TypeReg, Name: name, Size: size, Mode: 0644, ModTime: modTime}); err != nil {
+		return err
+	}
+	_, err := io.Copy(a.tw, r)
+	return err
+}
+
+func (a *tarArchiveWriter) Close() error {
+	if err := a.tw.Close(); err != nil {
+		a.gz.Close()
+		return err
+	}
+	return a.gz.Close()
+}
+
+// ExtractArchive unpacks the archive at archive into the folder dest. Entry
+// names that are absolute or climb out of dest are rejected, and the limits
+// in opts are enforced on the actual uncompressed sizes, not the sizes the
+// archive declares. Files are written as one batch, so a failed extraction
+// leaves nothing behind. If progress is set it is called as entries are
+// unpacked and written.
+func (vfs *VFSModule) ExtractArchive(archive, dest string, opts ExtractOptions, progress func(ExtractProgress)) (*ArchiveStats, error) {
+	format, err := ArchiveFormat(archive, opts.Format)
+	if err != nil {
+		return nil, err
+	}
+	limits := opts.Limits
+	if limits == (ArchiveLimits{}) {
+		limits = DefaultArchiveLimits
+	}
+	if progress == nil {
+		progress = func(ExtractProgress) {}
+	}
+
+	vfs.mu.RLock()
+	attrs, err := vfs.statObject(context.Background(), archive)
+	vfs.mu.RUnlock()
+	if err == nil && attrs == nil {
+		err = fmt.Errorf("no such file: %s", VirtualPath(archive))
+	}
+	if err == nil && limits.MaxTotalBytes > 0 && attrs.Size > limits.MaxTotalBytes {
+		err = fmt.Errorf("archive is larger than the %d byte limit", limits.MaxTotalBytes)
+	}
+	if err != nil {
+		return nil, err
+	}
+	rc, _, err := vfs.Open(archive, 0, -1)
+	if err != nil {
+		return nil, err
+	}
+	entries, stats, err := readArchive(format, rc, limits, progress)
+	rc.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	// Folders are only created where no file implies them, and a name that
+	// appears twice takes the last entry's content.
+	cleanDest := strings.Trim(dest, "/")
+	files := make(map[string][]byte)
+	var names, dirs []string
+	for _, e := range entries {
+		if e.isDir {
+			dirs = append(dirs, e.name)
+			continue
+		}
+		if _, ok := files[e.name]; !ok {
+			names = append(names, e.name)
+		}
+		files[e.name] = e.data
+	}
+	sort.Strings(names)
+
+	var ops []BatchOp
+	for _, name := range names {
+		op := BatchOp{Op: BatchWrite, Path: path.Join(cleanDest, name), Content: files[name]}
+		if !opts.Overwrite {
+			op.IfMatch = NoRevision
+		}
+		ops = append(ops, op)
+	}
+	for _, d := range dirs {
+		implied := false
+		for _, name := range names {
+			if strings.HasPrefix(name, d+"/") {
+				implied = true
+				break
+			}
+		}
+		if !implied {
+			ops = append(ops, BatchOp{Op: BatchCreateFolder, Path: path.Join(cleanDest, path.Dir(d)), Name: path.Base(d)})
+		}
+	}
+	if len(ops) == 0 {
+		return stats, nil
+	}
+
+	total := len(ops)
+	_, err = vfs.batch(ops, opts.Write, func(applied int) {
+		progress(ExtractProgress{Phase: "writing", Entries: applied, TotalEntries: total})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return stats, nil
+}
+
+// archiveEntry is a file or folder unpacked from an archive.
+type archiveEntry struct {
+	name  string // Cleaned path relative to the extraction root.
+	isDir bool
+	data  []byte
+}
+
+// readArchive unpacks an archive read from r in memory, enforcing limits and
+// rejecting unsafe entry names.
+func readArchive(format string, r io.Reader, limits ArchiveLimits, progress func(ExtractProgress)) ([]archiveEntry, *ArchiveStats, error) {
+	var entries []archiveEntry
+	stats := &ArchiveStats{}
+
+	add := func(name string, mode fs.FileMode, open func() (io.ReadCloser, error)) error {
+		if !mode.IsDir() && !mode.IsRegular() {
+			stats.Skipped++ // Symlinks, devices and the like have no VFS equivalent.
+			return nil
+		}
+		rel, err := archiveEntryPath(name)
+		if err != nil {
+			return err
+		}
+		if rel == "" {
+			return nil
+		}
+		if limits.MaxEntries > 0 && len(entries) >= limits.MaxEntries {
+			return fmt.Errorf("archive has more than %d entries", limits.MaxEntries)
+		}
+
+		if mode.IsDir() {
+			entries = append(entries, archiveEntry{name: rel, isDir: true})
+			stats.Folders++
+		} else {
+			// Read at most one byte past the limit, so archives that lie about
+			// their sizes are caught without inflating them in full.
+			limit := int64(-1)
+			if limits.MaxFileBytes > 0 {
+				limit = limits.MaxFileBytes
+			}
+			if remaining := limits.MaxTotalBytes - stats.Bytes; limits.MaxTotalBytes > 0 && (limit < 0 || remaining < limit) {
+				limit = remaining
+			}
+			rc, err := open()
+			if err != nil {
+				return fmt.Errorf("failed to open %s: %w", name, err)
+			}
+			var src io.Reader = rc
+			if limit >= 0 {
+				src = io.LimitReader(rc, limit+1)
+			}
+			content, err := AetherReadAll(src)
+			rc.Close()
+			if err != nil {
+				return fmt.Errorf("failed to read %s: %w", name, err)
+			}
+			if limit >= 0 && int64(len(content)) > limit {
+				return fmt.Errorf("%s exceeds the extraction size limit", name)
+			}
+			entries = append(entries, archiveEntry{name: rel, data: content})
+			stats.Files++
+			stats.Bytes += int64(len(content))
+		}
+		progress(ExtractProgress{Phase: "unpacking", Entries: len(entries), Bytes: stats.Bytes})
+		return nil
+	}
+
+	switch format {
+	case ArchiveZip:
+		data, err := AetherReadAll(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read zip archive: %w", err)
+		}
+		zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid zip archive: %w", err)
+		}
+		for _, f := range zr.File {
+			if err := add(f.Name, f.Mode(), f.Open); err != nil {
+				return nil, nil, err
+			}
+		}
+	case ArchiveTarGz:
+		gz, err := gzip.NewReader(r)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid tar.gz archive: %w", err)
+		}
+		defer gz.Close()
+		tr := tar.NewReader(gz)
+		for {
+			hdr, err := tr.Next()
+			if err == io.EOF {
+				break
+			}
+			if err != nil {
+				return nil, nil, fmt.Errorf("invalid tar.gz archive: %w", err)
+			}
+			open := func() (io.ReadCloser, error) { return io.NopCloser(tr), nil }
+			if err := add(hdr.Name, hdr.FileInfo().Mode(), open); err != nil {
+				return nil, nil, err
+			}
+		}
+	default:
+		return nil, nil, fmt.Errorf("unsupported archive format: %q", format)
+	}
+	return entries, stats, nil
+}
+
+// archiveEntryPath validates an entry name from an archive and returns it
+// cleaned and relative to the extraction root, or "" for the root itself.
+// Names that are absolute or would climb out of the root are rejected, which
+// guards against zip-slip.
+func archiveEntryPath(name string) (string, error) {
+	if strings.ContainsAny(name, "\\\x00") || strings.HasPrefix(name, "/") {
+		return "", fmt.Errorf("unsafe path in archive: %q", name)
+	}
+	clean := path.Clean(name)
+	if clean == "." {
+		return "", nil
+	}
+	if clean == ".." || strings.HasPrefix(clean, "../") {
+		return "", fmt.Errorf("unsafe path in archive: %q", name)
+	}
+	return clean, nil
+}
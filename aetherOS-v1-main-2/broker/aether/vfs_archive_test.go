@@ -0,0 +1,156 @@
+package aether
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// archiveFile is an entry of a test archive; names ending in "/" are folders.
+type archiveFile struct {
+	name, content string
+}
+
+func buildArchive(t *testing.T, format string, files []archiveFile) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	switch format {
+	case ArchiveZip:
+		zw := zip.NewWriter(&buf)
+		for _, f := range files {
+			w, err := zw.CreateHeader(&zip.FileHeader{Name: f.name, Method: zip.Deflate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := w.Write([]byte(f.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := zw.Close(); err != nil {
+			t.Fatal(err)
+		}
+	case ArchiveTarGz:
+		gz := gzip.NewWriter(&buf)
+		tw := tar.NewWriter(gz)
+		for _, f := range files {
+			hdr := &tar.Header{Typeflag: tar.TypeReg, Name: f.name, Size: int64(len(f.content)), Mode: 0644}
+			if strings.HasSuffix(f.name, "/") {
+				hdr = &tar.Header{Typeflag: tar.TypeDir, Name: f.name, Mode: 0755}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := tw.Write([]byte(f.content)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := tw.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := gz.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestArchiveEntryPath(t *testing.T) {
+	tests := []struct {
+		name    string
+		want    string
+		wantErr bool
+	}{
+		{"a/b.txt", "a/b.txt", false},
+		{"./a//b/", "a/b", false},
+		{"a/../b", "b", false},
+		{"./", "", false},
+		{"a/..", "", false},
+		{"..", "", true},
+		{"../evil.txt", "", true},
+		{"a/../../evil.txt", "", true},
+		{"/etc/passwd", "", true},
+		{"a\\..\\..\\evil.txt", "", true},
+		{"a\x00b", "", true},
+	}
+	for _, tt := range tests {
+		got, err := archiveEntryPath(tt.name)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("archiveEntryPath(%q) = %q, %v, want %q (error %v)", tt.name, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestExtractArchive(t *testing.T) {
+	zeros := strings.Repeat("\x00", 1500)
+	small := ArchiveLimits{MaxEntries: 3, MaxFileBytes: 1000, MaxTotalBytes: 2000}
+
+	tests := []struct {
+		name    string
+		format  string
+		files   []archiveFile
+		limits  ArchiveLimits
+		want    string // Files extracted, as "name=content", or "" if extraction fails.
+		wantErr string
+	}{
+		{"zip", ArchiveZip, []archiveFile{{"docs/", ""}, {"docs/a.txt", "a"}, {"b.txt", "b"}}, ArchiveLimits{}, "b.txt=b docs/a.txt=a", ""},
+		{"tar.gz", ArchiveTarGz, []archiveFile{{"docs/", ""}, {"docs/a.txt", "a"}, {"b.txt", "b"}}, ArchiveLimits{}, "b.txt=b docs/a.txt=a", ""},
+		{"zip slip", ArchiveZip, []archiveFile{{"ok.txt", "ok"}, {"../evil.txt", "evil"}}, ArchiveLimits{}, "", "unsafe path"},
+		{"tar slip", ArchiveTarGz, []archiveFile{{"ok.txt", "ok"}, {"docs/../../evil.txt", "evil"}}, ArchiveLimits{}, "", "unsafe path"},
+		{"absolute path", ArchiveZip, []archiveFile{{"/home/other/evil.txt", "evil"}}, ArchiveLimits{}, "", "unsafe path"},
+		{"within limits", ArchiveZip, []archiveFile{{"a", zeros[:1000]}, {"b", zeros[:1000]}}, small, "a=1000 bytes b=1000 bytes", ""},
+		{"too many entries", ArchiveZip, []archiveFile{{"a", ""}, {"b", ""}, {"c", ""}, {"d", ""}}, small, "", "more than 3 entries"},
+		{"file too large", ArchiveZip, []archiveFile{{"a", zeros}}, small, "", "size limit"},
+		{"total too large", ArchiveTarGz, []archiveFile{{"a", zeros[:1000]}, {"b", zeros[:1000]}, {"c", "c"}}, small, "", "size limit"},
+		{"archive too large", ArchiveZip, []archiveFile{{"a", zeros}}, ArchiveLimits{MaxTotalBytes: 100}, "", "archive is larger"},
+	}
+	for i, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			archive := "home/u/in." + tt.format
+			if err := vfs.Write(archive, buildArchive(t, tt.format, tt.files)); err != nil {
+				t.Fatal(err)
+			}
+			dest := fmt.Sprintf("home/u/out%d", i)
+			_, err := vfs.ExtractArchive(archive, dest, ExtractOptions{Limits: tt.limits, Write: WriteOptions{User: "u"}}, nil)
+			if tt.wantErr != "" && (err == nil || !strings.Contains(err.Error(), tt.wantErr)) {
+				t.Fatalf("err = %v, want one mentioning %q", err, tt.wantErr)
+			}
+			if tt.wantErr == "" && err != nil {
+				t.Fatal(err)
+			}
+
+			var names []string
+			err = vfs.Walk(dest, "", -1, 0, func(files []*FileInfo) error {
+				for _, f := range files {
+					if !f.IsDir {
+						names = append(names, f.Path)
+					}
+				}
+				return nil
+			})
+			if err != nil && tt.want != "" {
+				t.Fatal(err)
+			}
+			sort.Strings(names)
+			var got []string
+			for _, name := range names {
+				content, err := vfs.Read(strings.TrimPrefix(name, "/"))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if len(content) > 10 {
+					content = fmt.Sprintf("%d bytes", len(content))
+				}
+				got = append(got, strings.TrimPrefix(name, VirtualPath(dest)+"/")+"="+content)
+			}
+			if joined := strings.Join(got, " "); joined != tt.want {
+				t.Errorf("extracted %q, want %q", joined, tt.want)
+			}
+		})
+	}
+}
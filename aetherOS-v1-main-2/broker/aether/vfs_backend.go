@@ -0,0 +1,448 @@
+package aether
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/iterator"
+)
+
+// ErrPreconditionFailed is returned by a Backend when a write's condition does not hold.
+var ErrPreconditionFailed = errors.New("precondition failed")
+
+// Backend stores the objects behind one mount. Names are relative to the
+// mount. Object attributes reuse storage.ObjectAttrs so every backend reports
+// revisions (Generation), ownership (Metadata), sizes and times the same way.
+// Missing objects are reported with storage.ErrObjectNotExist.
+type Backend interface {
+	// Stat returns an object's attributes, or nil if it does not exist.
+	Stat(ctx context.Context, name string) (*storage.ObjectAttrs, error)
+	// List calls fn for each object under prefix, in name order. With a
+	// delimiter, names containing it after the prefix are rolled up into a
+	// single entry with only Prefix set, as in a storage.Query.
+	List(ctx context.Context, prefix, delimiter string, fn func(*storage.ObjectAttrs) error) error
+	// Open returns a reader for length bytes of an object's content from
+	// offset, or to the end if length is negative, along with the attributes
+	// of the whole object.
+	Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *storage.ObjectAttrs, error)
+	// Write replaces an object's content and metadata. If cond is set the
+	// write only happens if it holds, else ErrPreconditionFailed is returned.
+	Write(ctx context.Context, name string, content []byte, metadata map[string]string, cond *storage.Conditions) (*storage.ObjectAttrs, error)
+	// Copy duplicates an object, keeping its metadata.
+	Copy(ctx context.Context, src, dst string) error
+	// Delete removes an object.
+	Delete(ctx context.Context, name string) error
+}
+
+// bucketBackend stores objects in a cloud storage bucket.
+type bucketBackend struct {
+	bucket *storage.BucketHandle
+}
+
+func (b *bucketBackend) Stat(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	attrs, err := b.bucket.Object(name).Attrs(ctx)
+	if err == storage.ErrObjectNotExist {
+		return nil, nil
+	}
+	return attrs, err
+}
+
+func (b *bucketBackend) List(ctx context.Context, prefix, delimiter string, fn func(*storage.ObjectAttrs) error) error {
+	it := b.bucket.Objects(ctx, &storage.Query{Prefix: prefix, Delimiter: delimiter})
+	for {
+		attrs, err := it.Next()
+		if err == iterator.Done {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(attrs); err != nil {
+			return err
+		}
+	}
+}
+
+func (b *bucketBackend) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	rc, err := b.bucket.Object(name).NewRangeReader(ctx, offset, length)
+	if err != nil {
+		return nil, nil, err
+	}
+	return rc, &storage.ObjectAttrs{Name: name, Size: rc.Attrs.Size, ContentType: rc.Attrs.ContentType, Generation: rc.Attrs.Generation, Updated: rc.Attrs.LastModified}, nil
+}
+
+func (b *bucketBackend) Write(ctx context.Context, name string, content []byte, metadata map[string]string, cond *storage.Conditions) (*storage.ObjectAttrs, error) {
+	obj := b.bucket.Object(name)
+	if cond != nil {
+		obj = obj.If(*cond)
+	}
+	wc := obj.NewWriter(ctx)
+	wc.Metadata = metadata
+	if _, err := wc.Write(content); err != nil {
+		wc.Close()
+		return nil, err
+	}
+	if err := wc.Close(); err != nil {
+		if isPreconditionFailed(err) {
+			return nil, ErrPreconditionFailed
+		}
+		return nil, err
+	}
+	return wc.Attrs(), nil
+}
+
+func (b *bucketBackend) Copy(ctx context.Context, src, dst string) error {
+	_, err := b.bucket.Object(dst).CopierFrom(b.bucket.Object(src)).Run(ctx)
+	return err
+}
+
+func (b *bucketBackend) Delete(ctx context.Context, name string) error {
+	return b.bucket.Object(name).Delete(ctx)
+}
+
+// memoryBackend keeps objects in process memory. It is fast and loses
+// everything on restart or unmount, which suits /tmp.
+type memoryBackend struct {
+	mu      sync.RWMutex
+	objects map[string]*memoryObject
+}
+
+type memoryObject struct {
+	attrs storage.ObjectAttrs
+	data  []byte
+}
+
+func newMemoryBackend() *memoryBackend {
+	return &memoryBackend{objects: make(map[string]*memoryObject)}
+}
+
+func (b *memoryBackend) Stat(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.objects[name]
+	if !ok {
+		return nil, nil
+	}
+	attrs := obj.attrs
+	return &attrs, nil
+}
+
+func (b *memoryBackend) List(ctx context.Context, prefix, delimiter string, fn func(*storage.ObjectAttrs) error) error {
+	b.mu.RLock()
+	var entries []*storage.ObjectAttrs
+	seen := make(map[string]bool)
+	for name, obj := range b.objects {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					entries = append(entries, &storage.ObjectAttrs{Prefix: p})
+				}
+				continue
+			}
+		}
+		attrs := obj.attrs
+		entries = append(entries, &attrs)
+	}
+	b.mu.RUnlock()
+
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name+entries[i].Prefix < entries[j].Name+entries[j].Prefix })
+	for _, attrs := range entries {
+		if err := fn(attrs); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	obj, ok := b.objects[name]
+	if !ok {
+		return nil, nil, storage.ErrObjectNotExist
+	}
+	attrs := obj.attrs
+	data := obj.data[min(max(offset, 0), int64(len(obj.data))):]
+	if length >= 0 && length < int64(len(data)) {
+		data = data[:length]
+	}
+	return io.NopCloser(bytes.NewReader(data)), &attrs, nil
+}
+
+func (b *memoryBackend) Write(ctx context.Context, name string, content []byte, metadata map[string]string, cond *storage.Conditions) (*storage.ObjectAttrs, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	prev, exists := b.objects[name]
+	if cond != nil {
+		if (cond.DoesNotExist && exists) || (cond.GenerationMatch != 0 && (!exists || prev.attrs.Generation != cond.GenerationMatch)) {
+			return nil, ErrPreconditionFailed
+		}
+	}
+	return b.put(name, append([]byte(nil), content...), metadata), nil
+}
+
+// put stores an object with a fresh generation. Callers must hold b.mu.
+func (b *memoryBackend) put(name string, data []byte, metadata map[string]string) *storage.ObjectAttrs {
+	now := time.Now()
+	generation := now.UnixNano()
+	if prev, ok := b.objects[name]; ok && prev.attrs.Generation >= generation {
+		generation = prev.attrs.Generation + 1
+	}
+	obj := &memoryObject{
+		attrs: storage.ObjectAttrs{
+			Name:       name,
+			Size:       int64(len(data)),
+			Generation: generation,
+			Metadata:   metadata,
+			Created:    now,
+			Updated:    now,
+		},
+		data: data,
+	}
+	b.objects[name] = obj
+	attrs := obj.attrs
+	return &attrs
+}
+
+func (b *memoryBackend) Copy(ctx context.Context, src, dst string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	obj, ok := b.objects[src]
+	if !ok {
+		return storage.ErrObjectNotExist
+	}
+	b.put(dst, obj.data, obj.attrs.Metadata)
+	return nil
+}
+
+func (b *memoryBackend) Delete(ctx context.Context, name string) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, ok := b.objects[name]; !ok {
+		return storage.ErrObjectNotExist
+	}
+	delete(b.objects, name)
+	return nil
+}
+
+// subBackend exposes the objects under a prefix of another backend.
+type subBackend struct {
+	base   Backend
+	prefix string // Ends with "/".
+}
+
+func newSubBackend(base Backend, prefix string) *subBackend {
+	return &subBackend{base: base, prefix: strings.Trim(prefix, "/") + "/"}
+}
+
+func (b *subBackend) strip(attrs *storage.ObjectAttrs) *storage.ObjectAttrs {
+	if attrs == nil {
+		return nil
+	}
+	out := *attrs
+	out.Name = strings.TrimPrefix(out.Name, b.prefix)
+	out.Prefix = strings.TrimPrefix(out.Prefix, b.prefix)
+	return &out
+}
+
+func (b *subBackend) Stat(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	attrs, err := b.base.Stat(ctx, b.prefix+name)
+	return b.strip(attrs), err
+}
+
+func (b *subBackend) List(ctx context.Context, prefix, delimiter string, fn func(*storage.ObjectAttrs) error) error {
+	return b.base.List(ctx, b.prefix+prefix, delimiter, func(attrs *storage.ObjectAttrs) error {
+		return fn(b.strip(attrs))
+	})
+}
+
+func (b *subBackend) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	rc, attrs, err := b.base.Open(ctx, b.prefix+name, offset, length)
+	return rc, b.strip(attrs), err
+}
+
+func (b *subBackend) Write(ctx context.Context, name string, content []byte, metadata map[string]string, cond *storage.Conditions) (*storage.ObjectAttrs, error) {
+	attrs, err := b.base.Write(ctx, b.prefix+name, content, metadata, cond)
+	return b.strip(attrs), err
+}
+
+func (b *subBackend) Copy(ctx context.Context, src, dst string) error {
+	return b.base.Copy(ctx, b.prefix+src, b.prefix+dst)
+}
+
+func (b *subBackend) Delete(ctx context.Context, name string) error {
+	return b.base.Delete(ctx, b.prefix+name)
+}
+
+// metaWhiteout marks an object in an overlay's upper layer that hides the
+// lower object of the same name.
+const metaWhiteout = "aether-whiteout"
+
+// overlayBackend layers a writable upper backend over a read-only lower one.
+// Reads see the upper object if there is one and the lower one otherwise;
+// every write lands in the upper layer, copying lower objects up as needed,
+// and deleting a lower object leaves a whiteout in the upper layer.
+type overlayBackend struct {
+	upper, lower Backend
+}
+
+func isWhiteout(attrs *storage.ObjectAttrs) bool {
+	return attrs != nil && attrs.Metadata[metaWhiteout] != ""
+}
+
+func (b *overlayBackend) Stat(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	attrs, err := b.upper.Stat(ctx, name)
+	if err != nil || attrs != nil {
+		if isWhiteout(attrs) {
+			return nil, nil
+		}
+		return attrs, err
+	}
+	return b.lower.Stat(ctx, name)
+}
+
+// List merges both layers. Delimited listings are built from the merged
+// recursive listing, since a lower folder may be entirely whited out.
+func (b *overlayBackend) List(ctx context.Context, prefix, delimiter string, fn func(*storage.ObjectAttrs) error) error {
+	merged := make(map[string]*storage.ObjectAttrs)
+	hidden := make(map[string]bool)
+	err := b.upper.List(ctx, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if isWhiteout(attrs) {
+			hidden[attrs.Name] = true
+		} else {
+			merged[attrs.Name] = attrs
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	err = b.lower.List(ctx, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if _, ok := merged[attrs.Name]; !ok && !hidden[attrs.Name] {
+			merged[attrs.Name] = attrs
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	names := make([]string, 0, len(merged))
+	for name := range merged {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	seen := make(map[string]bool)
+	for _, name := range names {
+		if delimiter != "" {
+			if i := strings.Index(name[len(prefix):], delimiter); i >= 0 {
+				p := name[:len(prefix)+i+len(delimiter)]
+				if !seen[p] {
+					seen[p] = true
+					if err := fn(&storage.ObjectAttrs{Prefix: p}); err != nil {
+						return err
+					}
+				}
+				continue
+			}
+		}
+		if err := fn(merged[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b *overlayBackend) Open(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	attrs, err := b.upper.Stat(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	if isWhiteout(attrs) {
+		return nil, nil, storage.ErrObjectNotExist
+	}
+	if attrs != nil {
+		return b.upper.Open(ctx, name, offset, length)
+	}
+	return b.lower.Open(ctx, name, offset, length)
+}
+
+func (b *overlayBackend) Write(ctx context.Context, name string, content []byte, metadata map[string]string, cond *storage.Conditions) (*storage.ObjectAttrs, error) {
+	if cond == nil {
+		return b.upper.Write(ctx, name, content, metadata, nil)
+	}
+	// Conditions refer to the merged view, which may be showing the lower
+	// object; check those here and make the upper write conditional on the
+	// upper layer not having changed in the meantime.
+	upper, err := b.upper.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	current, err := b.Stat(ctx, name)
+	if err != nil {
+		return nil, err
+	}
+	if (cond.DoesNotExist && current != nil) || (cond.GenerationMatch != 0 && (current == nil || current.Generation != cond.GenerationMatch)) {
+		return nil, ErrPreconditionFailed
+	}
+	upperCond := &storage.Conditions{DoesNotExist: true}
+	if upper != nil {
+		upperCond = &storage.Conditions{GenerationMatch: upper.Generation}
+	}
+	return b.upper.Write(ctx, name, content, metadata, upperCond)
+}
+
+func (b *overlayBackend) Copy(ctx context.Context, src, dst string) error {
+	rc, attrs, err := b.Open(ctx, src, 0, -1)
+	if err != nil {
+		return err
+	}
+	defer rc.Close()
+	data, err := AetherReadAll(rc)
+	if err != nil {
+		return err
+	}
+	if full, err := b.Stat(ctx, src); err == nil && full != nil {
+		attrs = full // Open does not report metadata for every backend.
+	}
+	_, err = b.upper.Write(ctx, dst, data, attrs.Metadata, nil)
+	return err
+}
+
+func (b *overlayBackend) Delete(ctx context.Context, name string) error {
+	upper, err := b.upper.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	lower, err := b.lower.Stat(ctx, name)
+	if err != nil {
+		return err
+	}
+	if lower == nil {
+		if upper == nil || isWhiteout(upper) {
+			return storage.ErrObjectNotExist
+		}
+		return b.upper.Delete(ctx, name)
+	}
+	if isWhiteout(upper) {
+		return storage.ErrObjectNotExist
+	}
+	_, err = b.upper.Write(ctx, name, nil, map[string]string{metaWhiteout: "true"}, nil)
+	if err != nil {
+		return fmt.Errorf("failed to hide %s: %w", name, err)
+	}
+	return nil
+}
@@ -0,0 +1,345 @@
+package aether
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+// Operations accepted in a batch.
+const (
+	BatchWrite        = "write"
+	BatchCreateFile   = "create:file"
+	BatchCreateFolder = "create:folder"
+	BatchDelete       = "delete"
+	BatchMove         = "move"
+)
+
+// Statuses reported for each operation of a batch.
+const (
+	BatchApplied        = "applied"         // The operation took effect.
+	BatchFailed         = "failed"          // The operation caused the batch to fail.
+	BatchRolledBack     = "rolled_back"     // The operation was applied, then undone.
+	BatchRollbackFailed = "rollback_failed" // The operation was applied and could not be undone.
+	BatchSkipped        = "skipped"         // The batch failed before reaching the operation.
+)
+
+// MaxBatchOps bounds the number of operations in a single batch.
+const MaxBatchOps = 256
+
+// BatchOp is one operation of a batch. Paths are storage keys, already
+// resolved by the caller.
+type BatchOp struct {
+	Op      string // One of the Batch* operations.
+	Path    string // Target path; the parent folder for creates.
+	Name    string // Name of the file or folder to create.
+	NewPath string // Destination of a move.
+	Content []byte // Content of a write.
+	IfMatch string // Revision condition for writes, deletes and moves.
+}
+
+// target returns the path an operation acts on.
+func (op BatchOp) target() string {
+	if op.Op == BatchCreateFile || op.Op == BatchCreateFolder {
+		return path.Join(op.Path, op.Name)
+	}
+	return op.Path
+}
+
+func (op BatchOp) validate() error {
+	switch op.Op {
+	case BatchWrite, BatchDelete:
+	case BatchCreateFile, BatchCreateFolder:
+		if !ValidName(op.Name) {
+			return fmt.Errorf("invalid name: %q", op.Name)
+		}
+		return nil
+	case BatchMove:
+		if strings.Trim(op.NewPath, "/") == "" {
+			return fmt.Errorf("move requires a destination path")
+		}
+	default:
+		return fmt.Errorf("unknown batch operation: %q", op.Op)
+	}
+	if strings.Trim(op.Path, "/") == "" {
+		return fmt.Errorf("%s requires a path", op.Op)
+	}
+	return nil
+}
+
+// BatchResult reports the outcome of one operation of a batch.
+type BatchResult struct {
+	Op       string `json:"op"`
+	Path     string `json:"path"`
+	Status   string `json:"status"`
+	Revision string `json:"revision,omitempty"` // New revision of a written or created file.
+	TrashID  string `json:"trashId,omitempty"`  // Trash entry of a deleted item.
+	Error    string `json:"error,omitempty"`
+}
+
+// BatchError is returned when a batch fails. It unwraps to the error of the
+// failing operation.
+type BatchError struct {
+	Index       int   // Index of the failing operation.
+	Err         error // Why it failed.
+	RollbackErr error // Set if earlier operations could not all be undone.
+}
+
+func (e *BatchError) Error() string {
+	if e.RollbackErr != nil {
+		return fmt.Sprintf("batch operation %d failed: %v (rollback incomplete: %v)", e.Index, e.Err, e.RollbackErr)
+	}
+	return fmt.Sprintf("batch operation %d failed: %v", e.Index, e.Err)
+}
+
+func (e *BatchError) Unwrap() error {
+	return e.Err
+}
+
+// batchTx tracks the compensating actions and pending change events of a
+// batch being applied.
+type batchTx struct {
+	undo   []func() error
+	events []ChangeEvent
+}
+
+// Batch applies ops in order as one unit on behalf of the user and app in
+// opts: either every operation takes effect or, when one fails, those already
+// applied are undone in reverse order. The storage backend has no
+// transactions, so the batch holds vfs.mu throughout, which keeps other VFS
+// callers from seeing it half done, and compensates on failure. Change events
+// are emitted only once the whole batch has been applied. The returned
+// results line up with ops.
+func (vfs *VFSModule) Batch(ops []BatchOp, opts WriteOptions) ([]*BatchResult, error) {
+	if len(ops) > MaxBatchOps {
+		return nil, fmt.Errorf("batch has %d operations, the limit is %d", len(ops), MaxBatchOps)
+	}
+	return vfs.batch(ops, opts, nil)
+}
+
+// batch is Batch without the limit on the number of operations. If progress
+// is set it is called with the number of operations applied so far.
+func (vfs *VFSModule) batch(ops []BatchOp, opts WriteOptions, progress func(applied int)) ([]*BatchResult, error) {
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("batch has no operations")
+	}
+
+	results := make([]*BatchResult, len(ops))
+	for i, op := range ops {
+		results[i] = &BatchResult{Op: op.Op, Path: VirtualPath(op.target()), Status: BatchSkipped}
+	}
+	for i, op := range ops {
+		if err := op.validate(); err != nil {
+			results[i].Status = BatchFailed
+			results[i].Error = err.Error()
+			return results, &BatchError{Index: i, Err: err}
+		}
+	}
+
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	ctx := context.Background()
+
+	tx := &batchTx{}
+	for i, op := range ops {
+		err := vfs.applyBatchOp(ctx, tx, op, opts, results[i])
+		if err == nil {
+			results[i].Status = BatchApplied
+			if progress != nil {
+				progress(i + 1)
+			}
+			continue
+		}
+
+		results[i].Status = BatchFailed
+		results[i].Error = err.Error()
+		rollbackErr := tx.rollback()
+		for j := 0; j < i; j++ {
+			results[j].Status = BatchRolledBack
+			if rollbackErr != nil {
+				results[j].Status = BatchRollbackFailed
+			}
+		}
+		return results, &BatchError{Index: i, Err: err, RollbackErr: rollbackErr}
+	}
+
+	for _, event := range tx.events {
+		vfs.emitEvent(event)
+	}
+	return results, nil
+}
+
+// rollback runs the compensating actions in reverse order. It keeps going
+// past failures so as much as possible is restored, and returns the first error.
+func (tx *batchTx) rollback() error {
+	var first error
+	for i := len(tx.undo) - 1; i >= 0; i-- {
+		if err := tx.undo[i](); err != nil {
+			log.Printf("VFS batch rollback step failed: %v", err)
+			if first == nil {
+				first = err
+			}
+		}
+	}
+	return first
+}
+
+// applyBatchOp applies a single operation, recording how to undo whatever it
+// changed even if it fails part way. Callers must hold vfs.mu.
+func (vfs *VFSModule) applyBatchOp(ctx context.Context, tx *batchTx, op BatchOp, opts WriteOptions, result *BatchResult) error {
+	switch op.Op {
+	case BatchWrite:
+		writeOpts := opts
+		writeOpts.IfMatch = op.IfMatch
+		prev, next, err := vfs.batchWrite(ctx, tx, op.Path, op.Content, writeOpts)
+		if err != nil {
+			return err
+		}
+		changeType := ChangeModified
+		if prev == nil {
+			changeType = ChangeCreated
+		}
+		tx.events = append(tx.events, newChangeEvent(changeType, op.Path, false, int64(len(op.Content))))
+		result.Revision = Revision(next)
+
+	case BatchCreateFile:
+		name := op.target()
+		if existing, err := vfs.statObject(ctx, name); err != nil {
+			return err
+		} else if existing != nil {
+			return fmt.Errorf("file %w: %s", ErrExist, name)
+		}
+		_, next, err := vfs.batchWrite(ctx, tx, name, []byte(""), opts)
+		if err != nil {
+			return err
+		}
+		tx.events = append(tx.events, newChangeEvent(ChangeCreated, name, false, 0))
+		result.Revision = Revision(next)
+
+	case BatchCreateFolder:
+		if _, _, err := vfs.batchWrite(ctx, tx, path.Join(op.target(), ".placeholder"), []byte(""), opts); err != nil {
+			return err
+		}
+		tx.events = append(tx.events, newChangeEvent(ChangeCreated, op.target(), true, 0))
+
+	case BatchDelete:
+		if err := vfs.checkLocks(op.Path, opts); err != nil {
+			return err
+		}
+		if err := vfs.matchRevision(ctx, strings.Trim(op.Path, "/"), op.IfMatch); err != nil {
+			return err
+		}
+		entry, err := vfs.moveToTrash(ctx, opts.User, op.Path)
+		if entry != nil {
+			tx.undo = append(tx.undo, func() error { return vfs.untrash(ctx, opts.User, entry) })
+		}
+		if err != nil {
+			return err
+		}
+		tx.events = append(tx.events, newChangeEvent(ChangeDeleted, entry.OriginalPath, entry.IsDir, entry.Size))
+		result.TrashID = entry.ID
+
+	case BatchMove:
+		src := strings.Trim(op.Path, "/")
+		dst := strings.Trim(op.NewPath, "/")
+		moveOpts := opts
+		moveOpts.IfMatch = op.IfMatch
+		moved, isDir, size, err := vfs.move(ctx, src, dst, moveOpts)
+		for _, name := range moved {
+			name := name
+			tx.undo = append(tx.undo, func() error {
+				return vfs.moveBack(ctx, name, src+strings.TrimPrefix(name, dst))
+			})
+		}
+		if err != nil {
+			return err
+		}
+		vfs.moveACL(src, dst)
+		tx.undo = append(tx.undo, func() error {
+			vfs.moveACL(dst, src)
+			return nil
+		})
+		tx.events = append(tx.events, ChangeEvent{
+			Type:    ChangeMoved,
+			Path:    VirtualPath(dst),
+			OldPath: VirtualPath(src),
+			IsDir:   isDir,
+			Size:    size,
+			Time:    time.Now(),
+		})
+	}
+	return nil
+}
+
+// batchWrite writes an object after saving what is needed to put back its
+// previous state. Callers must hold vfs.mu.
+func (vfs *VFSModule) batchWrite(ctx context.Context, tx *batchTx, name string, content []byte, opts WriteOptions) (prev, next *storage.ObjectAttrs, err error) {
+	var prevData []byte
+	if existing, err := vfs.statObject(ctx, name); err != nil {
+		return nil, nil, err
+	} else if existing != nil {
+		if prevData, err = vfs.readObject(ctx, name); err != nil {
+			return nil, nil, err
+		}
+	}
+
+	prev, next, err = vfs.writeObject(ctx, name, content, opts)
+	if err != nil {
+		return nil, nil, err
+	}
+	tx.undo = append(tx.undo, func() error {
+		if prev == nil {
+			return vfs.deleteObject(ctx, name)
+		}
+		return vfs.restoreObject(ctx, name, prevData, prev)
+	})
+	return prev, next, nil
+}
+
+// restoreObject puts back an object's earlier content and ownership. It
+// bypasses quota checks since it only returns the VFS to an earlier state.
+// Callers must hold vfs.mu.
+func (vfs *VFSModule) restoreObject(ctx context.Context, name string, content []byte, prev *storage.ObjectAttrs) error {
+	current, err := vfs.statObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	backend, inner, _ := vfs.route(name)
+	if _, err := backend.Write(ctx, inner, content, prev.Metadata, nil); err != nil {
+		return fmt.Errorf("failed to restore %s: %w", name, err)
+	}
+	user, app := objectOwner(prev)
+	vfs.recordUsage(name, current, user, app, int64(len(content)), true)
+	return nil
+}
+
+// deleteObject permanently removes a single object. Callers must hold vfs.mu.
+func (vfs *VFSModule) deleteObject(ctx context.Context, name string) error {
+	attrs, err := vfs.statObject(ctx, name)
+	if err != nil || attrs == nil {
+		return err
+	}
+	backend, inner, _ := vfs.route(name)
+	if err := backend.Delete(ctx, inner); err != nil && err != storage.ErrObjectNotExist {
+		return fmt.Errorf("failed to delete object %s: %w", name, err)
+	}
+	vfs.recordUsage(name, attrs, "", "", 0, false)
+	return nil
+}
+
+// moveBack returns a moved object to its earlier name. Callers must hold vfs.mu.
+func (vfs *VFSModule) moveBack(ctx context.Context, name, original string) error {
+	attrs, err := vfs.statObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	if attrs == nil {
+		return fmt.Errorf("cannot move %s back to %s: it no longer exists", name, original)
+	}
+	return vfs.moveObject(ctx, attrs, original)
+}
@@ -0,0 +1,113 @@
+package aether
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// tree describes the files under dir as "name=content", relative to dir and
+// sorted, followed by the number of entries in user's trash.
+func tree(t *testing.T, vfs *VFSModule, dir, user string) string {
+	t.Helper()
+	var names []string
+	err := vfs.Walk(dir, "", -1, 0, func(files []*FileInfo) error {
+		for _, f := range files {
+			if !f.IsDir {
+				names = append(names, strings.TrimPrefix(f.Path, "/"))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	var files []string
+	for _, name := range names {
+		content, err := vfs.Read(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		files = append(files, strings.TrimPrefix(name, dir+"/")+"="+content)
+	}
+	trash, err := vfs.ListTrash(user)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return fmt.Sprintf("%s trash:%d", strings.Join(files, " "), len(trash))
+}
+
+func TestBatch(t *testing.T) {
+	const original = "a.txt=a dir/b.txt=b trash:0"
+
+	tests := []struct {
+		name     string
+		ops      []BatchOp
+		statuses string // Status of each operation, space separated.
+		failAt   int    // Index of the failing operation, or -1 if the batch succeeds.
+		want     string
+		wantErr  error
+	}{
+		{"applied", []BatchOp{
+			{Op: BatchWrite, Path: "home/u/new.txt", Content: []byte("n")},
+			{Op: BatchMove, Path: "home/u/dir", NewPath: "home/u/moved"},
+			{Op: BatchDelete, Path: "home/u/a.txt"},
+		}, "applied applied applied", -1, "moved/b.txt=b new.txt=n trash:1", nil},
+		{"rolled back", []BatchOp{
+			{Op: BatchWrite, Path: "home/u/a.txt", Content: []byte("changed")},
+			{Op: BatchCreateFile, Path: "home/u", Name: "c.txt"},
+			{Op: BatchCreateFolder, Path: "home/u", Name: "empty"},
+			{Op: BatchMove, Path: "home/u/dir", NewPath: "home/u/moved"},
+			{Op: BatchDelete, Path: "home/u/a.txt"},
+			{Op: BatchDelete, Path: "home/u/missing.txt"},
+		}, "rolled_back rolled_back rolled_back rolled_back rolled_back failed", 5, original, ErrNotFound},
+		{"revision conflict", []BatchOp{
+			{Op: BatchWrite, Path: "home/u/new.txt", Content: []byte("n")},
+			{Op: BatchWrite, Path: "home/u/a.txt", Content: []byte("changed"), IfMatch: "stale"},
+		}, "rolled_back failed", 1, original, nil},
+		{"create over existing", []BatchOp{
+			{Op: BatchDelete, Path: "home/u/dir"},
+			{Op: BatchCreateFile, Path: "home/u", Name: "a.txt"},
+		}, "rolled_back failed", 1, original, ErrExist},
+		{"move onto existing", []BatchOp{
+			{Op: BatchMove, Path: "home/u/a.txt", NewPath: "home/u/dir/b.txt"},
+		}, "failed", 0, original, nil},
+		{"invalid op", []BatchOp{
+			{Op: BatchWrite, Path: "home/u/new.txt", Content: []byte("n")},
+			{Op: "chmod", Path: "home/u/a.txt"},
+		}, "skipped failed", 1, original, nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			writeFiles(t, vfs, map[string]string{"home/u/a.txt": "a", "home/u/dir/b.txt": "b"})
+
+			results, err := vfs.Batch(tt.ops, WriteOptions{User: "u"})
+			if tt.failAt < 0 && err != nil {
+				t.Fatal(err)
+			}
+			if tt.failAt >= 0 {
+				var batchErr *BatchError
+				if !errors.As(err, &batchErr) || batchErr.Index != tt.failAt || batchErr.RollbackErr != nil {
+					t.Fatalf("err = %v, want a clean failure at operation %d", err, tt.failAt)
+				}
+				if tt.wantErr != nil && !errors.Is(err, tt.wantErr) {
+					t.Errorf("err = %v, want %v", err, tt.wantErr)
+				}
+			}
+			var statuses []string
+			for _, r := range results {
+				statuses = append(statuses, r.Status)
+			}
+			if got := strings.Join(statuses, " "); got != tt.statuses {
+				t.Errorf("statuses %s, want %s", got, tt.statuses)
+			}
+			if got := tree(t, vfs, "home/u", "u"); got != tt.want {
+				t.Errorf("after the batch: %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,78 @@
+package aether
+
+import (
+	"log"
+	"time"
+)
+
+// ChangeType identifies the kind of mutation reported by a ChangeEvent.
+type ChangeType string
+
+const (
+	ChangeCreated  ChangeType = "created"
+	ChangeModified ChangeType = "modified"
+	ChangeDeleted  ChangeType = "deleted"
+	ChangeMoved    ChangeType = "moved"
+)
+
+// changeQueueSize bounds how many change events may be waiting for listeners.
+const changeQueueSize = 1024
+
+// ChangeEvent describes a single mutation applied through the VFSModule.
+type ChangeEvent struct {
+	Type    ChangeType `json:"type"`
+	Path    string     `json:"path"`              // Absolute virtual path.
+	OldPath string     `json:"oldPath,omitempty"` // Set for moves.
+	IsDir   bool       `json:"isDir"`
+	Size    int64      `json:"size,omitempty"`
+	Time    time.Time  `json:"time"`
+}
+
+// ChangeListener receives change events. Listeners run on a dedicated
+// goroutine, in mutation order, and may safely call back into the VFSModule.
+type ChangeListener func(ChangeEvent)
+
+// OnChange registers a listener that is notified after every successful mutation.
+func (vfs *VFSModule) OnChange(listener ChangeListener) {
+	vfs.listenersMu.Lock()
+	defer vfs.listenersMu.Unlock()
+	vfs.listeners = append(vfs.listeners, listener)
+}
+
+// emit queues a change event for delivery to listeners. It never blocks the
+// mutation that produced it; if listeners fall far behind the event is dropped.
+func (vfs *VFSModule) emit(changeType ChangeType, path string, isDir bool, size int64) {
+	vfs.emitEvent(newChangeEvent(changeType, path, isDir, size))
+}
+
+func newChangeEvent(changeType ChangeType, path string, isDir bool, size int64) ChangeEvent {
+	return ChangeEvent{
+		Type:  changeType,
+		Path:  VirtualPath(path),
+		IsDir: isDir,
+		Size:  size,
+		Time:  time.Now(),
+	}
+}
+
+func (vfs *VFSModule) emitEvent(event ChangeEvent) {
+	vfs.generation.Add(1)
+	select {
+	case vfs.changes <- event:
+	default:
+		log.Printf("VFS change queue full, dropping %s event for %s", event.Type, event.Path)
+	}
+}
+
+// dispatchChanges delivers queued change events to the registered listeners.
+func (vfs *VFSModule) dispatchChanges() {
+	for event := range vfs.changes {
+		vfs.listenersMu.RLock()
+		listeners := vfs.listeners
+		vfs.listenersMu.RUnlock()
+
+		for _, listener := range listeners {
+			listener(event)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package aether
+
+import (
+	"path"
+	"strings"
+)
+
+// MatchGlob reports whether a slash-separated name matches pattern. It accepts
+// the syntax of path.Match, plus "**" as a whole segment matching zero or more
+// directories. A pattern without a slash is matched against the base name only,
+// so "*.go" matches Go files at any depth.
+func MatchGlob(pattern, name string) bool {
+	pattern = strings.Trim(pattern, "/")
+	name = strings.Trim(name, "/")
+	if pattern == "" {
+		return true
+	}
+	if !strings.Contains(pattern, "/") && pattern != "**" {
+		ok, _ := path.Match(pattern, path.Base(name))
+		return ok
+	}
+	return matchSegments(strings.Split(pattern, "/"), strings.Split(name, "/"))
+}
+
+func matchSegments(pattern, name []string) bool {
+	for len(pattern) > 0 {
+		if pattern[0] == "**" {
+			// Collapse consecutive "**" and try every possible split point.
+			for len(pattern) > 0 && pattern[0] == "**" {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(name); i++ {
+				if matchSegments(pattern, name[i:]) {
+					return true
+				}
+			}
+			return false
+		}
+		if len(name) == 0 {
+			return false
+		}
+		if ok, _ := path.Match(pattern[0], name[0]); !ok {
+			return false
+		}
+		pattern, name = pattern[1:], name[1:]
+	}
+	return len(name) == 0
+}
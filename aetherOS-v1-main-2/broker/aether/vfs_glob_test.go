@@ -0,0 +1,36 @@
+package aether
+
+import "testing"
+
+func TestMatchGlob(t *testing.T) {
+	tests := []struct {
+		pattern, name string
+		want          bool
+	}{
+		{"", "a/b.go", true},
+		{"*.go", "main.go", true},
+		{"*.go", "cmd/tool/main.go", true}, // No slash: base name only.
+		{"*.go", "main.go.txt", false},
+		{"cmd/*.go", "cmd/main.go", true},
+		{"cmd/*.go", "cmd/tool/main.go", false},
+		{"**", "a/b/c", true},
+		{"**/*.go", "main.go", true}, // "**" matches zero directories.
+		{"**/*.go", "a/b/main.go", true},
+		{"a/**/c", "a/c", true},
+		{"a/**/c", "a/b/x/c", true},
+		{"a/**/c", "a/b/x/d", false},
+		{"a/**/**/c", "a/b/c", true},
+		{"a/**", "a", true},
+		{"a/**", "b/c", false},
+		{"/src/*.ts/", "src/app.ts", true}, // Surrounding slashes are ignored.
+		{"src/[ab].ts", "src/b.ts", true},
+		{"src/[ab].ts", "src/c.ts", false},
+		{"src/?.ts", "src/ab.ts", false},
+		{"src/[", "src/[", false}, // Malformed patterns match nothing.
+	}
+	for _, tt := range tests {
+		if got := MatchGlob(tt.pattern, tt.name); got != tt.want {
+			t.Errorf("MatchGlob(%q, %q) = %v, want %v", tt.pattern, tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,474 @@
+package aether
+
+import (
+	"context"
+	"log"
+	"math"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"unicode"
+	"unicode/utf8"
+)
+
+const (
+	// maxIndexedFileSize keeps large or generated files out of the search index.
+	maxIndexedFileSize = 1 << 20
+	// snippetRadius is how many bytes of context are shown around a match.
+	snippetRadius = 80
+	// DefaultSearchLimit is the number of results returned when none is requested.
+	DefaultSearchLimit = 20
+	// MaxSearchLimit caps the number of results a single query can return.
+	MaxSearchLimit = 100
+)
+
+// SearchResult is a single ranked match from a full-text query.
+type SearchResult struct {
+	Path    string  `json:"path"`
+	Score   float64 `json:"score"`
+	Line    int     `json:"line"`
+	Snippet string  `json:"snippet"`
+}
+
+// SearchQuery is a parsed full-text query. Terms and phrases must all match;
+// PathPrefix and Types narrow the documents considered.
+type SearchQuery struct {
+	Terms      []string   // Single words; a trailing "*" makes a prefix match.
+	Phrases    [][]string // Quoted word sequences that must appear in order.
+	PathPrefix string     // From "path:", an absolute virtual path.
+	Types      []string   // From "type:" or "ext:", extensions without the dot.
+}
+
+type tokenSpan struct {
+	term  string
+	start int
+}
+
+type indexedDoc struct {
+	path    string
+	ext     string
+	content string
+	tokens  []tokenSpan
+}
+
+// SearchIndex is an in-memory inverted index over file contents, kept up to
+// date from VFSModule change events so queries never touch storage or the network.
+type SearchIndex struct {
+	vfs *VFSModule
+
+	mu       sync.RWMutex
+	docs     map[string]*indexedDoc
+	postings map[string]map[string][]int // term -> path -> token positions
+}
+
+// NewSearchIndex creates an empty index over the given VFS.
+func NewSearchIndex(vfs *VFSModule) *SearchIndex {
+	return &SearchIndex{
+		vfs:      vfs,
+		docs:     make(map[string]*indexedDoc),
+		postings: make(map[string]map[string][]int),
+	}
+}
+
+// Rebuild indexes every text file currently in storage. It is meant to run
+// at startup and after mount changes; otherwise HandleChange keeps the index
+// current.
+func (idx *SearchIndex) Rebuild() error {
+	indexed, err := idx.indexObjects("")
+	if err != nil {
+		return err
+	}
+	log.Printf("Search index built with %d documents", indexed)
+	return nil
+}
+
+// indexObjects indexes the text files whose storage keys start with prefix
+// and reports how many were indexed.
+func (idx *SearchIndex) indexObjects(prefix string) (int, error) {
+	idx.vfs.mu.RLock()
+	objects, err := idx.vfs.listObjects(context.Background(), prefix)
+	idx.vfs.mu.RUnlock()
+	if err != nil {
+		return 0, err
+	}
+
+	indexed := 0
+	for _, attrs := range objects {
+		if attrs.Size > maxIndexedFileSize || isSystemKey(attrs.Name) || path.Base(attrs.Name) == ".placeholder" {
+			continue
+		}
+		if idx.indexPath(VirtualPath(attrs.Name)) {
+			indexed++
+		}
+	}
+	return indexed, nil
+}
+
+// HandleChange updates the index for a VFS mutation. Register it with VFSModule.OnChange.
+func (idx *SearchIndex) HandleChange(event ChangeEvent) {
+	switch event.Type {
+	case ChangeCreated, ChangeModified:
+		if !event.IsDir {
+			idx.indexPath(event.Path)
+			break
+		}
+		// A folder can appear with files already in it, for example when it
+		// is restored from the trash.
+		if _, err := idx.indexObjects(strings.Trim(event.Path, "/") + "/"); err != nil {
+			log.Printf("Search index: failed to index %s: %v", event.Path, err)
+		}
+	case ChangeDeleted:
+		idx.removeTree(event.Path)
+	case ChangeMoved:
+		idx.moveTree(event.OldPath, event.Path)
+	}
+}
+
+// indexPath reads a file and (re)indexes it, reporting whether it was indexed.
+func (idx *SearchIndex) indexPath(p string) bool {
+	content, err := idx.vfs.Read(strings.TrimPrefix(p, "/"))
+	if err != nil || len(content) > maxIndexedFileSize || !utf8.ValidString(content) || strings.ContainsRune(content, 0) {
+		idx.remove(p)
+		return false
+	}
+	idx.add(p, content)
+	return true
+}
+
+func (idx *SearchIndex) add(p, content string) {
+	doc := &indexedDoc{
+		path:    p,
+		ext:     strings.TrimPrefix(strings.ToLower(path.Ext(p)), "."),
+		content: content,
+		tokens:  tokenize(content),
+	}
+
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(p)
+	idx.docs[p] = doc
+	for pos, tok := range doc.tokens {
+		docs, ok := idx.postings[tok.term]
+		if !ok {
+			docs = make(map[string][]int)
+			idx.postings[tok.term] = docs
+		}
+		docs[p] = append(docs[p], pos)
+	}
+}
+
+func (idx *SearchIndex) remove(p string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.removeLocked(p)
+}
+
+func (idx *SearchIndex) removeLocked(p string) {
+	doc, ok := idx.docs[p]
+	if !ok {
+		return
+	}
+	for _, tok := range doc.tokens {
+		if docs, ok := idx.postings[tok.term]; ok {
+			delete(docs, p)
+			if len(docs) == 0 {
+				delete(idx.postings, tok.term)
+			}
+		}
+	}
+	delete(idx.docs, p)
+}
+
+// removeTree drops a file, or every file under a folder, from the index.
+func (idx *SearchIndex) removeTree(p string) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	for docPath := range idx.docs {
+		if docPath == p || strings.HasPrefix(docPath, p+"/") {
+			idx.removeLocked(docPath)
+		}
+	}
+}
+
+// moveTree re-keys a file, or every file under a folder, without re-reading content.
+func (idx *SearchIndex) moveTree(oldPath, newPath string) {
+	idx.mu.RLock()
+	moved := make(map[string]string)
+	for docPath, doc := range idx.docs {
+		if docPath == oldPath || strings.HasPrefix(docPath, oldPath+"/") {
+			moved[newPath+strings.TrimPrefix(docPath, oldPath)] = doc.content
+		}
+	}
+	idx.mu.RUnlock()
+
+	idx.removeTree(oldPath)
+	for p, content := range moved {
+		idx.add(p, content)
+	}
+}
+
+// tokenize splits text into lowercase words made of letters, digits and underscores.
+func tokenize(text string) []tokenSpan {
+	var tokens []tokenSpan
+	start := -1
+	for i, r := range text {
+		isWord := unicode.IsLetter(r) || unicode.IsDigit(r) || r == '_'
+		if isWord && start < 0 {
+			start = i
+		} else if !isWord && start >= 0 {
+			tokens = append(tokens, tokenSpan{term: strings.ToLower(text[start:i]), start: start})
+			start = -1
+		}
+	}
+	if start >= 0 {
+		tokens = append(tokens, tokenSpan{term: strings.ToLower(text[start:]), start: start})
+	}
+	return tokens
+}
+
+// ParseSearchQuery parses query syntax: bare words, "quoted phrases", prefix*
+// words, path:<prefix> and type:<ext> (or ext:<ext>) filters.
+func ParseSearchQuery(query string) SearchQuery {
+	var q SearchQuery
+	for len(query) > 0 {
+		query = strings.TrimLeftFunc(query, unicode.IsSpace)
+		if query == "" {
+			break
+		}
+		if query[0] == '"' {
+			end := strings.IndexByte(query[1:], '"')
+			var phrase string
+			if end < 0 {
+				phrase, query = query[1:], ""
+			} else {
+				phrase, query = query[1:end+1], query[end+2:]
+			}
+			var words []string
+			for _, tok := range tokenize(phrase) {
+				words = append(words, tok.term)
+			}
+			switch len(words) {
+			case 0:
+			case 1:
+				q.Terms = append(q.Terms, words[0])
+			default:
+				q.Phrases = append(q.Phrases, words)
+			}
+			continue
+		}
+
+		end := strings.IndexFunc(query, unicode.IsSpace)
+		var word string
+		if end < 0 {
+			word, query = query, ""
+		} else {
+			word, query = query[:end], query[end:]
+		}
+
+		switch {
+		case strings.HasPrefix(word, "path:"):
+			q.PathPrefix = path.Clean("/" + strings.TrimPrefix(word, "path:"))
+		case strings.HasPrefix(word, "type:"), strings.HasPrefix(word, "ext:"):
+			ext := word[strings.IndexByte(word, ':')+1:]
+			q.Types = append(q.Types, strings.TrimPrefix(strings.ToLower(ext), "."))
+		default:
+			prefix := strings.HasSuffix(word, "*")
+			for _, tok := range tokenize(word) {
+				q.Terms = append(q.Terms, tok.term)
+			}
+			if prefix && len(q.Terms) > 0 {
+				q.Terms[len(q.Terms)-1] += "*"
+			}
+		}
+	}
+	return q
+}
+
+// Search runs a query and returns up to limit ranked results, along with the
+// total number of matching documents. allow, if non-nil, filters out paths
+// the caller may not see before ranking.
+func (idx *SearchIndex) Search(q SearchQuery, limit int, allow func(path string) bool) ([]*SearchResult, int) {
+	if limit <= 0 {
+		limit = DefaultSearchLimit
+	}
+	if limit > MaxSearchLimit {
+		limit = MaxSearchLimit
+	}
+
+	idx.mu.RLock()
+	defer idx.mu.RUnlock()
+
+	// Every clause maps matching documents to (term frequency, first position).
+	type hit struct {
+		tf    int
+		first int
+	}
+	var clauses []map[string]hit
+	var weights []float64
+	n := float64(len(idx.docs))
+	idf := func(df int) float64 { return math.Log(1 + n/float64(df)) }
+
+	for _, term := range q.Terms {
+		hits := make(map[string]hit)
+		if strings.HasSuffix(term, "*") {
+			prefix := strings.TrimSuffix(term, "*")
+			for t, docs := range idx.postings {
+				if !strings.HasPrefix(t, prefix) {
+					continue
+				}
+				for p, positions := range docs {
+					h, ok := hits[p]
+					if !ok || positions[0] < h.first {
+						h.first = positions[0]
+					}
+					h.tf += len(positions)
+					hits[p] = h
+				}
+			}
+		} else {
+			for p, positions := range idx.postings[term] {
+				hits[p] = hit{tf: len(positions), first: positions[0]}
+			}
+		}
+		clauses = append(clauses, hits)
+		weights = append(weights, idf(len(hits)+1))
+	}
+
+	for _, phrase := range q.Phrases {
+		hits := make(map[string]hit)
+		for p, positions := range idx.postings[phrase[0]] {
+			h := hit{first: -1}
+			for _, pos := range positions {
+				if idx.phraseAt(p, phrase, pos) {
+					if h.first < 0 {
+						h.first = pos
+					}
+					h.tf++
+				}
+			}
+			if h.tf > 0 {
+				hits[p] = h
+			}
+		}
+		clauses = append(clauses, hits)
+		// Phrases are rarer and more specific than single words, so weigh them up.
+		weights = append(weights, 2*idf(len(hits)+1))
+	}
+
+	matches := func(p string, doc *indexedDoc) bool {
+		if q.PathPrefix != "" && q.PathPrefix != "/" && p != q.PathPrefix && !strings.HasPrefix(p, q.PathPrefix+"/") {
+			return false
+		}
+		if len(q.Types) > 0 {
+			found := false
+			for _, t := range q.Types {
+				if doc.ext == t {
+					found = true
+					break
+				}
+			}
+			if !found {
+				return false
+			}
+		}
+		return allow == nil || allow(p)
+	}
+
+	var results []*SearchResult
+	for p, doc := range idx.docs {
+		if !matches(p, doc) {
+			continue
+		}
+		score := 0.0
+		first := -1
+		ok := true
+		for i, hits := range clauses {
+			h, found := hits[p]
+			if !found {
+				ok = false
+				break
+			}
+			score += weights[i] * (1 + math.Log(float64(h.tf)))
+			if first < 0 {
+				first = h.first
+			}
+		}
+		if !ok {
+			continue
+		}
+		if len(clauses) > 0 {
+			// Favour shorter documents and matches in the file name.
+			score /= math.Sqrt(float64(len(doc.tokens) + 1))
+			base := strings.ToLower(path.Base(p))
+			for _, term := range q.Terms {
+				if strings.Contains(base, strings.TrimSuffix(term, "*")) {
+					score *= 1.5
+				}
+			}
+		}
+		result := &SearchResult{Path: p, Score: score}
+		result.Line, result.Snippet = snippet(doc, first)
+		results = append(results, result)
+	}
+
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].Score != results[j].Score {
+			return results[i].Score > results[j].Score
+		}
+		return results[i].Path < results[j].Path
+	})
+	total := len(results)
+	if len(results) > limit {
+		results = results[:limit]
+	}
+	return results, total
+}
+
+// phraseAt reports whether phrase occurs in the document at token position pos.
+func (idx *SearchIndex) phraseAt(p string, phrase []string, pos int) bool {
+	doc := idx.docs[p]
+	if doc == nil || pos+len(phrase) > len(doc.tokens) {
+		return false
+	}
+	for i, word := range phrase {
+		if doc.tokens[pos+i].term != word {
+			return false
+		}
+	}
+	return true
+}
+
+// snippet returns the 1-based line number and surrounding text for the token
+// at position pos, or the start of the document when pos is negative.
+func snippet(doc *indexedDoc, pos int) (int, string) {
+	offset := 0
+	if pos >= 0 && pos < len(doc.tokens) {
+		offset = doc.tokens[pos].start
+	}
+	line := strings.Count(doc.content[:offset], "\n") + 1
+
+	start := offset - snippetRadius
+	if start < 0 {
+		start = 0
+	}
+	end := offset + snippetRadius
+	if end > len(doc.content) {
+		end = len(doc.content)
+	}
+	// Don't cut through a multi-byte character.
+	for start > 0 && !utf8.RuneStart(doc.content[start]) {
+		start--
+	}
+	for end < len(doc.content) && !utf8.RuneStart(doc.content[end]) {
+		end++
+	}
+	text := strings.Join(strings.Fields(doc.content[start:end]), " ")
+	if start > 0 {
+		text = "…" + text
+	}
+	if end < len(doc.content) {
+		text += "…"
+	}
+	return line, text
+}
@@ -0,0 +1,78 @@
+package aether
+
+import (
+	"sort"
+	"strings"
+	"testing"
+)
+
+// drainChanges passes the queued change events of vfs to fn, as
+// dispatchChanges would, and returns once the queue is empty.
+func drainChanges(vfs *VFSModule, fn ChangeListener) {
+	for {
+		select {
+		case event := <-vfs.changes:
+			fn(event)
+		default:
+			return
+		}
+	}
+}
+
+func searchPaths(idx *SearchIndex, query string) string {
+	results, _ := idx.Search(ParseSearchQuery(query), MaxSearchLimit, func(string) bool { return true })
+	var names []string
+	for _, r := range results {
+		names = append(names, r.Path)
+	}
+	sort.Strings(names)
+	return strings.Join(names, " ")
+}
+
+func TestSearchIndexFollowsChanges(t *testing.T) {
+	vfs := newTestVFS(t)
+	idx := NewSearchIndex(vfs)
+	writeFiles(t, vfs, map[string]string{
+		"home/u/docs/plan.txt":     "the launch plan",
+		"home/u/docs/sub/todo.txt": "launch checklist",
+		"home/u/other.txt":         "unrelated",
+	})
+	drainChanges(vfs, idx.HandleChange)
+	opts := WriteOptions{User: "u"}
+
+	tests := []struct {
+		name   string
+		change func(t *testing.T)
+		want   string
+	}{
+		{"written files", func(t *testing.T) {}, "/home/u/docs/plan.txt /home/u/docs/sub/todo.txt"},
+		{"folder trashed", func(t *testing.T) {
+			if _, err := vfs.Delete("home/u/docs", opts); err != nil {
+				t.Fatal(err)
+			}
+		}, ""},
+		{"folder restored", func(t *testing.T) {
+			entries, err := vfs.ListTrash("u")
+			if err != nil || len(entries) != 1 {
+				t.Fatalf("ListTrash = %v, %v", entries, err)
+			}
+			if _, err := vfs.RestoreTrash("u", entries[0].ID); err != nil {
+				t.Fatal(err)
+			}
+		}, "/home/u/docs/plan.txt /home/u/docs/sub/todo.txt"},
+		{"folder moved", func(t *testing.T) {
+			if err := vfs.Move("home/u/docs", "home/u/archive", opts); err != nil {
+				t.Fatal(err)
+			}
+		}, "/home/u/archive/plan.txt /home/u/archive/sub/todo.txt"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.change(t)
+			drainChanges(vfs, idx.HandleChange)
+			if got := searchPaths(idx, "launch"); got != tt.want {
+				t.Errorf("search = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,354 @@
+package aether
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"cloud.google.com/go/storage"
+)
+
+const (
+	// DefaultListPageSize is used when a list request does not set a page size.
+	DefaultListPageSize = 500
+	// MaxListPageSize caps a single page so responses fit in one envelope.
+	MaxListPageSize = 1000
+	// DefaultWalkBatchSize is the number of entries per vfs:walk batch.
+	DefaultWalkBatchSize = 200
+
+	// listCacheSize bounds the number of listings kept for later pages.
+	listCacheSize = 16
+	// listCacheTTL is how long a listing is kept for later pages.
+	listCacheTTL = time.Minute
+)
+
+// ListOptions control a recursive, filtered and paginated listing.
+type ListOptions struct {
+	Depth    int    // Levels to descend; 1 (the default) lists immediate children, negative is unlimited.
+	Glob     string // Pattern matched against paths relative to the listed directory.
+	SortBy   string // "name" (the default, folders first), "size" or "modTime".
+	Desc     bool   // Reverse the sort order.
+	PageSize int    // Entries per page; defaults to DefaultListPageSize.
+	Cursor   string // NextCursor from the previous page, empty for the first page.
+}
+
+// ListPage is one page of a listing. NextCursor is empty on the last page.
+type ListPage struct {
+	Files      []*FileInfo `json:"files"`
+	NextCursor string      `json:"nextCursor,omitempty"`
+	Total      int         `json:"total"`
+}
+
+// listCursor is the keyset position encoded in ListPage.NextCursor: the last
+// entry returned, so the next page resumes after it even if entries were
+// added or removed in between.
+type listCursor struct {
+	IsDir   bool      `json:"d"`
+	Name    string    `json:"n"`
+	Size    int64     `json:"s"`
+	ModTime time.Time `json:"m"`
+	Path    string    `json:"p"`
+}
+
+// ListWithOptions lists a directory according to opts.
+func (vfs *VFSModule) ListWithOptions(dir string, opts ListOptions) (*ListPage, error) {
+	less, err := listOrder(opts.SortBy, opts.Desc)
+	if err != nil {
+		return nil, err
+	}
+	pageSize := opts.PageSize
+	if pageSize <= 0 {
+		pageSize = DefaultListPageSize
+	}
+	if pageSize > MaxListPageSize {
+		pageSize = MaxListPageSize
+	}
+	depth := opts.Depth
+	if depth == 0 {
+		depth = 1
+	}
+
+	// Later pages reuse the sorted listing of the first while nothing changed.
+	key := fmt.Sprintf("%s\x00%d\x00%s\x00%s\x00%t", strings.Trim(dir, "/"), depth, opts.Glob, opts.SortBy, opts.Desc)
+	var entries []*FileInfo
+	if opts.Cursor != "" {
+		entries = vfs.listings.get(key, vfs.generation.Load())
+	}
+	if entries == nil {
+		vfs.mu.RLock()
+		generation := vfs.generation.Load()
+		if depth == 1 {
+			entries, err = vfs.listDir(context.Background(), dir)
+		} else {
+			entries, err = vfs.listTree(context.Background(), dir, depth)
+		}
+		vfs.mu.RUnlock()
+		if err != nil {
+			return nil, err
+		}
+
+		if opts.Glob != "" {
+			base := VirtualPath(dir)
+			filtered := entries[:0]
+			for _, e := range entries {
+				if MatchGlob(opts.Glob, strings.TrimPrefix(e.Path, base+"/")) {
+					filtered = append(filtered, e)
+				}
+			}
+			entries = filtered
+		}
+
+		sort.Slice(entries, func(i, j int) bool { return less(entries[i], entries[j]) })
+		if len(entries) > pageSize {
+			vfs.listings.put(key, entries, generation)
+		}
+	}
+
+	start := 0
+	if opts.Cursor != "" {
+		after, err := decodeListCursor(opts.Cursor)
+		if err != nil {
+			return nil, err
+		}
+		start = sort.Search(len(entries), func(i int) bool { return less(after, entries[i]) })
+	}
+	end := start + pageSize
+	if end > len(entries) {
+		end = len(entries)
+	}
+
+	page := &ListPage{Files: entries[start:end:end], Total: len(entries)}
+	if end < len(entries) {
+		page.NextCursor = encodeListCursor(entries[end-1])
+	}
+	return page, nil
+}
+
+// Walk streams every entry under dir, up to maxDepth levels (negative for
+// unlimited), to fn in batches of batchSize. Entries arrive in storage order
+// rather than sorted. The matching entries are listed under vfs.mu, which is
+// released before fn is called, so a slow consumer does not hold up writers
+// and fn may call back into the VFSModule. Walk stops early if fn returns an
+// error.
+func (vfs *VFSModule) Walk(dir, glob string, maxDepth, batchSize int, fn func([]*FileInfo) error) error {
+	if batchSize <= 0 {
+		batchSize = DefaultWalkBatchSize
+	}
+	if batchSize > MaxListPageSize {
+		batchSize = MaxListPageSize
+	}
+
+	var entries []*FileInfo
+	emitted := make(map[string]bool) // folders already listed
+	base := VirtualPath(dir)
+	add := func(e *FileInfo) {
+		if glob == "" || MatchGlob(glob, strings.TrimPrefix(e.Path, base+"/")) {
+			entries = append(entries, e)
+		}
+	}
+
+	vfs.mu.RLock()
+	err := vfs.eachObject(context.Background(), dir, maxDepth, func(attrs *storage.ObjectAttrs, dirs []string, isFile bool) error {
+		for _, d := range dirs {
+			if !emitted[d] {
+				emitted[d] = true
+				add(&FileInfo{Name: path.Base(d), IsDir: true, Path: VirtualPath(d), ModTime: attrs.Updated})
+			}
+		}
+		if isFile {
+			add(objectFileInfo(attrs))
+		}
+		return nil
+	})
+	vfs.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+
+	for len(entries) > 0 {
+		n := min(batchSize, len(entries))
+		if err := fn(entries[:n:n]); err != nil {
+			return err
+		}
+		entries = entries[n:]
+	}
+	return nil
+}
+
+// listCache keeps the sorted listings behind paginated ListWithOptions calls,
+// so fetching the next page does not list and sort the whole tree again. A
+// listing is only reused while vfs.generation, which every mutation bumps,
+// is what it was when the listing was taken.
+type listCache struct {
+	mu       sync.Mutex
+	listings map[string]*cachedListing
+}
+
+type cachedListing struct {
+	entries    []*FileInfo
+	generation uint64
+	taken      time.Time
+}
+
+// get returns the listing stored under key if it is still current.
+func (c *listCache) get(key string, generation uint64) []*FileInfo {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	l, ok := c.listings[key]
+	if !ok || l.generation != generation || time.Since(l.taken) > listCacheTTL {
+		return nil
+	}
+	return l.entries
+}
+
+// put stores a listing, evicting stale listings and then the oldest if the
+// cache is full.
+func (c *listCache) put(key string, entries []*FileInfo, generation uint64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.listings == nil {
+		c.listings = make(map[string]*cachedListing)
+	}
+	var oldest string
+	for k, l := range c.listings {
+		if l.generation != generation || time.Since(l.taken) > listCacheTTL {
+			delete(c.listings, k)
+		} else if oldest == "" || l.taken.Before(c.listings[oldest].taken) {
+			oldest = k
+		}
+	}
+	if len(c.listings) >= listCacheSize {
+		delete(c.listings, oldest)
+	}
+	c.listings[key] = &cachedListing{entries: entries, generation: generation, taken: time.Now()}
+}
+
+// listTree returns files and folders under dir, up to depth levels (negative
+// for unlimited), synthesizing folders from object names. Callers must hold vfs.mu.
+func (vfs *VFSModule) listTree(ctx context.Context, dir string, depth int) ([]*FileInfo, error) {
+	results := make([]*FileInfo, 0)
+	dirs := make(map[string]*FileInfo)
+
+	err := vfs.eachObject(ctx, dir, depth, func(attrs *storage.ObjectAttrs, parents []string, isFile bool) error {
+		for _, d := range parents {
+			info, ok := dirs[d]
+			if !ok {
+				info = &FileInfo{Name: path.Base(d), IsDir: true, Path: VirtualPath(d)}
+				dirs[d] = info
+				results = append(results, info)
+			}
+			// Folders have no timestamps of their own; use their newest object.
+			if attrs.Updated.After(info.ModTime) {
+				info.ModTime = attrs.Updated
+			}
+		}
+		if isFile {
+			results = append(results, objectFileInfo(attrs))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return results, nil
+}
+
+// eachObject iterates the objects under dir and calls fn with each object, the
+// folders between dir and the object that are within depth, and whether the
+// object itself is a visible file within depth. Callers must hold vfs.mu.
+func (vfs *VFSModule) eachObject(ctx context.Context, dir string, depth int, fn func(attrs *storage.ObjectAttrs, dirs []string, isFile bool) error) error {
+	prefix := strings.Trim(dir, "/")
+	if prefix != "" {
+		prefix += "/"
+	}
+
+	return vfs.listKeys(ctx, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		if prefix == "" && isSystemKey(attrs.Name) {
+			return nil
+		}
+
+		segments := strings.Split(strings.TrimPrefix(attrs.Name, prefix), "/")
+		var dirs []string
+		for i := 1; i < len(segments) && (depth < 0 || i <= depth); i++ {
+			dirs = append(dirs, prefix+strings.Join(segments[:i], "/"))
+		}
+		isFile := (depth < 0 || len(segments) <= depth) && segments[len(segments)-1] != ".placeholder" && segments[len(segments)-1] != ""
+		return fn(attrs, dirs, isFile)
+	})
+}
+
+func objectFileInfo(attrs *storage.ObjectAttrs) *FileInfo {
+	return &FileInfo{
+		Name:     path.Base(attrs.Name),
+		Size:     attrs.Size,
+		ModTime:  attrs.Updated,
+		Path:     VirtualPath(attrs.Name),
+		Revision: Revision(attrs),
+	}
+}
+
+// listOrder returns the comparison for a sort key. Ties are broken by path so
+// the order is total, which keyset cursors rely on.
+func listOrder(sortBy string, desc bool) (func(a, b *FileInfo) bool, error) {
+	var key func(a, b *FileInfo) int
+	switch sortBy {
+	case "", "name":
+		key = func(a, b *FileInfo) int {
+			if a.IsDir != b.IsDir {
+				if a.IsDir {
+					return -1
+				}
+				return 1
+			}
+			return strings.Compare(a.Name, b.Name)
+		}
+	case "size":
+		key = func(a, b *FileInfo) int {
+			switch {
+			case a.Size < b.Size:
+				return -1
+			case a.Size > b.Size:
+				return 1
+			}
+			return 0
+		}
+	case "modTime":
+		key = func(a, b *FileInfo) int { return a.ModTime.Compare(b.ModTime) }
+	default:
+		return nil, fmt.Errorf("unknown sort key: %q", sortBy)
+	}
+
+	return func(a, b *FileInfo) bool {
+		c := key(a, b)
+		if c == 0 {
+			c = strings.Compare(a.Path, b.Path)
+		}
+		if desc {
+			return c > 0
+		}
+		return c < 0
+	}, nil
+}
+
+func encodeListCursor(last *FileInfo) string {
+	data, _ := json.Marshal(listCursor{IsDir: last.IsDir, Name: last.Name, Size: last.Size, ModTime: last.ModTime, Path: last.Path})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func decodeListCursor(cursor string) (*FileInfo, error) {
+	data, err := base64.RawURLEncoding.DecodeString(cursor)
+	if err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	var c listCursor
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, fmt.Errorf("invalid cursor")
+	}
+	return &FileInfo{IsDir: c.IsDir, Name: c.Name, Size: c.Size, ModTime: c.ModTime, Path: c.Path}, nil
+}
@@ -0,0 +1,191 @@
+package aether
+
+import (
+	"context"
+	"strings"
+	"testing"
+	"time"
+)
+
+// newTestVFS returns a VFS held in memory, with the default mount table.
+func newTestVFS(t *testing.T) *VFSModule {
+	t.Helper()
+	vfs := &VFSModule{root: newMemoryBackend(), usage: newUsageIndex(), changes: make(chan ChangeEvent, changeQueueSize)}
+	if err := vfs.SetMounts(DefaultMounts); err != nil {
+		t.Fatal(err)
+	}
+	return vfs
+}
+
+func writeFiles(t *testing.T, vfs *VFSModule, files map[string]string) {
+	t.Helper()
+	for name, content := range files {
+		if err := vfs.Write(name, []byte(content)); err != nil {
+			t.Fatalf("Write(%s): %v", name, err)
+		}
+	}
+}
+
+func paths(files []*FileInfo) string {
+	var names []string
+	for _, f := range files {
+		names = append(names, f.Path)
+	}
+	return strings.Join(names, " ")
+}
+
+func TestListWithOptions(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{
+		"home/u/b.txt":        "bb",
+		"home/u/a.go":         "aaaa",
+		"home/u/c.go":         "c",
+		"home/u/src/main.go":  "package main",
+		"home/u/src/x/y.go":   "y",
+		"home/u/src/notes.md": "",
+	})
+
+	tests := []struct {
+		name string
+		opts ListOptions
+		want string
+	}{
+		{"children, folders first", ListOptions{}, "/home/u/src /home/u/a.go /home/u/b.txt /home/u/c.go"},
+		{"descending", ListOptions{Desc: true}, "/home/u/c.go /home/u/b.txt /home/u/a.go /home/u/src"},
+		{"by size", ListOptions{SortBy: "size", Glob: "*.*"}, "/home/u/c.go /home/u/b.txt /home/u/a.go"},
+		{"glob", ListOptions{Depth: -1, Glob: "*.go"}, "/home/u/a.go /home/u/c.go /home/u/src/main.go /home/u/src/x/y.go"},
+		{"glob with path", ListOptions{Depth: -1, Glob: "src/*.go"}, "/home/u/src/main.go"},
+		{"depth 2", ListOptions{Depth: 2, Glob: "src/*"}, "/home/u/src/x /home/u/src/main.go /home/u/src/notes.md"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			page, err := vfs.ListWithOptions("home/u", tt.opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := paths(page.Files); got != tt.want {
+				t.Errorf("got %s, want %s", got, tt.want)
+			}
+		})
+	}
+
+	if _, err := vfs.ListWithOptions("home/u", ListOptions{SortBy: "color"}); err == nil {
+		t.Error("unknown sort key accepted")
+	}
+	if _, err := vfs.ListWithOptions("home/u", ListOptions{Cursor: "!"}); err == nil {
+		t.Error("invalid cursor accepted")
+	}
+}
+
+func TestListPagination(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{
+		"home/u/1": "", "home/u/2": "", "home/u/3": "", "home/u/4": "", "home/u/5": "",
+	})
+
+	page, err := vfs.ListWithOptions("home/u", ListOptions{PageSize: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(page.Files); got != "/home/u/1 /home/u/2" || page.Total != 5 || page.NextCursor == "" {
+		t.Fatalf("first page: %s (total %d, cursor %q)", got, page.Total, page.NextCursor)
+	}
+
+	// The cursor is a position, not an offset, so entries added before it
+	// do not shift the next page.
+	writeFiles(t, vfs, map[string]string{"home/u/0": ""})
+	page, err = vfs.ListWithOptions("home/u", ListOptions{PageSize: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(page.Files); got != "/home/u/3 /home/u/4" {
+		t.Fatalf("second page: %s", got)
+	}
+
+	page, err = vfs.ListWithOptions("home/u", ListOptions{PageSize: 2, Cursor: page.NextCursor})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := paths(page.Files); got != "/home/u/5" || page.NextCursor != "" {
+		t.Fatalf("last page: %s (cursor %q)", got, page.NextCursor)
+	}
+}
+
+func TestListPaginationReusesListing(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{
+		"home/u/1": "", "home/u/2": "", "home/u/3": "", "home/u/4": "", "home/u/5": "",
+	})
+	opts := ListOptions{PageSize: 2}
+	next := func() string {
+		t.Helper()
+		page, err := vfs.ListWithOptions("home/u", opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		opts.Cursor = page.NextCursor
+		return paths(page.Files)
+	}
+
+	if got := next(); got != "/home/u/1 /home/u/2" {
+		t.Fatalf("first page: %s", got)
+	}
+	// Objects written behind the VFS's back do not invalidate the listing,
+	// which shows the second page comes from it.
+	if _, err := vfs.root.Write(context.Background(), "home/u/25", nil, nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := next(); got != "/home/u/3 /home/u/4" {
+		t.Fatalf("second page: %s", got)
+	}
+	// Writes through the VFS do.
+	writeFiles(t, vfs, map[string]string{"home/u/45": ""})
+	if got := next(); got != "/home/u/45 /home/u/5" {
+		t.Fatalf("last page: %s", got)
+	}
+}
+
+func TestWalk(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{
+		"home/u/a.go":       "",
+		"home/u/b.txt":      "",
+		"home/u/src/c.go":   "",
+		"home/u/src/x/d.go": "",
+	})
+
+	tests := []struct {
+		name     string
+		glob     string
+		maxDepth int
+		want     []string
+	}{
+		{"everything", "", -1, []string{"/home/u/a.go /home/u/b.txt", "/home/u/src /home/u/src/c.go", "/home/u/src/x /home/u/src/x/d.go"}},
+		{"glob", "**/*.go", -1, []string{"/home/u/a.go /home/u/src/c.go", "/home/u/src/x/d.go"}},
+		{"depth", "", 1, []string{"/home/u/a.go /home/u/b.txt", "/home/u/src"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			done := make(chan error, 1)
+			go func() {
+				done <- vfs.Walk("home/u", tt.glob, tt.maxDepth, 2, func(batch []*FileInfo) error {
+					got = append(got, paths(batch))
+					// The lock is released while fn runs, so it may write.
+					return vfs.Write("tmp/walked", []byte(paths(batch)))
+				})
+			}()
+			select {
+			case err := <-done:
+				if err != nil {
+					t.Fatal(err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Walk deadlocked writing from its callback")
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") {
+				t.Errorf("batches = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
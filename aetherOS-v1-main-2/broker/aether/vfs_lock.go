@@ -0,0 +1,267 @@
+package aether
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// Lock modes. Any number of shared locks may overlap; an exclusive lock
+// overlaps no lock of another holder and rejects their writes.
+const (
+	LockShared    = "shared"
+	LockExclusive = "exclusive"
+)
+
+const (
+	// DefaultLockTTL is the lease of a lock whose request does not give one.
+	DefaultLockTTL = 2 * time.Minute
+	// MaxLockTTL bounds a single lease; holders renew to keep a lock longer.
+	MaxLockTTL = time.Hour
+)
+
+// Kinds of LockEvent.
+const (
+	LockAcquired = "acquired"
+	LockRenewed  = "renewed"
+	LockReleased = "released"
+	LockExpired  = "expired"
+)
+
+// Lock is an advisory lock on a file or folder, covering everything below a
+// folder. It is held by a user through an app, so an agent acting for a user
+// does not hold the locks of that user's editor.
+type Lock struct {
+	ID       string    `json:"id"`
+	Path     string    `json:"path"` // Absolute virtual path.
+	Mode     string    `json:"mode"`
+	User     string    `json:"user"`
+	App      string    `json:"app,omitempty"`
+	Acquired time.Time `json:"acquired"`
+	Expires  time.Time `json:"expires"`
+}
+
+// heldBy reports whether the lock belongs to the writer described by opts.
+func (l *Lock) heldBy(opts WriteOptions) bool {
+	return l.User == opts.User && l.App == opts.App
+}
+
+// holder describes who holds the lock, for error messages.
+func (l *Lock) holder() string {
+	if l.App == "" {
+		return l.User
+	}
+	return l.User + " in " + l.App
+}
+
+// overlaps reports whether the lock covers the storage key name, or name is a
+// folder containing the locked item.
+func (l *Lock) overlaps(name string) bool {
+	key := strings.Trim(l.Path, "/")
+	return name == key || strings.HasPrefix(name, key+"/") || strings.HasPrefix(key, name+"/")
+}
+
+// LockEvent reports a lock being taken, renewed, released or lost to expiry.
+type LockEvent struct {
+	Type string    `json:"type"`
+	Lock *Lock     `json:"lock"`
+	Time time.Time `json:"time"`
+}
+
+// LockedError is returned when an operation runs into another holder's lock.
+type LockedError struct {
+	Path string // Absolute virtual path of the operation.
+	Lock *Lock  // The conflicting lock.
+}
+
+func (e *LockedError) Error() string {
+	return fmt.Sprintf("%s is locked (%s) by %s until %s", e.Path, e.Lock.Mode, e.Lock.holder(), e.Lock.Expires.Format(time.RFC3339))
+}
+
+// lockTable holds the live locks. Locks are leases and are not persisted.
+type lockTable struct {
+	mu        sync.Mutex
+	locks     map[string]*Lock // By ID.
+	listeners []func(LockEvent)
+}
+
+// OnLockChange registers a listener that is called whenever a lock is
+// acquired, renewed, released or expires.
+func (vfs *VFSModule) OnLockChange(listener func(LockEvent)) {
+	vfs.locks.mu.Lock()
+	defer vfs.locks.mu.Unlock()
+	vfs.locks.listeners = append(vfs.locks.listeners, listener)
+}
+
+// notifyLock calls the lock listeners. Callers must not hold vfs.locks.mu.
+func (vfs *VFSModule) notifyLock(events []LockEvent) {
+	vfs.locks.mu.Lock()
+	listeners := make([]func(LockEvent), len(vfs.locks.listeners))
+	copy(listeners, vfs.locks.listeners)
+	vfs.locks.mu.Unlock()
+	for _, event := range events {
+		for _, listener := range listeners {
+			listener(event)
+		}
+	}
+}
+
+// expireLocksLocked removes expired locks and returns events for them.
+// Callers must hold vfs.locks.mu.
+func (vfs *VFSModule) expireLocksLocked(now time.Time) []LockEvent {
+	var events []LockEvent
+	for id, l := range vfs.locks.locks {
+		if now.After(l.Expires) {
+			delete(vfs.locks.locks, id)
+			events = append(events, LockEvent{Type: LockExpired, Lock: l, Time: now})
+		}
+	}
+	return events
+}
+
+// ExpireLocks drops locks whose lease has run out, notifying listeners, and
+// returns how many there were. Expired locks never block anything, so this
+// only needs to run often enough for UIs to notice.
+func (vfs *VFSModule) ExpireLocks() int {
+	vfs.locks.mu.Lock()
+	events := vfs.expireLocksLocked(time.Now())
+	vfs.locks.mu.Unlock()
+	vfs.notifyLock(events)
+	return len(events)
+}
+
+// AcquireLock locks the file or folder at the storage key name for the
+// writer in opts. It fails with a LockedError if the lock would conflict
+// with another holder's. Passing the ID of a lock the writer already holds
+// renews its lease, and may change its mode.
+func (vfs *VFSModule) AcquireLock(name, mode, id string, ttl time.Duration, opts WriteOptions) (*Lock, error) {
+	name = strings.Trim(name, "/")
+	if mode != LockShared && mode != LockExclusive {
+		return nil, fmt.Errorf("invalid lock mode: %q", mode)
+	}
+	if name == "" {
+		return nil, fmt.Errorf("refusing to lock the root directory")
+	}
+	if ttl <= 0 {
+		ttl = DefaultLockTTL
+	}
+	if ttl > MaxLockTTL {
+		ttl = MaxLockTTL
+	}
+
+	now := time.Now()
+	vfs.locks.mu.Lock()
+	events := vfs.expireLocksLocked(now)
+	if vfs.locks.locks == nil {
+		vfs.locks.locks = make(map[string]*Lock)
+	}
+
+	var existing *Lock
+	if id != "" {
+		existing = vfs.locks.locks[id]
+		if existing == nil || !existing.heldBy(opts) || strings.Trim(existing.Path, "/") != name {
+			vfs.locks.mu.Unlock()
+			vfs.notifyLock(events)
+			return nil, fmt.Errorf("no such lock on %s: %s", VirtualPath(name), id)
+		}
+	}
+	for _, l := range vfs.locks.locks {
+		if l == existing || l.heldBy(opts) || !l.overlaps(name) {
+			continue
+		}
+		if mode == LockExclusive || l.Mode == LockExclusive {
+			lock := *l
+			vfs.locks.mu.Unlock()
+			vfs.notifyLock(events)
+			return nil, &LockedError{Path: VirtualPath(name), Lock: &lock}
+		}
+	}
+
+	event := LockEvent{Type: LockRenewed, Time: now}
+	if existing == nil {
+		existing = &Lock{ID: uuid.New().String(), Path: VirtualPath(name), User: opts.User, App: opts.App, Acquired: now}
+		event.Type = LockAcquired
+	}
+	existing.Mode = mode
+	existing.Expires = now.Add(ttl)
+	vfs.locks.locks[existing.ID] = existing
+	lock := *existing
+	event.Lock = &lock
+	vfs.locks.mu.Unlock()
+
+	vfs.notifyLock(append(events, event))
+	return &lock, nil
+}
+
+// ReleaseLock releases a lock held by the writer in opts.
+func (vfs *VFSModule) ReleaseLock(id string, opts WriteOptions) (*Lock, error) {
+	vfs.locks.mu.Lock()
+	l, ok := vfs.locks.locks[id]
+	if !ok || time.Now().After(l.Expires) {
+		vfs.locks.mu.Unlock()
+		return nil, fmt.Errorf("no such lock: %s", id)
+	}
+	if !l.heldBy(opts) {
+		vfs.locks.mu.Unlock()
+		return nil, fmt.Errorf("permission denied: lock %s is held by %s", id, l.holder())
+	}
+	delete(vfs.locks.locks, id)
+	vfs.locks.mu.Unlock()
+
+	vfs.notifyLock([]LockEvent{{Type: LockReleased, Lock: l, Time: time.Now()}})
+	return l, nil
+}
+
+// LockByID returns a live lock, or nil if there is none with that ID.
+func (vfs *VFSModule) LockByID(id string) *Lock {
+	vfs.locks.mu.Lock()
+	defer vfs.locks.mu.Unlock()
+	l, ok := vfs.locks.locks[id]
+	if !ok || time.Now().After(l.Expires) {
+		return nil
+	}
+	lock := *l
+	return &lock
+}
+
+// Locks returns the live locks on the storage key name, on the folders
+// containing it and on everything below it.
+func (vfs *VFSModule) Locks(name string) []*Lock {
+	name = strings.Trim(name, "/")
+	now := time.Now()
+	vfs.locks.mu.Lock()
+	defer vfs.locks.mu.Unlock()
+	var locks []*Lock
+	for _, l := range vfs.locks.locks {
+		if !now.After(l.Expires) && (name == "" || l.overlaps(name)) {
+			lock := *l
+			locks = append(locks, &lock)
+		}
+	}
+	sort.Slice(locks, func(i, j int) bool { return locks[i].Path < locks[j].Path })
+	return locks
+}
+
+// checkLocks returns a LockedError if another holder has an exclusive lock
+// overlapping the storage key name. System writes, with no user or app, are
+// not subject to locks.
+func (vfs *VFSModule) checkLocks(name string, opts WriteOptions) error {
+	if opts.User == "" && opts.App == "" {
+		return nil
+	}
+	name = strings.Trim(name, "/")
+	now := time.Now()
+	vfs.locks.mu.Lock()
+	defer vfs.locks.mu.Unlock()
+	for _, l := range vfs.locks.locks {
+		if l.Mode == LockExclusive && !now.After(l.Expires) && !l.heldBy(opts) && l.overlaps(name) {
+			lock := *l
+			return &LockedError{Path: VirtualPath(name), Lock: &lock}
+		}
+	}
+	return nil
+}
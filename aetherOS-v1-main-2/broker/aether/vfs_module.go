@@ -1,20 +1,19 @@
-
 package aether
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"path/filepath"
 	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"cloud.google.com/go/storage"
 	firebase "firebase.google.com/go/v4"
-	"google.golang.org/api/iterator"
-	"log"
 )
 
 // FileInfo represents a file or directory in the VFS.
@@ -24,14 +23,43 @@ type FileInfo struct {
 	IsDir   bool      `json:"isDir"`
 	ModTime time.Time `json:"modTime"`
 	Path    string    `json:"path"`
+	// Revision changes on every write to a file; pass it back as an if-match
+	// condition to detect concurrent edits. Folders have no revision.
+	Revision string `json:"revision,omitempty"`
+}
+
+// DefaultUser is the identity used when a request carries no user ID.
+const DefaultUser = "user"
+
+// ErrNotFound is wrapped by errors for paths that name no file or folder.
+var ErrNotFound = errors.New("no such file or directory")
+
+// IsNotFound reports whether a VFS error means the path does not exist.
+func IsNotFound(err error) bool {
+	return errors.Is(err, ErrNotFound) || errors.Is(err, storage.ErrObjectNotExist)
 }
 
+// ErrExist is wrapped by errors for creating or moving onto a path that is taken.
+var ErrExist = errors.New("already exists")
+
 // VFSModule represents the virtual file system, now backed by Firebase Storage.
 type VFSModule struct {
-	mu         sync.RWMutex
-	app        *firebase.App
-	bucketName string
-	client     *storage.Client
+	mu             sync.RWMutex
+	app            *firebase.App
+	bucketName     string
+	client         *storage.Client
+	trashRetention time.Duration
+	root           Backend // The VFS bucket, holding everything outside backed mounts.
+	mounts         []Mount
+	usage          *usageIndex
+	acl            aclStore
+	locks          lockTable
+	listings       listCache
+	generation     atomic.Uint64 // Bumped by every mutation; see listCache.
+
+	listenersMu sync.RWMutex
+	listeners   []ChangeListener
+	changes     chan ChangeEvent
 }
 
 // NewVFSModule creates a new VFS module connected to Firebase Storage.
@@ -52,222 +80,480 @@ func NewVFSModule(app *firebase.App) (*VFSModule, error) {
 		return nil, fmt.Errorf("error creating cloud storage client: %w", err)
 	}
 
-	return &VFSModule{
-		app:        app,
-		bucketName: bucketName.Name,
-		client:     storageClient,
-	}, nil
+	vfs := &VFSModule{
+		app:            app,
+		bucketName:     bucketName.Name,
+		client:         storageClient,
+		trashRetention: DefaultTrashRetention,
+		changes:        make(chan ChangeEvent, changeQueueSize),
+		usage:          newUsageIndex(),
+	}
+	vfs.root = &bucketBackend{bucket: storageClient.Bucket(bucketName.Name)}
+	if err := vfs.SetMounts(DefaultMounts); err != nil {
+		return nil, err
+	}
+	go vfs.dispatchChanges()
+	return vfs, nil
 }
 
 // List returns the contents of a directory from Firebase Storage.
 func (vfs *VFSModule) List(path string) ([]*FileInfo, error) {
 	vfs.mu.RLock()
 	defer vfs.mu.RUnlock()
-	ctx := context.Background()
 
-	var results []*FileInfo
-	cleanPath := strings.Trim(path, "/")
-	if cleanPath != "" {
-		cleanPath += "/"
+	results, err := vfs.listDir(context.Background(), path)
+	if err != nil {
+		return nil, err
 	}
 
-	it := vfs.client.Bucket(vfs.bucketName).Objects(ctx, &storage.Query{
-		Prefix:    cleanPath,
-		Delimiter: "/",
+	sort.Slice(results, func(i, j int) bool {
+		if results[i].IsDir != results[j].IsDir {
+			return results[i].IsDir
+		}
+		return results[i].Name < results[j].Name
 	})
 
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
-		}
-		if err != nil {
-			return nil, fmt.Errorf("error iterating objects/prefixes: %w", err)
-		}
+	return results, nil
+}
+
+// listDir returns the immediate children of a directory, unsorted. Callers must hold vfs.mu.
+func (vfs *VFSModule) listDir(ctx context.Context, path string) ([]*FileInfo, error) {
+	results := make([]*FileInfo, 0)
+	cleanPath := strings.Trim(path, "/")
+	if cleanPath != "" {
+		cleanPath += "/"
+	}
 
+	err := vfs.listKeys(ctx, cleanPath, "/", func(attrs *storage.ObjectAttrs) error {
 		// Handle subdirectories (prefixes)
 		if attrs.Prefix != "" {
 			dirName := strings.TrimSuffix(strings.TrimPrefix(attrs.Prefix, cleanPath), "/")
-			if dirName != "" {
+			// The trash and ACL table are managed through their own topics, not listed.
+			if dirName != "" && !isSystemKey(strings.TrimSuffix(attrs.Prefix, "/")) {
 				results = append(results, &FileInfo{
 					Name:    dirName,
 					IsDir:   true,
-					Path:    strings.TrimSuffix(attrs.Prefix, "/"),
+					Path:    VirtualPath(attrs.Prefix),
 					ModTime: time.Now(), // Storage doesn't have folder mod times
 				})
 			}
-			continue
+			return nil
 		}
-		
+
 		// Handle files in the current directory
 		// The object is a file if its name is not a prefix.
 		// We also need to filter out placeholder files for empty directories.
 		if !strings.HasSuffix(attrs.Name, "/.placeholder") && attrs.Name != cleanPath {
 			results = append(results, &FileInfo{
-				Name:    filepath.Base(attrs.Name),
-				Size:    attrs.Size,
-				IsDir:   false,
-				ModTime: attrs.Updated,
-				Path:    attrs.Name,
+				Name:     filepath.Base(attrs.Name),
+				Size:     attrs.Size,
+				IsDir:    false,
+				ModTime:  attrs.Updated,
+				Path:     VirtualPath(attrs.Name),
+				Revision: Revision(attrs),
 			})
 		}
-	}
-
-
-	sort.Slice(results, func(i, j int) bool {
-		if results[i].IsDir != results[j].IsDir {
-			return results[i].IsDir
-		}
-		return results[i].Name < results[j].Name
+		return nil
 	})
+	if err != nil {
+		return nil, fmt.Errorf("error iterating objects/prefixes: %w", err)
+	}
 
 	return results, nil
 }
 
-// Delete removes a file or folder from Firebase Storage.
-func (vfs *VFSModule) Delete(path string) error {
+// Delete moves a file or folder into the trash of the user in opts. Only the
+// exact object and objects below "path/" are affected, so deleting "docs"
+// never touches "docs-old". If opts.IfMatch is set, a file is only deleted at
+// that revision. The returned entry can be passed to RestoreTrash.
+func (vfs *VFSModule) Delete(path string, opts WriteOptions) (*TrashEntry, error) {
 	vfs.mu.Lock()
 	defer vfs.mu.Unlock()
 	ctx := context.Background()
-	bucket := vfs.client.Bucket(vfs.bucketName)
 
-	// To delete a "folder", we must delete all objects with that prefix.
-	// We list all objects with the prefix to see if it's a folder or a single file.
-	it := bucket.Objects(ctx, &storage.Query{Prefix: path})
-	if it == nil {
-		return fmt.Errorf("failed to create iterator for deletion check")
+	if err := vfs.checkLocks(path, opts); err != nil {
+		return nil, err
+	}
+	if err := vfs.matchRevision(ctx, strings.Trim(path, "/"), opts.IfMatch); err != nil {
+		return nil, err
 	}
+	entry, err := vfs.moveToTrash(ctx, opts.User, path)
+	if err != nil {
+		return nil, err
+	}
+	vfs.emit(ChangeDeleted, entry.OriginalPath, entry.IsDir, entry.Size)
+	return entry, nil
+}
 
-	isFolder := false
-	objCount := 0
-	for {
-		attrs, err := it.Next()
-		if err == iterator.Done {
-			break
+// Move renames a file or folder on behalf of the writer in opts. It refuses to
+// overwrite an existing destination or to move a folder inside itself. If
+// opts.IfMatch is set, a file is only moved at that revision.
+func (vfs *VFSModule) Move(src, dst string, opts WriteOptions) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	cleanSrc := strings.Trim(src, "/")
+	cleanDst := strings.Trim(dst, "/")
+	_, isDir, size, err := vfs.move(context.Background(), cleanSrc, cleanDst, opts)
+	if err != nil {
+		return err
+	}
+	vfs.moveACL(cleanSrc, cleanDst)
+
+	vfs.emitEvent(ChangeEvent{
+		Type:    ChangeMoved,
+		Path:    VirtualPath(cleanDst),
+		OldPath: VirtualPath(cleanSrc),
+		IsDir:   isDir,
+		Size:    size,
+		Time:    time.Now(),
+	})
+	return nil
+}
+
+// move renames the file or folder at src to dst without emitting a change
+// event. It returns the new names of the objects moved, even on failure, so a
+// partial move can be undone. Callers must hold vfs.mu.
+func (vfs *VFSModule) move(ctx context.Context, cleanSrc, cleanDst string, opts WriteOptions) (moved []string, isDir bool, size int64, err error) {
+	if cleanDst == "" {
+		return nil, false, 0, fmt.Errorf("invalid destination path")
+	}
+	if cleanDst == cleanSrc || strings.HasPrefix(cleanDst, cleanSrc+"/") {
+		return nil, false, 0, fmt.Errorf("cannot move %s into itself", cleanSrc)
+	}
+
+	for _, name := range []string{cleanSrc, cleanDst} {
+		if err := vfs.checkLocks(name, opts); err != nil {
+			return nil, false, 0, err
 		}
-		if err != nil {
-			return fmt.Errorf("failed to iterate objects for deletion check: %w", err)
+	}
+	if err := vfs.matchRevision(ctx, cleanSrc, opts.IfMatch); err != nil {
+		return nil, false, 0, err
+	}
+	objects, isDir, err := vfs.matchObjects(ctx, cleanSrc)
+	if err != nil {
+		return nil, false, 0, err
+	}
+	if existing, _, err := vfs.matchObjects(ctx, cleanDst); err == nil && len(existing) > 0 {
+		return nil, false, 0, fmt.Errorf("destination %w: %s", ErrExist, cleanDst)
+	}
+
+	for _, attrs := range objects {
+		dst := cleanDst + strings.TrimPrefix(attrs.Name, cleanSrc)
+		if err := vfs.moveObject(ctx, attrs, dst); err != nil {
+			return moved, isDir, size, err
 		}
-		objCount++
-		// If the object name is not the same as the path, it must be a folder.
-		if attrs.Name != path || strings.HasSuffix(path, "/") {
-			isFolder = true
+		moved = append(moved, dst)
+		size += attrs.Size
+	}
+	return moved, isDir, size, nil
+}
+
+// matchObjects returns the objects that make up the file or folder at path,
+// respecting path boundaries. isDir reports whether path named a folder.
+func (vfs *VFSModule) matchObjects(ctx context.Context, path string) (objects []*storage.ObjectAttrs, isDir bool, err error) {
+	cleanPath := strings.Trim(path, "/")
+	if cleanPath == "" {
+		return nil, false, fmt.Errorf("refusing to operate on the root directory")
+	}
+
+	if attrs, err := vfs.statObject(ctx, cleanPath); err != nil {
+		return nil, false, err
+	} else if attrs != nil {
+		return []*storage.ObjectAttrs{attrs}, false, nil
+	}
+
+	objects, err = vfs.listObjects(ctx, cleanPath+"/")
+	if err != nil {
+		return nil, false, err
+	}
+	if len(objects) == 0 {
+		return nil, false, fmt.Errorf("%w: %s", ErrNotFound, cleanPath)
+	}
+	return objects, true, nil
+}
+
+// listObjects returns every object under prefix, recursively, across mounts.
+// Callers must hold vfs.mu.
+func (vfs *VFSModule) listObjects(ctx context.Context, prefix string) ([]*storage.ObjectAttrs, error) {
+	var objects []*storage.ObjectAttrs
+	err := vfs.listKeys(ctx, prefix, "", func(attrs *storage.ObjectAttrs) error {
+		objects = append(objects, attrs)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("failed to iterate objects under %s: %w", prefix, err)
+	}
+	return objects, nil
+}
+
+// openObject returns a reader for a single object. Callers must hold vfs.mu.
+func (vfs *VFSModule) openObject(ctx context.Context, name string) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	return vfs.openObjectRange(ctx, name, 0, -1)
+}
+
+// openObjectRange returns a reader for part of a single object, as in
+// Backend.Open. Callers must hold vfs.mu.
+func (vfs *VFSModule) openObjectRange(ctx context.Context, name string, offset, length int64) (io.ReadCloser, *storage.ObjectAttrs, error) {
+	backend, inner, _ := vfs.route(name)
+	rc, attrs, err := backend.Open(ctx, inner, offset, length)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to create reader for %s: %w", name, err)
+	}
+	attrs.Name = name
+	return rc, attrs, nil
+}
+
+// readObject returns the content of a single object. Callers must hold vfs.mu.
+func (vfs *VFSModule) readObject(ctx context.Context, name string) ([]byte, error) {
+	data, _, err := vfs.readObjectRevision(ctx, name)
+	return data, err
+}
+
+// readObjectRevision returns the content of a single object and the revision
+// that content belongs to. Callers must hold vfs.mu.
+func (vfs *VFSModule) readObjectRevision(ctx context.Context, name string) ([]byte, string, error) {
+	rc, attrs, err := vfs.openObject(ctx, name)
+	if err != nil {
+		return nil, "", err
+	}
+	defer rc.Close()
+
+	data, err := AetherReadAll(rc)
+	if err != nil {
+		return nil, "", fmt.Errorf("failed to read content for %s: %w", name, err)
+	}
+	return data, Revision(attrs), nil
+}
+
+// statObject returns the attributes of a single object, or nil if it does not exist.
+func (vfs *VFSModule) statObject(ctx context.Context, name string) (*storage.ObjectAttrs, error) {
+	backend, inner, base := vfs.route(name)
+	if inner == "" && base != "" {
+		return nil, nil // A mount point is always a folder.
+	}
+	attrs, err := backend.Stat(ctx, inner)
+	if err != nil {
+		return nil, fmt.Errorf("failed to stat %s: %w", name, err)
+	}
+	if attrs != nil {
+		attrs.Name = name
+	}
+	return attrs, nil
+}
+
+// writeObject replaces the content of a single object, charging it to the
+// writer named in opts after checking locks, their quotas and the revision
+// condition. It returns the object's previous attributes, or nil if the
+// object was created, and its new attributes. Callers must hold vfs.mu.
+func (vfs *VFSModule) writeObject(ctx context.Context, name string, content []byte, opts WriteOptions) (prev, next *storage.ObjectAttrs, err error) {
+	if err := vfs.checkLocks(name, opts); err != nil {
+		return nil, nil, err
+	}
+	prev, err = vfs.statObject(ctx, name)
+	if err != nil {
+		return nil, nil, err
+	}
+	backend, inner, base := vfs.route(name)
+	if inner == "" && base != "" {
+		return nil, nil, fmt.Errorf("%s is a mount point", VirtualPath(name))
+	}
+	var cond *storage.Conditions
+	if opts.IfMatch != "" {
+		if current := Revision(prev); current != opts.IfMatch {
+			return nil, nil, &ConflictError{Path: VirtualPath(name), ExpectedRevision: opts.IfMatch, CurrentRevision: current}
 		}
+		// vfs.mu only serializes this process; the storage precondition also
+		// catches writers going to the bucket directly.
+		c := revisionConditions(prev)
+		cond = &c
+	}
+	if err := vfs.checkQuota(ctx, prev, opts, int64(len(content))); err != nil {
+		return nil, nil, err
 	}
 
-	// Re-start iterator for deletion
-	deleteIt := bucket.Objects(ctx, &storage.Query{Prefix: path})
-	if deleteIt == nil {
-		return fmt.Errorf("failed to create iterator for deletion")
+	var metadata map[string]string
+	if opts.User != "" || opts.App != "" {
+		metadata = map[string]string{metaOwnerUser: opts.User, metaOwnerApp: opts.App}
 	}
-	for {
-		attrs, err := deleteIt.Next()
-		if err == iterator.Done {
-			break
+	next, err = backend.Write(ctx, inner, content, metadata, cond)
+	if err == ErrPreconditionFailed {
+		current, _ := vfs.statObject(ctx, name)
+		return nil, nil, &ConflictError{Path: VirtualPath(name), ExpectedRevision: opts.IfMatch, CurrentRevision: Revision(current)}
+	}
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to write content to %s: %w", name, err)
+	}
+
+	vfs.recordUsage(name, prev, opts.User, opts.App, int64(len(content)), true)
+	return prev, next, nil
+}
+
+// moveObject copies src to dst and removes src, copying the content across
+// when they are on different backends. Callers must hold vfs.mu.
+func (vfs *VFSModule) moveObject(ctx context.Context, src *storage.ObjectAttrs, dst string) error {
+	srcBackend, srcName, _ := vfs.route(src.Name)
+	dstBackend, dstName, dstBase := vfs.route(dst)
+	if dstName == "" && dstBase != "" {
+		return fmt.Errorf("%s is a mount point", VirtualPath(dst))
+	}
+	if srcBackend == dstBackend {
+		if err := srcBackend.Copy(ctx, srcName, dstName); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", src.Name, dst, err)
 		}
+	} else {
+		data, err := vfs.readObject(ctx, src.Name)
 		if err != nil {
-			return fmt.Errorf("failed to iterate objects for deletion: %w", err)
+			return err
 		}
-		// If it's a folder, delete everything. If it's a file, only delete the exact match.
-		if isFolder || attrs.Name == path {
-			if err := bucket.Object(attrs.Name).Delete(ctx); err != nil {
-				// Don't fail the whole operation if one file fails. Log it.
-				log.Printf("failed to delete object %s: %v", attrs.Name, err)
-			}
+		if _, err := dstBackend.Write(ctx, dstName, data, src.Metadata, nil); err != nil {
+			return fmt.Errorf("failed to copy %s to %s: %w", src.Name, dst, err)
 		}
 	}
+	if err := srcBackend.Delete(ctx, srcName); err != nil {
+		return fmt.Errorf("failed to remove %s after copy: %w", src.Name, err)
+	}
 
+	user, app := objectOwner(src)
+	vfs.recordUsage(src.Name, src, "", "", 0, false)
+	vfs.recordUsage(dst, nil, user, app, src.Size, true)
 	return nil
 }
 
 // Read returns the content of a file.
 func (vfs *VFSModule) Read(path string) (string, error) {
+	content, _, err := vfs.ReadRevision(path)
+	return content, err
+}
+
+// ReadRevision returns the content of a file and its revision.
+func (vfs *VFSModule) ReadRevision(path string) (string, string, error) {
 	vfs.mu.RLock()
 	defer vfs.mu.RUnlock()
-	ctx := context.Background()
 
-	rc, err := vfs.client.Bucket(vfs.bucketName).Object(path).NewReader(ctx)
+	data, revision, err := vfs.readObjectRevision(context.Background(), path)
 	if err != nil {
-		return "", fmt.Errorf("failed to create reader for %s: %w", path, err)
+		return "", "", err
 	}
-	defer rc.Close()
+	return string(data), revision, nil
+}
 
-	data, err := AetherReadAll(rc)
+// Open returns a reader for length bytes of a file starting at offset, or up
+// to its end if length is negative, without loading the file into memory.
+// The returned information describes the whole file. Callers must close the
+// reader.
+func (vfs *VFSModule) Open(path string, offset, length int64) (io.ReadCloser, *FileInfo, error) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	name := strings.Trim(path, "/")
+	if _, inner, base := vfs.route(name); name == "" || (inner == "" && base != "") {
+		return nil, nil, fmt.Errorf("%s is a folder", VirtualPath(name))
+	}
+	rc, attrs, err := vfs.openObjectRange(context.Background(), name, offset, length)
+	if errors.Is(err, storage.ErrObjectNotExist) {
+		return nil, nil, fmt.Errorf("%w: %s", ErrNotFound, VirtualPath(name))
+	}
 	if err != nil {
-		return "", fmt.Errorf("failed to read content for %s: %w", path, err)
+		return nil, nil, err
 	}
-
-	return string(data), nil
+	return rc, objectFileInfo(attrs), nil
 }
 
 // AetherReadAll reads all data from an io.Reader, necessary because io.ReadAll is not available in older Go versions
 func AetherReadAll(r io.Reader) ([]byte, error) {
-    b := make([]byte, 0, 512)
-    for {
-        n, err := r.Read(b[len(b):cap(b)])
-        b = b[:len(b)+n]
-        if err != nil {
-            if err == io.EOF {
-                return b, nil
-            }
-            return b, err
-        }
-
-        if len(b) == cap(b) {
-            // Add more capacity (let's double it)
-            b = append(b, 0)[:len(b)]
-        }
-    }
+	b := make([]byte, 0, 512)
+	for {
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err != nil {
+			if err == io.EOF {
+				return b, nil
+			}
+			return b, err
+		}
+
+		if len(b) == cap(b) {
+			// Add more capacity (let's double it)
+			b = append(b, 0)[:len(b)]
+		}
+	}
 }
 
+// WriteOptions describe who a write is performed for and under what condition.
+type WriteOptions struct {
+	User    string // User charged for the bytes; empty for system writes, which are exempt from quotas.
+	App     string // App charged against its per-app quota, if any.
+	IfMatch string // Revision the file must be at, or NoRevision to only create; empty writes unconditionally.
+}
 
-// Write sets the content of a file, creating it if it doesn't exist.
+// Write sets the content of a file as the system, creating it if it doesn't exist.
 func (vfs *VFSModule) Write(path string, content []byte) error {
+	_, err := vfs.WriteWithOptions(path, content, WriteOptions{})
+	return err
+}
+
+// WriteWithOptions sets the content of a file on behalf of the user and app
+// in opts, enforcing their quotas and revision condition. It returns the new
+// revision of the file.
+func (vfs *VFSModule) WriteWithOptions(path string, content []byte, opts WriteOptions) (string, error) {
 	vfs.mu.Lock()
 	defer vfs.mu.Unlock()
-	ctx := context.Background()
-	obj := vfs.client.Bucket(vfs.bucketName).Object(path)
-	
-	wc := obj.NewWriter(ctx)
-	if _, err := wc.Write(content); err != nil {
-		return fmt.Errorf("failed to write content to %s: %w", path, err)
+
+	prev, next, err := vfs.writeObject(context.Background(), path, content, opts)
+	if err != nil {
+		return "", err
 	}
-	
-	if err := wc.Close(); err != nil {
-		return fmt.Errorf("failed to close writer for %s: %w", path, err)
+	changeType := ChangeModified
+	if prev == nil {
+		changeType = ChangeCreated
+	}
+	vfs.emit(changeType, path, false, int64(len(content)))
+	return Revision(next), nil
+}
+
+// CreateDir creates a new directory by creating a .placeholder file, on
+// behalf of the writer in opts.
+func (vfs *VFSModule) CreateDir(path string, name string, opts WriteOptions) error {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+
+	// Path should be the parent directory
+	fullPath := filepath.Join(path, name, ".placeholder")
+	if err := vfs.checkLocks(fullPath, opts); err != nil {
+		return err
 	}
 
+	// The placeholder is charged to the writer like any other object.
+	if _, _, err := vfs.writeObject(context.Background(), fullPath, []byte(""), opts); err != nil {
+		return err
+	}
+	vfs.emit(ChangeCreated, filepath.Join(path, name), true, 0)
 	return nil
 }
 
-// CreateDir creates a new directory by creating a .placeholder file.
-func (vfs *VFSModule) CreateDir(path string, name string) error {
-    vfs.mu.Lock()
+// CreateFile creates a new empty file on behalf of the writer in opts.
+func (vfs *VFSModule) CreateFile(path string, name string, opts WriteOptions) error {
+	vfs.mu.Lock()
 	defer vfs.mu.Unlock()
-    
-    // Path should be the parent directory
-    fullPath := filepath.Join(path, name, ".placeholder")
+	ctx := context.Background()
 
-    return vfs.Write(fullPath, []byte(""))
-}
+	fullPath := filepath.Join(path, name)
+
+	// Check if file already exists to avoid overwriting.
+	existing, err := vfs.statObject(ctx, fullPath)
+	if err != nil {
+		return fmt.Errorf("error checking file existence: %w", err)
+	}
+	if existing != nil {
+		return fmt.Errorf("file %w: %s", ErrExist, fullPath)
+	}
 
-// CreateFile creates a new empty file.
-func (vfs *VFSModule) CreateFile(path string, name string) error {
-    vfs.mu.Lock()
-    defer vfs.mu.Unlock()
-    
-    fullPath := filepath.Join(path, name)
-
-    // Check if file already exists to avoid overwriting.
-    _, err := vfs.client.Bucket(vfs.bucketName).Object(fullPath).Attrs(context.Background())
-    if err == nil {
-        return fmt.Errorf("file already exists: %s", fullPath)
-    }
-    if err != storage.ErrObjectNotExist {
-        return fmt.Errorf("error checking file existence: %w", err)
-    }
-
-    return vfs.Write(fullPath, []byte(""))
+	if _, _, err := vfs.writeObject(ctx, fullPath, []byte(""), opts); err != nil {
+		return err
+	}
+	vfs.emit(ChangeCreated, fullPath, false, 0)
+	return nil
 }
 
 // Close releases resources used by the VFS module.
@@ -276,5 +562,3 @@ func (vfs *VFSModule) Close() {
 		vfs.client.Close()
 	}
 }
-
-    
\ No newline at end of file
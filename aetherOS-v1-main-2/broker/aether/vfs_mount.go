@@ -0,0 +1,380 @@
+package aether
+
+import (
+	"context"
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+
+	"cloud.google.com/go/storage"
+)
+
+// Mount types.
+const (
+	MountBucket  = "bucket"  // Cloud storage; the default.
+	MountMemory  = "memory"  // Process memory, lost on restart or unmount.
+	MountOverlay = "overlay" // Writable layer over another part of the namespace.
+)
+
+// Mount attaches a storage backend at a path of the namespace and grants
+// users access to it.
+type Mount struct {
+	Path       string `json:"path"`                 // Absolute virtual path, e.g. "/shared".
+	Type       string `json:"type,omitempty"`       // One of the Mount* types; empty means MountBucket.
+	ReadOnly   bool   `json:"readOnly"`             // Rejects writes from every user.
+	Permission string `json:"permission,omitempty"` // App permission required to use the mount, if any.
+	// Source locates the mount's data. For a bucket mount it is
+	// "bucket[/prefix]", or empty to keep the data at the mount's own path in
+	// the VFS bucket. For an overlay it is the virtual path of the read-only
+	// lower layer; the writable upper layer lives at the mount's own path.
+	Source string `json:"source,omitempty"`
+
+	backend Backend // Nil for data stored at the mount's own path in the VFS bucket.
+}
+
+// DefaultMounts are the home, shared, system and scratch areas every user can reach.
+var DefaultMounts = []Mount{
+	{Path: HomeRoot},
+	{Path: "/shared"},
+	{Path: "/src/app/apps", ReadOnly: true},
+	{Path: "/tmp", Type: MountMemory},
+}
+
+// key returns the storage key of the mount point.
+func (m *Mount) key() string {
+	return strings.TrimPrefix(m.Path, "/")
+}
+
+// contains reports whether the storage key name is at or below the mount point.
+func (m *Mount) contains(name string) bool {
+	k := m.key()
+	return name == k || strings.HasPrefix(name, k+"/")
+}
+
+// newBackend validates a mount and creates its backend. Mounts made by a
+// user, rather than the system (an empty by), may only use sources in the
+// VFS bucket that the user can already reach.
+func (vfs *VFSModule) newBackend(by string, m *Mount) (Backend, error) {
+	switch m.Type {
+	case "", MountBucket:
+		if m.Source == "" {
+			return nil, nil
+		}
+		bucket, prefix, _ := strings.Cut(strings.Trim(m.Source, "/"), "/")
+		if by != "" {
+			if bucket != vfs.bucketName {
+				return nil, fmt.Errorf("permission denied: only the VFS bucket can be mounted")
+			}
+			key, err := vfs.resolveSource(by, m, "/"+prefix, !m.ReadOnly)
+			if err != nil {
+				return nil, err
+			}
+			return newSubBackend(vfs.root, key), nil
+		}
+		var b Backend = &bucketBackend{bucket: vfs.client.Bucket(bucket)}
+		if prefix != "" {
+			b = newSubBackend(b, prefix)
+		}
+		return b, nil
+	case MountMemory:
+		return newMemoryBackend(), nil
+	case MountOverlay:
+		lower := path.Clean("/" + m.Source)
+		if m.Source == "" || lower == "/" {
+			return nil, fmt.Errorf("overlay mount %s requires a source path", m.Path)
+		}
+		if lower == m.Path || strings.HasPrefix(lower, m.Path+"/") || strings.HasPrefix(m.Path, lower+"/") {
+			return nil, fmt.Errorf("overlay mount %s cannot overlap its source %s", m.Path, lower)
+		}
+		lowerKey := strings.TrimPrefix(lower, "/")
+		if by != "" {
+			key, err := vfs.resolveSource(by, m, lower, false)
+			if err != nil {
+				return nil, err
+			}
+			lowerKey = key
+		}
+		return &overlayBackend{
+			upper: newSubBackend(vfs.root, m.key()),
+			lower: newSubBackend(vfs.root, lowerKey),
+		}, nil
+	default:
+		return nil, fmt.Errorf("unknown mount type: %q", m.Type)
+	}
+}
+
+// resolveSource resolves the virtual path src of a mount's data as by,
+// returning its storage key, so the mount reaches nothing by could not. The
+// source must be stored in the VFS bucket itself, and data in another
+// user's home may only be mounted in by's own.
+func (vfs *VFSModule) resolveSource(by string, m *Mount, src string, write bool) (string, error) {
+	key, source, err := vfs.Resolve(by, src, write)
+	if err != nil {
+		return "", err
+	}
+	vfs.mu.RLock()
+	backed := vfs.mountOf(key) != nil
+	vfs.mu.RUnlock()
+	if backed {
+		return "", fmt.Errorf("cannot mount %s: it is not stored in the VFS bucket", src)
+	}
+	if source != nil && source.Permission != "" && source.Permission != m.Permission {
+		return "", fmt.Errorf("permission denied: a mount of %s must require the %q permission", src, source.Permission)
+	}
+	if inHomes(key) && !inHome(by, key) && !inHome(by, m.key()) {
+		return "", fmt.Errorf("permission denied: data from another user's home can only be mounted in your own")
+	}
+	return key, nil
+}
+
+// inHomes reports whether the storage key name is at or below HomeRoot.
+func inHomes(name string) bool {
+	root := strings.TrimPrefix(HomeRoot, "/")
+	return name == root || strings.HasPrefix(name, root+"/")
+}
+
+// inHome reports whether the storage key name is in user's home.
+func inHome(user, name string) bool {
+	home := strings.TrimPrefix(HomeDir(user), "/")
+	return name == home || strings.HasPrefix(name, home+"/")
+}
+
+// checkMountAccess returns an error unless by may change the mount at the
+// virtual path p. Only VFS administrators change mounts, and in homes only
+// in their own. An empty by acts as the system, which may mount anywhere.
+func (vfs *VFSModule) checkMountAccess(by, p string) error {
+	if by == "" {
+		return nil
+	}
+	if !vfs.IsAdmin(by) {
+		return fmt.Errorf("permission denied: changing mounts requires a VFS administrator")
+	}
+	if key := strings.TrimPrefix(p, "/"); inHomes(key) && !inHome(by, key) {
+		return fmt.Errorf("permission denied: cannot change mounts in another user's home")
+	}
+	return nil
+}
+
+// cleanMount normalizes a mount's path, checks that by may mount there and
+// creates its backend.
+func (vfs *VFSModule) cleanMount(by string, m Mount) (Mount, error) {
+	if strings.ContainsAny(m.Path, "\\\x00") {
+		return m, fmt.Errorf("invalid mount path: %q", m.Path)
+	}
+	m.Path = path.Clean("/" + m.Path)
+	if m.Path == "/" || isSystemKey(m.key()) || m.Path == ShareRoot || strings.HasPrefix(m.Path, ShareRoot+"/") {
+		return m, fmt.Errorf("cannot mount at %s", m.Path)
+	}
+	if err := vfs.checkMountAccess(by, m.Path); err != nil {
+		return m, err
+	}
+	backend, err := vfs.newBackend(by, &m)
+	if err != nil {
+		return m, err
+	}
+	m.backend = backend
+	return m, nil
+}
+
+// setMountsLocked installs a mount table, ordered so nested mounts come
+// before the mounts containing them. Callers must hold vfs.mu.
+func (vfs *VFSModule) setMountsLocked(mounts []Mount) {
+	sort.SliceStable(mounts, func(i, j int) bool { return len(mounts[i].Path) > len(mounts[j].Path) })
+	vfs.mounts = mounts
+	vfs.generation.Add(1)
+	// Usage is counted across every backend, so it is rebuilt for the new table.
+	vfs.usage.mu.Lock()
+	vfs.usage.loaded = false
+	vfs.usage.mu.Unlock()
+}
+
+// SetMounts replaces the mount table. Data in memory mounts that are replaced is lost.
+func (vfs *VFSModule) SetMounts(mounts []Mount) error {
+	table := make([]Mount, len(mounts))
+	seen := make(map[string]bool)
+	for i, m := range mounts {
+		m, err := vfs.cleanMount("", m)
+		if err != nil {
+			return err
+		}
+		if seen[m.Path] {
+			return fmt.Errorf("%s is mounted twice", m.Path)
+		}
+		seen[m.Path] = true
+		table[i] = m
+	}
+
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.setMountsLocked(table)
+	return nil
+}
+
+// Mounts returns a copy of the mount table.
+func (vfs *VFSModule) Mounts() []Mount {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	return append([]Mount(nil), vfs.mounts...)
+}
+
+// Mount adds a mount to the table on behalf of by. Objects already stored in
+// the VFS bucket under the mount point are hidden until it is unmounted.
+func (vfs *VFSModule) Mount(by string, m Mount) (*Mount, error) {
+	m, err := vfs.cleanMount(by, m)
+	if err != nil {
+		return nil, err
+	}
+
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	for _, existing := range vfs.mounts {
+		if existing.Path == m.Path {
+			return nil, fmt.Errorf("%s is already mounted", m.Path)
+		}
+	}
+	vfs.setMountsLocked(append(append([]Mount(nil), vfs.mounts...), m))
+	vfs.emit(ChangeCreated, m.key(), true, 0)
+	return &m, nil
+}
+
+// Unmount removes the mount at p on behalf of by. The contents of a memory
+// mount are discarded.
+func (vfs *VFSModule) Unmount(by, p string) error {
+	p = path.Clean("/" + p)
+	if p == HomeRoot {
+		return fmt.Errorf("cannot unmount %s", HomeRoot)
+	}
+	if err := vfs.checkMountAccess(by, p); err != nil {
+		return err
+	}
+
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	for i, m := range vfs.mounts {
+		if m.Path != p {
+			continue
+		}
+		mounts := append(append([]Mount(nil), vfs.mounts[:i]...), vfs.mounts[i+1:]...)
+		vfs.setMountsLocked(mounts)
+		vfs.moveACL(m.key(), "")
+		vfs.emit(ChangeDeleted, m.key(), true, 0)
+		return nil
+	}
+	return fmt.Errorf("nothing is mounted at %s", p)
+}
+
+// route returns the backend holding the object with storage key name, the
+// object's name within that backend and the key of the mount point it is
+// relative to ("" for the VFS bucket). Callers must hold vfs.mu.
+func (vfs *VFSModule) route(name string) (Backend, string, string) {
+	for i := range vfs.mounts {
+		m := &vfs.mounts[i]
+		if !m.contains(name) {
+			continue
+		}
+		if m.backend == nil {
+			break
+		}
+		return m.backend, strings.TrimPrefix(strings.TrimPrefix(name, m.key()), "/"), m.key()
+	}
+	return vfs.root, name, ""
+}
+
+// listKeys calls fn for every object under prefix across all backends, with
+// names and prefixes as storage keys. With a delimiter, folders are rolled up
+// as in Backend.List and mount points below prefix appear as folders.
+// Callers must hold vfs.mu.
+func (vfs *VFSModule) listKeys(ctx context.Context, prefix, delimiter string, fn func(*storage.ObjectAttrs) error) error {
+	backend, inner, base := vfs.route(prefix)
+	if base != "" {
+		base += "/"
+	}
+
+	// Mounts strictly below the prefix that are backed elsewhere shadow
+	// whatever their owning backend holds at that path.
+	var nested []*Mount
+	for i := range vfs.mounts {
+		m := &vfs.mounts[i]
+		k := m.key() + "/"
+		if m.backend != nil && strings.HasPrefix(k, prefix) && k != base && strings.HasPrefix(k, base) {
+			nested = append(nested, m)
+		}
+	}
+	shadowed := func(name string) bool {
+		for _, m := range nested {
+			if m.contains(strings.TrimSuffix(name, "/")) {
+				return true
+			}
+		}
+		return false
+	}
+
+	seen := make(map[string]bool)
+	emitPrefix := func(p string) error {
+		if seen[p] {
+			return nil
+		}
+		seen[p] = true
+		return fn(&storage.ObjectAttrs{Prefix: p})
+	}
+
+	err := backend.List(ctx, inner, delimiter, func(attrs *storage.ObjectAttrs) error {
+		out := *attrs
+		if out.Name != "" {
+			out.Name = base + out.Name
+		}
+		if out.Prefix != "" {
+			out.Prefix = base + out.Prefix
+			if shadowed(out.Prefix) {
+				return nil
+			}
+			return emitPrefix(out.Prefix)
+		}
+		if shadowed(out.Name) {
+			return nil
+		}
+		return fn(&out)
+	})
+	if err != nil {
+		return err
+	}
+
+	for _, m := range nested {
+		k := m.key() + "/"
+		if delimiter != "" {
+			rest := strings.TrimPrefix(k, prefix)
+			if err := emitPrefix(prefix + rest[:strings.Index(rest, delimiter)+len(delimiter)]); err != nil {
+				return err
+			}
+			continue
+		}
+		err := m.backend.List(ctx, "", "", func(attrs *storage.ObjectAttrs) error {
+			if shadowed(k+attrs.Name) && vfs.mountOf(k+attrs.Name) != m {
+				return nil
+			}
+			out := *attrs
+			out.Name = k + out.Name
+			return fn(&out)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mountOf returns the innermost backed mount containing the storage key name,
+// or nil. Callers must hold vfs.mu.
+func (vfs *VFSModule) mountOf(name string) *Mount {
+	for i := range vfs.mounts {
+		m := &vfs.mounts[i]
+		if m.contains(name) {
+			if m.backend == nil {
+				return nil
+			}
+			return m
+		}
+	}
+	return nil
+}
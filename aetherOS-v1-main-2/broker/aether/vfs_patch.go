@@ -0,0 +1,446 @@
+package aether
+
+import (
+	"context"
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// DefaultPatchFuzz is the number of context lines that may be ignored at each
+// end of a hunk when it does not match exactly, as with patch(1).
+const DefaultPatchFuzz = 2
+
+// Hunk is one "@@" section of a unified diff.
+type Hunk struct {
+	Header       string   // The "@@ ... @@" line.
+	OldStart     int      // 1-based first line in the original file.
+	OldLines     int      // Lines in the original file covered by the hunk.
+	NewStart     int      // 1-based first line in the patched file.
+	NewLines     int      // Lines in the patched file covered by the hunk.
+	Lines        []string // Body lines, each starting with ' ', '-' or '+'.
+	OldNoNewline bool     // The original file has no newline after the hunk's last line.
+	NewNoNewline bool     // The patched file has no newline after the hunk's last line.
+}
+
+// FilePatch is the set of hunks to apply to one file.
+type FilePatch struct {
+	Path         string // Storage key of the file, or its name in the diff until resolved.
+	Create       bool   // The diff creates the file ("--- /dev/null").
+	Delete       bool   // The diff deletes the file ("+++ /dev/null").
+	BaseRevision string // If set, the file must be at this revision.
+	Hunks        []*Hunk
+}
+
+// PatchOptions control Patch.
+type PatchOptions struct {
+	Fuzz   int          // Context lines that may be ignored per hunk end; see DefaultPatchFuzz.
+	DryRun bool         // Check that the patch applies without writing anything.
+	Write  WriteOptions // Who the patched files are written for.
+}
+
+// HunkResult reports how a hunk applied or why it was rejected.
+type HunkResult struct {
+	Hunk    int    `json:"hunk"` // 1-based, in diff order.
+	Header  string `json:"header"`
+	Applied bool   `json:"applied"`
+	Line    int    `json:"line,omitempty"`   // Line of the original file where the hunk applied or was expected.
+	Offset  int    `json:"offset,omitempty"` // Lines between where the header said and where the hunk applied.
+	Fuzz    int    `json:"fuzz,omitempty"`   // Context lines ignored at each end to make the hunk apply.
+	Reason  string `json:"reason,omitempty"` // Why the hunk was rejected.
+}
+
+// FilePatchResult reports the outcome of patching one file.
+type FilePatchResult struct {
+	Path     string        `json:"path"`
+	Applied  bool          `json:"applied"`
+	Revision string        `json:"revision,omitempty"` // New revision once written.
+	Hunks    []*HunkResult `json:"hunks"`
+	Error    string        `json:"error,omitempty"`
+}
+
+// PatchError is returned when a patch is not applied because some hunks were
+// rejected or a file could not be patched. Nothing is written in that case.
+type PatchError struct {
+	Rejected int   // Hunks that did not apply.
+	Err      error // The first file-level error, such as a revision conflict.
+}
+
+func (e *PatchError) Error() string {
+	if e.Err != nil {
+		return fmt.Sprintf("patch not applied: %v", e.Err)
+	}
+	return fmt.Sprintf("patch not applied: %d hunk(s) rejected", e.Rejected)
+}
+
+func (e *PatchError) Unwrap() error {
+	return e.Err
+}
+
+var hunkHeaderRe = regexp.MustCompile(`^@@ -(\d+)(?:,(\d+))? \+(\d+)(?:,(\d+))? @@`)
+
+// ParseUnifiedDiff parses a unified diff covering one or more files. Hunks
+// that are not preceded by "---"/"+++" headers are collected into a single
+// FilePatch with an empty path. Git-style "a/" and "b/" prefixes are removed.
+func ParseUnifiedDiff(diff string) ([]*FilePatch, error) {
+	lines := strings.Split(strings.ReplaceAll(diff, "\r\n", "\n"), "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+
+	var files []*FilePatch
+	var cur *FilePatch
+	for i := 0; i < len(lines); i++ {
+		line := lines[i]
+		switch {
+		case strings.HasPrefix(line, "--- ") && i+1 < len(lines) && strings.HasPrefix(lines[i+1], "+++ "):
+			cur = newFilePatch(diffFileName(line[4:]), diffFileName(lines[i+1][4:]))
+			files = append(files, cur)
+			i++
+
+		case strings.HasPrefix(line, "@@ "):
+			h, err := parseHunkHeader(line)
+			if err != nil {
+				return nil, err
+			}
+			if cur == nil {
+				cur = &FilePatch{}
+				files = append(files, cur)
+			}
+			oldLeft, newLeft := h.OldLines, h.NewLines
+			for oldLeft > 0 || newLeft > 0 || (i+1 < len(lines) && strings.HasPrefix(lines[i+1], "\\")) {
+				i++
+				if i >= len(lines) {
+					return nil, fmt.Errorf("hunk %q ends early", h.Header)
+				}
+				body := lines[i]
+				if body == "" {
+					body = " " // A blank context line whose leading space was stripped.
+				}
+				switch body[0] {
+				case ' ':
+					oldLeft--
+					newLeft--
+				case '-':
+					oldLeft--
+				case '+':
+					newLeft--
+				case '\\':
+					// "\ No newline at end of file" applies to the line before it.
+					if len(h.Lines) == 0 {
+						return nil, fmt.Errorf("misplaced %q in hunk %q", body, h.Header)
+					}
+					switch h.Lines[len(h.Lines)-1][0] {
+					case ' ':
+						h.OldNoNewline, h.NewNoNewline = true, true
+					case '-':
+						h.OldNoNewline = true
+					case '+':
+						h.NewNoNewline = true
+					}
+					continue
+				default:
+					return nil, fmt.Errorf("unexpected line %d in hunk %q: %q", i+1, h.Header, body)
+				}
+				if oldLeft < 0 || newLeft < 0 {
+					return nil, fmt.Errorf("hunk %q has more lines than its header says", h.Header)
+				}
+				h.Lines = append(h.Lines, body)
+			}
+			cur.Hunks = append(cur.Hunks, h)
+		}
+	}
+
+	for _, f := range files {
+		if len(f.Hunks) == 0 && !f.Create && !f.Delete {
+			return nil, fmt.Errorf("no hunks for %s", f.Path)
+		}
+	}
+	if len(files) == 0 {
+		return nil, fmt.Errorf("no hunks found in diff")
+	}
+	return files, nil
+}
+
+func newFilePatch(oldName, newName string) *FilePatch {
+	const devNull = "/dev/null"
+	if (oldName == devNull || strings.HasPrefix(oldName, "a/")) && (newName == devNull || strings.HasPrefix(newName, "b/")) {
+		oldName = strings.TrimPrefix(oldName, "a/")
+		newName = strings.TrimPrefix(newName, "b/")
+	}
+	switch {
+	case oldName == devNull:
+		return &FilePatch{Path: newName, Create: true}
+	case newName == devNull:
+		return &FilePatch{Path: oldName, Delete: true}
+	}
+	return &FilePatch{Path: newName}
+}
+
+// diffFileName extracts the file name from a "---" or "+++" header, dropping
+// any timestamp after a tab.
+func diffFileName(s string) string {
+	if i := strings.IndexByte(s, '\t'); i >= 0 {
+		s = s[:i]
+	}
+	return strings.TrimSpace(s)
+}
+
+func parseHunkHeader(line string) (*Hunk, error) {
+	m := hunkHeaderRe.FindStringSubmatch(line)
+	if m == nil {
+		return nil, fmt.Errorf("invalid hunk header: %q", line)
+	}
+	count := func(s string) int {
+		if s == "" {
+			return 1
+		}
+		n, _ := strconv.Atoi(s)
+		return n
+	}
+	oldStart, _ := strconv.Atoi(m[1])
+	newStart, _ := strconv.Atoi(m[3])
+	return &Hunk{
+		Header:   line,
+		OldStart: oldStart,
+		OldLines: count(m[2]),
+		NewStart: newStart,
+		NewLines: count(m[4]),
+	}, nil
+}
+
+// sides returns the hunk's lines as they appear in the original and patched
+// file, and how many context lines lead and trail the hunk.
+func (h *Hunk) sides() (before, after []string, lead, trail int) {
+	for _, l := range h.Lines {
+		switch l[0] {
+		case ' ':
+			before = append(before, l[1:])
+			after = append(after, l[1:])
+		case '-':
+			before = append(before, l[1:])
+		case '+':
+			after = append(after, l[1:])
+		}
+	}
+	for lead < len(h.Lines) && h.Lines[lead][0] == ' ' {
+		lead++
+	}
+	for trail < len(h.Lines)-lead && h.Lines[len(h.Lines)-1-trail][0] == ' ' {
+		trail++
+	}
+	return before, after, lead, trail
+}
+
+// ApplyHunks applies hunks to content in order. Each hunk is first tried where
+// its header says, then at growing offsets, then with up to fuzz context lines
+// ignored at each end. It returns the patched content and a result per hunk;
+// rejected hunks are skipped and leave the content untouched.
+func ApplyHunks(content string, hunks []*Hunk, fuzz int) (string, []*HunkResult) {
+	lines, eol := splitLines(content)
+	results := make([]*HunkResult, len(hunks))
+	delta := 0  // How many lines earlier hunks added, so positions map back to the original.
+	minPos := 0 // Hunks must apply after the previous one.
+
+	for i, h := range hunks {
+		res := &HunkResult{Hunk: i + 1, Header: h.Header}
+		results[i] = res
+		before, after, lead, trail := h.sides()
+
+		want := h.OldStart - 1 + delta
+		if h.OldLines == 0 {
+			want = h.OldStart + delta // Pure insertions name the line they follow.
+		}
+
+		for f := 0; f <= fuzz && !res.Applied; f++ {
+			top, bottom := min(f, lead), min(f, trail)
+			if f > 0 && top == 0 && bottom == 0 {
+				break // No more context to ignore.
+			}
+			o := before[top : len(before)-bottom]
+			n := after[top : len(after)-bottom]
+			pos := findLines(lines, o, want+top, minPos)
+			if pos < 0 {
+				continue
+			}
+
+			patched := make([]string, 0, len(lines)-len(o)+len(n))
+			patched = append(patched, lines[:pos]...)
+			patched = append(patched, n...)
+			patched = append(patched, lines[pos+len(o):]...)
+			atEnd := pos+len(o) == len(lines)
+			lines = patched
+
+			res.Applied = true
+			res.Line = pos - top - delta + 1
+			res.Offset = pos - (want + top)
+			res.Fuzz = f
+			if atEnd && bottom == 0 {
+				if h.NewNoNewline {
+					eol = false
+				} else if h.OldNoNewline {
+					eol = true
+				}
+			}
+			delta += len(n) - len(o)
+			minPos = pos + len(n)
+		}
+
+		if !res.Applied {
+			res.Line = want - delta + 1
+			res.Reason = mismatch(lines, before, want, delta)
+		}
+	}
+	return joinLines(lines, eol), results
+}
+
+// findLines returns the position at or after minPos where want appears in
+// lines, searching outward from near, or -1.
+func findLines(lines, want []string, near, minPos int) int {
+	last := len(lines) - len(want)
+	near = max(minPos, min(near, last))
+	for d := 0; near-d >= minPos || near+d <= last; d++ {
+		if pos := near - d; pos >= minPos && pos <= last && linesEqual(lines[pos:pos+len(want)], want) {
+			return pos
+		}
+		if pos := near + d; d > 0 && pos >= minPos && pos <= last && linesEqual(lines[pos:pos+len(want)], want) {
+			return pos
+		}
+	}
+	return -1
+}
+
+func linesEqual(a, b []string) bool {
+	for i := range b {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// mismatch describes the first line at which before differs from lines at
+// pos. Line numbers refer to the original file, delta lines behind lines.
+func mismatch(lines, before []string, pos, delta int) string {
+	pos = max(pos, 0)
+	for i, want := range before {
+		if pos+i >= len(lines) {
+			return fmt.Sprintf("line %d: expected %q, found end of file", pos+i-delta+1, want)
+		}
+		if lines[pos+i] != want {
+			return fmt.Sprintf("line %d: expected %q, found %q", pos+i-delta+1, want, lines[pos+i])
+		}
+	}
+	return "hunk would overlap an earlier hunk"
+}
+
+// splitLines splits content into lines and reports whether it ends with a
+// newline. Empty content counts as ending with one, so new files get it.
+func splitLines(content string) ([]string, bool) {
+	if content == "" {
+		return nil, true
+	}
+	eol := strings.HasSuffix(content, "\n")
+	return strings.Split(strings.TrimSuffix(content, "\n"), "\n"), eol
+}
+
+func joinLines(lines []string, eol bool) string {
+	if len(lines) == 0 {
+		return ""
+	}
+	s := strings.Join(lines, "\n")
+	if eol {
+		s += "\n"
+	}
+	return s
+}
+
+// Patch applies patches to their files as one unit: if any hunk is rejected,
+// a base revision does not match or a file cannot be read, nothing is written
+// and a PatchError is returned alongside the per-file results. Otherwise the
+// patched files are written, created or deleted together as a batch, each
+// conditional on the revision it was patched from.
+func (vfs *VFSModule) Patch(patches []*FilePatch, opts PatchOptions) ([]*FilePatchResult, error) {
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("patch has no files")
+	}
+	ctx := context.Background()
+	results := make([]*FilePatchResult, len(patches))
+	ops := make([]BatchOp, 0, len(patches))
+	patchErr := &PatchError{}
+	fail := func(res *FilePatchResult, err error) {
+		res.Error = err.Error()
+		if patchErr.Err == nil {
+			patchErr.Err = err
+		}
+	}
+
+	vfs.mu.RLock()
+	for i, p := range patches {
+		res := &FilePatchResult{Path: VirtualPath(p.Path), Hunks: make([]*HunkResult, 0)}
+		results[i] = res
+
+		var content, revision string
+		if p.Create {
+			attrs, err := vfs.statObject(ctx, p.Path)
+			if err != nil {
+				fail(res, err)
+				continue
+			}
+			if attrs != nil {
+				fail(res, &ConflictError{Path: res.Path, ExpectedRevision: NoRevision, CurrentRevision: Revision(attrs)})
+				continue
+			}
+			revision = NoRevision
+		} else {
+			data, rev, err := vfs.readObjectRevision(ctx, p.Path)
+			if err != nil {
+				fail(res, err)
+				continue
+			}
+			content, revision = string(data), rev
+		}
+		if p.BaseRevision != "" && p.BaseRevision != revision {
+			fail(res, &ConflictError{Path: res.Path, ExpectedRevision: p.BaseRevision, CurrentRevision: revision})
+			continue
+		}
+
+		patched, hunks := ApplyHunks(content, p.Hunks, opts.Fuzz)
+		res.Hunks = hunks
+		for _, h := range hunks {
+			if !h.Applied {
+				patchErr.Rejected++
+			}
+		}
+		if p.Delete && patched != "" {
+			fail(res, fmt.Errorf("%s still has content after applying its deletion", res.Path))
+			continue
+		}
+
+		if p.Delete {
+			ops = append(ops, BatchOp{Op: BatchDelete, Path: p.Path, IfMatch: revision})
+		} else {
+			ops = append(ops, BatchOp{Op: BatchWrite, Path: p.Path, Content: []byte(patched), IfMatch: revision})
+		}
+	}
+	vfs.mu.RUnlock()
+
+	if patchErr.Err != nil || patchErr.Rejected > 0 {
+		return results, patchErr
+	}
+	if !opts.DryRun {
+		// The revision conditions catch anything written since the files were read.
+		batchResults, err := vfs.batch(ops, opts.Write, nil)
+		if err != nil {
+			return results, err
+		}
+		for i, r := range batchResults {
+			results[i].Revision = r.Revision
+		}
+	}
+	for _, res := range results {
+		res.Applied = true
+	}
+	return results, nil
+}
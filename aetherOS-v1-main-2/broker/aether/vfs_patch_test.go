@@ -0,0 +1,309 @@
+package aether
+
+import (
+	"errors"
+	"strings"
+	"testing"
+)
+
+func TestParseUnifiedDiff(t *testing.T) {
+	tests := []struct {
+		name    string
+		diff    string
+		want    []FilePatch // Hunks are compared by count only.
+		hunks   []int
+		wantErr string
+	}{
+		{
+			name:  "git prefixes",
+			diff:  "--- a/src/main.go\n+++ b/src/main.go\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n",
+			want:  []FilePatch{{Path: "src/main.go"}},
+			hunks: []int{1},
+		},
+		{
+			name:  "create and delete",
+			diff:  "--- /dev/null\n+++ b/new.txt\n@@ -0,0 +1 @@\n+x\n--- a/old.txt\t2024-01-01\n+++ /dev/null\n@@ -1 +0,0 @@\n-y\n",
+			want:  []FilePatch{{Path: "new.txt", Create: true}, {Path: "old.txt", Delete: true}},
+			hunks: []int{1, 1},
+		},
+		{
+			name:  "bare hunks",
+			diff:  "@@ -1 +1 @@\n-a\n+b\n@@ -5 +5 @@\n-c\n+d\n",
+			want:  []FilePatch{{}},
+			hunks: []int{2},
+		},
+		{
+			name:  "blank context line",
+			diff:  "--- f\n+++ f\n@@ -1,3 +1,3 @@\n a\n\n-b\n+c\n",
+			want:  []FilePatch{{Path: "f"}},
+			hunks: []int{1},
+		},
+		{
+			name:  "crlf",
+			diff:  "--- f\r\n+++ f\r\n@@ -1 +1 @@\r\n-a\r\n+b\r\n",
+			want:  []FilePatch{{Path: "f"}},
+			hunks: []int{1},
+		},
+		{name: "empty", diff: "", wantErr: "no hunks found"},
+		{name: "headers only", diff: "--- a/f\n+++ b/f\n", wantErr: "no hunks for f"},
+		{name: "bad header", diff: "@@ -x +1 @@\n", wantErr: "invalid hunk header"},
+		{name: "ends early", diff: "@@ -1,3 +1,3 @@\n a\n", wantErr: "ends early"},
+		{name: "more lines than header", diff: "@@ -1,2 +1 @@\n a\n+b\n", wantErr: "more lines than its header says"},
+		{name: "bad line", diff: "@@ -1 +1 @@\n*a\n", wantErr: "unexpected line"},
+		{name: "misplaced no newline", diff: "@@ -0,0 +0,0 @@\n\\ No newline at end of file\n", wantErr: "misplaced"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := ParseUnifiedDiff(tt.diff)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(files) != len(tt.want) {
+				t.Fatalf("got %d files, want %d", len(files), len(tt.want))
+			}
+			for i, f := range files {
+				w := tt.want[i]
+				if f.Path != w.Path || f.Create != w.Create || f.Delete != w.Delete {
+					t.Errorf("file %d = %+v, want %+v", i, *f, w)
+				}
+				if len(f.Hunks) != tt.hunks[i] {
+					t.Errorf("file %d has %d hunks, want %d", i, len(f.Hunks), tt.hunks[i])
+				}
+			}
+		})
+	}
+}
+
+func TestParseUnifiedDiffNoNewline(t *testing.T) {
+	tests := []struct {
+		name         string
+		diff         string
+		oldNoNewline bool
+		newNoNewline bool
+	}{
+		{"old side", "@@ -1 +1 @@\n-a\n\\ No newline at end of file\n+a\n", true, false},
+		{"new side", "@@ -1 +1 @@\n-a\n+a\n\\ No newline at end of file\n", false, true},
+		{"both sides", "@@ -1,2 +1,2 @@\n-a\n+b\n c\n\\ No newline at end of file\n", true, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := ParseUnifiedDiff(tt.diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := files[0].Hunks[0]
+			if h.OldNoNewline != tt.oldNoNewline || h.NewNoNewline != tt.newNoNewline {
+				t.Errorf("OldNoNewline, NewNoNewline = %v, %v, want %v, %v", h.OldNoNewline, h.NewNoNewline, tt.oldNoNewline, tt.newNoNewline)
+			}
+		})
+	}
+}
+
+func TestApplyHunks(t *testing.T) {
+	const file = "1\n2\n3\n4\n5\n6\n7\n8\n9\n"
+	tests := []struct {
+		name    string
+		content string
+		diff    string
+		fuzz    int
+		want    string
+		results []HunkResult // Hunk and Header are not compared.
+	}{
+		{
+			name:    "exact",
+			content: file,
+			diff:    "@@ -4,3 +4,3 @@\n 4\n-5\n+five\n 6\n",
+			want:    "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			results: []HunkResult{{Applied: true, Line: 4}},
+		},
+		{
+			name:    "offset",
+			content: "0\n" + file,
+			diff:    "@@ -4,3 +4,3 @@\n 4\n-5\n+five\n 6\n",
+			want:    "0\n1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			results: []HunkResult{{Applied: true, Line: 5, Offset: 1}},
+		},
+		{
+			name:    "fuzz ignores stale context",
+			content: file,
+			diff:    "@@ -4,3 +4,3 @@\n four\n-5\n+five\n 6\n",
+			fuzz:    1,
+			want:    "1\n2\n3\n4\nfive\n6\n7\n8\n9\n",
+			results: []HunkResult{{Applied: true, Line: 4, Fuzz: 1}},
+		},
+		{
+			name:    "stale context without fuzz",
+			content: file,
+			diff:    "@@ -4,3 +4,3 @@\n four\n-5\n+five\n 6\n",
+			want:    file,
+			results: []HunkResult{{Line: 4, Reason: `line 4: expected "four", found "4"`}},
+		},
+		{
+			name:    "fuzz never ignores changed lines",
+			content: file,
+			diff:    "@@ -4,3 +4,3 @@\n 4\n-FIVE\n+five\n 6\n",
+			fuzz:    DefaultPatchFuzz,
+			want:    file,
+			results: []HunkResult{{Line: 4, Reason: `line 5: expected "FIVE", found "5"`}},
+		},
+		{
+			name:    "later hunks follow earlier ones",
+			content: file,
+			diff:    "@@ -2 +2,2 @@\n-2\n+2a\n+2b\n@@ -8 +9 @@\n-8\n+eight\n",
+			want:    "1\n2a\n2b\n3\n4\n5\n6\n7\neight\n9\n",
+			results: []HunkResult{{Applied: true, Line: 2}, {Applied: true, Line: 8}},
+		},
+		{
+			name:    "rejected hunk leaves others applied",
+			content: file,
+			diff:    "@@ -2 +2 @@\n-x\n+y\n@@ -8 +8 @@\n-8\n+eight\n",
+			want:    "1\n2\n3\n4\n5\n6\n7\neight\n9\n",
+			results: []HunkResult{{Line: 2, Reason: `line 2: expected "x", found "2"`}, {Applied: true, Line: 8}},
+		},
+		{
+			name:    "pure insertion",
+			content: file,
+			diff:    "@@ -3,0 +4 @@\n+3.5\n",
+			want:    "1\n2\n3\n3.5\n4\n5\n6\n7\n8\n9\n",
+			results: []HunkResult{{Applied: true, Line: 4}},
+		},
+		{
+			name:    "past end of file",
+			content: "1\n",
+			diff:    "@@ -1,2 +1,2 @@\n 1\n-2\n+3\n",
+			want:    "1\n",
+			results: []HunkResult{{Line: 1, Reason: `line 2: expected "2", found end of file`}},
+		},
+		{
+			name:    "removes trailing newline",
+			content: "a\nb\n",
+			diff:    "@@ -1,2 +1,2 @@\n a\n-b\n+b\n\\ No newline at end of file\n",
+			want:    "a\nb",
+			results: []HunkResult{{Applied: true, Line: 1}},
+		},
+		{
+			name:    "adds trailing newline",
+			content: "a\nb",
+			diff:    "@@ -1,2 +1,2 @@\n a\n-b\n\\ No newline at end of file\n+b\n",
+			want:    "a\nb\n",
+			results: []HunkResult{{Applied: true, Line: 1}},
+		},
+		{
+			name:    "keeps missing newline when the end is untouched",
+			content: "a\nb\nc",
+			diff:    "@@ -1 +1 @@\n-a\n+A\n",
+			want:    "A\nb\nc",
+			results: []HunkResult{{Applied: true, Line: 1}},
+		},
+		{
+			name:    "creates file",
+			content: "",
+			diff:    "--- /dev/null\n+++ b/f\n@@ -0,0 +1,2 @@\n+a\n+b\n",
+			want:    "a\nb\n",
+			results: []HunkResult{{Applied: true, Line: 1}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			files, err := ParseUnifiedDiff(tt.diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			got, results := ApplyHunks(tt.content, files[0].Hunks, tt.fuzz)
+			if got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+			if len(results) != len(tt.results) {
+				t.Fatalf("got %d results, want %d", len(results), len(tt.results))
+			}
+			for i, r := range results {
+				w := tt.results[i]
+				if r.Applied != w.Applied || r.Line != w.Line || r.Offset != w.Offset || r.Fuzz != w.Fuzz || r.Reason != w.Reason {
+					t.Errorf("hunk %d = %+v, want %+v", i+1, *r, w)
+				}
+			}
+		})
+	}
+}
+
+func TestPatch(t *testing.T) {
+	const diff = "--- a/home/u/f.txt\n+++ b/home/u/f.txt\n@@ -1,2 +1,2 @@\n a\n-b\n+c\n"
+
+	tests := []struct {
+		name     string
+		base     func(rev string) string
+		opts     PatchOptions
+		want     string
+		conflict bool
+	}{
+		{name: "applies", base: func(string) string { return "" }, want: "a\nc\n"},
+		{name: "matching base revision", base: func(rev string) string { return rev }, want: "a\nc\n"},
+		{name: "base revision mismatch", base: func(string) string { return "stale" }, want: "a\nb\n", conflict: true},
+		{name: "dry run", base: func(string) string { return "" }, opts: PatchOptions{DryRun: true}, want: "a\nb\n"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			writeFiles(t, vfs, map[string]string{"home/u/f.txt": "a\nb\n"})
+			_, rev, err := vfs.ReadRevision("home/u/f.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			patches, err := ParseUnifiedDiff(diff)
+			if err != nil {
+				t.Fatal(err)
+			}
+			patches[0].BaseRevision = tt.base(rev)
+			results, err := vfs.Patch(patches, tt.opts)
+
+			var conflict *ConflictError
+			if tt.conflict {
+				var patchErr *PatchError
+				if !errors.As(err, &patchErr) || !errors.As(err, &conflict) {
+					t.Fatalf("err = %v, want a PatchError wrapping a ConflictError", err)
+				}
+				if conflict.CurrentRevision != rev || results[0].Applied {
+					t.Errorf("conflict = %+v, result = %+v", *conflict, *results[0])
+				}
+			} else if err != nil {
+				t.Fatal(err)
+			} else if !results[0].Applied {
+				t.Errorf("result = %+v, want applied", *results[0])
+			}
+
+			got, err := vfs.Read("home/u/f.txt")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != tt.want {
+				t.Errorf("content = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPatchRejectedHunkWritesNothing(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{"home/u/a.txt": "a\n", "home/u/b.txt": "b\n"})
+
+	patches, err := ParseUnifiedDiff("--- a/home/u/a.txt\n+++ b/home/u/a.txt\n@@ -1 +1 @@\n-a\n+A\n" +
+		"--- a/home/u/b.txt\n+++ b/home/u/b.txt\n@@ -1 +1 @@\n-x\n+X\n")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = vfs.Patch(patches, PatchOptions{})
+	var patchErr *PatchError
+	if !errors.As(err, &patchErr) || patchErr.Rejected != 1 {
+		t.Fatalf("err = %v, want one rejected hunk", err)
+	}
+	if got, _ := vfs.Read("home/u/a.txt"); got != "a\n" {
+		t.Errorf("a.txt = %q, want it untouched", got)
+	}
+}
@@ -0,0 +1,129 @@
+package aether
+
+import (
+	"fmt"
+	"path"
+	"strings"
+)
+
+// HomeRoot is the parent of every user's home directory. A user's relative
+// paths resolve against HomeRoot/<user>, matching vfs.default_root in config.yaml.
+const HomeRoot = "/home"
+
+// ValidName reports whether name is a single, safe path segment. User IDs
+// must pass the same check since they become home directory names.
+func ValidName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, "/\\\x00")
+}
+
+// HomeDir returns the virtual home directory of a user.
+func HomeDir(user string) string {
+	if user == "" {
+		user = DefaultUser
+	}
+	return path.Join(HomeRoot, user)
+}
+
+// VirtualPath returns the client-facing absolute path for a storage key.
+func VirtualPath(key string) string {
+	return "/" + strings.Trim(key, "/")
+}
+
+// Resolve normalizes a client-supplied path and checks that user may access
+// it. Relative paths are taken from the user's home directory; absolute paths
+// must land in that home, in a mount or on something shared with the user,
+// either through an ACL grant or as ShareRoot/<token> through a share link.
+// It returns the storage key and, for paths in a mount, the mount so callers
+// can check its app permission.
+func (vfs *VFSModule) Resolve(user, p string, write bool) (string, *Mount, error) {
+	if !ValidName(user) {
+		return "", nil, fmt.Errorf("invalid user id: %q", user)
+	}
+	if strings.ContainsAny(p, "\\\x00") {
+		return "", nil, fmt.Errorf("invalid path: %q", p)
+	}
+
+	home := HomeDir(user)
+	var clean string
+	if strings.HasPrefix(p, "/") {
+		clean = path.Clean(p)
+	} else {
+		// Joining before cleaning lets ".." climb out of the home, which the
+		// checks below then reject like any other absolute path.
+		clean = path.Join(home, p)
+	}
+
+	if clean == home || strings.HasPrefix(clean, home+"/") {
+		return strings.TrimPrefix(clean, "/"), nil, nil
+	}
+	if clean == ShareRoot || strings.HasPrefix(clean, ShareRoot+"/") {
+		key, err := vfs.resolveShareLink(clean, write)
+		if err != nil {
+			return "", nil, err
+		}
+		m, err := vfs.mountFor(key, write)
+		if err != nil {
+			return "", nil, err
+		}
+		return key, m, nil
+	}
+
+	key := strings.TrimPrefix(clean, "/")
+	if m, err := vfs.mountFor(key, write); err != nil {
+		return "", nil, err
+	} else if m != nil {
+		return key, m, nil
+	}
+
+	need := AccessRead
+	if write {
+		need = AccessWrite
+	}
+	if accessRank(vfs.Access(user, key)) >= accessRank(need) {
+		return key, nil, nil
+	}
+	return "", nil, fmt.Errorf("permission denied: %s is outside your home directory", clean)
+}
+
+// ResolveForApp is Resolve for a request made through app. Paths in a mount
+// that requires a permission are refused unless permissions grants it to
+// app; with nil permissions, for clients that act without an app, they are
+// always refused.
+func (vfs *VFSModule) ResolveForApp(permissions *PermissionManager, app, user, p string, write bool) (string, error) {
+	key, mount, err := vfs.Resolve(user, p, write)
+	if err != nil {
+		return "", err
+	}
+	if mount == nil || mount.Permission == "" {
+		return key, nil
+	}
+	if permissions == nil {
+		return "", fmt.Errorf("permission denied: %s requires the %s permission", mount.Path, mount.Permission)
+	}
+	if !permissions.HasPermission(app, mount.Permission) {
+		return "", fmt.Errorf("Permission denied: app '%s' requires '%s' for %s", app, mount.Permission, mount.Path)
+	}
+	return key, nil
+}
+
+// mountFor returns the mount granting access to the storage key name, or nil
+// if it is not in one, checking that a write is allowed there.
+func (vfs *VFSModule) mountFor(name string, write bool) (*Mount, error) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	for i := range vfs.mounts {
+		m := vfs.mounts[i]
+		// Homes are only reachable by their owner or through grants.
+		if m.Path == HomeRoot {
+			continue
+		}
+		if !m.contains(name) {
+			continue
+		}
+		if write && m.ReadOnly {
+			return nil, fmt.Errorf("permission denied: %s is read-only", m.Path)
+		}
+		return &m, nil
+	}
+	return nil, nil
+}
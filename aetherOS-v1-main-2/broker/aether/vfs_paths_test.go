@@ -0,0 +1,101 @@
+package aether
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolve(t *testing.T) {
+	vfs := newTestVFS(t)
+	writeFiles(t, vfs, map[string]string{
+		"home/alice/docs/plan.txt": "plan",
+		"home/bob/secret.txt":      "secret",
+	})
+	if _, err := vfs.Share("alice", "home/alice/docs", Grant{User: "bob", Access: AccessRead}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		user  string
+		path  string
+		write bool
+		want  string // Storage key, or "" if the path is refused.
+	}{
+		{"relative", "alice", "docs/plan.txt", true, "home/alice/docs/plan.txt"},
+		{"home itself", "alice", "", false, "home/alice"},
+		{"absolute in home", "alice", "/home/alice/notes.txt", true, "home/alice/notes.txt"},
+		{"dot segments in home", "alice", "./docs/../notes.txt", true, "home/alice/notes.txt"},
+		{"relative climb", "alice", "../bob/secret.txt", false, ""},
+		{"nested climb", "alice", "docs/../../bob/secret.txt", false, ""},
+		{"absolute climb", "alice", "/home/alice/../bob/secret.txt", false, ""},
+		{"other home", "alice", "/home/bob/secret.txt", false, ""},
+		{"home root", "alice", "/home", false, ""},
+		{"root", "alice", "/", false, ""},
+		{"outside mounts", "alice", "/etc/passwd", false, ""},
+		{"trash", "alice", "/.trash/bob", false, ""},
+		{"backslash", "alice", "docs\\..\\..\\bob", false, ""},
+		{"nul byte", "alice", "docs/plan.txt\x00", false, ""},
+		{"invalid user", "../bob", "secret.txt", false, ""},
+		{"empty user", "", "notes.txt", false, ""},
+		{"shared mount", "alice", "/shared/notes.txt", true, "shared/notes.txt"},
+		{"scratch mount", "alice", "/tmp/x", true, "tmp/x"},
+		{"read-only mount read", "alice", "/src/app/apps/notes/manifest.json", false, "src/app/apps/notes/manifest.json"},
+		{"read-only mount write", "alice", "/src/app/apps/notes/manifest.json", true, ""},
+		{"granted read", "bob", "/home/alice/docs/plan.txt", false, "home/alice/docs/plan.txt"},
+		{"granted read, write", "bob", "/home/alice/docs/plan.txt", true, ""},
+		{"outside grant", "bob", "/home/alice/notes.txt", false, ""},
+		{"climb out of grant", "bob", "/home/alice/docs/../notes.txt", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, _, err := vfs.Resolve(tt.user, tt.path, tt.write)
+			if tt.want == "" && err == nil {
+				t.Errorf("Resolve(%q, %q, %v) = %q, want it refused", tt.user, tt.path, tt.write, key)
+			}
+			if tt.want != "" && (err != nil || key != tt.want) {
+				t.Errorf("Resolve(%q, %q, %v) = %q, %v, want %q", tt.user, tt.path, tt.write, key, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestResolveForApp(t *testing.T) {
+	vfs := newTestVFS(t)
+	mounts := append([]Mount{{Path: "/secure", Permission: "secure_access"}}, DefaultMounts...)
+	if err := vfs.SetMounts(mounts); err != nil {
+		t.Fatal(err)
+	}
+	dir := t.TempDir()
+	manifest := `{"id": "vault", "permissions": {"secure_access": true}}`
+	if err := os.WriteFile(filepath.Join(dir, "manifest.json"), []byte(manifest), 0644); err != nil {
+		t.Fatal(err)
+	}
+	permissions := NewPermissionManager(dir)
+	if err := permissions.LoadManifests(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name        string
+		permissions *PermissionManager
+		app         string
+		path        string
+		ok          bool
+	}{
+		{"permitted app", permissions, "vault", "/secure/key", true},
+		{"other app", permissions, "notes", "/secure/key", false},
+		{"no app", nil, "rest", "/secure/key", false},
+		{"mount without permission", nil, "rest", "/shared/key", true},
+		{"jailing still applies", permissions, "vault", "/home/bob/key", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := vfs.ResolveForApp(tt.permissions, tt.app, "alice", tt.path, false)
+			if (err == nil) != tt.ok {
+				t.Errorf("ResolveForApp(%s, %s) = %v, want ok %v", tt.app, tt.path, err, tt.ok)
+			}
+		})
+	}
+}
@@ -0,0 +1,456 @@
+package aether
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"cloud.google.com/go/storage"
+)
+
+// Object metadata keys recording who an object's bytes are charged to. The
+// storage layer preserves metadata on copy, so ownership survives moves and
+// trips through the trash.
+const (
+	metaOwnerUser = "aether-user"
+	metaOwnerApp  = "aether-app"
+)
+
+// DefaultUsageThresholds are the quota fractions at which warnings are raised.
+var DefaultUsageThresholds = []float64{0.8, 0.95}
+
+// DefaultUserQuota applies to users without an explicit quota.
+var DefaultUserQuota = Quota{MaxBytes: 5 << 30, MaxObjects: 100000}
+
+// Usage is a count of bytes and objects.
+type Usage struct {
+	Bytes   int64 `json:"bytes"`
+	Objects int64 `json:"objects"`
+}
+
+// Quota limits usage. Zero fields are unlimited.
+type Quota struct {
+	MaxBytes   int64 `json:"maxBytes,omitempty"`
+	MaxObjects int64 `json:"maxObjects,omitempty"`
+}
+
+// DirUsage is the recursive usage of a directory.
+type DirUsage struct {
+	Path string `json:"path"`
+	Usage
+}
+
+// QuotaWarning is raised when a write pushes a user or app past a threshold.
+type QuotaWarning struct {
+	Kind      string  `json:"kind"` // "user" or "app"
+	ID        string  `json:"id"`
+	Usage     Usage   `json:"usage"`
+	Quota     Quota   `json:"quota"`
+	Threshold float64 `json:"threshold"`
+}
+
+// QuotaError is returned when a write would exceed a quota.
+type QuotaError struct {
+	Kind  string
+	ID    string
+	Usage Usage
+	Quota Quota
+}
+
+func (e *QuotaError) Error() string {
+	return fmt.Sprintf("quota exceeded for %s '%s': %d bytes in %d objects (limit %d bytes, %d objects)",
+		e.Kind, e.ID, e.Usage.Bytes, e.Usage.Objects, e.Quota.MaxBytes, e.Quota.MaxObjects)
+}
+
+// objectOwner returns the user and app an object is charged to.
+func objectOwner(attrs *storage.ObjectAttrs) (user, app string) {
+	if attrs == nil || attrs.Metadata == nil {
+		return "", ""
+	}
+	return attrs.Metadata[metaOwnerUser], attrs.Metadata[metaOwnerApp]
+}
+
+// usageIndex keeps running usage totals per directory, owner user and owner
+// app. It is built by a single scan the first time it is needed and then
+// updated incrementally by every object-level mutation.
+type usageIndex struct {
+	mu     sync.Mutex
+	loaded bool
+	dirs   map[string]*Usage
+	users  map[string]*Usage
+	apps   map[string]*Usage
+
+	defaultQuota Quota // For users without an entry in userQuotas.
+	userQuotas   map[string]Quota
+	appQuotas    map[string]Quota
+	thresholds   []float64
+
+	warningsMu sync.RWMutex
+	warnings   []func(QuotaWarning)
+}
+
+func newUsageIndex() *usageIndex {
+	return &usageIndex{
+		dirs:         make(map[string]*Usage),
+		users:        make(map[string]*Usage),
+		apps:         make(map[string]*Usage),
+		defaultQuota: DefaultUserQuota,
+		userQuotas:   make(map[string]Quota),
+		appQuotas:    make(map[string]Quota),
+		thresholds:   DefaultUsageThresholds,
+	}
+}
+
+func addUsage(m map[string]*Usage, key string, bytes, objects int64) {
+	u, ok := m[key]
+	if !ok {
+		u = &Usage{}
+		m[key] = u
+	}
+	u.Bytes += bytes
+	u.Objects += objects
+	if u.Bytes <= 0 && u.Objects <= 0 {
+		delete(m, key)
+	}
+}
+
+// apply records a change of bytes and objects for an object. Callers must hold u.mu.
+func (u *usageIndex) apply(name, user, app string, bytes, objects int64) {
+	if !u.loaded {
+		return // The initial scan will pick the object up.
+	}
+	for dir := path.Dir(strings.Trim(name, "/")); ; dir = path.Dir(dir) {
+		if dir == "." {
+			dir = ""
+		}
+		addUsage(u.dirs, dir, bytes, objects)
+		if dir == "" {
+			break
+		}
+	}
+	if user != "" {
+		addUsage(u.users, user, bytes, objects)
+	}
+	if app != "" {
+		addUsage(u.apps, app, bytes, objects)
+	}
+}
+
+// ensureUsage builds the usage index with one full scan if it has not been
+// built yet. Callers must hold vfs.mu.
+func (vfs *VFSModule) ensureUsage(ctx context.Context) error {
+	vfs.usage.mu.Lock()
+	loaded := vfs.usage.loaded
+	vfs.usage.mu.Unlock()
+	if loaded {
+		return nil
+	}
+
+	objects, err := vfs.listObjects(ctx, "")
+	if err != nil {
+		return fmt.Errorf("failed to build usage index: %w", err)
+	}
+
+	vfs.usage.mu.Lock()
+	defer vfs.usage.mu.Unlock()
+	if vfs.usage.loaded {
+		return nil
+	}
+	vfs.usage.loaded = true
+	for _, attrs := range objects {
+		user, app := objectOwner(attrs)
+		vfs.usage.apply(attrs.Name, user, app, attrs.Size, 1)
+	}
+	log.Printf("VFS usage index built from %d objects", len(objects))
+	return nil
+}
+
+// recordUsage updates the usage index for an object-level change. prev holds
+// the object's previous attributes, or nil if it did not exist; exists reports
+// whether the object is present afterwards, owned as given and of nextSize bytes.
+func (vfs *VFSModule) recordUsage(name string, prev *storage.ObjectAttrs, nextUser, nextApp string, nextSize int64, exists bool) {
+	vfs.usage.mu.Lock()
+	defer vfs.usage.mu.Unlock()
+	if prev != nil {
+		user, app := objectOwner(prev)
+		vfs.usage.apply(name, user, app, -prev.Size, -1)
+	}
+	if exists {
+		vfs.usage.apply(name, nextUser, nextApp, nextSize, 1)
+	}
+}
+
+// checkQuota reports an error if writing size bytes to an object currently in
+// state prev would push the writer's user or app over quota, and raises
+// warnings for any thresholds crossed. Callers must hold vfs.mu.
+func (vfs *VFSModule) checkQuota(ctx context.Context, prev *storage.ObjectAttrs, opts WriteOptions, size int64) error {
+	if opts.User == "" && opts.App == "" {
+		return nil // System writes are exempt.
+	}
+	if err := vfs.ensureUsage(ctx); err != nil {
+		return err
+	}
+
+	prevUser, prevApp := objectOwner(prev)
+	var warnings []QuotaWarning
+
+	vfs.usage.mu.Lock()
+	check := func(kind, id, prevOwner string, totals map[string]*Usage, quota Quota) error {
+		if id == "" {
+			return nil
+		}
+		var current Usage
+		if u, ok := totals[id]; ok {
+			current = *u
+		}
+		next := current
+		next.Bytes += size
+		next.Objects++
+		if prev != nil && prevOwner == id {
+			next.Bytes -= prev.Size
+			next.Objects--
+		}
+		if next.Bytes <= current.Bytes && next.Objects <= current.Objects {
+			return nil // Shrinking writes are always allowed.
+		}
+		if (quota.MaxBytes > 0 && next.Bytes > quota.MaxBytes) || (quota.MaxObjects > 0 && next.Objects > quota.MaxObjects) {
+			return &QuotaError{Kind: kind, ID: id, Usage: current, Quota: quota}
+		}
+		for _, t := range vfs.usage.thresholds {
+			if crossed(current, next, quota, t) {
+				warnings = append(warnings, QuotaWarning{Kind: kind, ID: id, Usage: next, Quota: quota, Threshold: t})
+			}
+		}
+		return nil
+	}
+	err := check("user", opts.User, prevUser, vfs.usage.users, vfs.usage.userQuota(opts.User))
+	if err == nil {
+		err = check("app", opts.App, prevApp, vfs.usage.apps, vfs.usage.appQuotas[opts.App])
+	}
+	vfs.usage.mu.Unlock()
+
+	if err != nil {
+		return err
+	}
+	for _, w := range warnings {
+		vfs.usage.notify(w)
+	}
+	return nil
+}
+
+// crossed reports whether going from current to next usage passes threshold t
+// of either quota limit.
+func crossed(current, next Usage, quota Quota, t float64) bool {
+	if quota.MaxBytes > 0 {
+		limit := int64(float64(quota.MaxBytes) * t)
+		if current.Bytes < limit && next.Bytes >= limit {
+			return true
+		}
+	}
+	if quota.MaxObjects > 0 {
+		limit := int64(float64(quota.MaxObjects) * t)
+		if current.Objects < limit && next.Objects >= limit {
+			return true
+		}
+	}
+	return false
+}
+
+// userQuota returns the quota for a user. Callers must hold u.mu.
+func (u *usageIndex) userQuota(user string) Quota {
+	if q, ok := u.userQuotas[user]; ok {
+		return q
+	}
+	return u.defaultQuota
+}
+
+func (u *usageIndex) notify(w QuotaWarning) {
+	u.warningsMu.RLock()
+	defer u.warningsMu.RUnlock()
+	for _, listener := range u.warnings {
+		go listener(w)
+	}
+}
+
+// OnQuotaWarning registers a listener for usage threshold warnings.
+func (vfs *VFSModule) OnQuotaWarning(listener func(QuotaWarning)) {
+	vfs.usage.warningsMu.Lock()
+	defer vfs.usage.warningsMu.Unlock()
+	vfs.usage.warnings = append(vfs.usage.warnings, listener)
+}
+
+// SetUserQuota sets the quota for a user, overriding the default user quota.
+func (vfs *VFSModule) SetUserQuota(user string, quota Quota) {
+	vfs.usage.mu.Lock()
+	defer vfs.usage.mu.Unlock()
+	vfs.usage.userQuotas[user] = quota
+}
+
+// SetDefaultUserQuota sets the quota for users without one of their own,
+// DefaultUserQuota unless set.
+func (vfs *VFSModule) SetDefaultUserQuota(quota Quota) {
+	vfs.usage.mu.Lock()
+	defer vfs.usage.mu.Unlock()
+	vfs.usage.defaultQuota = quota
+}
+
+// SetAppQuota sets the quota for everything written by an app. Apps without
+// a quota are limited only by their users' quotas.
+func (vfs *VFSModule) SetAppQuota(app string, quota Quota) {
+	vfs.usage.mu.Lock()
+	defer vfs.usage.mu.Unlock()
+	vfs.usage.appQuotas[app] = quota
+}
+
+// SetUsageThresholds sets the quota fractions, such as 0.8, at which warnings are raised.
+func (vfs *VFSModule) SetUsageThresholds(thresholds []float64) {
+	vfs.usage.mu.Lock()
+	defer vfs.usage.mu.Unlock()
+	vfs.usage.thresholds = append([]float64(nil), thresholds...)
+}
+
+// QuotaConfig holds quota settings in their textual form, as read from the
+// environment. Empty fields keep the defaults.
+type QuotaConfig struct {
+	DefaultUser string // A quota, as ParseQuota accepts.
+	Users       string // Comma-separated "id=quota" pairs.
+	Apps        string // Comma-separated "id=quota" pairs.
+	Thresholds  string // Comma-separated fractions, such as "0.8,0.95".
+}
+
+// ConfigureQuotas applies the quotas and warning thresholds in config.
+func (vfs *VFSModule) ConfigureQuotas(config QuotaConfig) error {
+	if config.DefaultUser != "" {
+		quota, err := ParseQuota(config.DefaultUser)
+		if err != nil {
+			return fmt.Errorf("default user quota: %w", err)
+		}
+		vfs.SetDefaultUserQuota(quota)
+	}
+	users, err := parseQuotaList(config.Users)
+	if err != nil {
+		return fmt.Errorf("user quotas: %w", err)
+	}
+	apps, err := parseQuotaList(config.Apps)
+	if err != nil {
+		return fmt.Errorf("app quotas: %w", err)
+	}
+	for user, quota := range users {
+		vfs.SetUserQuota(user, quota)
+	}
+	for app, quota := range apps {
+		vfs.SetAppQuota(app, quota)
+	}
+	if config.Thresholds != "" {
+		var thresholds []float64
+		for _, field := range strings.Split(config.Thresholds, ",") {
+			t, err := strconv.ParseFloat(strings.TrimSpace(field), 64)
+			if err != nil || t <= 0 || t > 1 {
+				return fmt.Errorf("invalid usage threshold %q: want a fraction in (0, 1]", field)
+			}
+			thresholds = append(thresholds, t)
+		}
+		vfs.SetUsageThresholds(thresholds)
+	}
+	return nil
+}
+
+// ParseQuota parses a quota written as "bytes" or "bytes/objects", where
+// bytes may end in K, M, G or T for binary multiples and either limit may
+// be 0 for none. For example, "5G/100000".
+func ParseQuota(s string) (Quota, error) {
+	bytesPart, objectsPart, hasObjects := strings.Cut(strings.TrimSpace(s), "/")
+	var quota Quota
+	multiplier := int64(1)
+	if n := len(bytesPart); n > 0 {
+		if shift := strings.IndexByte("KMGT", bytesPart[n-1]); shift >= 0 {
+			multiplier = 1 << (10 * (shift + 1))
+			bytesPart = bytesPart[:n-1]
+		}
+	}
+	b, err := strconv.ParseInt(bytesPart, 10, 64)
+	if err != nil || b < 0 {
+		return Quota{}, fmt.Errorf("invalid quota %q: bad byte limit", s)
+	}
+	quota.MaxBytes = b * multiplier
+	if hasObjects {
+		o, err := strconv.ParseInt(objectsPart, 10, 64)
+		if err != nil || o < 0 {
+			return Quota{}, fmt.Errorf("invalid quota %q: bad object limit", s)
+		}
+		quota.MaxObjects = o
+	}
+	return quota, nil
+}
+
+// parseQuotaList parses comma-separated "id=quota" pairs.
+func parseQuotaList(s string) (map[string]Quota, error) {
+	quotas := make(map[string]Quota)
+	if strings.TrimSpace(s) == "" {
+		return quotas, nil
+	}
+	for _, pair := range strings.Split(s, ",") {
+		id, value, ok := strings.Cut(pair, "=")
+		id = strings.TrimSpace(id)
+		if !ok || !ValidName(id) {
+			return nil, fmt.Errorf("invalid entry %q: want id=quota", pair)
+		}
+		quota, err := ParseQuota(value)
+		if err != nil {
+			return nil, err
+		}
+		quotas[id] = quota
+	}
+	return quotas, nil
+}
+
+// UsageReport describes storage consumption under a directory and for a user.
+type UsageReport struct {
+	Path      string      `json:"path"`
+	Usage     Usage       `json:"usage"`
+	Children  []*DirUsage `json:"children"`
+	User      string      `json:"user"`
+	UserUsage Usage       `json:"userUsage"`
+	UserQuota Quota       `json:"userQuota"`
+}
+
+// Usage reports the recursive usage of the directory at dir, broken down by
+// its immediate subdirectories, along with the user's totals and quota.
+func (vfs *VFSModule) Usage(user, dir string) (*UsageReport, error) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	if err := vfs.ensureUsage(context.Background()); err != nil {
+		return nil, err
+	}
+
+	dir = strings.Trim(dir, "/")
+	report := &UsageReport{Path: VirtualPath(dir), User: user, Children: make([]*DirUsage, 0)}
+
+	vfs.usage.mu.Lock()
+	defer vfs.usage.mu.Unlock()
+	if u, ok := vfs.usage.dirs[dir]; ok {
+		report.Usage = *u
+	}
+	for name, u := range vfs.usage.dirs {
+		parent := path.Dir(name)
+		if parent == "." {
+			parent = ""
+		}
+		if name != "" && parent == dir {
+			report.Children = append(report.Children, &DirUsage{Path: VirtualPath(name), Usage: *u})
+		}
+	}
+	sort.Slice(report.Children, func(i, j int) bool {
+		return report.Children[i].Bytes > report.Children[j].Bytes
+	})
+	if u, ok := vfs.usage.users[user]; ok {
+		report.UserUsage = *u
+	}
+	report.UserQuota = vfs.usage.userQuota(user)
+	return report, nil
+}
@@ -0,0 +1,120 @@
+package aether
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseQuota(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Quota
+		wantErr bool
+	}{
+		{"1024", Quota{MaxBytes: 1024}, false},
+		{"5G/100000", Quota{MaxBytes: 5 << 30, MaxObjects: 100000}, false},
+		{"10K", Quota{MaxBytes: 10 << 10}, false},
+		{" 2M/0 ", Quota{MaxBytes: 2 << 20}, false},
+		{"0/10", Quota{MaxObjects: 10}, false},
+		{"", Quota{}, true},
+		{"G", Quota{}, true},
+		{"-1", Quota{}, true},
+		{"1X", Quota{}, true},
+		{"1G/many", Quota{}, true},
+	}
+	for _, tt := range tests {
+		got, err := ParseQuota(tt.in)
+		if (err != nil) != tt.wantErr || got != tt.want {
+			t.Errorf("ParseQuota(%q) = %+v, %v, want %+v (error %v)", tt.in, got, err, tt.want, tt.wantErr)
+		}
+	}
+}
+
+func TestConfigureQuotas(t *testing.T) {
+	tests := []struct {
+		name   string
+		config QuotaConfig
+		ok     bool
+	}{
+		{"empty", QuotaConfig{}, true},
+		{"all set", QuotaConfig{DefaultUser: "1G", Users: "alice=2G, bob=1M/10", Apps: "notes=10K", Thresholds: "0.5, 0.9"}, true},
+		{"bad default", QuotaConfig{DefaultUser: "lots"}, false},
+		{"missing id", QuotaConfig{Users: "=1G"}, false},
+		{"bad id", QuotaConfig{Apps: "../x=1G"}, false},
+		{"missing quota", QuotaConfig{Apps: "notes"}, false},
+		{"threshold too high", QuotaConfig{Thresholds: "1.5"}, false},
+		{"threshold not a number", QuotaConfig{Thresholds: "half"}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := newTestVFS(t).ConfigureQuotas(tt.config)
+			if (err == nil) != tt.ok {
+				t.Errorf("ConfigureQuotas(%+v) = %v, want ok %v", tt.config, err, tt.ok)
+			}
+		})
+	}
+}
+
+func TestQuotaEnforcement(t *testing.T) {
+	vfs := newTestVFS(t)
+	if err := vfs.ConfigureQuotas(QuotaConfig{DefaultUser: "100", Users: "bob=0", Apps: "notes=10/2"}); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name string
+		path string
+		size int
+		opts WriteOptions
+		kind string // Kind of the quota exceeded, or "" if the write is allowed.
+	}{
+		{"within quotas", "home/alice/a.txt", 8, WriteOptions{User: "alice", App: "notes"}, ""},
+		{"app over bytes", "home/alice/b.txt", 8, WriteOptions{User: "alice", App: "notes"}, "app"},
+		{"other app", "home/alice/b.txt", 8, WriteOptions{User: "alice", App: "files"}, ""},
+		{"app rewrites its file", "home/alice/a.txt", 10, WriteOptions{User: "alice", App: "notes"}, ""},
+		{"app fills its object quota", "home/alice/c.txt", 0, WriteOptions{User: "alice", App: "notes"}, ""},
+		{"app over objects", "home/alice/d.txt", 0, WriteOptions{User: "alice", App: "notes"}, "app"},
+		{"user over default quota", "home/alice/big.txt", 100, WriteOptions{User: "alice"}, "user"},
+		{"unlimited user", "home/bob/big.txt", 1000, WriteOptions{User: "bob", App: "files"}, ""},
+		{"system write", "home/alice/sys.txt", 1000, WriteOptions{}, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := vfs.WriteWithOptions(tt.path, make([]byte, tt.size), tt.opts)
+			var quotaErr *QuotaError
+			switch {
+			case tt.kind == "" && err != nil:
+				t.Fatalf("write refused: %v", err)
+			case tt.kind != "" && !errors.As(err, &quotaErr):
+				t.Fatalf("err = %v, want a QuotaError", err)
+			case tt.kind != "" && quotaErr.Kind != tt.kind:
+				t.Errorf("exceeded %s quota, want %s", quotaErr.Kind, tt.kind)
+			}
+		})
+	}
+}
+
+func TestQuotaWarnings(t *testing.T) {
+	vfs := newTestVFS(t)
+	if err := vfs.ConfigureQuotas(QuotaConfig{DefaultUser: "100", Thresholds: "0.5"}); err != nil {
+		t.Fatal(err)
+	}
+	warnings := make(chan QuotaWarning, 4)
+	vfs.OnQuotaWarning(func(w QuotaWarning) { warnings <- w })
+
+	opts := WriteOptions{User: "alice"}
+	for _, name := range []string{"a", "b", "c"} {
+		if _, err := vfs.WriteWithOptions("home/alice/"+name, make([]byte, 30), opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := <-warnings
+	if w.Kind != "user" || w.ID != "alice" || w.Threshold != 0.5 || w.Usage.Bytes != 60 {
+		t.Errorf("warning = %+v, want alice passing 0.5 at 60 bytes", w)
+	}
+	select {
+	case w := <-warnings:
+		t.Errorf("unexpected second warning %+v", w)
+	default:
+	}
+}
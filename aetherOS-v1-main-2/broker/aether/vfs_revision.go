@@ -0,0 +1,98 @@
+package aether
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"cloud.google.com/go/storage"
+	"google.golang.org/api/googleapi"
+)
+
+// NoRevision is the revision of a file that does not exist. Passing it as
+// WriteOptions.IfMatch makes a write succeed only if it creates the file.
+const NoRevision = "0"
+
+// ConflictError is returned when a conditional write, delete or move finds
+// the file at a different revision than the caller expected.
+type ConflictError struct {
+	Path             string // Absolute virtual path.
+	ExpectedRevision string
+	CurrentRevision  string // NoRevision if the file no longer exists.
+}
+
+func (e *ConflictError) Error() string {
+	if e.CurrentRevision == NoRevision {
+		return fmt.Sprintf("conflict: %s no longer exists (expected revision %s)", e.Path, e.ExpectedRevision)
+	}
+	return fmt.Sprintf("conflict: %s is at revision %s, expected %s", e.Path, e.CurrentRevision, e.ExpectedRevision)
+}
+
+// Revision returns the revision token for an object: its storage generation,
+// which changes on every write. Folders have no revision.
+func Revision(attrs *storage.ObjectAttrs) string {
+	if attrs == nil {
+		return NoRevision
+	}
+	return strconv.FormatInt(attrs.Generation, 10)
+}
+
+// revisionConditions returns the storage preconditions that make a write fail
+// if the object has changed since prev was read.
+func revisionConditions(prev *storage.ObjectAttrs) storage.Conditions {
+	if prev == nil {
+		return storage.Conditions{DoesNotExist: true}
+	}
+	return storage.Conditions{GenerationMatch: prev.Generation}
+}
+
+// isPreconditionFailed reports whether a storage error means a precondition did not hold.
+func isPreconditionFailed(err error) bool {
+	var apiErr *googleapi.Error
+	return errors.As(err, &apiErr) && apiErr.Code == http.StatusPreconditionFailed
+}
+
+// matchRevision checks that the file at name is at revision ifMatch, which
+// may be empty to skip the check. Callers must hold vfs.mu.
+func (vfs *VFSModule) matchRevision(ctx context.Context, name, ifMatch string) error {
+	if ifMatch == "" {
+		return nil
+	}
+	attrs, err := vfs.statObject(ctx, name)
+	if err != nil {
+		return err
+	}
+	if current := Revision(attrs); current != ifMatch {
+		return &ConflictError{Path: VirtualPath(name), ExpectedRevision: ifMatch, CurrentRevision: current}
+	}
+	return nil
+}
+
+// Stat returns information about a file or folder, including the revision of
+// a file.
+func (vfs *VFSModule) Stat(p string) (*FileInfo, error) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+
+	objects, isDir, err := vfs.matchObjects(context.Background(), p)
+	if err != nil {
+		return nil, err
+	}
+	if !isDir {
+		return objectFileInfo(objects[0]), nil
+	}
+
+	// Folders report their total size and the time of their newest object.
+	info := &FileInfo{Name: path.Base(strings.Trim(p, "/")), IsDir: true, Path: VirtualPath(p)}
+	for _, attrs := range objects {
+		info.Size += attrs.Size
+		if attrs.Updated.After(info.ModTime) {
+			info.ModTime = attrs.Updated
+		}
+	}
+	return info, nil
+}
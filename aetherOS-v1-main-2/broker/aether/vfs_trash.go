@@ -0,0 +1,287 @@
+package aether
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"cloud.google.com/go/storage"
+	"github.com/google/uuid"
+)
+
+const (
+	// trashDirName is the top-level folder holding every user's trash.
+	trashDirName = ".trash"
+	// trashInfoName is the metadata object stored alongside each trashed item.
+	trashInfoName = "info.json"
+	// trashDataDir is the folder under a trash entry that holds the moved objects.
+	trashDataDir = "data"
+
+	// DefaultTrashRetention is how long trashed items are kept before being purged.
+	DefaultTrashRetention = 30 * 24 * time.Hour
+)
+
+// TrashEntry describes a deleted file or folder waiting in a user's trash.
+type TrashEntry struct {
+	ID           string    `json:"id"`
+	Name         string    `json:"name"`
+	OriginalPath string    `json:"originalPath"`
+	IsDir        bool      `json:"isDir"`
+	Size         int64     `json:"size"`
+	ObjectCount  int       `json:"objectCount"`
+	DeletedAt    time.Time `json:"deletedAt"`
+}
+
+// trashRoot returns the storage prefix for a user's trash, without a trailing slash.
+func trashRoot(user string) string {
+	if user == "" {
+		user = DefaultUser
+	}
+	return path.Join(trashDirName, user)
+}
+
+// SetTrashRetention changes how long trashed items are kept. A zero or negative
+// duration disables retention-based purging.
+func (vfs *VFSModule) SetTrashRetention(retention time.Duration) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	vfs.trashRetention = retention
+}
+
+// moveToTrash relocates the file or folder at p into the user's trash and
+// records its original location. If it fails part way, the partially filled
+// entry is returned with the error so the move can be undone. Callers must hold vfs.mu.
+func (vfs *VFSModule) moveToTrash(ctx context.Context, user, p string) (*TrashEntry, error) {
+	cleanPath := strings.Trim(p, "/")
+	if cleanPath == trashDirName || strings.HasPrefix(cleanPath, trashDirName+"/") {
+		return nil, fmt.Errorf("cannot delete items inside the trash; empty it instead")
+	}
+	objects, isDir, err := vfs.matchObjects(ctx, cleanPath)
+	if err != nil {
+		return nil, err
+	}
+
+	entry := &TrashEntry{
+		ID:           uuid.New().String(),
+		Name:         path.Base(cleanPath),
+		OriginalPath: VirtualPath(cleanPath),
+		IsDir:        isDir,
+		DeletedAt:    time.Now(),
+	}
+	entryRoot := path.Join(trashRoot(user), entry.ID)
+
+	// Write the metadata first so a partially moved entry can still be restored.
+	if err := vfs.writeTrashInfo(ctx, entryRoot, entry); err != nil {
+		return nil, err
+	}
+
+	for _, attrs := range objects {
+		dst := path.Join(entryRoot, trashDataDir) + strings.TrimPrefix(attrs.Name, cleanPath)
+		if err := vfs.moveObject(ctx, attrs, dst); err != nil {
+			return entry, err
+		}
+		entry.Size += attrs.Size
+		entry.ObjectCount++
+	}
+	vfs.trashACL(entryRoot, cleanPath)
+
+	if err := vfs.writeTrashInfo(ctx, entryRoot, entry); err != nil {
+		return entry, err
+	}
+	return entry, nil
+}
+
+func (vfs *VFSModule) writeTrashInfo(ctx context.Context, entryRoot string, entry *TrashEntry) error {
+	info, err := json.Marshal(entry)
+	if err != nil {
+		return fmt.Errorf("failed to encode trash metadata: %w", err)
+	}
+	_, _, err = vfs.writeObject(ctx, path.Join(entryRoot, trashInfoName), info, WriteOptions{})
+	return err
+}
+
+// ListTrash returns the items in a user's trash, most recently deleted first.
+func (vfs *VFSModule) ListTrash(user string) ([]*TrashEntry, error) {
+	vfs.mu.RLock()
+	defer vfs.mu.RUnlock()
+	return vfs.listTrash(context.Background(), user)
+}
+
+func (vfs *VFSModule) listTrash(ctx context.Context, user string) ([]*TrashEntry, error) {
+	objects, err := vfs.listObjects(ctx, trashRoot(user)+"/")
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*TrashEntry, 0)
+	for _, attrs := range objects {
+		if path.Base(attrs.Name) != trashInfoName || path.Dir(path.Dir(attrs.Name)) != trashRoot(user) {
+			continue
+		}
+		data, err := vfs.readObject(ctx, attrs.Name)
+		if err != nil {
+			log.Printf("failed to read trash metadata %s: %v", attrs.Name, err)
+			continue
+		}
+		var entry TrashEntry
+		if err := json.Unmarshal(data, &entry); err != nil {
+			log.Printf("failed to parse trash metadata %s: %v", attrs.Name, err)
+			continue
+		}
+		entries = append(entries, &entry)
+	}
+
+	sort.Slice(entries, func(i, j int) bool {
+		return entries[i].DeletedAt.After(entries[j].DeletedAt)
+	})
+	return entries, nil
+}
+
+// RestoreTrash moves a trashed item back to its original path. It fails if
+// anything now exists at that path, rather than overwriting it.
+func (vfs *VFSModule) RestoreTrash(user, id string) (*TrashEntry, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	ctx := context.Background()
+
+	if id == "" || strings.Contains(id, "/") {
+		return nil, fmt.Errorf("invalid trash entry id: %q", id)
+	}
+	entryRoot := path.Join(trashRoot(user), id)
+	data, err := vfs.readObject(ctx, path.Join(entryRoot, trashInfoName))
+	if err != nil {
+		return nil, fmt.Errorf("trash entry not found: %s", id)
+	}
+	var entry TrashEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, fmt.Errorf("failed to parse trash metadata for %s: %w", id, err)
+	}
+
+	if existing, _, err := vfs.matchObjects(ctx, entry.OriginalPath); err == nil && len(existing) > 0 {
+		return nil, fmt.Errorf("cannot restore %s: path %w", entry.OriginalPath, ErrExist)
+	}
+
+	if err := vfs.untrash(ctx, user, &entry); err != nil {
+		return nil, err
+	}
+	vfs.emit(ChangeCreated, entry.OriginalPath, entry.IsDir, entry.Size)
+	return &entry, nil
+}
+
+// untrash moves the objects of a trash entry back to its original path and
+// removes the entry. It does not check the original path first, so it can
+// also put back a folder that was only partly trashed. Callers must hold vfs.mu.
+func (vfs *VFSModule) untrash(ctx context.Context, user string, entry *TrashEntry) error {
+	entryRoot := path.Join(trashRoot(user), entry.ID)
+	dataRoot := path.Join(entryRoot, trashDataDir)
+	objects, err := vfs.listObjects(ctx, dataRoot)
+	if err != nil {
+		return err
+	}
+	for _, attrs := range objects {
+		rel := strings.TrimPrefix(attrs.Name, dataRoot)
+		if rel != "" && !strings.HasPrefix(rel, "/") {
+			continue // A sibling such as "data-x", not part of this entry.
+		}
+		if err := vfs.moveObject(ctx, attrs, strings.Trim(entry.OriginalPath, "/")+rel); err != nil {
+			return err
+		}
+	}
+	vfs.untrashACL(entryRoot)
+	return vfs.deletePrefix(ctx, entryRoot+"/")
+}
+
+// EmptyTrash permanently removes items from a user's trash. When ids is empty
+// the whole trash is emptied. It returns the number of entries removed.
+func (vfs *VFSModule) EmptyTrash(user string, ids []string) (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	ctx := context.Background()
+
+	if len(ids) == 0 {
+		entries, err := vfs.listTrash(ctx, user)
+		if err != nil {
+			return 0, err
+		}
+		if err := vfs.deletePrefix(ctx, trashRoot(user)+"/"); err != nil {
+			return 0, err
+		}
+		vfs.purgeTrashACL(trashRoot(user))
+		return len(entries), nil
+	}
+
+	for _, id := range ids {
+		if id == "" || strings.Contains(id, "/") {
+			return 0, fmt.Errorf("invalid trash entry id: %q", id)
+		}
+		if err := vfs.deletePrefix(ctx, path.Join(trashRoot(user), id)+"/"); err != nil {
+			return 0, err
+		}
+		vfs.purgeTrashACL(path.Join(trashRoot(user), id))
+	}
+	return len(ids), nil
+}
+
+// PurgeTrash permanently removes every trashed item, for all users, that has
+// been in the trash longer than the configured retention.
+func (vfs *VFSModule) PurgeTrash() (int, error) {
+	vfs.mu.Lock()
+	defer vfs.mu.Unlock()
+	ctx := context.Background()
+
+	if vfs.trashRetention <= 0 {
+		return 0, nil
+	}
+	cutoff := time.Now().Add(-vfs.trashRetention)
+
+	objects, err := vfs.listObjects(ctx, trashDirName+"/")
+	if err != nil {
+		return 0, err
+	}
+
+	purged := 0
+	for _, attrs := range objects {
+		// Metadata objects live at .trash/<user>/<id>/info.json.
+		parts := strings.Split(attrs.Name, "/")
+		if len(parts) != 4 || parts[3] != trashInfoName {
+			continue
+		}
+		data, err := vfs.readObject(ctx, attrs.Name)
+		if err != nil {
+			log.Printf("failed to read trash metadata %s: %v", attrs.Name, err)
+			continue
+		}
+		var entry TrashEntry
+		if err := json.Unmarshal(data, &entry); err != nil || entry.DeletedAt.After(cutoff) {
+			continue
+		}
+		if err := vfs.deletePrefix(ctx, path.Dir(attrs.Name)+"/"); err != nil {
+			log.Printf("failed to purge trash entry %s: %v", path.Dir(attrs.Name), err)
+			continue
+		}
+		vfs.purgeTrashACL(path.Dir(attrs.Name))
+		purged++
+	}
+	return purged, nil
+}
+
+// deletePrefix permanently removes every object under prefix. Callers must hold vfs.mu.
+func (vfs *VFSModule) deletePrefix(ctx context.Context, prefix string) error {
+	objects, err := vfs.listObjects(ctx, prefix)
+	if err != nil {
+		return err
+	}
+	for _, attrs := range objects {
+		backend, inner, _ := vfs.route(attrs.Name)
+		if err := backend.Delete(ctx, inner); err != nil && err != storage.ErrObjectNotExist {
+			return fmt.Errorf("failed to delete object %s: %w", attrs.Name, err)
+		}
+		vfs.recordUsage(attrs.Name, attrs, "", "", 0, false)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package aether
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestRestoreTrash(t *testing.T) {
+	const original = "a.txt=a dir/b.txt=b dir/sub/c.txt=c trash:0"
+
+	tests := []struct {
+		name    string
+		delete  string
+		before  func(t *testing.T, vfs *VFSModule)
+		user    string
+		id      func(id string) string
+		want    string
+		wantErr error // Restoring fails whenever want differs from original.
+	}{
+		{"file", "home/u/a.txt", nil, "u", nil, original, nil},
+		{"folder", "home/u/dir", nil, "u", nil, original, nil},
+		{"subfolder", "home/u/dir/sub", nil, "u", nil, original, nil},
+		{"path occupied", "home/u/a.txt", func(t *testing.T, vfs *VFSModule) {
+			writeFiles(t, vfs, map[string]string{"home/u/a.txt": "new"})
+		}, "u", nil, "a.txt=new dir/b.txt=b dir/sub/c.txt=c trash:1", ErrExist},
+		{"folder path occupied", "home/u/dir", func(t *testing.T, vfs *VFSModule) {
+			writeFiles(t, vfs, map[string]string{"home/u/dir/x.txt": "x"})
+		}, "u", nil, "a.txt=a dir/x.txt=x trash:1", ErrExist},
+		{"other user's entry", "home/u/a.txt", nil, "v", nil, "dir/b.txt=b dir/sub/c.txt=c trash:1", nil},
+		{"unknown id", "home/u/a.txt", nil, "u", func(string) string { return "missing" }, "dir/b.txt=b dir/sub/c.txt=c trash:1", nil},
+		{"id with path", "home/u/a.txt", nil, "v", func(id string) string { return "../u/" + id }, "dir/b.txt=b dir/sub/c.txt=c trash:1", nil},
+		{"empty id", "home/u/a.txt", nil, "u", func(string) string { return "" }, "dir/b.txt=b dir/sub/c.txt=c trash:1", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			writeFiles(t, vfs, map[string]string{"home/u/a.txt": "a", "home/u/dir/b.txt": "b", "home/u/dir/sub/c.txt": "c"})
+			entry, err := vfs.Delete(tt.delete, WriteOptions{User: "u"})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.before != nil {
+				tt.before(t, vfs)
+			}
+			id := entry.ID
+			if tt.id != nil {
+				id = tt.id(id)
+			}
+
+			restored, err := vfs.RestoreTrash(tt.user, id)
+			switch {
+			case tt.wantErr != nil && !errors.Is(err, tt.wantErr):
+				t.Errorf("RestoreTrash = %v, want %v", err, tt.wantErr)
+			case tt.want != original && err == nil:
+				t.Error("RestoreTrash succeeded, want an error")
+			case tt.want == original && err != nil:
+				t.Errorf("RestoreTrash = %v", err)
+			case err == nil && restored.OriginalPath != VirtualPath(tt.delete):
+				t.Errorf("restored %s, want %s", restored.OriginalPath, VirtualPath(tt.delete))
+			}
+			if got := tree(t, vfs, "home/u", "u"); got != tt.want {
+				t.Errorf("after restoring: %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEmptyTrash(t *testing.T) {
+	tests := []struct {
+		name    string
+		empty   func(vfs *VFSModule, ids []string) (int, error)
+		removed int
+		want    string
+	}{
+		{"by id", func(vfs *VFSModule, ids []string) (int, error) {
+			return vfs.EmptyTrash("u", ids[:1])
+		}, 1, "a.txt=a trash:1"},
+		{"all", func(vfs *VFSModule, ids []string) (int, error) {
+			return vfs.EmptyTrash("u", nil)
+		}, 2, "a.txt=a trash:0"},
+		{"invalid id", func(vfs *VFSModule, ids []string) (int, error) {
+			return vfs.EmptyTrash("u", []string{"../v"})
+		}, 0, "a.txt=a trash:2"},
+		{"purge expired", func(vfs *VFSModule, ids []string) (int, error) {
+			vfs.SetTrashRetention(time.Nanosecond)
+			time.Sleep(time.Millisecond)
+			return vfs.PurgeTrash()
+		}, 2, "a.txt=a trash:0"},
+		{"purge recent", func(vfs *VFSModule, ids []string) (int, error) {
+			vfs.SetTrashRetention(time.Hour)
+			return vfs.PurgeTrash()
+		}, 0, "a.txt=a trash:2"},
+		{"purge disabled", func(vfs *VFSModule, ids []string) (int, error) {
+			vfs.SetTrashRetention(0)
+			return vfs.PurgeTrash()
+		}, 0, "a.txt=a trash:2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			vfs := newTestVFS(t)
+			writeFiles(t, vfs, map[string]string{"home/u/a.txt": "a", "home/u/b.txt": "b", "home/u/dir/c.txt": "c"})
+			var ids []string
+			for _, p := range []string{"home/u/b.txt", "home/u/dir"} {
+				entry, err := vfs.Delete(p, WriteOptions{User: "u"})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, entry.ID)
+			}
+
+			removed, err := tt.empty(vfs, ids)
+			if tt.removed > 0 && err != nil {
+				t.Fatal(err)
+			}
+			if removed != tt.removed {
+				t.Errorf("removed %d entries, want %d", removed, tt.removed)
+			}
+			if got := tree(t, vfs, "home/u", "u"); got != tt.want {
+				t.Errorf("after emptying: %s, want %s", got, tt.want)
+			}
+			if _, err := vfs.RestoreTrash("u", ids[0]); (err == nil) != (tt.want == "a.txt=a trash:2") {
+				t.Errorf("restoring the first entry = %v", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,610 @@
+package compute
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"aether/broker/aether"
+	"github.com/tetratelabs/wazero"
+	experimentalsys "github.com/tetratelabs/wazero/experimental/sys"
+	"github.com/tetratelabs/wazero/experimental/sysfs"
+	"github.com/tetratelabs/wazero/sys"
+)
+
+// MaxGuestFileBuffer bounds the memory an instance's open files may hold.
+// Files opened for writing are held in broker memory until they are closed,
+// so together they may only hold this much; opening more, or growing them
+// further, fails. Files opened only for reading are read from the VFS as the
+// guest reads them.
+const MaxGuestFileBuffer = 64 << 20
+
+// GuestMount exposes a VFS folder to a guest as a WASI preopen.
+type GuestMount struct {
+	Key       string // Storage key of the folder.
+	GuestPath string // Absolute path the guest sees it at.
+	ReadOnly  bool
+}
+
+// GuestAccess is who a guest's file operations are performed for.
+type GuestAccess struct {
+	// Resolve checks that the guest's app and user may access an absolute
+	// virtual path and returns its storage key, as for bus requests.
+	Resolve func(p string, write bool) (string, error)
+	// Write is who writes are charged to and locks are checked against.
+	Write aether.WriteOptions
+	// Telemetry reports each VFS operation, if set.
+	Telemetry func(operation, key string, err error, size int64)
+}
+
+// GuestFSConfig returns a wazero FS config mounting each of mounts for one
+// instance.
+func GuestFSConfig(vfs *aether.VFSModule, mounts []GuestMount, access GuestAccess) wazero.FSConfig {
+	config := wazero.NewFSConfig()
+	buffers := &guestBuffers{}
+	for _, m := range mounts {
+		var guestFS experimentalsys.FS = &vfsGuestFS{vfs: vfs, root: m.Key, access: access, buffers: buffers}
+		if m.ReadOnly {
+			guestFS = &sysfs.ReadFS{FS: guestFS}
+		}
+		config = config.(sysfs.FSConfig).WithSysFSMount(guestFS, m.GuestPath)
+	}
+	return config
+}
+
+// vfsGuestFS adapts a VFS folder to the file system interface of wazero's
+// WASI implementation. Like WebDAV files, guest files opened for writing are
+// held in memory while open and written back when closed.
+type vfsGuestFS struct {
+	experimentalsys.UnimplementedFS
+	vfs     *aether.VFSModule
+	root    string
+	access  GuestAccess
+	buffers *guestBuffers // Shared by the instance's mounts.
+}
+
+// guestBuffers counts the bytes an instance's open files hold in memory.
+type guestBuffers struct {
+	mu   sync.Mutex
+	used int64
+}
+
+// reserve claims n bytes, reporting whether they fit in MaxGuestFileBuffer.
+func (b *guestBuffers) reserve(n int64) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.used+n > MaxGuestFileBuffer {
+		return false
+	}
+	b.used += n
+	return true
+}
+
+func (b *guestBuffers) release(n int64) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.used -= n
+}
+
+func (gfs *vfsGuestFS) telemetry(operation, key string, err error, size int64) {
+	if gfs.access.Telemetry != nil {
+		gfs.access.Telemetry(operation, key, err, size)
+	}
+}
+
+// resolve maps a path relative to the mount to a storage key, checking
+// access on every operation so revoked grants take effect immediately.
+func (gfs *vfsGuestFS) resolve(p string, write bool) (string, experimentalsys.Errno) {
+	key := path.Join(gfs.root, p)
+	if key != gfs.root && !strings.HasPrefix(key, gfs.root+"/") {
+		return "", experimentalsys.EACCES
+	}
+	if gfs.access.Resolve == nil {
+		return key, 0
+	}
+	resolved, err := gfs.access.Resolve(aether.VirtualPath(key), write)
+	if err != nil {
+		return "", experimentalsys.EACCES
+	}
+	return resolved, 0
+}
+
+// stat returns information about the item at key. The mounted folder exists
+// even while it is empty.
+func (gfs *vfsGuestFS) stat(key string) (*aether.FileInfo, experimentalsys.Errno) {
+	info, err := gfs.vfs.Stat(key)
+	if err != nil && key == gfs.root && aether.IsNotFound(err) {
+		return &aether.FileInfo{Name: path.Base(key), IsDir: true, Path: aether.VirtualPath(key)}, 0
+	}
+	if err != nil {
+		return nil, guestErrno(err)
+	}
+	return info, 0
+}
+
+func (gfs *vfsGuestFS) OpenFile(p string, flag experimentalsys.Oflag, perm fs.FileMode) (experimentalsys.File, experimentalsys.Errno) {
+	write := flag&(experimentalsys.O_WRONLY|experimentalsys.O_RDWR|experimentalsys.O_CREAT|experimentalsys.O_TRUNC|experimentalsys.O_APPEND) != 0
+	key, errno := gfs.resolve(p, write)
+	if errno != 0 {
+		return nil, errno
+	}
+
+	info, errno := gfs.stat(key)
+	switch {
+	case errno == experimentalsys.ENOENT && flag&experimentalsys.O_CREAT != 0:
+		info = &aether.FileInfo{Name: path.Base(key), Path: aether.VirtualPath(key), ModTime: time.Now()}
+	case errno != 0:
+		return nil, errno
+	case flag&(experimentalsys.O_CREAT|experimentalsys.O_EXCL) == experimentalsys.O_CREAT|experimentalsys.O_EXCL:
+		return nil, experimentalsys.EEXIST
+	}
+
+	if info.IsDir {
+		if write {
+			return nil, experimentalsys.EISDIR
+		}
+		return adapt(func() (fs.File, error) {
+			return &guestDir{fs: gfs, key: key, info: info}, nil
+		}, flag)
+	}
+	if flag&experimentalsys.O_DIRECTORY != 0 {
+		return nil, experimentalsys.ENOTDIR
+	}
+
+	f := &guestFile{
+		fs:       gfs,
+		key:      key,
+		info:     info,
+		readable: flag&experimentalsys.O_WRONLY == 0,
+		writable: write,
+		append:   flag&experimentalsys.O_APPEND != 0,
+	}
+	if write && info.Revision != "" && flag&experimentalsys.O_TRUNC == 0 {
+		if errno := f.load(); errno != 0 {
+			return nil, errno
+		}
+	}
+	f.dirty = info.Revision == "" || flag&experimentalsys.O_TRUNC != 0
+	return adapt(func() (fs.File, error) { return f, nil }, flag)
+}
+
+func (gfs *vfsGuestFS) Lstat(p string) (sys.Stat_t, experimentalsys.Errno) {
+	return gfs.Stat(p)
+}
+
+func (gfs *vfsGuestFS) Stat(p string) (sys.Stat_t, experimentalsys.Errno) {
+	key, errno := gfs.resolve(p, false)
+	if errno != 0 {
+		return sys.Stat_t{}, errno
+	}
+	info, errno := gfs.stat(key)
+	if errno != 0 {
+		return sys.Stat_t{}, errno
+	}
+	return sys.NewStat_t(guestFileInfo{info: info, size: info.Size}), 0
+}
+
+func (gfs *vfsGuestFS) Mkdir(p string, perm fs.FileMode) experimentalsys.Errno {
+	key, errno := gfs.resolve(p, true)
+	if errno != 0 {
+		return errno
+	}
+	if _, errno := gfs.stat(key); errno == 0 {
+		return experimentalsys.EEXIST
+	}
+	err := gfs.vfs.CreateDir(path.Dir(key), path.Base(key), gfs.access.Write)
+	gfs.telemetry("create_folder", key, err, 0)
+	return guestErrno(err)
+}
+
+// Rename moves a file or folder. As in POSIX, a file replaces an existing
+// file at the destination, which goes to the trash.
+func (gfs *vfsGuestFS) Rename(from, to string) experimentalsys.Errno {
+	fromKey, errno := gfs.resolve(from, true)
+	if errno != 0 {
+		return errno
+	}
+	toKey, errno := gfs.resolve(to, true)
+	if errno != 0 {
+		return errno
+	}
+	src, errno := gfs.stat(fromKey)
+	if errno != 0 {
+		return errno
+	}
+	if dst, errno := gfs.stat(toKey); errno == 0 {
+		switch {
+		case src.IsDir:
+			return experimentalsys.EEXIST
+		case dst.IsDir:
+			return experimentalsys.EISDIR
+		}
+		if errno := gfs.delete(toKey); errno != 0 {
+			return errno
+		}
+	}
+	err := gfs.vfs.Move(fromKey, toKey, gfs.access.Write)
+	gfs.telemetry("move", fromKey, err, 0)
+	return guestErrno(err)
+}
+
+func (gfs *vfsGuestFS) Rmdir(p string) experimentalsys.Errno {
+	key, errno := gfs.resolve(p, true)
+	if errno != 0 {
+		return errno
+	}
+	if key == gfs.root {
+		return experimentalsys.EACCES
+	}
+	info, errno := gfs.stat(key)
+	if errno != 0 {
+		return errno
+	}
+	if !info.IsDir {
+		return experimentalsys.ENOTDIR
+	}
+	files, err := gfs.vfs.List(key)
+	if err != nil {
+		return guestErrno(err)
+	}
+	if len(files) > 0 {
+		return experimentalsys.ENOTEMPTY
+	}
+	return gfs.delete(key)
+}
+
+func (gfs *vfsGuestFS) Unlink(p string) experimentalsys.Errno {
+	key, errno := gfs.resolve(p, true)
+	if errno != 0 {
+		return errno
+	}
+	info, errno := gfs.stat(key)
+	if errno != 0 {
+		return errno
+	}
+	if info.IsDir {
+		return experimentalsys.EISDIR
+	}
+	return gfs.delete(key)
+}
+
+// delete moves a file or folder to the trash of the guest's user.
+func (gfs *vfsGuestFS) delete(key string) experimentalsys.Errno {
+	entry, err := gfs.vfs.Delete(key, gfs.access.Write)
+	var size int64
+	if entry != nil {
+		size = entry.Size
+	}
+	gfs.telemetry("delete", key, err, size)
+	return guestErrno(err)
+}
+
+// Utimens is accepted and ignored, as the VFS keeps its own times.
+func (gfs *vfsGuestFS) Utimens(p string, atim, mtim int64) experimentalsys.Errno {
+	_, errno := gfs.Stat(p)
+	return errno
+}
+
+// openedFS is an fs.FS whose Open returns a file the guest FS has already
+// resolved and checked. Wrapping it in sysfs.AdaptFS lets guest files use
+// the standard io interfaces, which wazero adapts to its own.
+type openedFS func() (fs.File, error)
+
+func (open openedFS) Open(string) (fs.File, error) {
+	return open()
+}
+
+// adapt turns an opened file into a file for wazero. Folders are opened
+// again, and so listed again, when the guest rewinds them.
+func adapt(open openedFS, flag experimentalsys.Oflag) (experimentalsys.File, experimentalsys.Errno) {
+	return (&sysfs.AdaptFS{FS: open}).OpenFile(".", flag&experimentalsys.O_DIRECTORY, 0)
+}
+
+// guestFile is an open guest file. A writable file's contents are held in
+// data; a read-only one is read from the VFS on each read.
+type guestFile struct {
+	fs       *vfsGuestFS
+	key      string
+	info     *aether.FileInfo
+	data     []byte
+	reserved int64 // Bytes of the instance's buffers claimed for data.
+	read     int64 // Bytes read from the VFS, for telemetry.
+	offset   int64
+	readable bool
+	writable bool
+	append   bool
+	dirty    bool
+	closed   bool
+
+	// reader streams a read-only file from readerOffset, so sequential reads
+	// share one VFS reader. It is reopened when a read lands elsewhere.
+	reader       io.ReadCloser
+	readerOffset int64
+}
+
+// load reads the file's current contents into data, to be changed in place.
+func (f *guestFile) load() experimentalsys.Errno {
+	if errno := f.grow(f.info.Size); errno != 0 {
+		return errno
+	}
+	rc, _, err := f.fs.vfs.Open(f.key, 0, f.info.Size)
+	if err == nil {
+		f.data, err = io.ReadAll(rc)
+		rc.Close()
+	}
+	f.fs.telemetry("read", f.key, err, int64(len(f.data)))
+	if err != nil {
+		f.release()
+		return guestErrno(err)
+	}
+	return 0
+}
+
+// grow claims room for the file's data to reach size bytes. In-place edits
+// beyond MaxGuestFileBuffer are not supported.
+func (f *guestFile) grow(size int64) experimentalsys.Errno {
+	if size <= f.reserved {
+		return 0
+	}
+	if !f.fs.buffers.reserve(size - f.reserved) {
+		return experimentalsys.ENOTSUP
+	}
+	f.reserved = size
+	return 0
+}
+
+// release frees the file's data and the buffer room claimed for it.
+func (f *guestFile) release() {
+	f.fs.buffers.release(f.reserved)
+	f.reserved = 0
+	f.data = nil
+}
+
+// size returns the file's current size.
+func (f *guestFile) size() int64 {
+	if f.writable {
+		return int64(len(f.data))
+	}
+	return f.info.Size
+}
+
+func (f *guestFile) Stat() (fs.FileInfo, error) {
+	if f.closed {
+		return nil, fs.ErrClosed
+	}
+	return guestFileInfo{info: f.info, size: f.size()}, nil
+}
+
+func (f *guestFile) Read(p []byte) (int, error) {
+	n, err := f.ReadAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *guestFile) ReadAt(p []byte, off int64) (int, error) {
+	if f.closed || !f.readable {
+		return 0, experimentalsys.EBADF
+	}
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if off >= f.size() {
+		return 0, io.EOF
+	}
+	if !f.writable {
+		return f.readRange(p, off)
+	}
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// readRange reads a read-only file's bytes at off straight from the VFS,
+// continuing with the open reader if the last read ended at off.
+func (f *guestFile) readRange(p []byte, off int64) (int, error) {
+	if f.reader != nil && f.readerOffset != off {
+		f.closeReader()
+	}
+	if f.reader == nil {
+		rc, _, err := f.fs.vfs.Open(f.key, off, -1)
+		if err != nil {
+			f.fs.telemetry("read", f.key, err, 0)
+			return 0, guestErrno(err)
+		}
+		f.reader, f.readerOffset = rc, off
+	}
+	n, err := io.ReadFull(f.reader, p)
+	f.readerOffset += int64(n)
+	f.read += int64(n)
+	if err == io.ErrUnexpectedEOF || err == io.EOF {
+		return n, io.EOF
+	}
+	if err != nil {
+		f.fs.telemetry("read", f.key, err, 0)
+		f.closeReader()
+		return n, experimentalsys.EIO
+	}
+	return n, nil
+}
+
+func (f *guestFile) closeReader() {
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+}
+
+func (f *guestFile) Seek(offset int64, whence int) (int64, error) {
+	if f.closed {
+		return 0, fs.ErrClosed
+	}
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size()
+	default:
+		return 0, fs.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, fs.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *guestFile) Write(p []byte) (int, error) {
+	if f.append {
+		f.offset = int64(len(f.data))
+	}
+	n, err := f.WriteAt(p, f.offset)
+	f.offset += int64(n)
+	return n, err
+}
+
+func (f *guestFile) WriteAt(p []byte, off int64) (int, error) {
+	if f.closed || !f.writable {
+		return 0, experimentalsys.EBADF
+	}
+	if off < 0 {
+		return 0, fs.ErrInvalid
+	}
+	if end := off + int64(len(p)); end > int64(len(f.data)) {
+		if errno := f.grow(end); errno != 0 {
+			return 0, errno
+		}
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	n := copy(f.data[off:], p)
+	f.dirty = true
+	return n, nil
+}
+
+// Close writes the file's contents back to the VFS if the guest changed it.
+func (f *guestFile) Close() error {
+	if f.closed {
+		return nil
+	}
+	f.closed = true
+	f.closeReader()
+	if f.read > 0 {
+		f.fs.telemetry("read", f.key, nil, f.read)
+	}
+	defer f.release()
+	if !f.writable || !f.dirty {
+		return nil
+	}
+	_, err := f.fs.vfs.WriteWithOptions(f.key, bytes.Clone(f.data), f.fs.access.Write)
+	f.fs.telemetry("write", f.key, err, int64(len(f.data)))
+	if err != nil {
+		return guestErrno(err)
+	}
+	return nil
+}
+
+// guestDir is an open guest folder, listed on the first ReadDir.
+type guestDir struct {
+	fs      *vfsGuestFS
+	key     string
+	info    *aether.FileInfo
+	entries []fs.DirEntry // Unread entries, once listed.
+	listed  bool
+}
+
+func (d *guestDir) Stat() (fs.FileInfo, error) {
+	return guestFileInfo{info: d.info}, nil
+}
+
+func (d *guestDir) Read([]byte) (int, error) {
+	return 0, experimentalsys.EISDIR
+}
+
+func (d *guestDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	if !d.listed {
+		files, err := d.fs.vfs.List(d.key)
+		d.fs.telemetry("list", d.key, err, 0)
+		if err != nil && !(d.key == d.fs.root && aether.IsNotFound(err)) {
+			return nil, guestErrno(err)
+		}
+		for _, file := range files {
+			d.entries = append(d.entries, fs.FileInfoToDirEntry(guestFileInfo{info: file, size: file.Size}))
+		}
+		d.listed = true
+	}
+	if n <= 0 || n > len(d.entries) {
+		n = len(d.entries)
+	}
+	entries := d.entries[:n]
+	d.entries = d.entries[n:]
+	return entries, nil
+}
+
+func (d *guestDir) Close() error {
+	d.entries = nil
+	return nil
+}
+
+// guestFileInfo describes a VFS item to the guest.
+type guestFileInfo struct {
+	info *aether.FileInfo
+	size int64 // The size of an open file may differ from the VFS's.
+}
+
+func (fi guestFileInfo) Name() string       { return fi.info.Name }
+func (fi guestFileInfo) ModTime() time.Time { return fi.info.ModTime }
+func (fi guestFileInfo) IsDir() bool        { return fi.info.IsDir }
+func (fi guestFileInfo) Sys() interface{}   { return nil }
+
+func (fi guestFileInfo) Size() int64 {
+	if fi.info.IsDir {
+		return 0
+	}
+	return fi.size
+}
+
+func (fi guestFileInfo) Mode() fs.FileMode {
+	if fi.info.IsDir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+// guestErrno maps a VFS error to the errno the guest sees.
+func guestErrno(err error) experimentalsys.Errno {
+	var locked *aether.LockedError
+	var quota *aether.QuotaError
+	var conflict *aether.ConflictError
+	switch {
+	case err == nil:
+		return 0
+	case aether.IsNotFound(err):
+		return experimentalsys.ENOENT
+	case errors.Is(err, aether.ErrExist):
+		return experimentalsys.EEXIST
+	case errors.As(err, &locked), errors.As(err, &conflict):
+		return experimentalsys.EAGAIN
+	case errors.As(err, &quota):
+		// WASI has ENOSPC and EDQUOT, but the errnos a wazero file system
+		// can return do not include them; anything else becomes EIO.
+		return experimentalsys.EIO
+	default:
+		return experimentalsys.EIO
+	}
+}
+
+// ValidGuestPath reports whether p can be used as the guest path of a mount.
+func ValidGuestPath(p string) error {
+	if !strings.HasPrefix(p, "/") || path.Clean(p) != p || strings.ContainsAny(p, "\\\x00") {
+		return fmt.Errorf("invalid guest path: %q", p)
+	}
+	return nil
+}
@@ -0,0 +1,539 @@
+package compute
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+	"unicode/utf8"
+
+	"aether/broker/aether"
+	"github.com/google/uuid"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+)
+
+// HostModuleName is the module guests import the bus host functions from.
+const HostModuleName = "aether"
+
+// Results of the host functions. subscribe and request return a
+// non-negative subscription handle on success instead of StatusOK.
+const (
+	StatusOK          int32 = 0
+	StatusDenied      int32 = -1 // The app's manifest does not allow the call.
+	StatusInvalid     int32 = -2 // Malformed topic, payload or memory range.
+	StatusNotFound    int32 = -3 // Unknown subscription handle.
+	StatusTimeout     int32 = -4 // No message arrived in time.
+	StatusTooSmall    int32 = -5 // The buffer cannot hold the next message.
+	StatusClosed      int32 = -6 // The subscription was dropped or the instance is stopping.
+	StatusLimit       int32 = -7 // Too many open subscriptions.
+	StatusUnavailable int32 = -8 // The instance has no bus, or its policy disables the function.
+)
+
+// Manifest permissions for the bus. Either may be true, for every topic, or
+// a topic pattern or list of patterns such as "vfs:*".
+const (
+	PermissionBusPublish   = "bus_publish"
+	PermissionBusSubscribe = "bus_subscribe"
+	PermissionBusLog       = "bus_log"
+)
+
+// LogTopic is where messages guests log are published.
+const LogTopic = "vm:log"
+
+const (
+	maxTopicLength     = 256
+	maxBusPayload      = 1 << 20
+	maxLogMessage      = 4 << 10
+	maxSubscriptions   = 64
+	subscriptionBuffer = 64
+)
+
+// logLevels names the levels guests log at.
+var logLevels = map[int32]string{0: "debug", 1: "info", 2: "warn", 3: "error"}
+
+// Bus is an instance's access to the broker through the host module. Every
+// call is made as the instance's app and user, and is checked against the
+// app's manifest.
+type Bus struct {
+	broker      *aether.Broker
+	permissions *aether.PermissionManager
+	info        InstanceInfo
+	policy      Policy
+	meter       *Meter
+
+	mu     sync.Mutex
+	subs   map[int32]*subscription
+	next   int32
+	closed bool
+}
+
+// NewBus returns the bus of the instance described by info, which runs as
+// its AppID for its Owner, with the host functions policy allows. Close
+// must be called once the instance exits.
+func NewBus(broker *aether.Broker, permissions *aether.PermissionManager, info InstanceInfo, policy Policy, meter *Meter) *Bus {
+	return &Bus{
+		broker:      broker,
+		permissions: permissions,
+		info:        info,
+		policy:      policy,
+		meter:       meter,
+		subs:        make(map[int32]*subscription),
+	}
+}
+
+type busKey struct{}
+
+// WithBus returns a context that gives the host functions called with it
+// access to bus. Instances must be created with such a context to use them.
+func WithBus(ctx context.Context, bus *Bus) context.Context {
+	return context.WithValue(ctx, busKey{}, bus)
+}
+
+func busFrom(ctx context.Context) *Bus {
+	bus, _ := ctx.Value(busKey{}).(*Bus)
+	return bus
+}
+
+// Publish publishes payload, a JSON value, to topic.
+func (b *Bus) Publish(topic string, payload []byte) int32 {
+	if !b.policy.Bus {
+		return StatusUnavailable
+	}
+	if !validTopic(topic) || !validPayload(payload) {
+		return StatusInvalid
+	}
+	if !b.mayPublish(topic) {
+		return StatusDenied
+	}
+	b.publish(topic, payload, "")
+	return StatusOK
+}
+
+// Subscribe follows topic and returns a handle to poll its messages with.
+func (b *Bus) Subscribe(topic string) int32 {
+	if !b.policy.Bus {
+		return StatusUnavailable
+	}
+	if !validTopic(topic) {
+		return StatusInvalid
+	}
+	if !b.permissions.HasScopedPermission(b.info.AppID, PermissionBusSubscribe, topic) {
+		return StatusDenied
+	}
+	return b.add("", topic)
+}
+
+// Request publishes payload to topic with a new request ID and returns a
+// handle to poll the reply with, which services publish to topic's
+// ":result" or ":error" topic.
+func (b *Bus) Request(topic string, payload []byte) int32 {
+	if !b.policy.Bus {
+		return StatusUnavailable
+	}
+	if !validTopic(topic) || !validPayload(payload) {
+		return StatusInvalid
+	}
+	if !b.mayPublish(topic) ||
+		!b.permissions.HasScopedPermission(b.info.AppID, PermissionBusSubscribe, topic+":result") {
+		return StatusDenied
+	}
+	requestID := uuid.New().String()
+	// Subscribe before publishing so a fast reply is not missed.
+	handle := b.add(requestID, topic+":result", topic+":error")
+	if handle >= 0 {
+		b.publish(topic, payload, requestID)
+	}
+	return handle
+}
+
+// Poll waits up to timeout for the next message of a subscription and
+// returns it as an envelope in JSON. A negative timeout waits until a
+// message arrives or the instance stops.
+func (b *Bus) Poll(ctx context.Context, handle int32, timeout time.Duration) ([]byte, int32) {
+	b.mu.Lock()
+	sub, ok := b.subs[handle]
+	b.mu.Unlock()
+	if !ok {
+		return nil, StatusNotFound
+	}
+	if b.meter != nil {
+		defer b.meter.Block()()
+	}
+	return sub.next(ctx, timeout)
+}
+
+// Unsubscribe closes a subscription.
+func (b *Bus) Unsubscribe(handle int32) int32 {
+	b.mu.Lock()
+	sub, ok := b.subs[handle]
+	delete(b.subs, handle)
+	b.mu.Unlock()
+	if !ok {
+		return StatusNotFound
+	}
+	sub.close()
+	return StatusOK
+}
+
+// Log records a message from the guest and publishes it to LogTopic. It
+// needs the bus_log permission. Messages longer than 4 KiB are truncated.
+func (b *Bus) Log(level int32, message string) int32 {
+	if !b.policy.Log {
+		return StatusUnavailable
+	}
+	name, ok := logLevels[level]
+	if !ok {
+		return StatusInvalid
+	}
+	if !b.permissions.HasPermission(b.info.AppID, PermissionBusLog) {
+		return StatusDenied
+	}
+	if len(message) > maxLogMessage {
+		message = message[:maxLogMessage]
+	}
+	log.Printf("Compute Service: [%s] %s (%s): %s", name, b.info.ID, b.info.AppID, message)
+	payload, err := json.Marshal(map[string]string{
+		"instanceId": b.info.ID,
+		"appId":      b.info.AppID,
+		"level":      name,
+		"message":    message,
+	})
+	if err != nil {
+		return StatusInvalid
+	}
+	b.publish(LogTopic, payload, "")
+	return StatusOK
+}
+
+// Close drops the instance's subscriptions. Later calls return StatusClosed.
+func (b *Bus) Close() {
+	b.mu.Lock()
+	subs := b.subs
+	b.subs = make(map[int32]*subscription)
+	b.closed = true
+	b.mu.Unlock()
+	for _, sub := range subs {
+		sub.close()
+	}
+}
+
+// mayPublish reports whether the app may publish to topic. Topics reserved
+// for the broker are refused whatever the manifest says.
+func (b *Bus) mayPublish(topic string) bool {
+	return !aether.IsSystemTopic(topic) && b.permissions.HasScopedPermission(b.info.AppID, PermissionBusPublish, topic)
+}
+
+func (b *Bus) publish(topic string, payload []byte, requestID string) {
+	meta := map[string]string{"appId": b.info.AppID, "userId": b.info.Owner, "instanceId": b.info.ID}
+	if requestID != "" {
+		meta["requestId"] = requestID
+	}
+	// Instances the guest creates over the bus belong to the same session.
+	if b.info.Session != "" {
+		meta["sessionId"] = b.info.Session
+	}
+	metaBytes, err := json.Marshal(meta)
+	if err != nil {
+		log.Printf("Compute Service: Failed to marshal guest message metadata: %v", err)
+		return
+	}
+	b.broker.GetTopic(topic).Publish(&aether.Envelope{
+		ID:          uuid.New().String(),
+		Topic:       topic,
+		Type:        "guest",
+		ContentType: "application/json",
+		Payload:     payload,
+		Meta:        metaBytes,
+		CreatedAt:   time.Now(),
+	})
+}
+
+func (b *Bus) add(requestID string, topics ...string) int32 {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.closed {
+		return StatusClosed
+	}
+	if len(b.subs) >= maxSubscriptions {
+		return StatusLimit
+	}
+	handle := b.next
+	b.next++
+	b.subs[handle] = newSubscription(b.broker, b.info.Owner, requestID, topics)
+	return handle
+}
+
+func validTopic(topic string) bool {
+	return topic != "" && len(topic) <= maxTopicLength && utf8.ValidString(topic)
+}
+
+// validPayload accepts an empty payload, for none, or a JSON value.
+func validPayload(payload []byte) bool {
+	return len(payload) == 0 || (len(payload) <= maxBusPayload && json.Valid(payload))
+}
+
+// subscription queues the messages of one or more topics for a guest. Each
+// topic has its own local client, since a topic closes the channel of a
+// client that falls behind.
+type subscription struct {
+	requestID string // If set, only replies to this request are queued.
+	topics    []*aether.Topic
+	clients   []*aether.Client
+	queue     chan []byte
+	lost      chan struct{} // Closed when a topic drops the subscription.
+	lostOnce  sync.Once
+	done      chan struct{}
+	closeOnce sync.Once
+
+	mu      sync.Mutex
+	pending []byte // A message the guest's buffer was too small for.
+}
+
+func newSubscription(broker *aether.Broker, userID, requestID string, topics []string) *subscription {
+	s := &subscription{
+		requestID: requestID,
+		queue:     make(chan []byte, subscriptionBuffer),
+		lost:      make(chan struct{}),
+		done:      make(chan struct{}),
+	}
+	for _, name := range topics {
+		topic := broker.GetTopic(name)
+		client := aether.NewLocalClient(userID)
+		topic.Subscribe(client)
+		s.topics = append(s.topics, topic)
+		s.clients = append(s.clients, client)
+		go s.forward(client)
+	}
+	return s
+}
+
+func (s *subscription) forward(client *aether.Client) {
+	for {
+		select {
+		case msg, ok := <-client.Messages():
+			if !ok {
+				s.lostOnce.Do(func() { close(s.lost) })
+				return
+			}
+			if s.requestID != "" && !isReplyTo(msg, s.requestID) {
+				continue
+			}
+			select {
+			case s.queue <- msg:
+			case <-s.done:
+				return
+			}
+		case <-s.done:
+			return
+		}
+	}
+}
+
+// next returns the message the guest could not take last time, or the next
+// queued one. Queued messages are still delivered after the subscription
+// is dropped.
+func (s *subscription) next(ctx context.Context, timeout time.Duration) ([]byte, int32) {
+	s.mu.Lock()
+	pending := s.pending
+	s.mu.Unlock()
+	if pending != nil {
+		return pending, StatusOK
+	}
+	select {
+	case msg := <-s.queue:
+		return msg, StatusOK
+	default:
+	}
+	select {
+	case <-s.lost:
+		return nil, StatusClosed
+	default:
+	}
+	if timeout == 0 {
+		return nil, StatusTimeout
+	}
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+	select {
+	case msg := <-s.queue:
+		return msg, StatusOK
+	case <-s.lost:
+		return nil, StatusClosed
+	case <-s.done:
+		return nil, StatusClosed
+	case <-ctx.Done():
+		return nil, StatusClosed
+	case <-expired:
+		return nil, StatusTimeout
+	}
+}
+
+// hold keeps msg to be returned by the next poll.
+func (s *subscription) hold(msg []byte) {
+	s.mu.Lock()
+	s.pending = msg
+	s.mu.Unlock()
+}
+
+func (s *subscription) close() {
+	s.closeOnce.Do(func() {
+		close(s.done)
+		for i, topic := range s.topics {
+			topic.Unsubscribe(s.clients[i])
+		}
+	})
+}
+
+func isReplyTo(msg []byte, requestID string) bool {
+	var env struct {
+		Meta struct {
+			RequestID string `json:"requestId"`
+		} `json:"meta"`
+	}
+	return json.Unmarshal(msg, &env) == nil && env.Meta.RequestID == requestID
+}
+
+// instantiateHostModule adds the bus host functions to rt. They reach the
+// calling instance's Bus through the context its start function is called
+// with; see WithBus.
+//
+// Strings and payloads are passed as a pointer and length in the guest's
+// memory. Functions return one of the Status codes, or a handle.
+func instantiateHostModule(ctx context.Context, rt wazero.Runtime) error {
+	_, err := rt.NewHostModuleBuilder(HostModuleName).
+		NewFunctionBuilder().WithFunc(hostPublish).Export("publish").
+		NewFunctionBuilder().WithFunc(hostSubscribe).Export("subscribe").
+		NewFunctionBuilder().WithFunc(hostRequest).Export("request").
+		NewFunctionBuilder().WithFunc(hostPoll).Export("poll").
+		NewFunctionBuilder().WithFunc(hostUnsubscribe).Export("unsubscribe").
+		NewFunctionBuilder().WithFunc(hostLog).Export("log").
+		Instantiate(ctx)
+	return err
+}
+
+// publish(topic_ptr, topic_len, payload_ptr, payload_len) -> status
+func hostPublish(ctx context.Context, mod api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) int32 {
+	bus := busFrom(ctx)
+	if bus == nil {
+		return StatusUnavailable
+	}
+	topic, ok := readGuest(mod, topicPtr, topicLen)
+	if !ok {
+		return StatusInvalid
+	}
+	payload, ok := readGuest(mod, payloadPtr, payloadLen)
+	if !ok {
+		return StatusInvalid
+	}
+	return bus.Publish(string(topic), payload)
+}
+
+// subscribe(topic_ptr, topic_len) -> handle or status
+func hostSubscribe(ctx context.Context, mod api.Module, topicPtr, topicLen uint32) int32 {
+	bus := busFrom(ctx)
+	if bus == nil {
+		return StatusUnavailable
+	}
+	topic, ok := readGuest(mod, topicPtr, topicLen)
+	if !ok {
+		return StatusInvalid
+	}
+	return bus.Subscribe(string(topic))
+}
+
+// request(topic_ptr, topic_len, payload_ptr, payload_len) -> handle or status
+func hostRequest(ctx context.Context, mod api.Module, topicPtr, topicLen, payloadPtr, payloadLen uint32) int32 {
+	bus := busFrom(ctx)
+	if bus == nil {
+		return StatusUnavailable
+	}
+	topic, ok := readGuest(mod, topicPtr, topicLen)
+	if !ok {
+		return StatusInvalid
+	}
+	payload, ok := readGuest(mod, payloadPtr, payloadLen)
+	if !ok {
+		return StatusInvalid
+	}
+	return bus.Request(string(topic), payload)
+}
+
+// poll(handle, timeout_ms, buf_ptr, buf_len, len_ptr) -> status
+//
+// The envelope's length is always written to len_ptr, so on StatusTooSmall
+// the guest can retry with a larger buffer and get the same message.
+func hostPoll(ctx context.Context, mod api.Module, handle, timeoutMs int32, bufPtr, bufLen, lenPtr uint32) int32 {
+	bus := busFrom(ctx)
+	if bus == nil {
+		return StatusUnavailable
+	}
+	timeout := time.Duration(timeoutMs) * time.Millisecond
+	msg, status := bus.Poll(ctx, handle, timeout)
+	if status != StatusOK {
+		return status
+	}
+	bus.mu.Lock()
+	sub := bus.subs[handle]
+	bus.mu.Unlock()
+	if sub == nil {
+		return StatusClosed
+	}
+	if !mod.Memory().WriteUint32Le(lenPtr, uint32(len(msg))) {
+		sub.hold(msg)
+		return StatusInvalid
+	}
+	if uint32(len(msg)) > bufLen {
+		sub.hold(msg)
+		return StatusTooSmall
+	}
+	if !mod.Memory().Write(bufPtr, msg) {
+		sub.hold(msg)
+		return StatusInvalid
+	}
+	sub.hold(nil)
+	return StatusOK
+}
+
+// unsubscribe(handle) -> status
+func hostUnsubscribe(ctx context.Context, handle int32) int32 {
+	bus := busFrom(ctx)
+	if bus == nil {
+		return StatusUnavailable
+	}
+	return bus.Unsubscribe(handle)
+}
+
+// log(level, msg_ptr, msg_len) -> status
+//
+// Levels are 0 debug, 1 info, 2 warn and 3 error.
+func hostLog(ctx context.Context, mod api.Module, level int32, msgPtr, msgLen uint32) int32 {
+	bus := busFrom(ctx)
+	if bus == nil {
+		return StatusUnavailable
+	}
+	msg, ok := readGuest(mod, msgPtr, msgLen)
+	if !ok {
+		return StatusInvalid
+	}
+	return bus.Log(level, string(msg))
+}
+
+// readGuest copies a range of the guest's memory, which it may overwrite
+// once the host function returns.
+func readGuest(mod api.Module, ptr, length uint32) ([]byte, bool) {
+	if length == 0 {
+		return nil, true
+	}
+	buf, ok := mod.Memory().Read(ptr, length)
+	if !ok {
+		return nil, false
+	}
+	return bytes.Clone(buf), true
+}
@@ -0,0 +1,52 @@
+package compute
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"aether/broker/aether"
+)
+
+func TestBusLog(t *testing.T) {
+	dir := t.TempDir()
+	manifests := map[string]string{
+		"logger": `{"id": "logger", "permissions": {"bus_log": true}}`,
+		"quiet":  `{"id": "quiet", "permissions": {"bus_publish": true}}`,
+	}
+	for name, manifest := range manifests {
+		if err := os.MkdirAll(filepath.Join(dir, name), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.WriteFile(filepath.Join(dir, name, "manifest.json"), []byte(manifest), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	permissions := aether.NewPermissionManager(dir)
+	if err := permissions.LoadManifests(); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name  string
+		app   string
+		log   bool // Whether the sandbox policy allows logging.
+		level int32
+		want  int32
+	}{
+		{"permitted", "logger", true, 1, StatusOK},
+		{"no permission", "quiet", true, 1, StatusDenied},
+		{"unknown app", "other", true, 1, StatusDenied},
+		{"policy forbids", "logger", false, 1, StatusUnavailable},
+		{"bad level", "logger", true, 7, StatusInvalid},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			bus := NewBus(aether.NewBroker(), permissions, InstanceInfo{ID: "i", AppID: tt.app}, Policy{Log: tt.log}, nil)
+			defer bus.Close()
+			if got := bus.Log(tt.level, "hello"); got != tt.want {
+				t.Errorf("Log = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
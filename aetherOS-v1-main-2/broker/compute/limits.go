@@ -0,0 +1,312 @@
+package compute
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tetratelabs/wazero/experimental"
+)
+
+// Names of the limits an instance can hit.
+const (
+	LimitMemory    = "memory"
+	LimitWallClock = "wallClock"
+	LimitCPU       = "cpu"
+	LimitOutput    = "output"
+)
+
+// MemoryPageSize is the size of a page of WASM linear memory.
+const MemoryPageSize = 64 << 10
+
+// Limits caps the resources of one instance. Zero values mean no limit.
+type Limits struct {
+	MemoryPages uint32        // Pages of linear memory.
+	WallClock   time.Duration // Time from start to exit.
+	CPUTime     time.Duration // Time spent running guest code; see Meter.
+	OutputBytes int64         // Bytes written to stdout and stderr together.
+}
+
+// Restrict returns l lowered to any tighter limits in req. Requests can only
+// tighten limits, never raise them above the profile's.
+func (l Limits) Restrict(req Limits) Limits {
+	if req.MemoryPages > 0 && (l.MemoryPages == 0 || req.MemoryPages < l.MemoryPages) {
+		l.MemoryPages = req.MemoryPages
+	}
+	if req.WallClock > 0 && (l.WallClock == 0 || req.WallClock < l.WallClock) {
+		l.WallClock = req.WallClock
+	}
+	if req.CPUTime > 0 && (l.CPUTime == 0 || req.CPUTime < l.CPUTime) {
+		l.CPUTime = req.CPUTime
+	}
+	if req.OutputBytes > 0 && (l.OutputBytes == 0 || req.OutputBytes < l.OutputBytes) {
+		l.OutputBytes = req.OutputBytes
+	}
+	return l
+}
+
+// LimitError is the cause of an instance's context being cancelled when it
+// exceeds one of its limits.
+type LimitError struct {
+	Limit string // One of the Limit* names.
+}
+
+func (e *LimitError) Error() string {
+	return fmt.Sprintf("instance exceeded its %s limit", e.Limit)
+}
+
+// LimitExceeded returns the limit that cancelled an instance's context, or
+// nil if it was not cancelled by a limit.
+func LimitExceeded(ctx context.Context) *LimitError {
+	var limitErr *LimitError
+	if errors.As(context.Cause(ctx), &limitErr) {
+		return limitErr
+	}
+	return nil
+}
+
+// meterInterval is how often time limits are checked.
+const meterInterval = 25 * time.Millisecond
+
+// Meter tracks the resources an instance uses and cancels its context with a
+// *LimitError once a limit is exceeded. The runtime must be configured to
+// close modules when their context is done for this to stop a guest.
+//
+// CPU time is counted as time since the start that the guest did not spend
+// blocked in the I/O and sleeps passed through the meter.
+type Meter struct {
+	limits  Limits
+	ctx     context.Context
+	cancel  context.CancelCauseFunc
+	started time.Time
+	done    chan struct{}
+	once    sync.Once
+
+	mu           sync.Mutex
+	blocked      time.Duration
+	blocking     int
+	blockedSince time.Time
+
+	input  atomic.Int64
+	output atomic.Int64
+	memory atomic.Uint64 // Bytes of linear memory.
+}
+
+// NewMeter prepares to meter an instance against limits. The returned
+// context is cancelled when a limit is exceeded. Metering starts when the
+// runtime starts the guest, so compiling it does not count; Stop must be
+// called once the instance exits.
+func NewMeter(ctx context.Context, limits Limits) (context.Context, *Meter) {
+	ctx, cancel := context.WithCancelCause(ctx)
+	m := &Meter{
+		limits:  limits,
+		ctx:     ctx,
+		cancel:  cancel,
+		started: time.Now(),
+		done:    make(chan struct{}),
+	}
+	return ctx, m
+}
+
+// start restarts the clocks and begins enforcing the time limits.
+func (m *Meter) start() {
+	m.mu.Lock()
+	m.started = time.Now()
+	m.mu.Unlock()
+	if m.limits.WallClock > 0 || m.limits.CPUTime > 0 {
+		go m.watch()
+	}
+}
+
+// Limits returns the limits being enforced.
+func (m *Meter) Limits() Limits {
+	return m.limits
+}
+
+// Stop stops metering and releases the instance's context.
+func (m *Meter) Stop() {
+	m.once.Do(func() {
+		close(m.done)
+		m.cancel(context.Canceled)
+	})
+}
+
+func (m *Meter) watch() {
+	ticker := time.NewTicker(meterInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-m.ctx.Done():
+			return
+		case <-m.done:
+			return
+		}
+		if m.limits.WallClock > 0 && time.Since(m.Started()) > m.limits.WallClock {
+			m.exceed(LimitWallClock)
+			return
+		}
+		if m.limits.CPUTime > 0 && m.CPUTime() > m.limits.CPUTime {
+			m.exceed(LimitCPU)
+			return
+		}
+	}
+}
+
+// exceed cancels the instance for exceeding limit.
+func (m *Meter) exceed(limit string) {
+	m.cancel(&LimitError{Limit: limit})
+}
+
+// Block marks the guest as blocked, not using CPU, until the returned
+// function is called. Host functions that wait call it.
+func (m *Meter) Block() func() {
+	m.mu.Lock()
+	if m.blocking == 0 {
+		m.blockedSince = time.Now()
+	}
+	m.blocking++
+	m.mu.Unlock()
+	return func() {
+		m.mu.Lock()
+		m.blocking--
+		if m.blocking == 0 {
+			m.blocked += time.Since(m.blockedSince)
+		}
+		m.mu.Unlock()
+	}
+}
+
+// CPUTime returns the time the guest has spent running so far.
+func (m *Meter) CPUTime() time.Duration {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	blocked := m.blocked
+	if m.blocking > 0 {
+		blocked += time.Since(m.blockedSince)
+	}
+	return time.Since(m.started) - blocked
+}
+
+// Started returns when the guest was started.
+func (m *Meter) Started() time.Time {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.started
+}
+
+// InputBytes returns the bytes read through the meter's readers.
+func (m *Meter) InputBytes() int64 {
+	return m.input.Load()
+}
+
+// OutputBytes returns the bytes written through the meter's writers.
+func (m *Meter) OutputBytes() int64 {
+	return m.output.Load()
+}
+
+// MemoryBytes returns the current size of the guest's linear memory.
+func (m *Meter) MemoryBytes() uint64 {
+	return m.memory.Load()
+}
+
+// Sleep is a sys.Nanosleep that counts as blocked time. It returns early
+// when the instance is stopped, which could otherwise not interrupt it.
+func (m *Meter) Sleep(ns int64) {
+	defer m.Block()()
+	timer := time.NewTimer(time.Duration(ns))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-m.ctx.Done():
+	}
+}
+
+// Reader wraps a guest's stdin so waiting for input is not counted as CPU time.
+func (m *Meter) Reader(r io.Reader) io.Reader {
+	return &meteredReader{r: r, m: m}
+}
+
+// Writer wraps a guest's stdout or stderr to enforce the output limit. Time
+// spent waiting for the reader is not counted as CPU time.
+func (m *Meter) Writer(w io.Writer) io.Writer {
+	return &meteredWriter{w: w, m: m}
+}
+
+type meteredReader struct {
+	r io.Reader
+	m *Meter
+}
+
+func (r *meteredReader) Read(p []byte) (int, error) {
+	defer r.m.Block()()
+	n, err := r.r.Read(p)
+	r.m.input.Add(int64(n))
+	return n, err
+}
+
+type meteredWriter struct {
+	w io.Writer
+	m *Meter
+}
+
+func (w *meteredWriter) Write(p []byte) (int, error) {
+	total := w.m.output.Add(int64(len(p)))
+	if limit := w.m.limits.OutputBytes; limit > 0 && total > limit {
+		w.m.output.Add(-int64(len(p)))
+		w.m.exceed(LimitOutput)
+		return 0, &LimitError{Limit: LimitOutput}
+	}
+	defer w.m.Block()()
+	return w.w.Write(p)
+}
+
+// MemoryAllocator returns an allocator for the guest's linear memory that
+// enforces the memory limit. Growing past the limit aborts the guest rather
+// than failing the grow, so the instance reports which limit it hit.
+func (m *Meter) MemoryAllocator() experimental.MemoryAllocator {
+	return experimental.MemoryAllocatorFunc(func(capacity, max uint64) experimental.LinearMemory {
+		return &meteredMemory{m: m, max: max}
+	})
+}
+
+type meteredMemory struct {
+	m   *Meter
+	buf []byte
+	max uint64
+}
+
+func (mem *meteredMemory) Reallocate(size uint64) []byte {
+	if limit := uint64(mem.m.limits.MemoryPages) * MemoryPageSize; limit > 0 && size > limit {
+		mem.m.exceed(LimitMemory)
+		// A grow happens in a guest call, where wazero recovers the panic
+		// and fails the call with it. The initial allocation is not, and is
+		// checked against the limit before instantiating.
+		if mem.buf != nil {
+			panic(&LimitError{Limit: LimitMemory})
+		}
+	}
+	if size > uint64(cap(mem.buf)) {
+		// Grow geometrically, as append would, so repeated small grows
+		// don't copy the whole memory each time.
+		newCap := min(max(size, 2*uint64(cap(mem.buf))), mem.max)
+		if limit := uint64(mem.m.limits.MemoryPages) * MemoryPageSize; limit > 0 {
+			newCap = min(newCap, limit)
+		}
+		buf := make([]byte, size, max(newCap, size))
+		copy(buf, mem.buf)
+		mem.buf = buf
+	} else {
+		mem.buf = mem.buf[:size]
+	}
+	mem.m.memory.Store(size)
+	return mem.buf
+}
+
+func (mem *meteredMemory) Free() {
+	mem.buf = nil
+}
@@ -0,0 +1,52 @@
+package compute
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimitsRestrict(t *testing.T) {
+	profile := Limits{MemoryPages: 256, WallClock: time.Minute, CPUTime: 10 * time.Second, OutputBytes: 1 << 20}
+
+	tests := []struct {
+		name    string
+		profile Limits
+		req     Limits
+		want    Limits
+	}{
+		{"no request", profile, Limits{}, profile},
+		{
+			name:    "tightens",
+			profile: profile,
+			req:     Limits{MemoryPages: 16, WallClock: time.Second, CPUTime: time.Second, OutputBytes: 1024},
+			want:    Limits{MemoryPages: 16, WallClock: time.Second, CPUTime: time.Second, OutputBytes: 1024},
+		},
+		{
+			name:    "cannot raise",
+			profile: profile,
+			req:     Limits{MemoryPages: 1024, WallClock: time.Hour, CPUTime: time.Hour, OutputBytes: 1 << 30},
+			want:    profile,
+		},
+		{
+			name:    "mixed",
+			profile: profile,
+			req:     Limits{MemoryPages: 1024, WallClock: time.Second},
+			want:    Limits{MemoryPages: 256, WallClock: time.Second, CPUTime: 10 * time.Second, OutputBytes: 1 << 20},
+		},
+		{
+			name:    "limits an unlimited profile",
+			profile: Limits{},
+			req:     Limits{MemoryPages: 16, OutputBytes: 1024},
+			want:    Limits{MemoryPages: 16, OutputBytes: 1024},
+		},
+		{"unlimited stays unlimited", Limits{}, Limits{}, Limits{}},
+		{"negative request is ignored", profile, Limits{WallClock: -time.Second, OutputBytes: -1}, profile},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.profile.Restrict(tt.req); got != tt.want {
+				t.Errorf("Restrict(%+v) = %+v, want %+v", tt.req, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,141 @@
+package compute
+
+import (
+	"container/list"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"log"
+	"sync"
+
+	"github.com/tetratelabs/wazero"
+)
+
+// DefaultModuleCacheSize is how many compiled modules a runtime keeps in memory.
+const DefaultModuleCacheSize = 32
+
+// ModuleHash returns the content hash compiled modules are cached under.
+func ModuleHash(wasm []byte) string {
+	sum := sha256.Sum256(wasm)
+	return hex.EncodeToString(sum[:])
+}
+
+// moduleCache keeps the most recently used compiled modules by content hash.
+// Callers hold a reference to a module from lookup until they have finished
+// instantiating it, and an evicted module is only closed once no references
+// remain: closing it removes it from the engine, so instantiating it would
+// then fail.
+type moduleCache struct {
+	mu      sync.Mutex
+	size    int
+	order   *list.List // Of *cachedModule, most recently used first.
+	entries map[string]*list.Element
+}
+
+type cachedModule struct {
+	hash     string
+	compiled wazero.CompiledModule
+	refs     int  // Guarded by moduleCache.mu.
+	evicted  bool // No longer in the cache; closed when refs drops to 0.
+}
+
+func newModuleCache(size int) *moduleCache {
+	return &moduleCache{
+		size:    size,
+		order:   list.New(),
+		entries: make(map[string]*list.Element),
+	}
+}
+
+// get returns the cached module for hash with a reference held, marking it
+// recently used. The caller must release it.
+func (c *moduleCache) get(hash string) (*cachedModule, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[hash]
+	if !ok {
+		return nil, false
+	}
+	c.order.MoveToFront(e)
+	m := e.Value.(*cachedModule)
+	m.refs++
+	return m, true
+}
+
+// add caches a compiled module and returns it with a reference held,
+// evicting the least recently used modules over the size. If another caller
+// cached the same module first, compiled is closed and the cached one
+// returned. The caller must release the returned module.
+func (c *moduleCache) add(ctx context.Context, hash string, compiled wazero.CompiledModule) *cachedModule {
+	c.mu.Lock()
+	if e, ok := c.entries[hash]; ok {
+		c.order.MoveToFront(e)
+		m := e.Value.(*cachedModule)
+		m.refs++
+		c.mu.Unlock()
+		_ = compiled.Close(ctx)
+		return m
+	}
+	added := &cachedModule{hash: hash, compiled: compiled, refs: 1}
+	c.entries[hash] = c.order.PushFront(added)
+	var closing []*cachedModule
+	for c.order.Len() > c.size {
+		e := c.order.Back()
+		c.order.Remove(e)
+		m := e.Value.(*cachedModule)
+		delete(c.entries, m.hash)
+		if c.evictLocked(m) {
+			closing = append(closing, m)
+		}
+	}
+	c.mu.Unlock()
+
+	closeModules(ctx, closing)
+	return added
+}
+
+// release drops a reference taken by get or add, closing the module if it
+// has been evicted and this was the last reference.
+func (c *moduleCache) release(ctx context.Context, m *cachedModule) {
+	c.mu.Lock()
+	m.refs--
+	closing := m.evicted && m.refs == 0
+	c.mu.Unlock()
+	if closing {
+		closeModules(ctx, []*cachedModule{m})
+	}
+}
+
+// evictLocked marks a module removed from the cache and reports whether it
+// can be closed now. Callers must hold c.mu.
+func (c *moduleCache) evictLocked(m *cachedModule) bool {
+	m.evicted = true
+	return m.refs == 0
+}
+
+// clear forgets every cached module, closing those not in use. The rest are
+// closed when released.
+func (c *moduleCache) clear(ctx context.Context) {
+	c.mu.Lock()
+	var closing []*cachedModule
+	for e := c.order.Front(); e != nil; e = e.Next() {
+		if m := e.Value.(*cachedModule); c.evictLocked(m) {
+			closing = append(closing, m)
+		}
+	}
+	c.order = list.New()
+	c.entries = make(map[string]*list.Element)
+	c.mu.Unlock()
+
+	closeModules(ctx, closing)
+}
+
+// closeModules closes compiled modules. Instances already created from them
+// are not affected.
+func closeModules(ctx context.Context, modules []*cachedModule) {
+	for _, m := range modules {
+		if err := m.compiled.Close(ctx); err != nil {
+			log.Printf("moduleCache: error closing compiled module %s: %v", m.hash, err)
+		}
+	}
+}
@@ -0,0 +1,96 @@
+package compute
+
+import (
+	"bytes"
+	"io"
+	"time"
+	"unicode/utf8"
+)
+
+// Defaults for streaming a guest's output.
+const (
+	DefaultChunkSize     = 16 << 10
+	DefaultFlushInterval = 50 * time.Millisecond
+)
+
+// ReadChunks reads r until EOF and passes its data to emit in chunks of at
+// most size bytes. Data is emitted once size bytes are buffered or interval
+// has passed since the oldest buffered byte arrived, so output without
+// newlines is not held back. Chunks do not split a UTF-8 character unless
+// it stays incomplete for a whole interval.
+//
+// emit is called from the calling goroutine, and r is not read while it
+// runs, so a slow consumer blocks the writer rather than buffering without
+// bound. ReadChunks returns r's error, or nil at EOF.
+func ReadChunks(r io.Reader, size int, interval time.Duration, emit func(chunk []byte)) error {
+	reads := make(chan []byte)
+	errc := make(chan error, 1)
+	go func() {
+		buf := make([]byte, size)
+		for {
+			n, err := r.Read(buf)
+			if n > 0 {
+				reads <- bytes.Clone(buf[:n])
+			}
+			if err != nil {
+				if err == io.EOF {
+					err = nil
+				}
+				errc <- err
+				close(reads)
+				return
+			}
+		}
+	}()
+
+	var pending []byte
+	timer := time.NewTimer(interval)
+	timer.Stop()
+	defer timer.Stop()
+	flush := func(n int) {
+		emit(pending[:n])
+		pending = append([]byte(nil), pending[n:]...)
+	}
+	for {
+		select {
+		case data, ok := <-reads:
+			if !ok {
+				if len(pending) > 0 {
+					flush(len(pending))
+				}
+				return <-errc
+			}
+			if len(pending) == 0 {
+				timer.Reset(interval)
+			}
+			pending = append(pending, data...)
+			for len(pending) >= size {
+				flush(completeUTF8(pending[:size]))
+			}
+			if len(pending) == 0 {
+				timer.Stop()
+			}
+		case <-timer.C:
+			if len(pending) > 0 {
+				flush(completeUTF8(pending))
+			}
+			if len(pending) > 0 {
+				timer.Reset(interval)
+			}
+		}
+	}
+}
+
+// completeUTF8 returns the length of b without a UTF-8 character cut off at
+// its end, or the whole length if that would leave nothing.
+func completeUTF8(b []byte) int {
+	for i := len(b) - 1; i >= 0 && i >= len(b)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(b[i]) {
+			if i > 0 && !utf8.FullRune(b[i:]) {
+				return i
+			}
+			break
+		}
+	}
+	return len(b)
+}
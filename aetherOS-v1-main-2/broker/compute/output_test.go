@@ -0,0 +1,128 @@
+package compute
+
+import (
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReadChunks(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		size  int
+		want  []string
+	}{
+		{"empty", "", 4, nil},
+		{"shorter than a chunk", "ab", 4, []string{"ab"}},
+		{"split by size", "abcdefgh", 3, []string{"abc", "def", "gh"}},
+		{"exact chunks", "abcdef", 3, []string{"abc", "def"}},
+		{"does not split a character", "aé", 2, []string{"a", "é"}},
+		{"does not split a wide character", "ab€cd", 4, []string{"ab", "€c", "d"}},
+		{"splits a character wider than a chunk", "€", 2, []string{"\xe2\x82", "\xac"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var got []string
+			err := ReadChunks(strings.NewReader(tt.input), tt.size, time.Hour, func(chunk []byte) {
+				got = append(got, string(chunk))
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if strings.Join(got, "|") != strings.Join(tt.want, "|") || len(got) != len(tt.want) {
+				t.Errorf("chunks = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+type failingReader struct {
+	data string
+	err  error
+}
+
+func (r *failingReader) Read(p []byte) (int, error) {
+	if r.data == "" {
+		return 0, r.err
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func TestReadChunksError(t *testing.T) {
+	readErr := errors.New("read failed")
+	var got []string
+	err := ReadChunks(&failingReader{data: "abc", err: readErr}, 16, time.Hour, func(chunk []byte) {
+		got = append(got, string(chunk))
+	})
+	if !errors.Is(err, readErr) {
+		t.Errorf("err = %v, want %v", err, readErr)
+	}
+	if len(got) != 1 || got[0] != "abc" {
+		t.Errorf("chunks = %q, want the data read before the error", got)
+	}
+}
+
+func TestReadChunksInterval(t *testing.T) {
+	pr, pw := io.Pipe()
+	chunks := make(chan string, 8)
+	done := make(chan error, 1)
+	go func() {
+		done <- ReadChunks(pr, 1024, 10*time.Millisecond, func(chunk []byte) {
+			chunks <- string(chunk)
+		})
+	}()
+	next := func(want string) {
+		t.Helper()
+		select {
+		case got := <-chunks:
+			if got != want {
+				t.Errorf("chunk = %q, want %q", got, want)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("no chunk within a second, want %q", want)
+		}
+	}
+
+	// Output without a newline is flushed once the interval passes.
+	pw.Write([]byte("ab"))
+	next("ab")
+
+	// An incomplete character is held back for one interval, then sent as is.
+	pw.Write([]byte("x\xe2\x82"))
+	next("x")
+	next("\xe2\x82")
+
+	pw.Write([]byte("tail"))
+	pw.Close()
+	next("tail")
+	if err := <-done; err != nil {
+		t.Errorf("err = %v, want nil at EOF", err)
+	}
+}
+
+func TestCompleteUTF8(t *testing.T) {
+	tests := []struct {
+		in   string
+		want int
+	}{
+		{"", 0},
+		{"abc", 3},
+		{"aé", 3},
+		{"a\xc3", 1},
+		{"a\xe2\x82", 1},
+		{"a\xf0\x9f\x98", 1},
+		{"a😀", 5},
+		{"\xe2\x82", 2},
+		{"a\x82", 2},
+	}
+	for _, tt := range tests {
+		if got := completeUTF8([]byte(tt.in)); got != tt.want {
+			t.Errorf("completeUTF8(%q) = %d, want %d", tt.in, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,103 @@
+package compute
+
+import "time"
+
+// Sandbox profiles, as named in app manifests.
+const (
+	ProfileUI         = "ui"
+	ProfileBackground = "background"
+	ProfileAgent      = "agent"
+	ProfilePrivileged = "privileged"
+)
+
+// How much of the VFS an instance's mounts may expose.
+const (
+	FilesystemNone      = "none"
+	FilesystemReadOnly  = "readOnly"
+	FilesystemReadWrite = "readWrite"
+)
+
+// Policy is what instances of a sandbox profile may do. It applies on top
+// of the app's manifest permissions, which still gate each mount and bus
+// topic.
+type Policy struct {
+	Profile string
+	Limits  Limits // Defaults, which requests may only tighten.
+
+	// WASI features.
+	Env        bool   // Environment variables from the request are passed on.
+	RealClock  bool   // Clocks and sleeps are the host's; otherwise clocks are fake and sleeps return at once.
+	RealRandom bool   // random_get is cryptographically random; otherwise it is a fixed, repeatable sequence.
+	Filesystem string // The most access a VFS mount may give; one of the Filesystem* values.
+
+	// aether host functions.
+	Bus bool // publish, subscribe and request.
+	Log bool
+
+	// OutliveSession lets an instance keep running after the session that
+	// created it closes. Others are killed with their session.
+	OutliveSession bool
+}
+
+// profilePolicies are the policies of each sandbox profile. Agent instances
+// run generated code, so they are deterministic and cannot write files or
+// reach the bus.
+var profilePolicies = map[string]Policy{
+	ProfileUI: {
+		Limits:     Limits{MemoryPages: 1024, CPUTime: time.Minute, OutputBytes: 16 << 20},
+		Env:        true,
+		RealClock:  true,
+		RealRandom: true,
+		Filesystem: FilesystemReadWrite,
+		Bus:        true,
+		Log:        true,
+	},
+	ProfileBackground: {
+		Limits:         Limits{MemoryPages: 4096, WallClock: 10 * time.Minute, CPUTime: 5 * time.Minute, OutputBytes: 64 << 20},
+		Env:            true,
+		RealClock:      true,
+		RealRandom:     true,
+		Filesystem:     FilesystemReadWrite,
+		Bus:            true,
+		Log:            true,
+		OutliveSession: true,
+	},
+	ProfileAgent: {
+		Limits:     Limits{MemoryPages: 2048, WallClock: 2 * time.Minute, CPUTime: time.Minute, OutputBytes: 8 << 20},
+		Filesystem: FilesystemReadOnly,
+		Log:        true,
+	},
+	ProfilePrivileged: {
+		Limits:         Limits{MemoryPages: 16384},
+		Env:            true,
+		RealClock:      true,
+		RealRandom:     true,
+		Filesystem:     FilesystemReadWrite,
+		Bus:            true,
+		Log:            true,
+		OutliveSession: true,
+	},
+}
+
+// ProfilePolicy returns the policy of a sandbox profile. Apps without a
+// known profile get the policy of "ui".
+func ProfilePolicy(profile string) Policy {
+	policy, ok := profilePolicies[profile]
+	if !ok {
+		profile = ProfileUI
+		policy = profilePolicies[profile]
+	}
+	policy.Profile = profile
+	return policy
+}
+
+// AllowsMount reports whether the policy permits a VFS mount.
+func (p Policy) AllowsMount(readOnly bool) bool {
+	switch p.Filesystem {
+	case FilesystemReadWrite:
+		return true
+	case FilesystemReadOnly:
+		return readOnly
+	}
+	return false
+}
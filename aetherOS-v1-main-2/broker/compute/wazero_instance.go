@@ -1,72 +1,254 @@
-
 package compute
 
 import (
-    "context"
-    "io"
-    "log"
-    "sync"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/sys"
+)
 
-    "github.com/tetratelabs/wazero/api"
+// Instance states. An instance is created, runs its _start function once
+// and ends in exactly one of the final states.
+const (
+	StateCreated = "created"
+	StateRunning = "running"
+	StateExited  = "exited"  // The guest returned or called proc_exit.
+	StateKilled  = "killed"  // Stopped by a kill request or for exceeding a limit.
+	StateCrashed = "crashed" // The guest trapped.
 )
 
+// ExitStatus describes how an instance ended.
+type ExitStatus struct {
+	State    string
+	ExitCode uint32 // Set for StateExited.
+	Limit    string // The limit that killed the instance, if any.
+	Error    string // The trap message of a crash or the limit error.
+	Trace    string // The guest stack trace of a crash.
+}
+
+// String describes how the instance ended, for logs.
+func (s *ExitStatus) String() string {
+	switch s.State {
+	case StateExited:
+		return fmt.Sprintf("exited with code %d", s.ExitCode)
+	case StateCrashed:
+		return "crashed: " + s.Error
+	default:
+		if s.Limit != "" {
+			return "killed: " + s.Error
+		}
+		return s.State
+	}
+}
+
+// InstanceInfo describes an instance for the process table.
+type InstanceInfo struct {
+	ID          string    `json:"instanceId"`
+	AppID       string    `json:"appId"`               // The app it runs as.
+	Owner       string    `json:"owner"`               // The user it runs for.
+	Name        string    `json:"name"`                // Its program name.
+	Profile     string    `json:"profile"`             // The sandbox profile whose policy it runs under.
+	Session     string    `json:"sessionId,omitempty"` // The bus session that created it.
+	StartedAt   time.Time `json:"startedAt"`
+	State       string    `json:"state"`
+	MemoryBytes uint64    `json:"memoryBytes"` // Size of its linear memory.
+	CPUTimeMs   int64     `json:"cpuTimeMs"`
+	StdinBytes  int64     `json:"stdinBytes"`
+	OutputBytes int64     `json:"outputBytes"` // Written to stdout and stderr.
+}
+
 type wazeroInstance struct {
-    mu      sync.Mutex
-    mod     api.Module
-    stdin   io.WriteCloser
-    stdout  io.ReadCloser
-    stderr  io.ReadCloser
-    cancel  context.CancelFunc
-    done    chan struct{}
-    closed  bool
+	info   InstanceInfo
+	mu     sync.Mutex
+	ctx    context.Context
+	mod    api.Module
+	meter  *Meter
+	stdin  io.WriteCloser
+	stdout io.ReadCloser
+	stderr io.ReadCloser
+	cancel context.CancelFunc
+	done   chan struct{}
+	closed bool
+	state  string
+	killed bool
+	status *ExitStatus
 }
 
-func NewWazeroInstance(ctx context.Context, mod api.Module, stdin io.WriteCloser, stdout io.ReadCloser, stderr io.ReadCloser, cancel context.CancelFunc) *wazeroInstance {
+// NewWazeroInstance wraps an instantiated module. Only the ID, AppID, Owner,
+// Name, Profile and Session of info are used; Info reports the rest.
+func NewWazeroInstance(ctx context.Context, info InstanceInfo, mod api.Module, meter *Meter, stdin io.WriteCloser, stdout io.ReadCloser, stderr io.ReadCloser, cancel context.CancelFunc) *wazeroInstance {
 	return &wazeroInstance{
+		info: InstanceInfo{
+			ID:      info.ID,
+			AppID:   info.AppID,
+			Owner:   info.Owner,
+			Name:    info.Name,
+			Profile: info.Profile,
+			Session: info.Session,
+		},
+		ctx:    ctx,
 		mod:    mod,
+		meter:  meter,
 		stdin:  stdin,
 		stdout: stdout,
 		stderr: stderr,
 		cancel: cancel,
 		done:   make(chan struct{}),
+		state:  StateCreated,
 	}
 }
 
-
-func (i *wazeroInstance) Stdin() io.WriteCloser  { return i.stdin }
+func (i *wazeroInstance) Stdin() io.WriteCloser { return i.stdin }
 func (i *wazeroInstance) Stdout() io.ReadCloser { return i.stdout }
 func (i *wazeroInstance) Stderr() io.ReadCloser { return i.stderr }
 
+// State returns the instance's current state.
+func (i *wazeroInstance) State() string {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.state
+}
+
+// Info returns the instance's identity, state and resource usage so far.
+func (i *wazeroInstance) Info() InstanceInfo {
+	info := i.info
+	info.State = i.State()
+	if i.meter != nil {
+		info.StartedAt = i.meter.Started()
+		info.MemoryBytes = i.meter.MemoryBytes()
+		info.StdinBytes = i.meter.InputBytes()
+		info.OutputBytes = i.meter.OutputBytes()
+		if info.State == StateRunning {
+			info.CPUTimeMs = i.meter.CPUTime().Milliseconds()
+		}
+	}
+	return info
+}
+
+// Done is closed once the instance has reached a final state.
+func (i *wazeroInstance) Done() <-chan struct{} { return i.done }
+
+// Status returns how the instance ended, or nil while it has not.
+func (i *wazeroInstance) Status() *ExitStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	return i.status
+}
+
+// Run runs the guest's _start function to completion and returns how it
+// ended. onStart is called once the instance is running and before any
+// guest code executes, so events about the start precede its output. Run may
+// only be called once.
+func (i *wazeroInstance) Run(onStart func()) *ExitStatus {
+	i.mu.Lock()
+	if i.state != StateCreated || i.mod == nil {
+		i.mu.Unlock()
+		return i.finish(&ExitStatus{State: StateKilled})
+	}
+	i.state = StateRunning
+	mod := i.mod
+	i.mu.Unlock()
+
+	if onStart != nil {
+		onStart()
+	}
+	if i.meter != nil {
+		i.meter.start()
+	}
+	start := mod.ExportedFunction("_start")
+	if start == nil {
+		start = mod.ExportedFunction("_initialize")
+	}
+	var err error
+	if start != nil {
+		_, err = start.Call(i.ctx)
+	}
+	return i.finish(i.exitStatus(err))
+}
+
+// exitStatus classifies the result of calling the guest's _start function.
+func (i *wazeroInstance) exitStatus(err error) *ExitStatus {
+	i.mu.Lock()
+	killed := i.killed
+	i.mu.Unlock()
+
+	if limitErr := LimitExceeded(i.ctx); limitErr != nil {
+		return &ExitStatus{State: StateKilled, Limit: limitErr.Limit, Error: limitErr.Error()}
+	}
+	var exitErr *sys.ExitError
+	switch {
+	case killed || (i.ctx.Err() != nil && err != nil):
+		return &ExitStatus{State: StateKilled}
+	case err == nil:
+		return &ExitStatus{State: StateExited}
+	case errors.As(err, &exitErr):
+		return &ExitStatus{State: StateExited, ExitCode: exitErr.ExitCode()}
+	default:
+		msg, trace, _ := strings.Cut(err.Error(), "\n")
+		return &ExitStatus{State: StateCrashed, Error: msg, Trace: strings.TrimSpace(trace)}
+	}
+}
+
+// finish records the final state and releases the guest.
+func (i *wazeroInstance) finish(status *ExitStatus) *ExitStatus {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.status != nil {
+		return i.status
+	}
+	i.state = status.State
+	i.status = status
+	if i.mod != nil {
+		if err := i.mod.Close(context.Background()); err != nil {
+			log.Printf("wazeroInstance: error closing module: %v", err)
+		}
+		i.mod = nil
+	}
+	if i.meter != nil {
+		i.meter.Stop()
+	}
+	close(i.done)
+	return status
+}
+
+// Kill stops the instance. A running guest is interrupted and Run returns
+// with StateKilled; one that never started is released immediately.
 func (i *wazeroInstance) Kill() {
-    if i.cancel != nil {
-        i.cancel()
-    }
-
-    i.mu.Lock()
-    defer i.mu.Unlock()
-    if i.closed {
-        return
-    }
-
-    if i.mod != nil {
-        if err := i.mod.Close(context.Background()); err != nil {
-            log.Printf("wazeroInstance: error closing module: %v", err)
-        }
-        i.mod = nil
-    }
-
-    if i.stdin != nil {
-        _ = i.stdin.Close()
-        i.stdin = nil
-    }
-    if i.stdout != nil {
-        _ = i.stdout.Close()
-        i.stdout = nil
-    }
-    if i.stderr != nil {
-        _ = i.stderr.Close()
-        i.stderr = nil
-    }
-
-    i.closed = true
+	i.mu.Lock()
+	if i.status == nil {
+		i.killed = true
+	}
+	notStarted := i.state == StateCreated
+	i.mu.Unlock()
+
+	if i.cancel != nil {
+		i.cancel()
+	}
+	if notStarted {
+		i.finish(&ExitStatus{State: StateKilled})
+	}
+	i.Close()
+}
+
+// Close releases the instance's pipes.
+func (i *wazeroInstance) Close() {
+	i.mu.Lock()
+	defer i.mu.Unlock()
+	if i.closed {
+		return
+	}
+
+	// Closing stdin unblocks a guest waiting for input. The output pipes are
+	// left to be drained until the guest's ends are closed.
+	if i.stdin != nil {
+		_ = i.stdin.Close()
+	}
+	i.closed = true
 }
@@ -1,67 +1,154 @@
-
 package compute
 
 import (
-    "context"
-    "sync"
-    "time"
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
 
-    "github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero"
+	"github.com/tetratelabs/wazero/api"
+	"github.com/tetratelabs/wazero/experimental"
+	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
 type WazeroRuntime struct {
-    rt        wazero.Runtime
-    mu        sync.RWMutex
-    instances map[string]*wazeroInstance
+	rt        wazero.Runtime
+	mu        sync.RWMutex
+	instances map[string]*wazeroInstance
+	modules   *moduleCache
+
+	// WASI and aether host functions are shared by every guest, and wazero
+	// refuses to instantiate a host module twice in one runtime.
+	hostOnce sync.Once
+	hostErr  error
 }
 
 func NewWazeroRuntime(rt wazero.Runtime) *WazeroRuntime {
-    return &WazeroRuntime{
-        rt:        rt,
-        instances: make(map[string]*wazeroInstance),
-    }
+	return &WazeroRuntime{
+		rt:        rt,
+		instances: make(map[string]*wazeroInstance),
+		modules:   newModuleCache(DefaultModuleCacheSize),
+	}
 }
 
 func (w *WazeroRuntime) GetRuntime() wazero.Runtime {
 	return w.rt
 }
 
+// Compile returns the compiled form of a WASM binary, compiling it only if
+// the same bytes are not already cached. The module stays usable until
+// release is called, even if the cache evicts it meanwhile; call release
+// once it has been instantiated.
+func (w *WazeroRuntime) Compile(ctx context.Context, wasm []byte) (compiled wazero.CompiledModule, release func(), err error) {
+	hash := ModuleHash(wasm)
+	m, ok := w.modules.get(hash)
+	if !ok {
+		compiled, err := w.rt.CompileModule(ctx, wasm)
+		if err != nil {
+			return nil, nil, err
+		}
+		m = w.modules.add(ctx, hash, compiled)
+	}
+	return m.compiled, func() { w.modules.release(context.Background(), m) }, nil
+}
+
+// Instantiate compiles a WASM binary, using the cache, and instantiates it
+// with WASI and the aether host module available, without running its start
+// function. Guests are anonymous, so any number of instances of the same
+// module may run at once. If meter is not nil, the guest's linear memory is
+// held to its memory limit.
+func (w *WazeroRuntime) Instantiate(ctx context.Context, wasm []byte, config wazero.ModuleConfig, meter *Meter) (api.Module, error) {
+	w.hostOnce.Do(func() {
+		if _, err := wasi_snapshot_preview1.Instantiate(context.Background(), w.rt); err != nil {
+			w.hostErr = fmt.Errorf("failed to instantiate WASI: %w", err)
+			return
+		}
+		if err := instantiateHostModule(context.Background(), w.rt); err != nil {
+			w.hostErr = fmt.Errorf("failed to instantiate %s host module: %w", HostModuleName, err)
+		}
+	})
+	if w.hostErr != nil {
+		return nil, w.hostErr
+	}
+	compiled, release, err := w.Compile(ctx, wasm)
+	if err != nil {
+		return nil, fmt.Errorf("failed to compile module: %w", err)
+	}
+	defer release()
+	if meter != nil {
+		if pages := meter.Limits().MemoryPages; pages > 0 {
+			for _, mem := range append(compiled.ImportedMemories(), exportedMemories(compiled)...) {
+				if mem.Min() > pages {
+					return nil, &LimitError{Limit: LimitMemory}
+				}
+			}
+		}
+		ctx = experimental.WithMemoryAllocator(ctx, meter.MemoryAllocator())
+	}
+	return w.rt.InstantiateModule(ctx, compiled, config.WithName("").WithStartFunctions())
+}
+
+func exportedMemories(compiled wazero.CompiledModule) []api.MemoryDefinition {
+	var mems []api.MemoryDefinition
+	for _, mem := range compiled.ExportedMemories() {
+		mems = append(mems, mem)
+	}
+	return mems
+}
+
 func (w *WazeroRuntime) Register(id string, inst *wazeroInstance) {
-    w.mu.Lock()
-    defer w.mu.Unlock()
-    w.instances[id] = inst
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.instances[id] = inst
 }
 
 func (w *WazeroRuntime) Unregister(id string) {
-    w.mu.Lock()
-    defer w.mu.Unlock()
-    delete(w.instances, id)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	delete(w.instances, id)
 }
 
 func (w *WazeroRuntime) Get(id string) (*wazeroInstance, bool) {
-    w.mu.RLock()
-    defer w.mu.RUnlock()
-    inst, ok := w.instances[id]
-    return inst, ok
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+	inst, ok := w.instances[id]
+	return inst, ok
+}
+
+// List returns the registered instances, oldest first.
+func (w *WazeroRuntime) List() []InstanceInfo {
+	w.mu.RLock()
+	infos := make([]InstanceInfo, 0, len(w.instances))
+	for _, inst := range w.instances {
+		infos = append(infos, inst.Info())
+	}
+	w.mu.RUnlock()
+	sort.Slice(infos, func(a, b int) bool {
+		return infos[a].StartedAt.Before(infos[b].StartedAt)
+	})
+	return infos
 }
 
 func (w *WazeroRuntime) Shutdown(ctx context.Context) error {
-    w.mu.Lock()
-    instances := make([]*wazeroInstance, 0, len(w.instances))
-    for _, inst := range w.instances {
-        instances = append(instances, inst)
-    }
-    w.instances = make(map[string]*wazeroInstance)
-    w.mu.Unlock()
-
-    for _, inst := range instances {
-        inst.Kill()
-    }
-
-    select {
-    case <-time.After(2 * time.Second):
-    case <-ctx.Done():
-    }
-
-    return w.rt.Close(ctx)
+	w.mu.Lock()
+	instances := make([]*wazeroInstance, 0, len(w.instances))
+	for _, inst := range w.instances {
+		instances = append(instances, inst)
+	}
+	w.instances = make(map[string]*wazeroInstance)
+	w.mu.Unlock()
+
+	for _, inst := range instances {
+		inst.Kill()
+	}
+
+	select {
+	case <-time.After(2 * time.Second):
+	case <-ctx.Done():
+	}
+
+	w.modules.clear(ctx)
+	return w.rt.Close(ctx)
 }
@@ -1,4 +1,3 @@
-
 package main
 
 import (
@@ -12,6 +11,7 @@ import (
 	"os"
 	"os/signal"
 	"path/filepath"
+	"strings"
 	"syscall"
 	"time"
 
@@ -58,6 +58,17 @@ func main() {
 		log.Fatalf("failed to create VFS module: %v", err)
 	}
 	defer vfsModule.Close()
+	// AETHER_ADMIN_USERS lists, comma-separated, the users who may change mounts.
+	vfsModule.SetAdmins(strings.Split(os.Getenv("AETHER_ADMIN_USERS"), ","))
+	// Storage quotas and the usage at which warnings are raised; see aether.QuotaConfig.
+	if err := vfsModule.ConfigureQuotas(aether.QuotaConfig{
+		DefaultUser: os.Getenv("AETHER_DEFAULT_USER_QUOTA"),
+		Users:       os.Getenv("AETHER_USER_QUOTAS"),
+		Apps:        os.Getenv("AETHER_APP_QUOTAS"),
+		Thresholds:  os.Getenv("AETHER_USAGE_THRESHOLDS"),
+	}); err != nil {
+		log.Fatalf("failed to configure storage quotas: %v", err)
+	}
 
 	// Initialize AI Module
 	aiModule, err := aether.NewAIModule()
@@ -66,8 +77,19 @@ func main() {
 	}
 	defer aiModule.Close()
 
-	// Initialize Wazero Runtime for Compute Service
-	wazeroRuntime := wazero.NewRuntime(ctx)
+	// Initialize Wazero Runtime for Compute Service. Setting AETHER_WASM_CACHE_DIR
+	// keeps compiled modules on disk so restarts skip compilation.
+	// Instances are stopped by cancelling their context, e.g. when they exceed a limit.
+	runtimeConfig := wazero.NewRuntimeConfig().WithCloseOnContextDone(true)
+	if cacheDir := os.Getenv("AETHER_WASM_CACHE_DIR"); cacheDir != "" {
+		compilationCache, err := wazero.NewCompilationCacheWithDir(cacheDir)
+		if err != nil {
+			log.Fatalf("failed to open wasm compilation cache: %v", err)
+		}
+		defer compilationCache.Close(ctx)
+		runtimeConfig = runtimeConfig.WithCompilationCache(compilationCache)
+	}
+	wazeroRuntime := wazero.NewRuntimeWithConfig(ctx, runtimeConfig)
 	computeRuntime := compute.NewWazeroRuntime(wazeroRuntime)
 	defer func() {
 		if err := computeRuntime.Shutdown(ctx); err != nil {
@@ -82,7 +104,7 @@ func main() {
 	vfsService := services.NewVfsService(broker, vfsModule, aiModule, permissionManager)
 	go vfsService.Run()
 
-	computeService := services.NewComputeService(broker, computeRuntime, permissionManager)
+	computeService := services.NewComputeService(broker, computeRuntime, vfsModule, permissionManager)
 	go computeService.Run()
 
 	agentService := services.NewAgentService(broker, firestoreClient, permissionManager)
@@ -98,8 +120,17 @@ func main() {
 	go installService.Run()
 
 	// Setup router and register API routes
+	// With auth enabled, tokens must be signed with AETHER_JWT_SECRET.
+	if err := server.ConfigureAuth(os.Getenv("AETHER_AUTH_ENABLED") == "true", os.Getenv("AETHER_JWT_SECRET")); err != nil {
+		log.Fatalf("failed to configure auth: %v", err)
+	}
+	if !server.RequireAuth {
+		log.Printf("WARNING: auth is disabled; anonymous requests act as user %q.", aether.DefaultUser)
+	}
 	r := mux.NewRouter()
 	server.RegisterBusRoutes(r, broker)
+	server.RegisterDAVRoutes(r, broker, vfsModule)
+	server.RegisterFSRoutes(r, broker, vfsModule)
 
 	// Start the server
 	port := "8080"
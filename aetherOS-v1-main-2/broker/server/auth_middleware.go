@@ -2,9 +2,13 @@ package server
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"net/http"
 	"strings"
 
+	"aether/broker/aether"
+
 	"github.com/golang-jwt/jwt/v5"
 )
 
@@ -12,8 +16,95 @@ type contextKey string
 
 const authClaimsKey contextKey = "authClaims"
 
+// demoSecret signs tokens when no secret is configured. It is public, so
+// anyone can mint a token for any user with it.
+const demoSecret = "aether-secret"
+
 // simple HMAC secret for demo. In production: use KMS or public-key verification (RS256/ES256).
-var hmacSecret = []byte("aether-secret")
+var hmacSecret = []byte(demoSecret)
+
+// RequireAuth rejects requests without a valid bearer token. When false,
+// anonymous requests act as aether.DefaultUser, matching auth.enabled in config.yaml.
+var RequireAuth = false
+
+// ConfigureAuth sets RequireAuth and the HMAC secret tokens are signed with.
+// An empty secret keeps the demo one, which is refused when auth is
+// required since it would let anyone act as any user.
+func ConfigureAuth(required bool, secret string) error {
+	if secret == "" {
+		secret = demoSecret
+	}
+	if required && secret == demoSecret {
+		return errors.New("auth is enabled but no JWT secret is configured")
+	}
+	RequireAuth = required
+	hmacSecret = []byte(secret)
+	return nil
+}
+
+// UserIDFromRequest returns the user a request acts for, taken from the "sub"
+// claim of its bearer token. Browsers cannot set headers on WebSocket
+// upgrades, so the token may also be passed as the "token" query parameter.
+func UserIDFromRequest(r *http.Request) (string, error) {
+	userID, _, err := IdentityFromRequest(r)
+	return userID, err
+}
+
+// IdentityFromRequest returns the user a request acts for, as
+// UserIDFromRequest does, and the apps it may act for, taken from the "apps"
+// claim of its token. A nil apps allows any app, which is only the case while
+// RequireAuth is off and the token does not name its apps.
+func IdentityFromRequest(r *http.Request) (userID string, apps []string, err error) {
+	tokenStr := r.URL.Query().Get("token")
+	if auth := r.Header.Get("Authorization"); auth != "" {
+		parts := strings.SplitN(auth, " ", 2)
+		if len(parts) != 2 || !strings.EqualFold(parts[0], "Bearer") {
+			return "", nil, errors.New("invalid authorization header")
+		}
+		tokenStr = parts[1]
+	}
+	if tokenStr == "" {
+		if RequireAuth {
+			return "", nil, errors.New("missing authorization")
+		}
+		return aether.DefaultUser, nil, nil
+	}
+
+	claims := jwt.MapClaims{}
+	token, err := jwt.ParseWithClaims(tokenStr, claims, func(t *jwt.Token) (interface{}, error) {
+		if _, ok := t.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, jwt.ErrTokenUnverifiable
+		}
+		return hmacSecret, nil
+	})
+	if err != nil || !token.Valid {
+		return "", nil, fmt.Errorf("invalid token: %v", err)
+	}
+
+	sub, err := claims.GetSubject()
+	if err != nil || !aether.ValidName(sub) {
+		return "", nil, errors.New("invalid token: missing or malformed subject")
+	}
+
+	switch claim := claims["apps"].(type) {
+	case nil:
+		if RequireAuth {
+			apps = []string{} // A token that names no apps may act for none.
+		}
+	case []interface{}:
+		apps = make([]string, 0, len(claim))
+		for _, app := range claim {
+			id, ok := app.(string)
+			if !ok {
+				return "", nil, errors.New("invalid token: malformed apps claim")
+			}
+			apps = append(apps, id)
+		}
+	default:
+		return "", nil, errors.New("invalid token: malformed apps claim")
+	}
+	return sub, apps, nil
+}
 
 // JWTAuthMiddleware validates Authorization header and stores claims in context.
 func JWTAuthMiddleware(next http.Handler) http.Handler {
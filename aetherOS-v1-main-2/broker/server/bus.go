@@ -1,4 +1,3 @@
-
 package server
 
 import (
@@ -27,11 +26,29 @@ func RegisterBusRoutes(r *mux.Router, b *aether.Broker) {
 }
 
 func (s *BusServer) handlePublish(w http.ResponseWriter, r *http.Request) {
+	userID, apps, err := IdentityFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	var env aether.Envelope
 	if err := json.NewDecoder(r.Body).Decode(&env); err != nil {
 		http.Error(w, "invalid envelope", http.StatusBadRequest)
 		return
 	}
+	if err := env.SetUserID(userID); err != nil {
+		http.Error(w, "invalid envelope metadata", http.StatusBadRequest)
+		return
+	}
+	if err := env.BindAppID(apps); err != nil {
+		http.Error(w, "invalid envelope metadata", http.StatusBadRequest)
+		return
+	}
+	if aether.IsSystemTopic(env.Topic) {
+		http.Error(w, "topic is reserved for the broker", http.StatusForbidden)
+		return
+	}
 
 	topic := s.Broker.GetTopic(env.Topic)
 	topic.Publish(&env)
@@ -45,13 +62,20 @@ var upgrader = websocket.Upgrader{
 
 // handleWSGateway upgrades the connection and connects the client to the bus.
 func (s *BusServer) handleWSGateway(w http.ResponseWriter, r *http.Request) {
+	// Authenticate before upgrading so a bad token gets a proper HTTP error.
+	userID, apps, err := IdentityFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
 	conn, err := upgrader.Upgrade(w, r, nil)
 	if err != nil {
 		return // upgrader logs errors
 	}
 
 	busTopic := s.Broker.GetTopic("bus")
-	client := aether.NewClient(conn, busTopic)
+	client := aether.NewClient(conn, busTopic, userID, apps)
 
 	// List of all topics the frontend might need to subscribe to
 	topicsToSubscribe := []string{
@@ -62,15 +86,42 @@ func (s *BusServer) handleWSGateway(w http.ResponseWriter, r *http.Request) {
 		"ai:generate:palette:resp", "ai:generate:palette:error",
 		"ai:generate:accent:resp", "ai:generate:accent:error",
 		"vfs:search:result", "vfs:search:error",
+		"vfs:search:fulltext:result", "vfs:search:fulltext:error",
 		"vfs:summarize:code:result", "vfs:summarize:code:error",
 		"vfs:list:result", "vfs:list:error",
+		"vfs:walk:batch", "vfs:walk:result", "vfs:walk:error",
 		"vfs:delete:result", "vfs:delete:error",
 		"vfs:create:file:result", "vfs:create:file:error",
 		"vfs:create:folder:result", "vfs:create:folder:error",
 		"vfs:read:result", "vfs:read:error",
+		"vfs:stat:result", "vfs:stat:error",
 		"vfs:write:result", "vfs:write:error",
+		"vfs:trash:list:result", "vfs:trash:list:error",
+		"vfs:trash:restore:result", "vfs:trash:restore:error",
+		"vfs:trash:empty:result", "vfs:trash:empty:error",
+		"vfs:move:result", "vfs:move:error",
+		"vfs:batch:result", "vfs:batch:error",
+		"vfs:patch:result", "vfs:patch:error",
+		"vfs:mounts:result", "vfs:mounts:error",
+		"vfs:mount:result", "vfs:mount:error",
+		"vfs:unmount:result", "vfs:unmount:error",
+		"vfs:share:result", "vfs:share:error",
+		"vfs:unshare:result", "vfs:unshare:error",
+		"vfs:shares:result", "vfs:shares:error",
+		"vfs:group:set:result", "vfs:group:set:error",
+		"vfs:lock:result", "vfs:lock:error", "vfs:lock:changed",
+		"vfs:unlock:result", "vfs:unlock:error",
+		"vfs:locks:result", "vfs:locks:error",
+		"vfs:archive:create:result", "vfs:archive:create:error", "vfs:archive:chunk",
+		"vfs:archive:extract:result", "vfs:archive:extract:error", "vfs:archive:progress",
+		"vfs:watch:result", "vfs:watch:error",
+		"vfs:unwatch:result", "vfs:unwatch:error",
+		"vfs:usage:result", "vfs:usage:error", "vfs:usage:warning",
 		"vm:started", "vm:stdout", "vm:stderr", "vm:exited",
-		"vm:killed", "vm:crashed", "vm:create:error", "vm:kill:error", "vm:stdin:error",
+		"vm:killed", "vm:crashed", "vm:log", "vm:create:error", "vm:kill:error", "vm:stdin:error",
+		"vm:list:result", "vm:list:error", "vm:inspect:result", "vm:inspect:error",
+		"vm:killall:result", "vm:killall:error",
+		"vm:pipeline:started", "vm:pipeline:exited", "vm:pipeline:error",
 		"telemetry:vfs",
 		"system:install:app:result", "system:install:app:error",
 		"agent.taskgraph.created", "agent.taskgraph.started",
@@ -0,0 +1,528 @@
+package server
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"aether/broker/aether"
+	"github.com/gorilla/mux"
+	"golang.org/x/net/webdav"
+)
+
+const (
+	// davPrefix is where the WebDAV tree is served. Its root is the
+	// authenticated user's home directory.
+	davPrefix = "/v1/dav"
+	// davApp is the app identity WebDAV clients write and lock as, so their
+	// locks are distinct from those taken through apps on the bus.
+	davApp = "webdav"
+	// davLockTokenPrefix turns VFS lock IDs into WebDAV lock token URIs.
+	davLockTokenPrefix = "urn:uuid:"
+	// davRequestToken stands for the lock the WebDAV handler takes for the
+	// length of a single request when the client has not locked anything.
+	davRequestToken = "urn:aether:request"
+)
+
+// DAVServer serves the VFS over WebDAV.
+type DAVServer struct {
+	Broker *aether.Broker
+	VFS    *aether.VFSModule
+}
+
+// RegisterDAVRoutes registers the WebDAV handler with the router.
+func RegisterDAVRoutes(r *mux.Router, b *aether.Broker, vfs *aether.VFSModule) {
+	s := &DAVServer{Broker: b, VFS: vfs}
+	// WebDAV uses its own methods (PROPFIND, MKCOL, LOCK...), so no method filter.
+	r.PathPrefix(davPrefix).Handler(http.HandlerFunc(s.handleDAV))
+}
+
+// handleDAV authenticates the request like the bus endpoints do, then serves
+// it from a file system jailed to the user's home and mounts.
+func (s *DAVServer) handleDAV(w http.ResponseWriter, r *http.Request) {
+	userID, err := UserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	// Infinite lock timeouts are indistinguishable from the handler's own
+	// per-request locks, and VFS leases are bounded anyway.
+	if r.Method == "LOCK" && !strings.HasPrefix(r.Header.Get("Timeout"), "Second-") {
+		r.Header.Set("Timeout", fmt.Sprintf("Second-%d", int(aether.MaxLockTTL.Seconds())))
+	}
+
+	fs := &davFS{server: s, user: userID}
+	h := &webdav.Handler{
+		Prefix:     davPrefix,
+		FileSystem: fs,
+		LockSystem: &davLockSystem{fs: fs},
+		Logger: func(r *http.Request, err error) {
+			if err != nil {
+				log.Printf("WebDAV: %s %s for %s: %v", r.Method, r.URL.Path, userID, err)
+			}
+		},
+	}
+	h.ServeHTTP(w, r)
+}
+
+// davFS adapts the VFS to webdav.FileSystem for one user.
+type davFS struct {
+	server *DAVServer
+	user   string
+}
+
+func (fs *davFS) opts() aether.WriteOptions {
+	return aether.WriteOptions{User: fs.user, App: davApp}
+}
+
+func (fs *davFS) telemetry(operation, key string, err error, size int64) {
+	aether.PublishVfsTelemetry(fs.server.Broker, operation, key, err, size)
+}
+
+// resolve maps a WebDAV name, relative to the user's home, to a storage key
+// with the same jailing as bus requests.
+func (fs *davFS) resolve(name string, write bool) (string, error) {
+	// As over REST, WebDAV clients act without an app to hold the permission.
+	key, err := fs.server.VFS.ResolveForApp(nil, davApp, fs.user, strings.TrimPrefix(name, "/"), write)
+	if err != nil {
+		log.Printf("WebDAV: %s denied %s: %v", fs.user, name, err)
+		return "", os.ErrPermission
+	}
+	return key, nil
+}
+
+// stat returns information about the item at key. The home directory
+// exists even while it is empty.
+func (fs *davFS) stat(key string) (*aether.FileInfo, error) {
+	info, err := fs.server.VFS.Stat(key)
+	if aether.IsNotFound(err) && key == strings.TrimPrefix(aether.HomeDir(fs.user), "/") {
+		return &aether.FileInfo{Name: path.Base(key), IsDir: true, Path: aether.VirtualPath(key)}, nil
+	}
+	if aether.IsNotFound(err) {
+		return nil, os.ErrNotExist
+	}
+	return info, err
+}
+
+func (fs *davFS) Mkdir(ctx context.Context, name string, perm os.FileMode) error {
+	key, err := fs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	if _, err := fs.stat(key); err == nil {
+		return os.ErrExist
+	}
+	err = fs.server.VFS.CreateDir(path.Dir(key), path.Base(key), fs.opts())
+	fs.telemetry("create_folder", key, err, 0)
+	return err
+}
+
+func (fs *davFS) OpenFile(ctx context.Context, name string, flag int, perm os.FileMode) (webdav.File, error) {
+	write := flag&(os.O_WRONLY|os.O_RDWR|os.O_CREATE|os.O_TRUNC) != 0
+	key, err := fs.resolve(name, write)
+	if err != nil {
+		return nil, err
+	}
+
+	info, err := fs.stat(key)
+	switch {
+	case err == os.ErrNotExist && flag&os.O_CREATE != 0:
+		info = &aether.FileInfo{Name: path.Base(key), Path: aether.VirtualPath(key), ModTime: time.Now()}
+	case err != nil:
+		return nil, err
+	case flag&(os.O_CREATE|os.O_EXCL) == os.O_CREATE|os.O_EXCL:
+		return nil, os.ErrExist
+	}
+
+	f := &davFile{fs: fs, key: key, info: info, writable: write}
+	if info.IsDir {
+		if write {
+			return nil, os.ErrPermission
+		}
+		return f, nil
+	}
+	// New and truncated files start out empty in memory. Anything else is
+	// streamed from the VFS until it is written to.
+	f.dirty = info.Revision == "" || flag&os.O_TRUNC != 0
+	f.buffered = f.dirty
+	return f, nil
+}
+
+func (fs *davFS) RemoveAll(ctx context.Context, name string) error {
+	key, err := fs.resolve(name, true)
+	if err != nil {
+		return err
+	}
+	entry, err := fs.server.VFS.Delete(key, fs.opts())
+	var size int64
+	if entry != nil {
+		size = entry.Size
+	}
+	fs.telemetry("delete", key, err, size)
+	if aether.IsNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (fs *davFS) Rename(ctx context.Context, oldName, newName string) error {
+	oldKey, err := fs.resolve(oldName, true)
+	if err != nil {
+		return err
+	}
+	newKey, err := fs.resolve(newName, true)
+	if err != nil {
+		return err
+	}
+	err = fs.server.VFS.Move(oldKey, newKey, fs.opts())
+	fs.telemetry("move", oldKey, err, 0)
+	if aether.IsNotFound(err) {
+		return os.ErrNotExist
+	}
+	return err
+}
+
+func (fs *davFS) Stat(ctx context.Context, name string) (os.FileInfo, error) {
+	key, err := fs.resolve(name, false)
+	if err != nil {
+		return nil, err
+	}
+	info, err := fs.stat(key)
+	if err != nil {
+		return nil, err
+	}
+	return davFileInfo{info}, nil
+}
+
+// errDAVTooLarge is returned for writes that would make a file larger than
+// a WebDAV client may write, since files being written are held in memory.
+var errDAVTooLarge = fmt.Errorf("file too large: WebDAV writes are limited to %d bytes", maxPutBytes)
+
+// davFile is an open WebDAV file or folder. Reads are streamed from the VFS;
+// a file that is written to is held in memory, up to maxPutBytes, and written
+// back to the VFS when it is closed.
+type davFile struct {
+	fs       *davFS
+	key      string
+	info     *aether.FileInfo
+	data     []byte // The file's content, once buffered.
+	buffered bool
+	offset   int64
+	writable bool
+	dirty    bool
+	entries  []os.FileInfo // Unread folder entries, once listed.
+	listed   bool
+
+	// reader streams the file from readerOffset while reads are sequential.
+	reader       io.ReadCloser
+	readerOffset int64
+	read         int64 // Bytes streamed, for telemetry.
+}
+
+func (f *davFile) Read(p []byte) (int, error) {
+	if f.info.IsDir {
+		return 0, os.ErrInvalid
+	}
+	if !f.buffered {
+		return f.readStream(p)
+	}
+	if f.offset >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+	n := copy(p, f.data[f.offset:])
+	f.offset += int64(n)
+	return n, nil
+}
+
+// readStream reads from the VFS at the current offset, reusing the open
+// reader unless the file was seeked since the last read.
+func (f *davFile) readStream(p []byte) (int, error) {
+	if f.offset >= f.info.Size {
+		return 0, io.EOF
+	}
+	if f.reader != nil && f.readerOffset != f.offset {
+		f.closeReader()
+	}
+	if f.reader == nil {
+		rc, _, err := f.fs.server.VFS.Open(f.key, f.offset, -1)
+		if err != nil {
+			f.fs.telemetry("read", f.key, err, 0)
+			return 0, err
+		}
+		f.reader, f.readerOffset = rc, f.offset
+	}
+	n, err := f.reader.Read(p)
+	f.offset += int64(n)
+	f.readerOffset += int64(n)
+	f.read += int64(n)
+	if err != nil && err != io.EOF {
+		f.fs.telemetry("read", f.key, err, 0)
+		f.closeReader()
+	}
+	return n, err
+}
+
+func (f *davFile) closeReader() {
+	if f.reader != nil {
+		f.reader.Close()
+		f.reader = nil
+	}
+}
+
+// buffer loads the file into memory so it can be modified.
+func (f *davFile) buffer() error {
+	if f.buffered {
+		return nil
+	}
+	if f.info.Size > maxPutBytes {
+		return errDAVTooLarge
+	}
+	f.closeReader()
+	rc, _, err := f.fs.server.VFS.Open(f.key, 0, -1)
+	if err == nil {
+		f.data, err = io.ReadAll(io.LimitReader(rc, maxPutBytes+1))
+		rc.Close()
+	}
+	f.fs.telemetry("read", f.key, err, int64(len(f.data)))
+	if err != nil {
+		return err
+	}
+	if len(f.data) > maxPutBytes {
+		f.data = nil
+		return errDAVTooLarge
+	}
+	f.buffered = true
+	return nil
+}
+
+func (f *davFile) size() int64 {
+	if f.buffered {
+		return int64(len(f.data))
+	}
+	return f.info.Size
+}
+
+func (f *davFile) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += f.offset
+	case io.SeekEnd:
+		offset += f.size()
+	default:
+		return 0, os.ErrInvalid
+	}
+	if offset < 0 {
+		return 0, os.ErrInvalid
+	}
+	f.offset = offset
+	return offset, nil
+}
+
+func (f *davFile) Write(p []byte) (int, error) {
+	if !f.writable || f.info.IsDir {
+		return 0, os.ErrPermission
+	}
+	if err := f.buffer(); err != nil {
+		return 0, err
+	}
+	end := f.offset + int64(len(p))
+	if end > maxPutBytes {
+		// Drop what was written so far, so Close leaves the file as it was.
+		f.data, f.dirty, f.writable = nil, false, false
+		return 0, errDAVTooLarge
+	}
+	if end > int64(len(f.data)) {
+		f.data = append(f.data, make([]byte, end-int64(len(f.data)))...)
+	}
+	n := copy(f.data[f.offset:], p)
+	f.offset += int64(n)
+	f.dirty = true
+	return n, nil
+}
+
+func (f *davFile) Readdir(count int) ([]os.FileInfo, error) {
+	if !f.info.IsDir {
+		return nil, os.ErrInvalid
+	}
+	if !f.listed {
+		files, err := f.fs.server.VFS.List(f.key)
+		f.fs.telemetry("list", f.key, err, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			f.entries = append(f.entries, davFileInfo{file})
+		}
+		f.listed = true
+	}
+	if count <= 0 {
+		entries := f.entries
+		f.entries = nil
+		return entries, nil
+	}
+	if len(f.entries) == 0 {
+		return nil, io.EOF
+	}
+	n := min(count, len(f.entries))
+	entries := f.entries[:n]
+	f.entries = f.entries[n:]
+	return entries, nil
+}
+
+func (f *davFile) Stat() (os.FileInfo, error) {
+	return davFileInfo{f.info}, nil
+}
+
+func (f *davFile) Close() error {
+	f.closeReader()
+	if f.read > 0 {
+		f.fs.telemetry("read", f.key, nil, f.read)
+		f.read = 0
+	}
+	if !f.writable || !f.dirty {
+		return nil
+	}
+	_, err := f.fs.server.VFS.WriteWithOptions(f.key, bytes.Clone(f.data), f.fs.opts())
+	f.fs.telemetry("write", f.key, err, int64(len(f.data)))
+	if err == nil {
+		f.dirty = false
+	}
+	return err
+}
+
+// davFileInfo adapts aether.FileInfo to os.FileInfo. It also reports the
+// file's revision as its ETag.
+type davFileInfo struct {
+	info *aether.FileInfo
+}
+
+func (fi davFileInfo) Name() string       { return fi.info.Name }
+func (fi davFileInfo) Size() int64        { return fi.info.Size }
+func (fi davFileInfo) ModTime() time.Time { return fi.info.ModTime }
+func (fi davFileInfo) IsDir() bool        { return fi.info.IsDir }
+func (fi davFileInfo) Sys() interface{}   { return nil }
+
+func (fi davFileInfo) Mode() os.FileMode {
+	if fi.info.IsDir {
+		return os.ModeDir | 0755
+	}
+	return 0644
+}
+
+// ETag implements webdav.ETager.
+func (fi davFileInfo) ETag(ctx context.Context) (string, error) {
+	if fi.info.Revision == "" {
+		return "", webdav.ErrNotImplemented
+	}
+	return `"` + fi.info.Revision + `"`, nil
+}
+
+// davLockSystem maps WebDAV locks onto exclusive VFS locks, so they exclude
+// writers on the bus as well as other WebDAV clients.
+type davLockSystem struct {
+	fs *davFS
+}
+
+// Confirm checks that no lock stands in the way of changing name0 and name1.
+// As WebDAV requires, even the user's own locks must be named by token in
+// the request's If header.
+func (ls *davLockSystem) Confirm(now time.Time, name0, name1 string, conditions ...webdav.Condition) (func(), error) {
+	tokens := make(map[string]bool)
+	for _, c := range conditions {
+		if c.Token == "" || c.Not {
+			continue
+		}
+		if ls.lock(c.Token) == nil {
+			return nil, webdav.ErrConfirmationFailed
+		}
+		tokens[strings.TrimPrefix(c.Token, davLockTokenPrefix)] = true
+	}
+	for _, name := range []string{name0, name1} {
+		if name == "" {
+			continue
+		}
+		key, err := ls.fs.resolve(name, false)
+		if err != nil {
+			return nil, err
+		}
+		for _, l := range ls.fs.server.VFS.Locks(key) {
+			if l.Mode == aether.LockExclusive && !tokens[l.ID] {
+				return nil, webdav.ErrLocked
+			}
+		}
+	}
+	return func() {}, nil
+}
+
+// lock returns the VFS lock behind a token, if the user holds it.
+func (ls *davLockSystem) lock(token string) *aether.Lock {
+	l := ls.fs.server.VFS.LockByID(strings.TrimPrefix(token, davLockTokenPrefix))
+	if l == nil || l.User != ls.fs.user || l.App != davApp {
+		return nil
+	}
+	return l
+}
+
+// Create locks details.Root. Locks with no duration are taken by the handler
+// around a single request; they only check that nothing is locked and are
+// not recorded, since the write itself checks locks again.
+func (ls *davLockSystem) Create(now time.Time, details webdav.LockDetails) (string, error) {
+	key, err := ls.fs.resolve(details.Root, true)
+	if err != nil {
+		return "", err
+	}
+	for _, l := range ls.fs.server.VFS.Locks(key) {
+		if l.Mode == aether.LockExclusive {
+			return "", webdav.ErrLocked
+		}
+	}
+	if details.Duration < 0 {
+		return davRequestToken, nil
+	}
+	l, err := ls.fs.server.VFS.AcquireLock(key, aether.LockExclusive, "", details.Duration, ls.fs.opts())
+	var locked *aether.LockedError
+	if errors.As(err, &locked) {
+		return "", webdav.ErrLocked
+	}
+	if err != nil {
+		return "", err
+	}
+	return davLockTokenPrefix + l.ID, nil
+}
+
+func (ls *davLockSystem) Refresh(now time.Time, token string, duration time.Duration) (webdav.LockDetails, error) {
+	l := ls.lock(token)
+	if l == nil {
+		return webdav.LockDetails{}, webdav.ErrNoSuchLock
+	}
+	l, err := ls.fs.server.VFS.AcquireLock(strings.TrimPrefix(l.Path, "/"), l.Mode, l.ID, duration, ls.fs.opts())
+	if err != nil {
+		return webdav.LockDetails{}, err
+	}
+	home := aether.HomeDir(ls.fs.user)
+	return webdav.LockDetails{
+		Root:     "/" + strings.TrimPrefix(strings.TrimPrefix(l.Path, home), "/"),
+		Duration: time.Until(l.Expires),
+	}, nil
+}
+
+func (ls *davLockSystem) Unlock(now time.Time, token string) error {
+	if token == davRequestToken {
+		return nil
+	}
+	if ls.lock(token) == nil {
+		return webdav.ErrNoSuchLock
+	}
+	_, err := ls.fs.server.VFS.ReleaseLock(strings.TrimPrefix(token, davLockTokenPrefix), ls.fs.opts())
+	return err
+}
@@ -0,0 +1,346 @@
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"path"
+	"strconv"
+	"strings"
+
+	"aether/broker/aether"
+	"github.com/gorilla/mux"
+)
+
+const (
+	// fsPrefix is where the REST API is served. The rest of the URL path is
+	// the absolute virtual path of the file or folder.
+	fsPrefix = "/v1/fs"
+	// fsApp is the app identity REST clients write and lock as.
+	fsApp = "rest"
+	// maxPutBytes bounds the body of a PUT, or a file written over WebDAV,
+	// which is held in memory.
+	maxPutBytes = 256 << 20
+)
+
+// FSServer serves the VFS as a plain REST API.
+type FSServer struct {
+	Broker *aether.Broker
+	VFS    *aether.VFSModule
+}
+
+// RegisterFSRoutes registers the REST file API with the router:
+//
+//	GET    /v1/fs/<path>        download a file (Range, If-None-Match) or list a folder
+//	GET    /v1/fs/<path>?stat   file or folder information as JSON
+//	HEAD   /v1/fs/<path>        file headers without the body
+//	PUT    /v1/fs/<path>        create or replace a file (If-Match, If-None-Match: *)
+//	DELETE /v1/fs/<path>        move a file or folder to the trash (If-Match)
+func RegisterFSRoutes(r *mux.Router, b *aether.Broker, vfs *aether.VFSModule) {
+	s := &FSServer{Broker: b, VFS: vfs}
+	r.PathPrefix(fsPrefix+"/").HandlerFunc(s.handleFS).Methods("GET", "HEAD", "PUT", "DELETE")
+}
+
+func (s *FSServer) handleFS(w http.ResponseWriter, r *http.Request) {
+	userID, err := UserIDFromRequest(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+
+	p := "/" + strings.TrimPrefix(r.URL.Path, fsPrefix+"/")
+	write := r.Method == "PUT" || r.Method == "DELETE"
+	// Only apps can hold permissions, and REST clients act without one.
+	key, err := s.VFS.ResolveForApp(nil, fsApp, userID, p, write)
+	if err != nil {
+		writeFSError(w, http.StatusForbidden, err)
+		return
+	}
+	opts := aether.WriteOptions{User: userID, App: fsApp}
+
+	switch r.Method {
+	case "GET", "HEAD":
+		s.handleGet(w, r, key)
+	case "PUT":
+		s.handlePut(w, r, key, opts)
+	case "DELETE":
+		opts.IfMatch = trimETag(r.Header.Get("If-Match"))
+		entry, err := s.VFS.Delete(key, opts)
+		var size int64
+		if entry != nil {
+			size = entry.Size
+		}
+		s.telemetry("delete", key, err, size)
+		if err != nil {
+			writeFSError(w, fsErrorStatus(err), err)
+			return
+		}
+		writeFSJSON(w, http.StatusOK, map[string]interface{}{"path": aether.VirtualPath(key), "trash": entry})
+	}
+}
+
+func (s *FSServer) telemetry(operation, key string, err error, size int64) {
+	aether.PublishVfsTelemetry(s.Broker, operation, key, err, size)
+}
+
+// handleGet serves file contents, folder listings and information.
+func (s *FSServer) handleGet(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	info, err := s.VFS.Stat(key)
+	if err != nil {
+		writeFSError(w, fsErrorStatus(err), err)
+		return
+	}
+	if query.Has("stat") {
+		writeFSJSON(w, http.StatusOK, map[string]interface{}{"path": aether.VirtualPath(key), "file": info})
+		return
+	}
+	if info.IsDir {
+		s.handleList(w, r, key)
+		return
+	}
+
+	etag := `"` + info.Revision + `"`
+	w.Header().Set("ETag", etag)
+	w.Header().Set("Last-Modified", info.ModTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("Accept-Ranges", "bytes")
+	if match := r.Header.Get("If-Match"); match != "" && !etagMatches(match, etag) {
+		w.WriteHeader(http.StatusPreconditionFailed)
+		return
+	}
+	if match := r.Header.Get("If-None-Match"); match != "" && etagMatches(match, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	offset, length, status := int64(0), info.Size, http.StatusOK
+	if rangeHeader := r.Header.Get("Range"); rangeHeader != "" {
+		// A stale If-Range means the client's partial copy is useless, so
+		// it gets the whole file.
+		if ifRange := r.Header.Get("If-Range"); ifRange == "" || ifRange == etag {
+			var ok bool
+			offset, length, ok = parseRange(rangeHeader, info.Size)
+			if !ok {
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes */%d", info.Size))
+				writeFSError(w, http.StatusRequestedRangeNotSatisfiable, fmt.Errorf("invalid range %q for %d bytes", rangeHeader, info.Size))
+				return
+			}
+			if offset != 0 || length != info.Size {
+				status = http.StatusPartialContent
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", offset, offset+length-1, info.Size))
+			}
+		}
+	}
+
+	contentType := mime.TypeByExtension(path.Ext(key))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.FormatInt(length, 10))
+	if r.Method == "HEAD" {
+		w.WriteHeader(status)
+		return
+	}
+
+	rc, _, err := s.VFS.Open(key, offset, length)
+	if err != nil {
+		s.telemetry("read", key, err, 0)
+		w.Header().Del("Content-Length")
+		writeFSError(w, fsErrorStatus(err), err)
+		return
+	}
+	defer rc.Close()
+	w.WriteHeader(status)
+	n, err := io.Copy(w, rc)
+	s.telemetry("read", key, err, n)
+	if err != nil {
+		log.Printf("REST: failed to stream %s: %v", key, err)
+	}
+}
+
+// handleList serves a folder listing, taking the options of vfs:list from
+// the query string.
+func (s *FSServer) handleList(w http.ResponseWriter, r *http.Request, key string) {
+	query := r.URL.Query()
+	opts := aether.ListOptions{
+		Glob:   query.Get("glob"),
+		SortBy: query.Get("sortBy"),
+		Desc:   query.Get("order") == "desc",
+		Cursor: query.Get("cursor"),
+	}
+	if recursive, _ := strconv.ParseBool(query.Get("recursive")); recursive {
+		opts.Depth = -1
+	}
+	if depth, err := strconv.Atoi(query.Get("depth")); err == nil {
+		opts.Depth = depth
+	}
+	if pageSize, err := strconv.Atoi(query.Get("pageSize")); err == nil {
+		opts.PageSize = pageSize
+	}
+
+	page, err := s.VFS.ListWithOptions(key, opts)
+	s.telemetry("list", key, err, 0)
+	if err != nil {
+		writeFSError(w, http.StatusBadRequest, err)
+		return
+	}
+	writeFSJSON(w, http.StatusOK, map[string]interface{}{
+		"path":       aether.VirtualPath(key),
+		"files":      page.Files,
+		"nextCursor": page.NextCursor,
+		"total":      page.Total,
+	})
+}
+
+// handlePut replaces a file with the request body.
+func (s *FSServer) handlePut(w http.ResponseWriter, r *http.Request, key string, opts aether.WriteOptions) {
+	opts.IfMatch = trimETag(r.Header.Get("If-Match"))
+	if r.Header.Get("If-None-Match") == "*" {
+		opts.IfMatch = aether.NoRevision
+	}
+	existing, err := s.VFS.Stat(key)
+	if err != nil && !aether.IsNotFound(err) {
+		writeFSError(w, fsErrorStatus(err), err)
+		return
+	}
+	if existing != nil && existing.IsDir {
+		writeFSError(w, http.StatusConflict, fmt.Errorf("%s is a folder", aether.VirtualPath(key)))
+		return
+	}
+
+	content, err := io.ReadAll(http.MaxBytesReader(w, r.Body, maxPutBytes))
+	if err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeFSError(w, http.StatusRequestEntityTooLarge, err)
+			return
+		}
+		writeFSError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	revision, err := s.VFS.WriteWithOptions(key, content, opts)
+	s.telemetry("write", key, err, int64(len(content)))
+	if err != nil {
+		writeFSError(w, fsErrorStatus(err), err)
+		return
+	}
+	status := http.StatusOK
+	if existing == nil {
+		status = http.StatusCreated
+		w.Header().Set("Location", fsPrefix+aether.VirtualPath(key))
+	}
+	w.Header().Set("ETag", `"`+revision+`"`)
+	writeFSJSON(w, status, map[string]interface{}{"path": aether.VirtualPath(key), "revision": revision})
+}
+
+// parseRange parses a Range header with a single byte range against a file
+// of size bytes. Requests for several ranges are served the whole file.
+func parseRange(header string, size int64) (offset, length int64, ok bool) {
+	spec, found := strings.CutPrefix(header, "bytes=")
+	if !found {
+		return 0, 0, false
+	}
+	if strings.Contains(spec, ",") {
+		return 0, size, true
+	}
+	first, last, found := strings.Cut(strings.TrimSpace(spec), "-")
+	if !found {
+		return 0, 0, false
+	}
+	if first == "" {
+		// A suffix range: the last n bytes.
+		n, err := strconv.ParseInt(last, 10, 64)
+		if err != nil || n <= 0 {
+			return 0, 0, false
+		}
+		n = min(n, size)
+		return size - n, n, true
+	}
+	start, err := strconv.ParseInt(first, 10, 64)
+	if err != nil || start < 0 || start >= size {
+		return 0, 0, false
+	}
+	end := size - 1
+	if last != "" {
+		end, err = strconv.ParseInt(last, 10, 64)
+		if err != nil || end < start {
+			return 0, 0, false
+		}
+		end = min(end, size-1)
+	}
+	return start, end - start + 1, true
+}
+
+// trimETag turns an If-Match header into a revision, ignoring "*".
+func trimETag(header string) string {
+	header = strings.TrimPrefix(strings.TrimSpace(header), "W/")
+	if header == "*" {
+		return ""
+	}
+	return strings.Trim(header, `"`)
+}
+
+// etagMatches reports whether a list of entity tags from a conditional
+// header contains etag or "*".
+func etagMatches(header, etag string) bool {
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+		if tag == "*" || tag == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// fsErrorStatus maps a VFS error to an HTTP status.
+func fsErrorStatus(err error) int {
+	var conflict *aether.ConflictError
+	var locked *aether.LockedError
+	var quota *aether.QuotaError
+	switch {
+	case aether.IsNotFound(err):
+		return http.StatusNotFound
+	case errors.As(err, &conflict):
+		return http.StatusPreconditionFailed
+	case errors.As(err, &locked):
+		return http.StatusLocked
+	case errors.As(err, &quota):
+		return http.StatusInsufficientStorage
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// writeFSError writes an error as JSON, with the same fields the VFS
+// service puts in its error payloads.
+func writeFSError(w http.ResponseWriter, status int, err error) {
+	payload := map[string]interface{}{"error": err.Error()}
+	var conflict *aether.ConflictError
+	if errors.As(err, &conflict) {
+		payload["code"] = "conflict"
+		payload["path"] = conflict.Path
+		payload["expectedRevision"] = conflict.ExpectedRevision
+		payload["currentRevision"] = conflict.CurrentRevision
+	}
+	var locked *aether.LockedError
+	if errors.As(err, &locked) {
+		payload["code"] = "locked"
+		payload["path"] = locked.Path
+		payload["lock"] = locked.Lock
+	}
+	writeFSJSON(w, status, payload)
+}
+
+func writeFSJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("REST: failed to write response: %v", err)
+	}
+}
@@ -0,0 +1,78 @@
+package services
+
+import (
+	"aether/broker/aether"
+	"aether/broker/compute"
+	"bytes"
+	"encoding/base64"
+	"io"
+	"log"
+	"sync"
+	"sync/atomic"
+	"unicode/utf8"
+)
+
+// maxOutputLog caps the output saved to an instance's log file.
+const maxOutputLog = 16 << 20
+
+// streamPipe publishes what an instance writes to pipe as chunks on
+// topicName until the guest's end is closed. Each chunk carries the next of
+// the instance's sequence numbers, which order its output and lifecycle
+// events across topics. Data that is not valid UTF-8 is sent in base64.
+// If capture is not nil, the output is also appended to it.
+func (s *ComputeService) streamPipe(instanceID string, originalEnv *aether.Envelope, pipe io.Reader, topicName string, seq *atomic.Uint64, capture *outputLog) {
+	err := compute.ReadChunks(pipe, compute.DefaultChunkSize, compute.DefaultFlushInterval, func(chunk []byte) {
+		if capture != nil {
+			capture.Write(chunk)
+		}
+		data, encoding := string(chunk), "utf8"
+		if !utf8.Valid(chunk) {
+			data, encoding = base64.StdEncoding.EncodeToString(chunk), "base64"
+		}
+		s.publishResponse(originalEnv, topicName, map[string]interface{}{
+			"instanceId": instanceID,
+			"seq":        seq.Add(1),
+			"data":       data,
+			"encoding":   encoding,
+		})
+	})
+	if err != nil && err != io.ErrClosedPipe {
+		log.Printf("Error reading from pipe for instance %s on topic %s: %v", instanceID, topicName, err)
+		s.publishError(originalEnv, "Error reading from instance pipe: "+err.Error())
+	}
+}
+
+// outputLog collects an instance's stdout and stderr, interleaved as they
+// arrive, to be saved to a VFS file when it ends.
+type outputLog struct {
+	mu        sync.Mutex
+	buf       bytes.Buffer
+	truncated bool
+}
+
+func (l *outputLog) Write(p []byte) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if room := maxOutputLog - l.buf.Len(); len(p) > room {
+		p = p[:room]
+		l.truncated = true
+	}
+	l.buf.Write(p)
+}
+
+// saveOutputLog writes the output collected in capture to the file at key.
+func (s *ComputeService) saveOutputLog(originalEnv *aether.Envelope, capture *outputLog, key string, opts aether.WriteOptions) {
+	capture.mu.Lock()
+	content := bytes.Clone(capture.buf.Bytes())
+	if capture.truncated {
+		content = append(content, "\n[output truncated]\n"...)
+	}
+	capture.mu.Unlock()
+
+	_, err := s.vfs.WriteWithOptions(key, content, opts)
+	aether.PublishVfsTelemetry(s.broker, "write", key, err, int64(len(content)))
+	if err != nil {
+		log.Printf("Compute Service: Failed to save output log %s: %v", key, err)
+		s.publishError(originalEnv, "Failed to save output log: "+err.Error())
+	}
+}
@@ -0,0 +1,108 @@
+package services
+
+import (
+	"aether/broker/aether"
+	"aether/broker/compute"
+	"fmt"
+	"io"
+	"log"
+
+	"github.com/google/uuid"
+)
+
+// maxPipelineStages caps the number of instances one vm:pipeline starts.
+const maxPipelineStages = 16
+
+// pipelineRequest is the payload of vm:pipeline. Each stage is a vm:create
+// request; stages run concurrently with each one's stdout connected to the
+// next one's stdin.
+type pipelineRequest struct {
+	Stages []createRequest `json:"stages"`
+}
+
+// runPipeline starts the stages of a pipeline requested by appId for userId
+// in a bus session.
+// vm:stdin writes to the first stage and the last stage's stdout is streamed
+// to vm:stdout; every stage streams its own stderr. The pipes between stages
+// are synchronous, so a stage writing faster than the next one reads is
+// blocked rather than buffered.
+func (s *ComputeService) runPipeline(env *aether.Envelope, appId, userId, session string, req pipelineRequest) {
+	if len(req.Stages) < 2 || len(req.Stages) > maxPipelineStages {
+		s.publishError(env, fmt.Sprintf("vm:pipeline needs between 2 and %d stages", maxPipelineStages))
+		return
+	}
+	specs := make([]instanceSpec, len(req.Stages))
+	for i, stage := range req.Stages {
+		spec, err := s.instanceSpec(appId, userId, stage)
+		if err != nil {
+			s.publishError(env, fmt.Sprintf("stage %d: %v", i+1, err))
+			return
+		}
+		spec.session = session
+		specs[i] = spec
+	}
+
+	// Every stage is instantiated before any starts, so a pipeline either
+	// runs whole or not at all.
+	stages := make([]*preparedInstance, 0, len(specs))
+	var next io.Reader
+	for i, spec := range specs {
+		stdio := instanceIO{stdin: next}
+		var pipeReader *io.PipeReader
+		if i < len(specs)-1 {
+			pipeReader, stdio.stdout = io.Pipe()
+		}
+		prepared, err := s.prepareInstance(env, spec, stdio)
+		if err != nil {
+			for _, stage := range stages {
+				stage.release()
+			}
+			s.publishError(env, fmt.Sprintf("stage %d: %v", i+1, err))
+			return
+		}
+		stages = append(stages, prepared)
+		next = pipeReader
+	}
+
+	pipelineID := uuid.New().String()
+	instanceIDs := make([]string, len(stages))
+	for i, stage := range stages {
+		instanceIDs[i] = stage.id
+	}
+	s.publishResponse(env, "vm:pipeline:started", map[string]interface{}{
+		"pipelineId":  pipelineID,
+		"instanceIds": instanceIDs,
+	})
+	for _, stage := range stages {
+		stage.start()
+	}
+
+	go func() {
+		results := make([]map[string]interface{}, len(stages))
+		statuses := make([]*compute.ExitStatus, len(stages))
+		for i, stage := range stages {
+			<-stage.done
+			statuses[i] = stage.status
+			results[i] = exitPayload(stage.id, stage.status)
+		}
+		status := pipelineStatus(statuses)
+		log.Printf("Compute Service: pipeline %s %s", pipelineID, status)
+		payload := exitPayload("", status)
+		delete(payload, "instanceId")
+		payload["pipelineId"] = pipelineID
+		payload["stages"] = results
+		s.publishResponse(env, "vm:pipeline:exited", payload)
+	}()
+}
+
+// pipelineStatus combines the exit statuses of a pipeline's stages the way
+// a shell with pipefail does: the pipeline ends as its last stage that did
+// not exit with code 0, or as its last stage if they all did.
+func pipelineStatus(statuses []*compute.ExitStatus) *compute.ExitStatus {
+	for i := len(statuses) - 1; i >= 0; i-- {
+		if status := statuses[i]; status.State != compute.StateExited || status.ExitCode != 0 {
+			return status
+		}
+	}
+	return statuses[len(statuses)-1]
+}
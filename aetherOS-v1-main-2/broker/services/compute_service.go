@@ -1,41 +1,47 @@
-
 package services
 
 import (
 	"aether/broker/aether"
 	"aether/broker/compute"
-	"bufio"
 	"context"
+	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/google/uuid"
 	"github.com/tetratelabs/wazero"
-	"github.com/tetratelabs/wazero/imports/wasi_snapshot_preview1"
 )
 
 // ComputeService handles WASM execution requests from the message bus.
 type ComputeService struct {
 	broker      *aether.Broker
 	runtime     *compute.WazeroRuntime
+	vfs         *aether.VFSModule
 	permissions *aether.PermissionManager
 }
 
 // NewComputeService creates a new compute service.
-func NewComputeService(broker *aether.Broker, runtime *compute.WazeroRuntime, permissions *aether.PermissionManager) *ComputeService {
+func NewComputeService(broker *aether.Broker, runtime *compute.WazeroRuntime, vfs *aether.VFSModule, permissions *aether.PermissionManager) *ComputeService {
 	return &ComputeService{
 		broker:      broker,
 		runtime:     runtime,
+		vfs:         vfs,
 		permissions: permissions,
 	}
 }
 
 // Run starts the compute service's listeners.
 func (s *ComputeService) Run() {
-	topics := []string{"vm:create", "vm:kill", "vm:stdin"}
+	topics := []string{"vm:create", "vm:pipeline", "vm:kill", "vm:stdin", "vm:list", "vm:inspect", "vm:killall"}
 	for _, topicName := range topics {
 		topic := s.broker.GetTopic(topicName)
 		log.Printf("Compute Service listening on topic: %s", topicName)
@@ -47,17 +53,45 @@ func (s *ComputeService) Run() {
 			}
 		}(broadcastChan)
 	}
+
+	// Instances whose policy does not let them outlive their session are
+	// killed when it closes.
+	s.broker.OnSessionClosed(s.closeSession)
+}
+
+// closeSession kills the instances created in a session that has closed,
+// unless their policy lets them outlive it. It is registered as a session
+// handler.
+func (s *ComputeService) closeSession(userId, sessionId string) {
+	if sessionId == "" {
+		return
+	}
+	for _, info := range s.runtime.List() {
+		if info.Session != sessionId || compute.ProfilePolicy(info.Profile).OutliveSession {
+			continue
+		}
+		if instance, ok := s.runtime.Get(info.ID); ok {
+			log.Printf("Compute Service: killing instance %s as its session has closed", info.ID)
+			instance.Kill()
+		}
+	}
 }
 
 func (s *ComputeService) handleRequest(env *aether.Envelope) {
 	var meta struct {
-		AppId string `json:"appId"`
+		AppId     string `json:"appId"`
+		UserId    string `json:"userId"`
+		SessionId string `json:"sessionId"`
 	}
 	if err := json.Unmarshal(env.Meta, &meta); err != nil {
 		s.publishError(env, "Invalid metadata: could not determine origin app")
 		return
 	}
 	appId := meta.AppId
+	userId := meta.UserId
+	if userId == "" {
+		userId = aether.DefaultUser
+	}
 	log.Printf("Compute Service processing message ID %s on topic %s from app %s", env.ID, env.Topic, appId)
 
 	if !s.permissions.HasPermission(appId, "vm_run") {
@@ -69,14 +103,25 @@ func (s *ComputeService) handleRequest(env *aether.Envelope) {
 
 	switch env.Topic {
 	case "vm:create":
-		var req struct {
-			WasmBase64 string `json:"wasmBase64"`
-		}
+		var req createRequest
 		if err := json.Unmarshal(rawPayload, &req); err != nil {
 			s.publishError(env, "Invalid payload for vm:create")
 			return
 		}
-		s.createInstance(env, req.WasmBase64)
+		spec, err := s.instanceSpec(appId, userId, req)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		spec.session = meta.SessionId
+		s.createInstance(env, spec)
+	case "vm:pipeline":
+		var req pipelineRequest
+		if err := json.Unmarshal(rawPayload, &req); err != nil {
+			s.publishError(env, "Invalid payload for vm:pipeline")
+			return
+		}
+		s.runPipeline(env, appId, userId, meta.SessionId, req)
 	case "vm:kill":
 		var req struct {
 			InstanceID string `json:"instanceId"`
@@ -85,7 +130,7 @@ func (s *ComputeService) handleRequest(env *aether.Envelope) {
 			s.publishError(env, "Invalid payload for vm:kill")
 			return
 		}
-		s.killInstance(env, req.InstanceID)
+		s.killInstance(env, appId, userId, req.InstanceID)
 	case "vm:stdin":
 		var req struct {
 			InstanceID string `json:"instanceId"`
@@ -95,95 +140,605 @@ func (s *ComputeService) handleRequest(env *aether.Envelope) {
 			s.publishError(env, "Invalid payload for vm:stdin")
 			return
 		}
-		s.writeToStdin(env, req.InstanceID, req.Data)
+		s.writeToStdin(env, appId, userId, req.InstanceID, req.Data)
+	case "vm:list":
+		var req instanceFilter
+		if len(rawPayload) > 0 {
+			if err := json.Unmarshal(rawPayload, &req); err != nil {
+				s.publishError(env, "Invalid payload for vm:list")
+				return
+			}
+		}
+		s.publishResponse(env, "vm:list:result", map[string]interface{}{
+			"instances": s.visibleInstances(appId, userId, req),
+		})
+	case "vm:inspect":
+		var req struct {
+			InstanceID string `json:"instanceId"`
+		}
+		if err := json.Unmarshal(rawPayload, &req); err != nil {
+			s.publishError(env, "Invalid payload for vm:inspect")
+			return
+		}
+		instance, ok := s.runtime.Get(req.InstanceID)
+		if !ok || !s.canManage(appId, userId, instance.Info()) {
+			s.publishError(env, "Instance not found")
+			return
+		}
+		s.publishResponse(env, "vm:inspect:result", instance.Info())
+	case "vm:killall":
+		var req instanceFilter
+		if err := json.Unmarshal(rawPayload, &req); err != nil {
+			s.publishError(env, "Invalid payload for vm:killall")
+			return
+		}
+		if req.AppID == "" && req.Owner == "" {
+			s.publishError(env, "vm:killall needs an appId or owner filter")
+			return
+		}
+		s.killAll(env, appId, userId, req)
+	}
+}
+
+// instanceFilter selects instances for vm:list and vm:killall. Empty fields
+// match every instance.
+type instanceFilter struct {
+	AppID string `json:"appId"`
+	Owner string `json:"owner"`
+}
+
+func (f instanceFilter) matches(info compute.InstanceInfo) bool {
+	return (f.AppID == "" || f.AppID == info.AppID) && (f.Owner == "" || f.Owner == info.Owner)
+}
+
+// isPrivileged reports whether appId runs with the privileged sandbox
+// profile. Privileged apps may see and manage every user's instances.
+func (s *ComputeService) isPrivileged(appId string) bool {
+	manifest, ok := s.permissions.GetManifest(appId)
+	return ok && manifest.Sandbox.Profile == "privileged"
+}
+
+// visibleInstances returns the instances matching filter that a request from
+// appId for userId may see: the user's own, or all for a privileged app.
+func (s *ComputeService) visibleInstances(appId, userId string, filter instanceFilter) []compute.InstanceInfo {
+	instances := make([]compute.InstanceInfo, 0)
+	for _, info := range s.runtime.List() {
+		if filter.matches(info) && s.canManage(appId, userId, info) {
+			instances = append(instances, info)
+		}
+	}
+	return instances
+}
+
+// canManage reports whether a request from appId for userId may inspect or
+// control an instance. Other users' instances are reported as not found to
+// unprivileged apps.
+func (s *ComputeService) canManage(appId, userId string, info compute.InstanceInfo) bool {
+	return info.Owner == userId || s.isPrivileged(appId)
+}
+
+// killAll kills the visible instances matching filter and reports their IDs.
+func (s *ComputeService) killAll(originalEnv *aether.Envelope, appId, userId string, filter instanceFilter) {
+	killed := make([]string, 0)
+	for _, info := range s.visibleInstances(appId, userId, filter) {
+		if instance, ok := s.runtime.Get(info.ID); ok {
+			instance.Kill()
+			killed = append(killed, info.ID)
+		}
+	}
+	log.Printf("Compute Service: app %s killed %d instances for user %s", appId, len(killed), userId)
+	s.publishResponse(originalEnv, "vm:killall:result", map[string]interface{}{"instanceIds": killed})
+}
+
+// appsRoot is the storage key installed apps live under, one folder per app ID.
+const appsRoot = "src/app/apps"
+
+// createRequest is the payload of vm:create. The module to run is given by
+// exactly one of WasmBase64, AppID or Path.
+type createRequest struct {
+	WasmBase64 string            `json:"wasmBase64"`
+	AppID      string            `json:"appId"` // An installed app, run with its own manifest.
+	Path       string            `json:"path"`  // A VFS path to a .wasm file.
+	Args       []string          `json:"args"`
+	Env        map[string]string `json:"env"`
+	WorkDir    string            `json:"workDir"` // Guest path of the initial working directory.
+	Limits     limitsRequest     `json:"limits"`
+	Mounts     []mountRequest    `json:"mounts"`
+	LogPath    string            `json:"logPath"` // A VFS file the output is saved to when the instance ends.
+}
+
+// instanceSpec resolves a vm:create request from appId into the module to
+// run and the identity it runs as. An app launched by ID runs as itself, with
+// its manifest's permissions and sandbox profile, if the requester may launch
+// it; anything else runs as the requesting app.
+func (s *ComputeService) instanceSpec(appId, userId string, req createRequest) (instanceSpec, error) {
+	spec := instanceSpec{appId: appId, userId: userId}
+	sources := 0
+	for _, source := range []string{req.WasmBase64, req.AppID, req.Path} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources != 1 {
+		return spec, fmt.Errorf("vm:create needs exactly one of wasmBase64, appId or path")
+	}
+	if err := validEnv(req.Env); err != nil {
+		return spec, err
+	}
+	if req.WorkDir != "" {
+		if err := compute.ValidGuestPath(req.WorkDir); err != nil {
+			return spec, fmt.Errorf("invalid working directory: %q", req.WorkDir)
+		}
+	}
+
+	var err error
+	switch {
+	case req.WasmBase64 != "":
+		spec.name = "main.wasm"
+		spec.wasm, err = base64.StdEncoding.DecodeString(req.WasmBase64)
+		if err != nil {
+			return spec, fmt.Errorf("Failed to decode wasm binary: %v", err)
+		}
+	case req.AppID != "":
+		spec.appId = req.AppID
+		spec.name = req.AppID
+		spec.wasm, err = s.appModule(appId, req.AppID)
+	default:
+		if !s.permissions.HasPermission(appId, "filesystem_read") {
+			return spec, fmt.Errorf("Permission denied: app '%s' requires 'filesystem_read' to run %s", appId, req.Path)
+		}
+		var key string
+		if key, err = s.vfs.ResolveForApp(s.permissions, appId, userId, req.Path, false); err == nil {
+			spec.name = path.Base(key)
+			spec.wasm, err = s.readModule(key)
+		}
+	}
+	if err != nil {
+		return spec, err
+	}
+
+	// The instance runs under the policy of its app's sandbox profile.
+	spec.policy = s.policyFor(spec.appId)
+	if len(req.Env) > 0 && !spec.policy.Env {
+		return spec, fmt.Errorf("Permission denied: the %s profile does not pass environment variables", spec.policy.Profile)
+	}
+	spec.args, spec.env, spec.workDir = req.Args, req.Env, req.WorkDir
+
+	// Mounts are checked against the requesting app as well, so launching an
+	// app cannot reach files the requester could not.
+	apps := []string{appId, spec.appId}
+	for _, mount := range req.Mounts {
+		for _, id := range apps {
+			if policy := s.policyFor(id); !policy.AllowsMount(mount.ReadOnly) {
+				return spec, fmt.Errorf("Permission denied: the %s profile of app '%s' does not allow mounting %s %s", policy.Profile, id, mountMode(mount.ReadOnly), mount.Path)
+			}
+		}
+	}
+	spec.mounts, err = s.guestMounts(apps, userId, req.Mounts)
+	if err != nil {
+		return spec, err
+	}
+	spec.limits = spec.policy.Limits.Restrict(req.Limits.limits())
+	spec.access = s.guestAccess(spec.appId, userId)
+
+	// The log file is written for the requesting app, like a vfs:write.
+	if req.LogPath != "" {
+		if !s.permissions.HasPermission(appId, "filesystem_write") {
+			return spec, fmt.Errorf("Permission denied: app '%s' requires 'filesystem_write' to save output to %s", appId, req.LogPath)
+		}
+		if spec.logKey, err = s.vfs.ResolveForApp(s.permissions, appId, userId, req.LogPath, true); err != nil {
+			return spec, err
+		}
+		spec.logWrite = aether.WriteOptions{User: userId, App: appId}
+	}
+	return spec, nil
+}
+
+// appModule reads the WASM entry of an installed app for a launch requested
+// by appId. The launched app runs with its own permissions, so apps may only
+// launch others their app_launch permission names, and only privileged apps
+// may launch privileged ones.
+func (s *ComputeService) appModule(appId, targetId string) ([]byte, error) {
+	manifest, ok := s.permissions.GetManifest(targetId)
+	if !ok {
+		return nil, fmt.Errorf("app not installed: %s", targetId)
+	}
+	if targetId != appId && !s.permissions.HasScopedPermission(appId, "app_launch", targetId) {
+		return nil, fmt.Errorf("Permission denied: app '%s' requires 'app_launch' to launch app '%s'", appId, targetId)
+	}
+	if path.Ext(manifest.Entry) != ".wasm" {
+		return nil, fmt.Errorf("app '%s' has no WASM entry: %s", targetId, manifest.Entry)
+	}
+	if manifest.Sandbox.Profile == "privileged" {
+		if !s.isPrivileged(appId) {
+			return nil, fmt.Errorf("Permission denied: app '%s' cannot launch privileged app '%s'", appId, targetId)
+		}
+	}
+	if s.vfs == nil {
+		return nil, fmt.Errorf("cannot launch %s: no VFS", targetId)
+	}
+	entry := path.Clean("/" + manifest.Entry)
+	return s.readModule(path.Join(appsRoot, targetId, entry))
+}
+
+// readModule reads a WASM binary from the VFS.
+func (s *ComputeService) readModule(key string) ([]byte, error) {
+	rc, _, err := s.vfs.Open(key, 0, -1)
+	if err != nil {
+		aether.PublishVfsTelemetry(s.broker, "read", key, err, 0)
+		return nil, fmt.Errorf("Failed to read wasm module %s: %v", aether.VirtualPath(key), err)
+	}
+	defer rc.Close()
+	wasm, err := io.ReadAll(rc)
+	aether.PublishVfsTelemetry(s.broker, "read", key, err, int64(len(wasm)))
+	if err != nil {
+		return nil, fmt.Errorf("Failed to read wasm module %s: %v", aether.VirtualPath(key), err)
+	}
+	return wasm, nil
+}
+
+// validEnv checks environment variables before they reach the guest.
+func validEnv(env map[string]string) error {
+	for key, value := range env {
+		if key == "" || strings.ContainsAny(key, "=\x00") || strings.ContainsRune(value, 0) {
+			return fmt.Errorf("invalid environment variable: %q", key)
+		}
+	}
+	return nil
+}
+
+// limitsRequest is the limits object of a vm:create payload.
+type limitsRequest struct {
+	MemoryPages uint32 `json:"memoryPages"`
+	WallClockMs int64  `json:"wallClockMs"`
+	CPUMs       int64  `json:"cpuMs"`
+	OutputBytes int64  `json:"outputBytes"`
+}
+
+func (r limitsRequest) limits() compute.Limits {
+	return compute.Limits{
+		MemoryPages: r.MemoryPages,
+		WallClock:   time.Duration(r.WallClockMs) * time.Millisecond,
+		CPUTime:     time.Duration(r.CPUMs) * time.Millisecond,
+		OutputBytes: r.OutputBytes,
+	}
+}
+
+// policyFor returns the policy for instances of an app, from the sandbox
+// profile in its manifest.
+func (s *ComputeService) policyFor(appId string) compute.Policy {
+	var profile string
+	if manifest, ok := s.permissions.GetManifest(appId); ok {
+		profile = manifest.Sandbox.Profile
+	}
+	return compute.ProfilePolicy(profile)
+}
+
+func mountMode(readOnly bool) string {
+	if readOnly {
+		return "read-only"
+	}
+	return "writable"
+}
+
+// mountRequest is an entry of the mounts list of a vm:create payload.
+type mountRequest struct {
+	Path      string `json:"path"`      // VFS folder, resolved like vfs:* paths.
+	GuestPath string `json:"guestPath"` // Where the guest sees it.
+	ReadOnly  bool   `json:"readOnly"`
+}
+
+// guestMounts validates the mounts of a vm:create request against the
+// filesystem permissions of each of apps and the user's access to each folder.
+func (s *ComputeService) guestMounts(apps []string, userId string, reqs []mountRequest) ([]compute.GuestMount, error) {
+	if len(reqs) == 0 {
+		return nil, nil
+	}
+	if s.vfs == nil {
+		return nil, fmt.Errorf("mounts are not available: no VFS")
+	}
+	mounts := make([]compute.GuestMount, 0, len(reqs))
+	seen := make(map[string]bool)
+	for _, req := range reqs {
+		permission := "filesystem_read"
+		if !req.ReadOnly {
+			permission = "filesystem_write"
+		}
+		for _, appId := range apps {
+			if !s.permissions.HasPermission(appId, permission) {
+				return nil, fmt.Errorf("Permission denied: app '%s' requires '%s' to mount %s", appId, permission, req.Path)
+			}
+		}
+		if err := compute.ValidGuestPath(req.GuestPath); err != nil {
+			return nil, err
+		}
+		if seen[req.GuestPath] {
+			return nil, fmt.Errorf("guest path mounted twice: %s", req.GuestPath)
+		}
+		seen[req.GuestPath] = true
+
+		var key string
+		for _, appId := range apps {
+			var err error
+			if key, err = s.vfs.ResolveForApp(s.permissions, appId, userId, req.Path, !req.ReadOnly); err != nil {
+				return nil, err
+			}
+		}
+		// A missing folder is mounted empty and created by the guest's writes.
+		if info, err := s.vfs.Stat(key); err == nil && !info.IsDir {
+			return nil, fmt.Errorf("cannot mount %s: not a folder", aether.VirtualPath(key))
+		}
+		mounts = append(mounts, compute.GuestMount{Key: key, GuestPath: req.GuestPath, ReadOnly: req.ReadOnly})
+	}
+	return mounts, nil
+}
+
+// guestAccess is who the file operations of an app's instance are performed
+// for. Every path the guest touches is checked as a vfs:* request would be.
+func (s *ComputeService) guestAccess(appId, userId string) compute.GuestAccess {
+	return compute.GuestAccess{
+		Resolve: func(p string, write bool) (string, error) {
+			return s.vfs.ResolveForApp(s.permissions, appId, userId, p, write)
+		},
+		Write: aether.WriteOptions{User: userId, App: appId},
+		Telemetry: func(operation, key string, err error, size int64) {
+			aether.PublishVfsTelemetry(s.broker, operation, key, err, size)
+		},
+	}
+}
+
+// instanceSpec describes an instance to create.
+type instanceSpec struct {
+	appId   string // The app the instance runs as.
+	userId  string // The user it runs for.
+	name    string // The program name, passed as the first argument.
+	wasm    []byte
+	args    []string
+	env     map[string]string
+	workDir string
+	policy  compute.Policy
+	limits  compute.Limits
+	mounts  []compute.GuestMount
+	access  compute.GuestAccess
+
+	logKey   string // Storage key of the output log file, if any.
+	logWrite aether.WriteOptions
+
+	session string // The bus session the request came from.
+}
+
+func (s *ComputeService) createInstance(originalEnv *aether.Envelope, spec instanceSpec) {
+	prepared, err := s.prepareInstance(originalEnv, spec, instanceIO{})
+	if err != nil {
+		s.publishError(originalEnv, err.Error())
+		return
 	}
+	prepared.start()
+}
+
+// instanceIO connects an instance's stdin or stdout to something other than
+// the bus, such as a neighbouring stage of a pipeline.
+type instanceIO struct {
+	// stdin, if set, is read instead of a pipe fed by vm:stdin. It is closed
+	// when the instance exits if it is an io.Closer.
+	stdin io.Reader
+	// stdout, if set, is written instead of streaming to vm:stdout, and is
+	// closed when the instance exits.
+	stdout io.WriteCloser
 }
 
-func (s *ComputeService) createInstance(originalEnv *aether.Envelope, wasmBase64 string) {
+// preparedInstance is an instantiated guest that has not started yet.
+type preparedInstance struct {
+	id string
+	// start runs the guest. done is closed once its final events are
+	// published, after which status holds how it ended.
+	start  func()
+	done   chan struct{}
+	status *compute.ExitStatus
+	// release frees an instance that will not be started.
+	release func()
+}
+
+// prepareInstance instantiates spec without running it, so that modules
+// that cannot be loaded, or need more memory than allowed, are refused
+// before anything starts.
+func (s *ComputeService) prepareInstance(originalEnv *aether.Envelope, spec instanceSpec, stdio instanceIO) (*preparedInstance, error) {
 	instanceID := uuid.New().String()
 	// Create a new context for this instance
 	instanceCtx, cancel := context.WithCancel(context.Background())
-
-	stdinReader, stdinWriter := io.Pipe()
-	stdoutReader, stdoutWriter := io.Pipe()
+	instanceCtx, meter := compute.NewMeter(instanceCtx, spec.limits)
+
+	// The instance's stdin is a pipe written by vm:stdin unless stdio
+	// provides one, and likewise its stdout is streamed to vm:stdout.
+	stdin := stdio.stdin
+	var stdinWriter io.WriteCloser
+	if stdin == nil {
+		reader, writer := io.Pipe()
+		stdin, stdinWriter = reader, writer
+	}
+	stdoutWriter := stdio.stdout
+	var stdoutReader io.ReadCloser
+	if stdoutWriter == nil {
+		stdoutReader, stdoutWriter = io.Pipe()
+	}
 	stderrReader, stderrWriter := io.Pipe()
 
 	config := wazero.NewModuleConfig().
-		WithStdin(stdinReader).
-		WithStdout(stdoutWriter).
-		WithStderr(stderrWriter).
-		WithSysNanosleep().
-		WithSysNanotime().
-		WithSysWalltime()
-
-	wasmBytes, err := base64.StdEncoding.DecodeString(wasmBase64)
-	if err != nil {
-		s.publishError(originalEnv, "Failed to decode wasm binary: "+err.Error())
-		cancel()
-		return
+		WithStdin(meter.Reader(stdin)).
+		WithStdout(meter.Writer(stdoutWriter)).
+		WithStderr(meter.Writer(stderrWriter)).
+		WithArgs(append([]string{spec.name}, spec.args...)...)
+	// Without real clocks and randomness, wazero's defaults give the guest
+	// fake clocks, sleeps that return at once and a fixed random sequence,
+	// so it runs the same way every time.
+	if spec.policy.RealClock {
+		config = config.WithNanosleep(meter.Sleep).WithSysNanotime().WithSysWalltime()
+	}
+	if spec.policy.RealRandom {
+		config = config.WithRandSource(rand.Reader)
+	}
+	envKeys := make([]string, 0, len(spec.env))
+	for key := range spec.env {
+		envKeys = append(envKeys, key)
+	}
+	sort.Strings(envKeys)
+	for _, key := range envKeys {
+		config = config.WithEnv(key, spec.env[key])
+	}
+	if spec.workDir != "" {
+		// WASI has no working directory; Go's wasip1 runtime starts in $PWD.
+		config = config.WithEnv("PWD", spec.workDir)
+	}
+	if len(spec.mounts) > 0 {
+		config = config.WithFSConfig(compute.GuestFSConfig(s.vfs, spec.mounts, spec.access))
 	}
 
-	// Instantiate the WASI imports
-	wasi_snapshot_preview1.MustInstantiate(instanceCtx, s.runtime.GetRuntime())
-
-	mod, err := s.runtime.GetRuntime().Instantiate(instanceCtx, wasmBytes, config)
+	// Instantiating does not run the guest, so a module needing more memory
+	// than allowed is refused here before it starts.
+	mod, err := s.runtime.Instantiate(instanceCtx, spec.wasm, config, meter)
 	if err != nil {
-		s.publishError(originalEnv, "Failed to instantiate wasm module: "+err.Error())
+		meter.Stop()
 		cancel()
-		return
+		return nil, fmt.Errorf("Failed to instantiate wasm module: %v", err)
 	}
 
-	instance := compute.NewWazeroInstance(instanceCtx, mod, stdinWriter, stdoutReader, stderrReader, cancel)
-	s.runtime.Register(instanceID, instance)
+	// Guests reach the bus through the aether host module as their app.
+	info := compute.InstanceInfo{
+		ID:      instanceID,
+		AppID:   spec.appId,
+		Owner:   spec.userId,
+		Name:    spec.name,
+		Profile: spec.policy.Profile,
+		Session: spec.session,
+	}
+	bus := compute.NewBus(s.broker, s.permissions, info, spec.policy, meter)
+	instanceCtx = compute.WithBus(instanceCtx, bus)
+	instance := compute.NewWazeroInstance(instanceCtx, info, mod, meter, stdinWriter, stdoutReader, stderrReader, cancel)
+
+	prepared := &preparedInstance{id: instanceID, done: make(chan struct{})}
+	prepared.release = func() {
+		instance.Kill()
+		bus.Close()
+	}
+	prepared.start = func() {
+		s.runtime.Register(instanceID, instance)
+
+		// Events of the instance are numbered so clients can order its
+		// output and lifecycle events, which arrive on different topics.
+		var seq atomic.Uint64
+		var capture *outputLog
+		if spec.logKey != "" {
+			capture = &outputLog{}
+		}
 
-	s.publishResponse(originalEnv, "vm:started", map[string]string{"instanceId": instanceID})
+		// Goroutines to stream stdout and stderr. They run until the guest's
+		// ends of the pipes are closed after it exits.
+		var streams sync.WaitGroup
+		if stdoutReader != nil {
+			streams.Add(1)
+			go func() {
+				defer streams.Done()
+				s.streamPipe(instanceID, originalEnv, stdoutReader, "vm:stdout", &seq, capture)
+			}()
+		}
+		streams.Add(1)
+		go func() {
+			defer streams.Done()
+			s.streamPipe(instanceID, originalEnv, stderrReader, "vm:stderr", &seq, capture)
+		}()
+
+		// Goroutine to run the instance. vm:started precedes any output, and
+		// the final events follow all of it.
+		go func() {
+			status := instance.Run(func() {
+				s.publishResponse(originalEnv, "vm:started", map[string]interface{}{
+					"instanceId": instanceID,
+					"state":      compute.StateRunning,
+					"seq":        seq.Add(1),
+				})
+			})
+			bus.Close()
+			// Closing the guest's ends of its pipes ends the streams, and in
+			// a pipeline gives the next stage EOF and the previous one
+			// ErrClosedPipe.
+			stdoutWriter.Close()
+			stderrWriter.Close()
+			if closer, ok := stdin.(io.Closer); ok {
+				closer.Close()
+			}
+			streams.Wait()
 
-	// Goroutines to stream stdout and stderr
-	go s.streamPipe(instanceID, originalEnv, instance.Stdout(), "vm:stdout")
-	go s.streamPipe(instanceID, originalEnv, instance.Stderr(), "vm:stderr")
+			s.runtime.Unregister(instanceID)
+			instance.Close()
+			log.Printf("Compute Service: instance %s %s", instanceID, status)
+			if capture != nil {
+				s.saveOutputLog(originalEnv, capture, spec.logKey, spec.logWrite)
+			}
+			s.publishExit(originalEnv, instanceID, status, &seq)
+			prepared.status = status
+			close(prepared.done)
+		}()
+	}
+	return prepared, nil
+}
 
-	// Goroutine to wait for the instance to finish
-	go func() {
-		<-instanceCtx.Done() // Wait for context cancellation or module close
-		s.runtime.Unregister(instanceID)
-		s.publishResponse(originalEnv, "vm:exited", map[string]string{"instanceId": instanceID})
-		instance.Kill() // Ensure cleanup
-	}()
+// publishExit reports the end of an instance: vm:killed or vm:crashed if it
+// did not exit by itself, then vm:exited in every case.
+func (s *ComputeService) publishExit(originalEnv *aether.Envelope, instanceID string, status *compute.ExitStatus, seq *atomic.Uint64) {
+	payload := exitPayload(instanceID, status)
+	switch status.State {
+	case compute.StateKilled:
+		payload["seq"] = seq.Add(1)
+		s.publishResponse(originalEnv, "vm:killed", payload)
+	case compute.StateCrashed:
+		payload["seq"] = seq.Add(1)
+		s.publishResponse(originalEnv, "vm:crashed", payload)
+	}
+	payload["seq"] = seq.Add(1)
+	s.publishResponse(originalEnv, "vm:exited", payload)
 }
 
-func (s *ComputeService) killInstance(originalEnv *aether.Envelope, instanceID string) {
+// exitPayload describes how an instance ended for the vm:exited events.
+func exitPayload(instanceID string, status *compute.ExitStatus) map[string]interface{} {
+	payload := map[string]interface{}{"instanceId": instanceID, "state": status.State}
+	switch status.State {
+	case compute.StateExited:
+		payload["exitCode"] = status.ExitCode
+	case compute.StateKilled:
+		if status.Limit != "" {
+			payload["limit"] = status.Limit
+			payload["error"] = status.Error
+		}
+	case compute.StateCrashed:
+		payload["error"] = status.Error
+		payload["trace"] = status.Trace
+	}
+	return payload
+}
+
+func (s *ComputeService) killInstance(originalEnv *aether.Envelope, appId, userId, instanceID string) {
 	instance, ok := s.runtime.Get(instanceID)
-	if !ok {
+	if !ok || !s.canManage(appId, userId, instance.Info()) {
 		s.publishError(originalEnv, "Instance not found")
 		return
 	}
+	// vm:killed and vm:exited follow once the guest has stopped.
 	instance.Kill()
-	s.runtime.Unregister(instanceID)
-	s.publishResponse(originalEnv, "vm:killed", map[string]string{"instanceId": instanceID})
 }
 
-func (s *ComputeService) writeToStdin(originalEnv *aether.Envelope, instanceID string, data string) {
+func (s *ComputeService) writeToStdin(originalEnv *aether.Envelope, appId, userId, instanceID string, data string) {
 	instance, ok := s.runtime.Get(instanceID)
-	if !ok {
+	if !ok || !s.canManage(appId, userId, instance.Info()) {
 		s.publishError(originalEnv, "Instance not found")
 		return
 	}
-	if _, err := instance.Stdin().Write([]byte(data)); err != nil {
-		s.publishError(originalEnv, "Failed to write to stdin: "+err.Error())
-	}
-}
-
-func (s *ComputeService) streamPipe(instanceID string, originalEnv *aether.Envelope, pipe io.ReadCloser, topicName string) {
-	scanner := bufio.NewScanner(pipe)
-	for scanner.Scan() {
-		s.publishResponse(originalEnv, topicName, map[string]string{
-			"instanceId": instanceID,
-			"data":       scanner.Text(),
-		})
+	stdin := instance.Stdin()
+	if stdin == nil {
+		s.publishError(originalEnv, "Instance reads its stdin from a pipeline")
+		return
 	}
-	if err := scanner.Err(); err != nil && err != io.EOF {
-		log.Printf("Error reading from pipe for instance %s on topic %s: %v", instanceID, topicName, err)
-		s.publishError(originalEnv, "Error reading from instance pipe: "+err.Error())
+	if _, err := stdin.Write([]byte(data)); err != nil {
+		s.publishError(originalEnv, "Failed to write to stdin: "+err.Error())
 	}
 }
 
@@ -1,4 +1,3 @@
-
 package services
 
 import (
@@ -7,7 +6,9 @@ import (
 	"encoding/json"
 	"fmt"
 	"log"
+	"path"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -42,6 +43,21 @@ func (s *InstallService) Run() {
 }
 
 func (s *InstallService) handleRequest(env *aether.Envelope) {
+	var meta struct {
+		AppId  string `json:"appId"`
+		UserId string `json:"userId"`
+	}
+	if err := json.Unmarshal(env.Meta, &meta); err != nil {
+		s.publishError(env, "Invalid metadata: could not determine origin app")
+		return
+	}
+	// Installed apps are shared by every user and written as the system, so
+	// only VFS admins and apps allowed to install may do it.
+	if !s.vfs.IsAdmin(meta.UserId) && !s.permissions.HasPermission(meta.AppId, "app_install") {
+		s.publishError(env, fmt.Sprintf("Permission denied: app '%s' requires 'app_install' to install apps", meta.AppId))
+		return
+	}
+
 	var payloadData struct {
 		Manifest   aether.AppManifest `json:"manifest"`
 		WasmBase64 string             `json:"wasmBase64"`
@@ -67,36 +83,27 @@ func (s *InstallService) handleRequest(env *aether.Envelope) {
 	appInstallPath := filepath.Join("src", "app", "apps", manifest.ID)
 	log.Printf("Install Service: Installing app '%s' to VFS path: %s", manifest.ID, appInstallPath)
 
-	// Create the main app directory (CreateDir is idempotent)
-	// We pass the parent path and the directory name to create
-	parentDir := filepath.Dir(appInstallPath)
-	appDirName := filepath.Base(appInstallPath)
-	if err := s.vfs.CreateDir(parentDir, appDirName); err != nil {
-		s.publishError(env, "Failed to create app directory: "+err.Error())
-		return
-	}
-
-	// Write the manifest.json
 	manifestBytes, err := json.MarshalIndent(manifest, "", "  ")
 	if err != nil {
 		s.publishError(env, "Failed to serialize manifest for writing: "+err.Error())
 		return
 	}
-	manifestPath := filepath.Join(appInstallPath, "manifest.json")
-	if err := s.vfs.Write(manifestPath, manifestBytes); err != nil {
-		s.publishError(env, "Failed to write manifest.json: "+err.Error())
-		return
-	}
-
-	// Decode and write the WASM binary
 	wasmBytes, err := base64.StdEncoding.DecodeString(payloadData.WasmBase64)
 	if err != nil {
 		s.publishError(env, "Failed to decode wasm binary: "+err.Error())
 		return
 	}
-	wasmPath := filepath.Join(appInstallPath, manifest.Entry)
-	if err := s.vfs.Write(wasmPath, wasmBytes); err != nil {
-		s.publishError(env, "Failed to write wasm binary: "+err.Error())
+
+	// The directory, manifest.json and WASM binary are written as one batch so
+	// a failed install never leaves a half-written app behind.
+	// Creating the folder is idempotent, so reinstalling over an existing app works.
+	_, err = s.vfs.Batch([]aether.BatchOp{
+		{Op: aether.BatchCreateFolder, Path: filepath.Dir(appInstallPath), Name: filepath.Base(appInstallPath)},
+		{Op: aether.BatchWrite, Path: filepath.Join(appInstallPath, "manifest.json"), Content: manifestBytes},
+		{Op: aether.BatchWrite, Path: filepath.Join(appInstallPath, manifest.Entry), Content: wasmBytes},
+	}, aether.WriteOptions{})
+	if err != nil {
+		s.publishError(env, "Failed to install app files: "+err.Error())
 		return
 	}
 
@@ -120,6 +127,11 @@ func (s *InstallService) validateManifest(manifest *aether.AppManifest) error {
 	if manifest.ID == "" {
 		return fmt.Errorf("manifest is missing required 'id' field")
 	}
+	// The ID and entry name where the app is written, so they must stay
+	// inside its folder.
+	if !aether.ValidName(manifest.ID) {
+		return fmt.Errorf("invalid app id: '%s'", manifest.ID)
+	}
 	if manifest.Name == "" {
 		return fmt.Errorf("manifest is missing required 'name' field")
 	}
@@ -129,6 +141,10 @@ func (s *InstallService) validateManifest(manifest *aether.AppManifest) error {
 	if manifest.Entry == "" {
 		return fmt.Errorf("manifest is missing required 'entry' field")
 	}
+	if entry := manifest.Entry; path.IsAbs(entry) || strings.Contains(entry, "\\") || path.Clean(entry) != entry ||
+		entry == "." || entry == ".." || strings.HasPrefix(entry, "../") || entry == "manifest.json" {
+		return fmt.Errorf("invalid entry: '%s' must be a clean relative path inside the app", entry)
+	}
 
 	// Validate sandbox profile
 	switch manifest.Sandbox.Profile {
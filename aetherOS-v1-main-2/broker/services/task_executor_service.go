@@ -1,4 +1,3 @@
-
 package services
 
 import (
@@ -53,13 +52,18 @@ func (s *TaskExecutorService) handleRequest(env *aether.Envelope) {
 	}
 
 	var meta struct {
-		AppId string `json:"appId"`
+		AppId  string `json:"appId"`
+		UserId string `json:"userId"`
 	}
 	if err := json.Unmarshal(env.Meta, &meta); err != nil {
 		s.publishError(env, payloadData.GraphID, payloadData.NodeID, "Invalid metadata: could not determine origin app for permission check")
 		return
 	}
 	appId := meta.AppId
+	userId := meta.UserId
+	if userId == "" {
+		userId = aether.DefaultUser
+	}
 
 	s.publish(env, "agent.tasknode.started", map[string]string{
 		"graphId": payloadData.GraphID,
@@ -87,7 +91,7 @@ func (s *TaskExecutorService) handleRequest(env *aether.Envelope) {
 
 		case "vfs:read":
 			if path, ok := payloadData.Input["path"].(string); ok {
-				content, readErr := s.vfs.Read(path)
+				content, readErr := s.readFile(appId, userId, path)
 				if readErr != nil {
 					toolErr = readErr.Error()
 				} else {
@@ -101,7 +105,7 @@ func (s *TaskExecutorService) handleRequest(env *aether.Envelope) {
 			path, pathOk := payloadData.Input["path"].(string)
 			content, contentOk := payloadData.Input["content"].(string) // Assume content is now always a string after template resolution
 			if pathOk && contentOk {
-				writeErr := s.vfs.Write(path, []byte(content))
+				writeErr := s.writeFile(appId, userId, path, []byte(content))
 				if writeErr != nil {
 					toolErr = writeErr.Error()
 				} else {
@@ -113,7 +117,7 @@ func (s *TaskExecutorService) handleRequest(env *aether.Envelope) {
 
 		case "ai:summarize:code": // Note: This tool name is kept for backward compatibility with existing graph generation logic
 			if path, ok := payloadData.Input["filePath"].(string); ok {
-				fileContent, readErr := s.vfs.Read(path)
+				fileContent, readErr := s.readFile(appId, userId, path)
 				if readErr != nil {
 					toolErr = readErr.Error()
 				} else {
@@ -150,6 +154,23 @@ func (s *TaskExecutorService) handleRequest(env *aether.Envelope) {
 	}
 }
 
+func (s *TaskExecutorService) readFile(appId, userId, path string) (string, error) {
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, false)
+	if err != nil {
+		return "", err
+	}
+	return s.vfs.Read(key)
+}
+
+func (s *TaskExecutorService) writeFile(appId, userId, path string, content []byte) error {
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, true)
+	if err != nil {
+		return err
+	}
+	_, err = s.vfs.WriteWithOptions(key, content, aether.WriteOptions{User: userId, App: appId})
+	return err
+}
+
 func (s *TaskExecutorService) checkPermissionsForTool(appId string, toolName string) bool {
 	switch toolName {
 	case "vfs:read", "ai:summarize:code": // summarize needs to read
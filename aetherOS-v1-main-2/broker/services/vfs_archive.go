@@ -0,0 +1,180 @@
+package services
+
+import (
+	"aether/broker/aether"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"time"
+)
+
+const (
+	// archiveChunkSize is the amount of archive data sent per vfs:archive:chunk
+	// message when an archive is streamed back instead of stored.
+	archiveChunkSize = 256 << 10
+	// archiveProgressInterval throttles vfs:archive:progress messages.
+	archiveProgressInterval = 250 * time.Millisecond
+)
+
+// archiveChunkWriter streams an archive to the requester as base64 chunks on
+// vfs:archive:chunk, tagged with the request's envelope ID and a sequence number.
+type archiveChunkWriter struct {
+	s   *VfsService
+	env *aether.Envelope
+	buf []byte
+	seq int
+}
+
+func (w *archiveChunkWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for len(w.buf) >= archiveChunkSize {
+		w.send(w.buf[:archiveChunkSize])
+		w.buf = w.buf[archiveChunkSize:]
+	}
+	return len(p), nil
+}
+
+// flush sends any buffered data.
+func (w *archiveChunkWriter) flush() {
+	if len(w.buf) > 0 {
+		w.send(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *archiveChunkWriter) send(data []byte) {
+	w.seq++
+	w.s.publishResponse(w.env, "vfs:archive:chunk", map[string]interface{}{
+		"archiveId": w.env.ID,
+		"seq":       w.seq,
+		"data":      base64.StdEncoding.EncodeToString(data),
+		"encoding":  "base64",
+	})
+}
+
+// handleArchiveCreate packs the directory at key into a zip or tar.gz. With a
+// "dest" path the archive is written to the VFS; otherwise it is streamed back
+// in chunks followed by a vfs:archive:create:result.
+func (s *VfsService) handleArchiveCreate(env *aether.Envelope, appId, userId, key string, payload map[string]interface{}) {
+	path, _ := payload["path"].(string)
+	dest, _ := payload["dest"].(string)
+	formatName, _ := payload["format"].(string)
+	if dest == "" && formatName == "" {
+		formatName = aether.ArchiveZip
+	}
+	format, err := aether.ArchiveFormat(dest, formatName)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+
+	if dest == "" {
+		w := &archiveChunkWriter{s: s, env: env}
+		stats, err := s.vfs.CreateArchive(key, format, aether.DefaultArchiveLimits, w)
+		s.publishTelemetry("archive_create", key, err, 0)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		w.flush()
+		s.publishResponse(env, "vfs:archive:create:result", map[string]interface{}{
+			"archiveId": env.ID,
+			"path":      path,
+			"format":    format,
+			"chunks":    w.seq,
+			"stats":     stats,
+		})
+		return
+	}
+
+	if !s.permissions.HasPermission(appId, "filesystem_write") {
+		s.publishError(env, fmt.Sprintf("Permission denied: app '%s' requires 'filesystem_write' to store an archive", appId))
+		return
+	}
+	destKey, err := s.vfs.ResolveForApp(s.permissions, appId, userId, dest, true)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	// Writes take the whole content, so the archive is built in memory. Its
+	// size is bounded by DefaultArchiveLimits.MaxTotalBytes plus overhead.
+	var buf bytes.Buffer
+	stats, err := s.vfs.CreateArchive(key, format, aether.DefaultArchiveLimits, &buf)
+	if err == nil {
+		var revision string
+		revision, err = s.vfs.WriteWithOptions(destKey, buf.Bytes(), aether.WriteOptions{User: userId, App: appId})
+		if err == nil {
+			s.publishTelemetry("archive_create", key, nil, int64(buf.Len()))
+			s.publishResponse(env, "vfs:archive:create:result", map[string]interface{}{
+				"archiveId": env.ID,
+				"path":      path,
+				"dest":      dest,
+				"format":    format,
+				"revision":  revision,
+				"size":      buf.Len(),
+				"stats":     stats,
+			})
+			return
+		}
+	}
+	s.publishTelemetry("archive_create", key, err, 0)
+	s.publishFailure(env, err)
+}
+
+// handleArchiveExtract unpacks the archive at "path" into the folder "dest",
+// publishing throttled vfs:archive:progress messages along the way.
+func (s *VfsService) handleArchiveExtract(env *aether.Envelope, appId, userId string, payload map[string]interface{}) {
+	path, _ := payload["path"].(string)
+	dest, _ := payload["dest"].(string)
+	format, _ := payload["format"].(string)
+	overwrite, _ := payload["overwrite"].(bool)
+
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, false)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	destKey, err := s.vfs.ResolveForApp(s.permissions, appId, userId, dest, true)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+
+	var lastProgress time.Time
+	progress := func(p aether.ExtractProgress) {
+		done := p.Phase == "writing" && p.Entries == p.TotalEntries
+		if !done && time.Since(lastProgress) < archiveProgressInterval {
+			return
+		}
+		lastProgress = time.Now()
+		s.publishResponse(env, "vfs:archive:progress", map[string]interface{}{
+			"archiveId":    env.ID,
+			"path":         path,
+			"phase":        p.Phase,
+			"entries":      p.Entries,
+			"totalEntries": p.TotalEntries,
+			"bytes":        p.Bytes,
+		})
+	}
+
+	stats, err := s.vfs.ExtractArchive(key, destKey, aether.ExtractOptions{
+		Format:    format,
+		Overwrite: overwrite,
+		Write:     aether.WriteOptions{User: userId, App: appId},
+	}, progress)
+	var size int64
+	if stats != nil {
+		size = stats.Bytes
+	}
+	s.publishTelemetry("archive_extract", key, err, size)
+	if err != nil {
+		s.publishFailure(env, err)
+		return
+	}
+	s.publishResponse(env, "vfs:archive:extract:result", map[string]interface{}{
+		"archiveId": env.ID,
+		"path":      path,
+		"dest":      dest,
+		"stats":     stats,
+	})
+}
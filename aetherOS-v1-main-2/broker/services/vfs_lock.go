@@ -0,0 +1,80 @@
+package services
+
+import (
+	"aether/broker/aether"
+	"log"
+	"slices"
+	"time"
+)
+
+// lockExpiryInterval is how often expired VFS locks are swept, so that
+// vfs:lock:changed reports them promptly.
+const lockExpiryInterval = 5 * time.Second
+
+// handleLock takes or renews a lock on key. Shared locks only need read
+// access to the path; exclusive locks need write access. Passing the "lockId"
+// of a held lock renews it for another "ttl" seconds.
+func (s *VfsService) handleLock(env *aether.Envelope, appId, userId string, payload map[string]interface{}) {
+	path, _ := payload["path"].(string)
+	mode, _ := payload["mode"].(string)
+	if mode == "" {
+		mode = aether.LockExclusive
+	}
+	id, _ := payload["lockId"].(string)
+	var ttl time.Duration
+	if seconds, ok := payload["ttl"].(float64); ok && seconds > 0 {
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, mode == aether.LockExclusive)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	lock, err := s.vfs.AcquireLock(key, mode, id, ttl, aether.WriteOptions{User: userId, App: appId})
+	if err != nil {
+		s.publishFailure(env, err)
+		return
+	}
+	s.publishResponse(env, "vfs:lock:result", map[string]interface{}{"success": true, "path": path, "lock": lock})
+}
+
+// handleUnlock releases the caller's lock named by "lockId".
+func (s *VfsService) handleUnlock(env *aether.Envelope, appId, userId string, payload map[string]interface{}) {
+	id, _ := payload["lockId"].(string)
+	lock, err := s.vfs.ReleaseLock(id, aether.WriteOptions{User: userId, App: appId})
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	s.publishResponse(env, "vfs:unlock:result", map[string]interface{}{"success": true, "lockId": id, "path": lock.Path})
+}
+
+// publishLockChange announces a lock being taken, renewed, released or lost
+// so editors can show who is working on a file. Only the holder and the
+// users who can read the path are told, since the event names both.
+func (s *VfsService) publishLockChange(event aether.LockEvent) {
+	users := s.vfs.Readers(event.Lock.Path)
+	if event.Lock.User != "" && !slices.Contains(users, event.Lock.User) {
+		users = append(users, event.Lock.User)
+	}
+	for _, user := range users {
+		env := &aether.Envelope{}
+		if err := env.SetUserID(user); err != nil {
+			log.Printf("VFS Service: failed to address lock event to %s: %v", user, err)
+			continue
+		}
+		s.publishResponse(env, "vfs:lock:changed", event)
+	}
+}
+
+// expireLocksPeriodically sweeps expired locks so their expiry is announced.
+func (s *VfsService) expireLocksPeriodically() {
+	ticker := time.NewTicker(lockExpiryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if expired := s.vfs.ExpireLocks(); expired > 0 {
+			log.Printf("VFS Service: %d locks expired", expired)
+		}
+	}
+}
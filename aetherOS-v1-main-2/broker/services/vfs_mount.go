@@ -0,0 +1,49 @@
+package services
+
+import (
+	"aether/broker/aether"
+	"log"
+)
+
+// handleMount adds a mount to the VFS mount table. The payload mirrors
+// aether.Mount: path, type, source, readOnly and permission. Only VFS
+// administrators may mount, and sources are resolved as userId.
+func (s *VfsService) handleMount(env *aether.Envelope, userId string, payload map[string]interface{}) {
+	m := aether.Mount{}
+	m.Path, _ = payload["path"].(string)
+	m.Type, _ = payload["type"].(string)
+	m.Source, _ = payload["source"].(string)
+	m.ReadOnly, _ = payload["readOnly"].(bool)
+	m.Permission, _ = payload["permission"].(string)
+
+	mount, err := s.vfs.Mount(userId, m)
+	s.publishTelemetry("mount", m.Path, err, 0)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	log.Printf("VFS Service: mounted %s (%s)", mount.Path, mount.Type)
+	go s.reindex(mount.Path)
+	s.publishResponse(env, "vfs:mount:result", map[string]interface{}{"success": true, "mount": mount})
+}
+
+// handleUnmount removes the mount at path from the VFS mount table.
+func (s *VfsService) handleUnmount(env *aether.Envelope, userId, path string) {
+	err := s.vfs.Unmount(userId, path)
+	s.publishTelemetry("unmount", path, err, 0)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	log.Printf("VFS Service: unmounted %s", path)
+	go s.reindex(path)
+	s.publishResponse(env, "vfs:unmount:result", map[string]interface{}{"success": true, "path": path})
+}
+
+// reindex rebuilds the search index after a mount change, which can make a
+// whole tree of files appear without a change event for each of them.
+func (s *VfsService) reindex(path string) {
+	if err := s.search.Rebuild(); err != nil {
+		log.Printf("VFS Service: failed to re-index after mount change at %s: %v", path, err)
+	}
+}
@@ -1,23 +1,32 @@
-
 package services
 
 import (
 	"aether/broker/aether"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
+// trashPurgeInterval is how often expired trash entries are purged.
+const trashPurgeInterval = time.Hour
+
 // VfsService handles file system-related requests from the message bus.
 type VfsService struct {
 	broker      *aether.Broker
 	vfs         *aether.VFSModule
 	aiModule    *aether.AIModule
 	permissions *aether.PermissionManager
+	search      *aether.SearchIndex
+
+	watchesMu sync.RWMutex
+	watches   map[string]*vfsWatch
 }
 
 // NewVfsService creates a new VFS service.
@@ -27,6 +36,8 @@ func NewVfsService(broker *aether.Broker, vfs *aether.VFSModule, aiModule *aethe
 		vfs:         vfs,
 		aiModule:    aiModule,
 		permissions: permissions,
+		search:      aether.NewSearchIndex(vfs),
+		watches:     make(map[string]*vfsWatch),
 	}
 }
 
@@ -41,6 +52,30 @@ func (s *VfsService) Run() {
 		"vfs:write",
 		"vfs:search",
 		"vfs:summarize:code",
+		"vfs:trash:list",
+		"vfs:trash:restore",
+		"vfs:trash:empty",
+		"vfs:move",
+		"vfs:watch",
+		"vfs:unwatch",
+		"vfs:usage",
+		"vfs:search:fulltext",
+		"vfs:walk",
+		"vfs:stat",
+		"vfs:batch",
+		"vfs:archive:create",
+		"vfs:archive:extract",
+		"vfs:patch",
+		"vfs:mounts",
+		"vfs:mount",
+		"vfs:unmount",
+		"vfs:share",
+		"vfs:unshare",
+		"vfs:shares",
+		"vfs:group:set",
+		"vfs:lock",
+		"vfs:unlock",
+		"vfs:locks",
 	}
 
 	for _, topicName := range vfsTopics {
@@ -54,30 +89,88 @@ func (s *VfsService) Run() {
 			}
 		}(topicName, broadcastChan)
 	}
+
+	s.vfs.OnChange(s.notifyWatches)
+	s.broker.OnSessionClosed(s.dropSessionWatches)
+	s.vfs.OnChange(s.search.HandleChange)
+	go func() {
+		if err := s.search.Rebuild(); err != nil {
+			log.Printf("VFS Service: failed to build search index: %v", err)
+		}
+	}()
+	s.vfs.OnQuotaWarning(s.publishQuotaWarning)
+	s.vfs.OnLockChange(s.publishLockChange)
+	go s.purgeTrashPeriodically()
+	go s.expireLocksPeriodically()
+}
+
+// purgeTrashPeriodically removes trashed items older than the VFS retention period.
+func (s *VfsService) purgeTrashPeriodically() {
+	ticker := time.NewTicker(trashPurgeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		purged, err := s.vfs.PurgeTrash()
+		if err != nil {
+			log.Printf("VFS Service: trash purge failed: %v", err)
+			continue
+		}
+		if purged > 0 {
+			log.Printf("VFS Service: purged %d expired trash entries", purged)
+		}
+	}
 }
 
 func (s *VfsService) handleRequest(env *aether.Envelope) {
 	var meta struct {
-		AppId string `json:"appId"`
+		AppId  string `json:"appId"`
+		UserId string `json:"userId"`
 	}
 	if err := json.Unmarshal(env.Meta, &meta); err != nil {
 		s.publishError(env, "Invalid metadata: could not determine origin app")
 		return
 	}
 	appId := meta.AppId
+	userId := meta.UserId
+	if userId == "" {
+		userId = aether.DefaultUser
+	}
 
 	log.Printf("VFS Service processing message ID %s on topic %s from app %s", env.ID, env.Topic, appId)
 
 	// Check permission for the operation
 	requiredPermission, ok := map[string]string{
-		"vfs:list":           "filesystem_read",
-		"vfs:read":           "filesystem_read",
-		"vfs:search":         "filesystem_read", // Search needs to read the file list
-		"vfs:summarize:code": "filesystem_read", // Summarize needs to read file content
-		"vfs:delete":         "filesystem_write",
-		"vfs:create:file":    "filesystem_write",
-		"vfs:create:folder":  "filesystem_write",
-		"vfs:write":          "filesystem_write",
+		"vfs:list":            "filesystem_read",
+		"vfs:read":            "filesystem_read",
+		"vfs:search":          "filesystem_read", // Search needs to read the file list
+		"vfs:summarize:code":  "filesystem_read", // Summarize needs to read file content
+		"vfs:delete":          "filesystem_write",
+		"vfs:create:file":     "filesystem_write",
+		"vfs:create:folder":   "filesystem_write",
+		"vfs:write":           "filesystem_write",
+		"vfs:trash:list":      "filesystem_read",
+		"vfs:trash:restore":   "filesystem_write",
+		"vfs:trash:empty":     "filesystem_write",
+		"vfs:move":            "filesystem_write",
+		"vfs:watch":           "filesystem_read",
+		"vfs:unwatch":         "filesystem_read",
+		"vfs:usage":           "filesystem_read",
+		"vfs:search:fulltext": "filesystem_read",
+		"vfs:walk":            "filesystem_read",
+		"vfs:stat":            "filesystem_read",
+		"vfs:batch":           "filesystem_write",
+		"vfs:archive:create":  "filesystem_read", // Storing the archive also needs filesystem_write
+		"vfs:archive:extract": "filesystem_write",
+		"vfs:patch":           "filesystem_write",
+		"vfs:mounts":          "filesystem_read",
+		"vfs:mount":           "filesystem_admin",
+		"vfs:unmount":         "filesystem_admin",
+		"vfs:share":           "filesystem_write",
+		"vfs:unshare":         "filesystem_write",
+		"vfs:shares":          "filesystem_read",
+		"vfs:group:set":       "filesystem_admin",
+		"vfs:lock":            "filesystem_read", // Exclusive locks also need write access to the path
+		"vfs:unlock":          "filesystem_read",
+		"vfs:locks":           "filesystem_read",
 	}[env.Topic]
 
 	if !ok {
@@ -104,56 +197,142 @@ func (s *VfsService) handleRequest(env *aether.Envelope) {
 	}
 
 	path, _ := payloadData["path"].(string)
+	// Writes, deletes and moves may carry the revision the client last saw.
+	ifMatch, _ := payloadData["ifMatch"].(string)
+
+	// Paths are resolved against the caller's home directory and mounts
+	// before anything reaches the VFS module; key is the jailed storage path.
+	var key string
+	switch env.Topic {
+	case "vfs:list", "vfs:walk", "vfs:delete", "vfs:create:file", "vfs:create:folder", "vfs:read", "vfs:write", "vfs:move", "vfs:watch", "vfs:usage", "vfs:stat", "vfs:archive:create", "vfs:locks":
+		var err error
+		key, err = s.vfs.ResolveForApp(s.permissions, appId, userId, path, requiredPermission == "filesystem_write")
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+	}
 
 	switch env.Topic {
 	case "vfs:list":
-		files, err := s.vfs.List(path)
-		s.publishTelemetry("list", path, err, 0)
+		opts := aether.ListOptions{}
+		if recursive, _ := payloadData["recursive"].(bool); recursive {
+			opts.Depth = -1
+		}
+		if depth, ok := payloadData["depth"].(float64); ok {
+			opts.Depth = int(depth)
+		}
+		opts.Glob, _ = payloadData["glob"].(string)
+		opts.SortBy, _ = payloadData["sortBy"].(string)
+		order, _ := payloadData["order"].(string)
+		opts.Desc = order == "desc"
+		if pageSize, ok := payloadData["pageSize"].(float64); ok {
+			opts.PageSize = int(pageSize)
+		}
+		opts.Cursor, _ = payloadData["cursor"].(string)
+
+		page, err := s.vfs.ListWithOptions(key, opts)
+		s.publishTelemetry("list", key, err, 0)
 		if err != nil {
 			s.publishError(env, err.Error())
 			return
 		}
 		s.publishResponse(env, "vfs:list:result", map[string]interface{}{
-			"path":  path,
-			"files": files,
+			"path":       path,
+			"files":      page.Files,
+			"nextCursor": page.NextCursor,
+			"total":      page.Total,
 		})
-	case "vfs:delete":
-		err := s.vfs.Delete(path)
-		s.publishTelemetry("delete", path, err, 0)
+
+	case "vfs:walk":
+		glob, _ := payloadData["glob"].(string)
+		depth := -1
+		if d, ok := payloadData["depth"].(float64); ok && d > 0 {
+			depth = int(d)
+		}
+		batchSize, _ := payloadData["batchSize"].(float64)
+
+		// Batches share the request's envelope ID so clients can correlate them.
+		seq, total := 0, 0
+		err := s.vfs.Walk(key, glob, depth, int(batchSize), func(batch []*aether.FileInfo) error {
+			seq++
+			total += len(batch)
+			s.publishResponse(env, "vfs:walk:batch", map[string]interface{}{
+				"walkId":  env.ID,
+				"path":    path,
+				"seq":     seq,
+				"entries": batch,
+			})
+			return nil
+		})
+		s.publishTelemetry("walk", key, err, 0)
 		if err != nil {
 			s.publishError(env, err.Error())
 			return
 		}
-		s.publishResponse(env, "vfs:delete:result", map[string]interface{}{"success": true, "path": path})
+		s.publishResponse(env, "vfs:walk:result", map[string]interface{}{
+			"walkId":  env.ID,
+			"path":    path,
+			"batches": seq,
+			"total":   total,
+		})
+	case "vfs:delete":
+		entry, err := s.vfs.Delete(key, aether.WriteOptions{User: userId, App: appId, IfMatch: ifMatch})
+		var size int64
+		if entry != nil {
+			size = entry.Size
+		}
+		s.publishTelemetry("delete", key, err, size)
+		if err != nil {
+			s.publishFailure(env, err)
+			return
+		}
+		s.publishResponse(env, "vfs:delete:result", map[string]interface{}{"success": true, "path": path, "trashId": entry.ID})
 	case "vfs:create:file":
 		name, _ := payloadData["name"].(string)
-		err := s.vfs.CreateFile(path, name)
-		s.publishTelemetry("create_file", path, err, 0)
+		if !aether.ValidName(name) {
+			s.publishError(env, fmt.Sprintf("Invalid file name: %q", name))
+			return
+		}
+		err := s.vfs.CreateFile(key, name, aether.WriteOptions{User: userId, App: appId})
+		s.publishTelemetry("create_file", key, err, 0)
 		if err != nil {
-			s.publishError(env, err.Error())
+			s.publishFailure(env, err)
 			return
 		}
 		s.publishResponse(env, "vfs:create:file:result", map[string]interface{}{"success": true, "path": path})
 	case "vfs:create:folder":
 		name, _ := payloadData["name"].(string)
-		err := s.vfs.CreateDir(path, name)
-		s.publishTelemetry("create_folder", path, err, 0)
+		if !aether.ValidName(name) {
+			s.publishError(env, fmt.Sprintf("Invalid folder name: %q", name))
+			return
+		}
+		err := s.vfs.CreateDir(key, name, aether.WriteOptions{User: userId, App: appId})
+		s.publishTelemetry("create_folder", key, err, 0)
 		if err != nil {
-			s.publishError(env, err.Error())
+			s.publishFailure(env, err)
 			return
 		}
 		s.publishResponse(env, "vfs:create:folder:result", map[string]interface{}{"success": true, "path": path})
 	case "vfs:read":
-		content, err := s.vfs.Read(path)
-		s.publishTelemetry("read", path, err, int64(len(content)))
+		content, revision, err := s.vfs.ReadRevision(key)
+		s.publishTelemetry("read", key, err, int64(len(content)))
 		if err != nil {
 			s.publishError(env, err.Error())
 			return
 		}
 		s.publishResponse(env, "vfs:read:result", map[string]interface{}{
-			"path":    path,
-			"content": content,
+			"path":     path,
+			"content":  content,
+			"revision": revision,
 		})
+	case "vfs:stat":
+		info, err := s.vfs.Stat(key)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishResponse(env, "vfs:stat:result", map[string]interface{}{"path": path, "file": info})
 	case "vfs:write":
 		contentStr, _ := payloadData["content"].(string)
 		encoding, _ := payloadData["encoding"].(string)
@@ -164,7 +343,7 @@ func (s *VfsService) handleRequest(env *aether.Envelope) {
 		if encoding == "base64" {
 			contentBytes, err = base64.StdEncoding.DecodeString(contentStr)
 			if err != nil {
-				s.publishTelemetry("write", path, err, 0)
+				s.publishTelemetry("write", key, err, 0)
 				s.publishError(env, "Invalid base64 content")
 				return
 			}
@@ -172,13 +351,13 @@ func (s *VfsService) handleRequest(env *aether.Envelope) {
 			contentBytes = []byte(contentStr)
 		}
 
-		err = s.vfs.Write(path, contentBytes)
-		s.publishTelemetry("write", path, err, int64(len(contentBytes)))
+		revision, err := s.vfs.WriteWithOptions(key, contentBytes, aether.WriteOptions{User: userId, App: appId, IfMatch: ifMatch})
+		s.publishTelemetry("write", key, err, int64(len(contentBytes)))
 		if err != nil {
-			s.publishError(env, err.Error())
+			s.publishFailure(env, err)
 			return
 		}
-		s.publishResponse(env, "vfs:write:result", map[string]interface{}{"success": true, "path": path})
+		s.publishResponse(env, "vfs:write:result", map[string]interface{}{"success": true, "path": path, "revision": revision})
 
 	case "vfs:search":
 		query, _ := payloadData["query"].(string)
@@ -201,7 +380,12 @@ func (s *VfsService) handleRequest(env *aether.Envelope) {
 
 	case "vfs:summarize:code":
 		filePath, _ := payloadData["filePath"].(string)
-		fileContent, err := s.vfs.Read(filePath)
+		fileKey, err := s.vfs.ResolveForApp(s.permissions, appId, userId, filePath, false)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		fileContent, err := s.vfs.Read(fileKey)
 		if err != nil {
 			s.publishError(env, "Could not read file for summarization: "+err.Error())
 			return
@@ -221,44 +405,313 @@ func (s *VfsService) handleRequest(env *aether.Envelope) {
 			"filePath": filePath,
 		})
 
+	case "vfs:move":
+		newPath, _ := payloadData["newPath"].(string)
+		newKey, err := s.vfs.ResolveForApp(s.permissions, appId, userId, newPath, true)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		err = s.vfs.Move(key, newKey, aether.WriteOptions{User: userId, App: appId, IfMatch: ifMatch})
+		s.publishTelemetry("move", key, err, 0)
+		if err != nil {
+			s.publishFailure(env, err)
+			return
+		}
+		s.publishResponse(env, "vfs:move:result", map[string]interface{}{"success": true, "path": path, "newPath": newPath})
+
+	case "vfs:batch":
+		opsData, _ := payloadData["ops"].([]interface{})
+		ops := make([]aether.BatchOp, len(opsData))
+		var size int64
+		for i, v := range opsData {
+			op, err := s.batchOp(appId, userId, v)
+			if err != nil {
+				s.publishError(env, fmt.Sprintf("Invalid batch operation %d: %v", i, err))
+				return
+			}
+			ops[i] = op
+			size += int64(len(op.Content))
+		}
+		results, err := s.vfs.Batch(ops, aether.WriteOptions{User: userId, App: appId})
+		s.publishTelemetry("batch", "", err, size)
+		if err != nil {
+			payload := failurePayload(err)
+			payload["results"] = results
+			s.publishErrorPayload(env, err.Error(), payload)
+			return
+		}
+		s.publishResponse(env, "vfs:batch:result", map[string]interface{}{"success": true, "results": results})
+
+	case "vfs:patch":
+		patches, err := s.patchFiles(appId, userId, payloadData)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		opts := aether.PatchOptions{Fuzz: aether.DefaultPatchFuzz, Write: aether.WriteOptions{User: userId, App: appId}}
+		if fuzz, ok := payloadData["fuzz"].(float64); ok && fuzz >= 0 {
+			opts.Fuzz = int(fuzz)
+		}
+		opts.DryRun, _ = payloadData["dryRun"].(bool)
+
+		results, err := s.vfs.Patch(patches, opts)
+		s.publishTelemetry("patch", "", err, 0)
+		if err != nil {
+			payload := failurePayload(err)
+			payload["files"] = results
+			s.publishErrorPayload(env, err.Error(), payload)
+			return
+		}
+		s.publishResponse(env, "vfs:patch:result", map[string]interface{}{"success": true, "dryRun": opts.DryRun, "files": results})
+
+	case "vfs:search:fulltext":
+		queryStr, _ := payloadData["query"].(string)
+		limit, _ := payloadData["limit"].(float64)
+		query := aether.ParseSearchQuery(queryStr)
+		if len(query.Terms) == 0 && len(query.Phrases) == 0 && query.PathPrefix == "" && len(query.Types) == 0 {
+			s.publishError(env, "Search query is empty")
+			return
+		}
+		// Only files the caller could open directly are searchable.
+		results, total := s.search.Search(query, int(limit), func(p string) bool {
+			_, err := s.vfs.ResolveForApp(s.permissions, appId, userId, p, false)
+			return err == nil
+		})
+		s.publishResponse(env, "vfs:search:fulltext:result", map[string]interface{}{
+			"query":   queryStr,
+			"results": results,
+			"total":   total,
+		})
+
+	case "vfs:usage":
+		report, err := s.vfs.Usage(userId, key)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishResponse(env, "vfs:usage:result", report)
+
+	case "vfs:archive:create":
+		s.handleArchiveCreate(env, appId, userId, key, payloadData)
+
+	case "vfs:archive:extract":
+		s.handleArchiveExtract(env, appId, userId, payloadData)
+
+	case "vfs:mounts":
+		s.publishResponse(env, "vfs:mounts:result", map[string]interface{}{"mounts": s.vfs.Mounts()})
+
+	case "vfs:mount":
+		s.handleMount(env, userId, payloadData)
+
+	case "vfs:unmount":
+		s.handleUnmount(env, userId, path)
+
+	case "vfs:share":
+		s.handleShare(env, appId, userId, payloadData)
+
+	case "vfs:unshare":
+		s.handleUnshare(env, appId, userId, payloadData)
+
+	case "vfs:shares":
+		s.handleShares(env, appId, userId, payloadData)
+
+	case "vfs:group:set":
+		s.handleGroupSet(env, userId, payloadData)
+
+	case "vfs:lock":
+		s.handleLock(env, appId, userId, payloadData)
+
+	case "vfs:unlock":
+		s.handleUnlock(env, appId, userId, payloadData)
+
+	case "vfs:locks":
+		s.publishResponse(env, "vfs:locks:result", map[string]interface{}{"path": path, "locks": s.vfs.Locks(key)})
+
+	case "vfs:watch":
+		s.handleWatch(env, userId, key, payloadData)
+
+	case "vfs:unwatch":
+		s.handleUnwatch(env, userId, payloadData)
+
+	case "vfs:trash:list":
+		entries, err := s.vfs.ListTrash(userId)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishResponse(env, "vfs:trash:list:result", map[string]interface{}{"entries": entries})
+
+	case "vfs:trash:restore":
+		id, _ := payloadData["id"].(string)
+		entry, err := s.vfs.RestoreTrash(userId, id)
+		if err != nil {
+			s.publishTelemetry("restore", "", err, 0)
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishTelemetry("restore", entry.OriginalPath, nil, entry.Size)
+		s.publishResponse(env, "vfs:trash:restore:result", map[string]interface{}{
+			"success": true,
+			"id":      entry.ID,
+			"path":    entry.OriginalPath,
+		})
+
+	case "vfs:trash:empty":
+		// An empty or missing "ids" list empties the whole trash.
+		idsData, _ := payloadData["ids"].([]interface{})
+		ids := make([]string, 0, len(idsData))
+		for _, v := range idsData {
+			if id, ok := v.(string); ok {
+				ids = append(ids, id)
+			}
+		}
+		removed, err := s.vfs.EmptyTrash(userId, ids)
+		s.publishTelemetry("empty_trash", "", err, 0)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishResponse(env, "vfs:trash:empty:result", map[string]interface{}{"success": true, "removed": removed})
+
 	default:
 		s.publishError(env, "Unknown VFS topic: "+env.Topic)
 	}
 }
 
-func (s *VfsService) publishTelemetry(operation, path string, err error, size int64) {
-	telemetryTopic := s.broker.GetTopic("telemetry:vfs")
-	vfsEvent := aether.VfsEvent{
-		Operation: operation,
-		Path:      path,
-		Success:   err == nil,
-		Size:      size,
+// batchOp decodes one operation of a vfs:batch request, resolving its paths
+// the same way the single-operation topics do.
+func (s *VfsService) batchOp(appId, userId string, v interface{}) (aether.BatchOp, error) {
+	data, ok := v.(map[string]interface{})
+	if !ok {
+		return aether.BatchOp{}, fmt.Errorf("operation must be an object")
+	}
+	var op aether.BatchOp
+	op.Op, _ = data["op"].(string)
+	op.Name, _ = data["name"].(string)
+	op.IfMatch, _ = data["ifMatch"].(string)
+
+	path, _ := data["path"].(string)
+	if path == "" && op.Op != aether.BatchCreateFile && op.Op != aether.BatchCreateFolder {
+		// An empty path would resolve to the home directory itself.
+		return op, fmt.Errorf("missing path")
 	}
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, true)
 	if err != nil {
-		vfsEvent.Error = err.Error()
+		return op, err
 	}
+	op.Path = key
 
-	sensorEvent := aether.SensorEvent{
-		Type:      "vfs",
-		Timestamp: time.Now(),
-		Payload:   vfsEvent,
+	if op.Op == aether.BatchMove {
+		newPath, _ := data["newPath"].(string)
+		if op.NewPath, err = s.vfs.ResolveForApp(s.permissions, appId, userId, newPath, true); err != nil {
+			return op, err
+		}
 	}
 
-	payloadBytes, marshalErr := json.Marshal(sensorEvent)
-	if marshalErr != nil {
-		log.Printf("VFS Telemetry: Failed to marshal sensor event: %v", marshalErr)
-		return
+	if op.Op == aether.BatchWrite {
+		content, _ := data["content"].(string)
+		if encoding, _ := data["encoding"].(string); encoding == "base64" {
+			if op.Content, err = base64.StdEncoding.DecodeString(content); err != nil {
+				return op, fmt.Errorf("invalid base64 content")
+			}
+		} else {
+			op.Content = []byte(content)
+		}
 	}
+	return op, nil
+}
 
-	envelope := &aether.Envelope{
-		ID:          uuid.New().String(),
-		Topic:       "telemetry:vfs",
-		Type:        "sensor_event",
-		ContentType: "application/json",
-		Payload:     payloadBytes,
-		CreatedAt:   time.Now(),
+// patchFiles decodes the files of a vfs:patch request. It accepts a single
+// "path" and "diff", a "patches" list of {path, diff, baseRevision}, or a
+// multi-file "diff" whose file names are taken relative to "root".
+func (s *VfsService) patchFiles(appId, userId string, payload map[string]interface{}) ([]*aether.FilePatch, error) {
+	type target struct{ path, diff, baseRevision string }
+	var targets []target
+	if list, ok := payload["patches"].([]interface{}); ok {
+		for _, v := range list {
+			item, _ := v.(map[string]interface{})
+			path, _ := item["path"].(string)
+			diff, _ := item["diff"].(string)
+			baseRevision, _ := item["baseRevision"].(string)
+			targets = append(targets, target{path, diff, baseRevision})
+		}
+	} else {
+		path, _ := payload["path"].(string)
+		diff, _ := payload["diff"].(string)
+		baseRevision, _ := payload["baseRevision"].(string)
+		if path == "" {
+			root, _ := payload["root"].(string)
+			return s.resolvePatch(appId, userId, root, diff, payload["baseRevisions"])
+		}
+		targets = append(targets, target{path, diff, baseRevision})
 	}
-	telemetryTopic.Publish(envelope)
+
+	var patches []*aether.FilePatch
+	for _, t := range targets {
+		files, err := aether.ParseUnifiedDiff(t.diff)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", t.path, err)
+		}
+		if len(files) != 1 {
+			return nil, fmt.Errorf("%s: diff covers %d files, expected one", t.path, len(files))
+		}
+		if files[0].Path, err = s.vfs.ResolveForApp(s.permissions, appId, userId, t.path, true); err != nil {
+			return nil, err
+		}
+		files[0].BaseRevision = t.baseRevision
+		patches = append(patches, files[0])
+	}
+	if len(patches) == 0 {
+		return nil, fmt.Errorf("no patches given")
+	}
+	return patches, nil
+}
+
+// resolvePatch parses a multi-file diff and resolves its file names against
+// root. baseRevisions optionally maps those names to base revisions.
+func (s *VfsService) resolvePatch(appId, userId, root, diff string, baseRevisions interface{}) ([]*aether.FilePatch, error) {
+	revisions, _ := baseRevisions.(map[string]interface{})
+	files, err := aether.ParseUnifiedDiff(diff)
+	if err != nil {
+		return nil, err
+	}
+	for _, f := range files {
+		if f.Path == "" {
+			return nil, fmt.Errorf("diff has hunks without file headers; give a path")
+		}
+		f.BaseRevision, _ = revisions[f.Path].(string)
+		name := f.Path
+		if root != "" {
+			name = strings.TrimSuffix(root, "/") + "/" + f.Path
+		}
+		if f.Path, err = s.vfs.ResolveForApp(s.permissions, appId, userId, name, true); err != nil {
+			return nil, err
+		}
+	}
+	return files, nil
+}
+
+// publishQuotaWarning sends a usage threshold warning raised by the VFS
+// module to the user it is about, or for an app's quota to the VFS admins.
+func (s *VfsService) publishQuotaWarning(warning aether.QuotaWarning) {
+	log.Printf("VFS Service: %s '%s' passed %.0f%% of its storage quota", warning.Kind, warning.ID, warning.Threshold*100)
+	users := s.vfs.Admins()
+	if warning.Kind == "user" {
+		users = []string{warning.ID}
+	}
+	for _, user := range users {
+		env := &aether.Envelope{}
+		if err := env.SetUserID(user); err != nil {
+			log.Printf("VFS Service: failed to address quota warning to %s: %v", user, err)
+			continue
+		}
+		s.publishResponse(env, "vfs:usage:warning", warning)
+	}
+}
+
+func (s *VfsService) publishTelemetry(operation, path string, err error, size int64) {
+	aether.PublishVfsTelemetry(s.broker, operation, path, err, size)
 }
 
 func (s *VfsService) publishResponse(originalEnv *aether.Envelope, topicName string, payload interface{}) {
@@ -283,11 +736,47 @@ func (s *VfsService) publishResponse(originalEnv *aether.Envelope, topicName str
 	responseTopic.Publish(responseEnv)
 }
 
+// publishFailure reports err on the request's error topic, with the details
+// added by failurePayload.
+func (s *VfsService) publishFailure(originalEnv *aether.Envelope, err error) {
+	s.publishErrorPayload(originalEnv, err.Error(), failurePayload(err))
+}
+
+// failurePayload builds the error payload for err. Revision conflicts carry a
+// "conflict" code and the file's current revision so clients can reload and
+// retry instead of overwriting someone else's change; lock conflicts carry a
+// "locked" code and the lock in the way; failed batches name the operation
+// that failed.
+func failurePayload(err error) map[string]interface{} {
+	payload := map[string]interface{}{"error": err.Error()}
+	var batchErr *aether.BatchError
+	if errors.As(err, &batchErr) {
+		payload["failedIndex"] = batchErr.Index
+	}
+	var conflict *aether.ConflictError
+	if errors.As(err, &conflict) {
+		payload["code"] = "conflict"
+		payload["path"] = conflict.Path
+		payload["expectedRevision"] = conflict.ExpectedRevision
+		payload["currentRevision"] = conflict.CurrentRevision
+	}
+	var locked *aether.LockedError
+	if errors.As(err, &locked) {
+		payload["code"] = "locked"
+		payload["path"] = locked.Path
+		payload["lock"] = locked.Lock
+	}
+	return payload
+}
+
 func (s *VfsService) publishError(originalEnv *aether.Envelope, errorMsg string) {
+	s.publishErrorPayload(originalEnv, errorMsg, map[string]interface{}{"error": errorMsg})
+}
+
+func (s *VfsService) publishErrorPayload(originalEnv *aether.Envelope, errorMsg string, errorPayload map[string]interface{}) {
 	errorTopicName := originalEnv.Topic + ":error"
 	errorTopic := s.broker.GetTopic(errorTopicName)
 
-	errorPayload := map[string]string{"error": errorMsg}
 	payloadBytes, _ := json.Marshal(errorPayload)
 
 	errorEnv := &aether.Envelope{
@@ -0,0 +1,138 @@
+package services
+
+import (
+	"aether/broker/aether"
+	"time"
+)
+
+// defaultShareLinkTTL is how long a share link lasts when the request does not say.
+const defaultShareLinkTTL = 7 * 24 * time.Hour
+
+// handleShare grants a user or group access to a path, or with "link" set
+// creates a share link to it. "expiresIn" is a lifetime in seconds.
+func (s *VfsService) handleShare(env *aether.Envelope, appId, userId string, payload map[string]interface{}) {
+	path, _ := payload["path"].(string)
+	access, _ := payload["access"].(string)
+	if access == "" {
+		access = aether.AccessRead
+	}
+	var ttl time.Duration
+	if seconds, ok := payload["expiresIn"].(float64); ok && seconds > 0 {
+		ttl = time.Duration(seconds * float64(time.Second))
+	}
+
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, false)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+
+	if link, _ := payload["link"].(bool); link {
+		if ttl == 0 {
+			ttl = defaultShareLinkTTL
+		}
+		shareLink, err := s.vfs.CreateShareLink(userId, key, access, ttl)
+		s.publishTelemetry("share_link", key, err, 0)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishResponse(env, "vfs:share:result", map[string]interface{}{
+			"success":   true,
+			"path":      path,
+			"link":      shareLink,
+			"sharePath": shareLink.SharePath(),
+		})
+		return
+	}
+
+	grant := aether.Grant{Access: access}
+	grant.User, _ = payload["user"].(string)
+	grant.Group, _ = payload["group"].(string)
+	if ttl > 0 {
+		grant.Expires = time.Now().Add(ttl)
+	}
+	g, err := s.vfs.Share(userId, key, grant)
+	s.publishTelemetry("share", key, err, 0)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	s.publishResponse(env, "vfs:share:result", map[string]interface{}{"success": true, "path": path, "grant": g})
+}
+
+// handleUnshare revokes a share link given its "token", or the grant on
+// "path" to "user" or "group".
+func (s *VfsService) handleUnshare(env *aether.Envelope, appId, userId string, payload map[string]interface{}) {
+	if token, _ := payload["token"].(string); token != "" {
+		err := s.vfs.RevokeShareLink(userId, token)
+		s.publishTelemetry("unshare_link", "", err, 0)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishResponse(env, "vfs:unshare:result", map[string]interface{}{"success": true, "token": token})
+		return
+	}
+
+	path, _ := payload["path"].(string)
+	user, _ := payload["user"].(string)
+	group, _ := payload["group"].(string)
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, false)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	err = s.vfs.Unshare(userId, key, user, group)
+	s.publishTelemetry("unshare", key, err, 0)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	s.publishResponse(env, "vfs:unshare:result", map[string]interface{}{"success": true, "path": path, "user": user, "group": group})
+}
+
+// handleShares lists the grants and links on "path" and below, or without a
+// path, what has been shared with the caller.
+func (s *VfsService) handleShares(env *aether.Envelope, appId, userId string, payload map[string]interface{}) {
+	path, _ := payload["path"].(string)
+	if path == "" {
+		grants, err := s.vfs.SharedWith(userId)
+		if err != nil {
+			s.publishError(env, err.Error())
+			return
+		}
+		s.publishResponse(env, "vfs:shares:result", map[string]interface{}{"sharedWithMe": grants})
+		return
+	}
+
+	key, err := s.vfs.ResolveForApp(s.permissions, appId, userId, path, false)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	grants, links, err := s.vfs.Shares(userId, key)
+	if err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	s.publishResponse(env, "vfs:shares:result", map[string]interface{}{"path": path, "grants": grants, "links": links})
+}
+
+// handleGroupSet replaces the members of the group named "group" with
+// "members", on behalf of userId.
+func (s *VfsService) handleGroupSet(env *aether.Envelope, userId string, payload map[string]interface{}) {
+	group, _ := payload["group"].(string)
+	membersData, _ := payload["members"].([]interface{})
+	members := make([]string, 0, len(membersData))
+	for _, v := range membersData {
+		if member, ok := v.(string); ok {
+			members = append(members, member)
+		}
+	}
+	if err := s.vfs.SetGroupMembers(userId, group, members); err != nil {
+		s.publishError(env, err.Error())
+		return
+	}
+	s.publishResponse(env, "vfs:group:set:result", map[string]interface{}{"success": true, "group": group, "members": members})
+}
@@ -0,0 +1,222 @@
+package services
+
+import (
+	"aether/broker/aether"
+	"encoding/json"
+	"fmt"
+	"log"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// maxWatchDebounce caps how long a watch may hold back events.
+const maxWatchDebounce = 10 * time.Second
+
+// vfsWatch is a live subscription to changes under a VFS path. Matching
+// events are published on the watch's own topic, "vfs:watch:<id>".
+type vfsWatch struct {
+	ID        string        `json:"watchId"`
+	UserID    string        `json:"-"`
+	SessionID string        `json:"-"` // The session that created the watch; it ends with it.
+	Path      string        `json:"path"`
+	Glob      string        `json:"glob,omitempty"`
+	Recursive bool          `json:"recursive"`
+	Debounce  time.Duration `json:"-"`
+	Topic     string        `json:"topic"`
+	meta      json.RawMessage
+
+	mu      sync.Mutex
+	pending []aether.ChangeEvent
+	byPath  map[string]int // index into pending, for coalescing
+	armed   bool           // a flush is already scheduled
+}
+
+// matches reports whether the watch covers the given path.
+func (w *vfsWatch) matches(p string) bool {
+	if p == "" {
+		return false
+	}
+	var rel string
+	switch {
+	case p == w.Path:
+		rel = path.Base(p)
+	case strings.HasPrefix(p, w.Path+"/"):
+		rel = strings.TrimPrefix(p, w.Path+"/")
+	default:
+		return false
+	}
+	if !w.Recursive && strings.Contains(rel, "/") {
+		return false
+	}
+	return w.Glob == "" || aether.MatchGlob(w.Glob, rel)
+}
+
+// add queues an event, merging it with any pending event for the same path.
+// It reports whether the caller should arm the debounce timer.
+func (w *vfsWatch) add(event aether.ChangeEvent) bool {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if i, ok := w.byPath[event.Path]; ok && event.Type != aether.ChangeMoved {
+		prev := w.pending[i]
+		// A file created and then modified within the window is still just "created".
+		if prev.Type == aether.ChangeCreated && event.Type == aether.ChangeModified {
+			event.Type = aether.ChangeCreated
+		}
+		w.pending[i] = event
+	} else {
+		w.byPath[event.Path] = len(w.pending)
+		w.pending = append(w.pending, event)
+	}
+
+	if w.armed {
+		return false
+	}
+	w.armed = true
+	return true
+}
+
+// drain returns and clears the pending events.
+func (w *vfsWatch) drain() []aether.ChangeEvent {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	events := w.pending
+	w.pending = nil
+	w.byPath = make(map[string]int)
+	w.armed = false
+	return events
+}
+
+// handleWatch registers a watch on key, the caller's resolved path. Patterns
+// go in the "glob" field and are matched relative to that path.
+func (s *VfsService) handleWatch(env *aether.Envelope, userId, key string, payloadData map[string]interface{}) {
+	glob, _ := payloadData["glob"].(string)
+	recursive, _ := payloadData["recursive"].(bool)
+	debounceMs, _ := payloadData["debounceMs"].(float64)
+
+	debounce := time.Duration(debounceMs) * time.Millisecond
+	if debounce < 0 {
+		debounce = 0
+	}
+	if debounce > maxWatchDebounce {
+		debounce = maxWatchDebounce
+	}
+
+	if glob != "" {
+		if _, err := path.Match(strings.ReplaceAll(glob, "**", "*"), ""); err != nil {
+			s.publishError(env, fmt.Sprintf("Invalid glob pattern %q: %v", glob, err))
+			return
+		}
+	}
+
+	var meta struct {
+		SessionId string `json:"sessionId"`
+	}
+	json.Unmarshal(env.Meta, &meta)
+
+	id := uuid.New().String()
+	watch := &vfsWatch{
+		ID:        id,
+		UserID:    userId,
+		SessionID: meta.SessionId,
+		Path:      aether.VirtualPath(key),
+		Glob:      glob,
+		Recursive: recursive,
+		Debounce:  debounce,
+		Topic:     "vfs:watch:" + id,
+		meta:      env.Meta,
+		byPath:    make(map[string]int),
+	}
+
+	s.watchesMu.Lock()
+	s.watches[id] = watch
+	s.watchesMu.Unlock()
+
+	// Only the watch's user may follow its topic.
+	s.broker.OpenPrivateTopic(watch.Topic, userId)
+	s.publishResponse(env, "vfs:watch:result", watch)
+}
+
+func (s *VfsService) handleUnwatch(env *aether.Envelope, userId string, payloadData map[string]interface{}) {
+	id, _ := payloadData["watchId"].(string)
+
+	s.watchesMu.Lock()
+	watch, ok := s.watches[id]
+	if ok && watch.UserID == userId {
+		delete(s.watches, id)
+	}
+	s.watchesMu.Unlock()
+
+	if !ok || watch.UserID != userId {
+		s.publishError(env, "Watch not found: "+id)
+		return
+	}
+	s.broker.CloseTopic(watch.Topic)
+	s.publishResponse(env, "vfs:unwatch:result", map[string]interface{}{"success": true, "watchId": id})
+}
+
+// dropSessionWatches removes the watches created in a session that has
+// ended, along with their topics. It is registered as a session handler.
+func (s *VfsService) dropSessionWatches(userId, sessionId string) {
+	s.watchesMu.Lock()
+	var dropped []*vfsWatch
+	for id, watch := range s.watches {
+		if watch.SessionID != "" && watch.SessionID == sessionId {
+			delete(s.watches, id)
+			dropped = append(dropped, watch)
+		}
+	}
+	s.watchesMu.Unlock()
+
+	for _, watch := range dropped {
+		s.broker.CloseTopic(watch.Topic)
+	}
+	if len(dropped) > 0 {
+		log.Printf("VFS Service: dropped %d watches of %s's closed session", len(dropped), userId)
+	}
+}
+
+// notifyWatches is registered with the VFSModule and fans each change out to
+// the watches that cover it.
+func (s *VfsService) notifyWatches(event aether.ChangeEvent) {
+	s.watchesMu.RLock()
+	var matched []*vfsWatch
+	for _, watch := range s.watches {
+		if watch.matches(event.Path) || watch.matches(event.OldPath) {
+			matched = append(matched, watch)
+		}
+	}
+	s.watchesMu.RUnlock()
+
+	for _, watch := range matched {
+		if watch.Debounce == 0 {
+			s.publishWatchEvents(watch, []aether.ChangeEvent{event})
+			continue
+		}
+		if watch.add(event) {
+			time.AfterFunc(watch.Debounce, func() {
+				if events := watch.drain(); len(events) > 0 {
+					s.publishWatchEvents(watch, events)
+				}
+			})
+		}
+	}
+}
+
+func (s *VfsService) publishWatchEvents(watch *vfsWatch, events []aether.ChangeEvent) {
+	s.watchesMu.RLock()
+	_, active := s.watches[watch.ID]
+	s.watchesMu.RUnlock()
+	if !active {
+		return
+	}
+
+	s.publishResponse(&aether.Envelope{Meta: watch.meta}, watch.Topic, map[string]interface{}{
+		"watchId": watch.ID,
+		"events":  events,
+	})
+}
@@ -0,0 +1,196 @@
+package aether
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"time"
+)
+
+// Results of the host functions, as defined by the broker.
+const (
+	statusOK          int32 = 0
+	statusDenied      int32 = -1
+	statusInvalid     int32 = -2
+	statusNotFound    int32 = -3
+	statusTimeout     int32 = -4
+	statusTooSmall    int32 = -5
+	statusClosed      int32 = -6
+	statusLimit       int32 = -7
+	statusUnavailable int32 = -8
+)
+
+var (
+	ErrDenied      = errors.New("aether: permission denied")
+	ErrInvalid     = errors.New("aether: invalid topic or payload")
+	ErrNotFound    = errors.New("aether: unknown subscription")
+	ErrTimeout     = errors.New("aether: timed out")
+	ErrClosed      = errors.New("aether: subscription closed")
+	ErrLimit       = errors.New("aether: too many subscriptions")
+	ErrUnavailable = errors.New("aether: bus unavailable")
+)
+
+func statusError(status int32) error {
+	switch status {
+	case statusOK:
+		return nil
+	case statusDenied:
+		return ErrDenied
+	case statusInvalid:
+		return ErrInvalid
+	case statusNotFound:
+		return ErrNotFound
+	case statusTimeout:
+		return ErrTimeout
+	case statusClosed:
+		return ErrClosed
+	case statusLimit:
+		return ErrLimit
+	case statusUnavailable:
+		return ErrUnavailable
+	}
+	return fmt.Errorf("aether: unexpected status %d", status)
+}
+
+// Envelope is a message received from the bus.
+type Envelope struct {
+	ID          string          `json:"id"`
+	Topic       string          `json:"topic,omitempty"`
+	Type        string          `json:"type,omitempty"`
+	ContentType string          `json:"contentType,omitempty"`
+	Payload     json.RawMessage `json:"payload,omitempty"`
+	Meta        json.RawMessage `json:"meta,omitempty"`
+	CreatedAt   time.Time       `json:"createdAt,omitempty"`
+}
+
+// Decode unmarshals the envelope's payload into v.
+func (e *Envelope) Decode(v any) error {
+	return json.Unmarshal(e.Payload, v)
+}
+
+// RequestError is the error a service replied to a request with.
+type RequestError struct {
+	Topic   string
+	Message string
+}
+
+func (e *RequestError) Error() string {
+	return fmt.Sprintf("aether: %s: %s", e.Topic, e.Message)
+}
+
+// Level is the severity of a logged message.
+type Level int32
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+// Publish publishes payload, marshalled to JSON, to topic. A nil payload
+// publishes a message without one.
+func Publish(topic string, payload any) error {
+	data, err := marshal(payload)
+	if err != nil {
+		return err
+	}
+	return statusError(hostPublish(topic, data))
+}
+
+// Subscription is a topic followed with Subscribe.
+type Subscription struct {
+	handle int32
+	buf    []byte
+}
+
+// Subscribe follows topic. Messages published from then on, and recent ones
+// the broker keeps, are returned by Poll until Close is called.
+func Subscribe(topic string) (*Subscription, error) {
+	handle := hostSubscribe(topic)
+	if handle < 0 {
+		return nil, statusError(handle)
+	}
+	return &Subscription{handle: handle}, nil
+}
+
+// Poll waits up to timeout for the next message. A zero timeout does not
+// wait and a negative one waits until a message arrives. It returns
+// ErrTimeout if none did, and ErrClosed once the broker has dropped the
+// subscription, for instance because it fell too far behind. The whole
+// guest, including its other goroutines, is paused while Poll waits.
+func (s *Subscription) Poll(timeout time.Duration) (*Envelope, error) {
+	ms := int32(-1)
+	if timeout >= 0 {
+		ms = int32(min(timeout.Milliseconds(), math.MaxInt32))
+	}
+	if s.buf == nil {
+		s.buf = make([]byte, 4096)
+	}
+	for {
+		n, status := hostPoll(s.handle, ms, s.buf)
+		if status == statusTooSmall {
+			// The message is kept for the next call.
+			s.buf = make([]byte, n)
+			continue
+		}
+		if err := statusError(status); err != nil {
+			return nil, err
+		}
+		env := new(Envelope)
+		if err := json.Unmarshal(s.buf[:n], env); err != nil {
+			return nil, err
+		}
+		return env, nil
+	}
+}
+
+// Close stops following the topic.
+func (s *Subscription) Close() error {
+	return statusError(hostUnsubscribe(s.handle))
+}
+
+// Request publishes payload to topic and waits up to timeout for the
+// service's reply on the topic's ":result" topic. A reply on its ":error"
+// topic is returned as a *RequestError.
+func Request(topic string, payload any, timeout time.Duration) (*Envelope, error) {
+	data, err := marshal(payload)
+	if err != nil {
+		return nil, err
+	}
+	handle := hostRequest(topic, data)
+	if handle < 0 {
+		return nil, statusError(handle)
+	}
+	sub := &Subscription{handle: handle}
+	defer sub.Close()
+	reply, err := sub.Poll(timeout)
+	if err != nil {
+		return nil, err
+	}
+	if reply.Topic == topic+":error" {
+		var body struct {
+			Error string `json:"error"`
+		}
+		reply.Decode(&body)
+		return nil, &RequestError{Topic: topic, Message: body.Error}
+	}
+	return reply, nil
+}
+
+// Log records msg in the broker's log and publishes it to the vm:log topic,
+// tagged with the instance it came from. It needs the bus_log permission.
+func Log(level Level, msg string) error {
+	return statusError(hostLog(int32(level), msg))
+}
+
+func marshal(payload any) ([]byte, error) {
+	if payload == nil {
+		return nil, nil
+	}
+	if raw, ok := payload.(json.RawMessage); ok {
+		return raw, nil
+	}
+	return json.Marshal(payload)
+}
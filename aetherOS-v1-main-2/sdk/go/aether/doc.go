@@ -0,0 +1,18 @@
+// Package aether lets Go programs running as WASM guests under the broker's
+// compute service use the message bus. Build guests with GOOS=wasip1
+// GOARCH=wasm; they call the host functions of the broker's "aether" module.
+//
+// Every call is made as the guest's app and is subject to its manifest: a
+// topic may only be published to with the bus_publish permission, and
+// followed with bus_subscribe. Either may be true, for every topic, or a
+// topic pattern or list of patterns such as "vfs:*". Request needs
+// bus_publish for the topic and bus_subscribe for its ":result" topic. Log
+// needs bus_log, which is not scoped since messages only go to vm:log.
+//
+//	if err := aether.Publish("sensors:reading", map[string]float64{"temp": 21.5}); err != nil {
+//		aether.Log(aether.LevelError, err.Error())
+//	}
+//	reply, err := aether.Request("vfs:list", map[string]string{"path": "/home"}, 5*time.Second)
+//
+// Outside wasip1 the functions return ErrUnavailable.
+package aether
@@ -0,0 +1,10 @@
+//go:build !wasip1
+
+package aether
+
+func hostPublish(topic string, payload []byte) int32            { return statusUnavailable }
+func hostSubscribe(topic string) int32                          { return statusUnavailable }
+func hostRequest(topic string, payload []byte) int32            { return statusUnavailable }
+func hostPoll(handle, timeoutMs int32, buf []byte) (int, int32) { return 0, statusUnavailable }
+func hostUnsubscribe(handle int32) int32                        { return statusUnavailable }
+func hostLog(level int32, msg string) int32                     { return statusUnavailable }
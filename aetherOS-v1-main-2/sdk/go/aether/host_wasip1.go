@@ -0,0 +1,49 @@
+//go:build wasip1
+
+package aether
+
+import "unsafe"
+
+//go:wasmimport aether publish
+func publish(topic unsafe.Pointer, topicLen uint32, payload unsafe.Pointer, payloadLen uint32) int32
+
+//go:wasmimport aether subscribe
+func subscribe(topic unsafe.Pointer, topicLen uint32) int32
+
+//go:wasmimport aether request
+func request(topic unsafe.Pointer, topicLen uint32, payload unsafe.Pointer, payloadLen uint32) int32
+
+//go:wasmimport aether poll
+func poll(handle int32, timeoutMs int32, buf unsafe.Pointer, bufLen uint32, n unsafe.Pointer) int32
+
+//go:wasmimport aether unsubscribe
+func unsubscribe(handle int32) int32
+
+//go:wasmimport aether log
+func log(level int32, msg unsafe.Pointer, msgLen uint32) int32
+
+func hostPublish(topic string, payload []byte) int32 {
+	return publish(unsafe.Pointer(unsafe.StringData(topic)), uint32(len(topic)), unsafe.Pointer(unsafe.SliceData(payload)), uint32(len(payload)))
+}
+
+func hostSubscribe(topic string) int32 {
+	return subscribe(unsafe.Pointer(unsafe.StringData(topic)), uint32(len(topic)))
+}
+
+func hostRequest(topic string, payload []byte) int32 {
+	return request(unsafe.Pointer(unsafe.StringData(topic)), uint32(len(topic)), unsafe.Pointer(unsafe.SliceData(payload)), uint32(len(payload)))
+}
+
+func hostPoll(handle, timeoutMs int32, buf []byte) (int, int32) {
+	var n uint32
+	status := poll(handle, timeoutMs, unsafe.Pointer(unsafe.SliceData(buf)), uint32(len(buf)), unsafe.Pointer(&n))
+	return int(n), status
+}
+
+func hostUnsubscribe(handle int32) int32 {
+	return unsubscribe(handle)
+}
+
+func hostLog(level int32, msg string) int32 {
+	return log(level, unsafe.Pointer(unsafe.StringData(msg)), uint32(len(msg)))
+}
@@ -12,6 +12,34 @@ type HistoryItem = {
   content: string;
 };
 
+const formatBytes = (bytes: number) => {
+  if (bytes < 1024) return `${bytes}B`;
+  if (bytes < 1024 * 1024) return `${(bytes / 1024).toFixed(1)}K`;
+  return `${(bytes / (1024 * 1024)).toFixed(1)}M`;
+};
+
+// Output arrives in chunks of text, or of base64 when it is not valid UTF-8.
+const decodeChunk = (payload: { data: string; encoding?: string }) => {
+  let text = payload.data;
+  if (payload.encoding === 'base64') {
+    const bytes = Uint8Array.from(atob(payload.data), c => c.charCodeAt(0));
+    text = new TextDecoder().decode(bytes);
+  }
+  return text.endsWith('\n') ? text.slice(0, -1) : text;
+};
+
+// toCreateRequest turns `<appId|path|base64_wasm> [args...]` into a vm:create payload.
+const toCreateRequest = (words: string[]) => {
+  if (words.length === 0) return null;
+  const [target, ...args] = words;
+  if (target.startsWith('/') || target.endsWith('.wasm')) {
+    return { path: target, args };
+  } else if (target.length > 100) {
+    return { wasmBase64: target, args };
+  }
+  return { appId: target, args };
+};
+
 export default function VmTerminalApp() {
   const { publish, subscribe } = useAppAether();
   const [input, setInput] = useState('');
@@ -23,7 +51,6 @@ export default function VmTerminalApp() {
   const [isLoading, setIsLoading] = useState(false);
   const endOfHistoryRef = useRef<HTMLDivElement>(null);
   const inputRef = useRef<HTMLInputElement>(null);
-  const [activeInstances, setActiveInstances] = useState<Record<string, boolean>>({});
 
   const username = 'user';
   const hostname = 'aether-ai';
@@ -42,7 +69,9 @@ export default function VmTerminalApp() {
       "agent.taskgraph.created", "agent.taskgraph.started",
       "agent.taskgraph.completed", "agent.taskgraph.failed",
       "agent.tasknode.started", "agent.tasknode.completed", "agent.tasknode.failed",
-      "vm:started", "vm:stdout", "vm:stderr", "vm:exited", "vm:killed", "vm:crashed", "vm:create:error", "vm:kill:error", "vm:stdin:error"
+      "vm:started", "vm:stdout", "vm:stderr", "vm:exited", "vm:killed", "vm:crashed", "vm:create:error", "vm:kill:error", "vm:stdin:error",
+      "vm:list:result", "vm:list:error", "vm:killall:result", "vm:killall:error",
+      "vm:pipeline:started", "vm:pipeline:exited", "vm:pipeline:error"
     ];
 
     const handleEvent = (payload: any, envelope: any) => {
@@ -77,36 +106,60 @@ export default function VmTerminalApp() {
                 break;
             case 'vm:started':
                 message = `[VM] Instance started with ID: ${payload.instanceId}`;
-                setActiveInstances(prev => ({...prev, [payload.instanceId]: true}));
                 break;
             case 'vm:stdout':
-                message = payload.data;
+                message = decodeChunk(payload);
                 type = 'stdout';
                 break;
             case 'vm:stderr':
-                message = `[stderr] ${payload.data}`;
+                message = `[stderr] ${decodeChunk(payload)}`;
                 type = 'stderr';
                 break;
             case 'vm:exited':
-                message = `[VM] Instance ${payload.instanceId} exited.`;
-                setActiveInstances(prev => {
-                    const newState = {...prev};
-                    delete newState[payload.instanceId];
-                    return newState;
-                });
+                message = payload.state === 'exited'
+                    ? `[VM] Instance ${payload.instanceId} exited with code ${payload.exitCode}.`
+                    : `[VM] Instance ${payload.instanceId} ${payload.state}.`;
                 break;
             case 'vm:killed':
-                 message = `[VM] Instance ${payload.instanceId} killed.`;
-                setActiveInstances(prev => {
-                    const newState = {...prev};
-                    delete newState[payload.instanceId];
-                    return newState;
-                });
+                 message = payload.limit
+                    ? `[VM] Instance ${payload.instanceId} killed: ${payload.error}.`
+                    : `[VM] Instance ${payload.instanceId} killed.`;
                  break;
+            case 'vm:list:result':
+                if (payload.instances.length === 0) {
+                    message = 'No active VM instances.';
+                } else {
+                    message = ['INSTANCE                              APP            STATE     STARTED   MEM     I/O',
+                        ...payload.instances.map((i: any) => [
+                            i.instanceId.padEnd(37),
+                            i.appId.padEnd(14),
+                            i.state.padEnd(9),
+                            new Date(i.startedAt).toLocaleTimeString().padEnd(9),
+                            formatBytes(i.memoryBytes).padEnd(7),
+                            `${formatBytes(i.stdinBytes)} in / ${formatBytes(i.outputBytes)} out`,
+                        ].join(' ')),
+                    ].join('\n');
+                }
+                type = 'response';
+                break;
+            case 'vm:pipeline:started':
+                message = `[VM] Pipeline ${payload.pipelineId} started: ${payload.instanceIds.join(' | ')}`;
+                break;
+            case 'vm:pipeline:exited':
+                message = payload.state === 'exited'
+                    ? `[VM] Pipeline ${payload.pipelineId} exited with code ${payload.exitCode}.`
+                    : `[VM] Pipeline ${payload.pipelineId} ${payload.state}.`;
+                break;
+            case 'vm:killall:result':
+                message = `[VM] Killed ${payload.instanceIds.length} instance(s).`;
+                break;
             case 'vm:crashed':
             case 'vm:create:error':
             case 'vm:kill:error':
             case 'vm:stdin:error':
+            case 'vm:list:error':
+            case 'vm:killall:error':
+            case 'vm:pipeline:error':
                 message = `[VM] Error: ${payload.error}`;
                 type = 'error';
                 break;
@@ -139,26 +192,30 @@ export default function VmTerminalApp() {
         case 'help':
             setHistory(prev => [...prev, 
                 { type: 'response', content: 'Available VM Commands:'},
-                { type: 'response', content: '  run <base64_wasm> - Runs a WASM binary.'},
+                { type: 'response', content: '  run <appId|path|base64_wasm> [args...] - Runs an installed app, a .wasm file or a WASM binary.'},
+                { type: 'response', content: '  run <a> [args...] | <b> [args...] - Runs a pipeline, feeding each stdout to the next stdin.'},
                 { type: 'response', content: '  stdin <instanceId> <data> - Sends data to a running VM.'},
                 { type: 'response', content: '  kill <instanceId> - Stops a running VM.'},
+                { type: 'response', content: '  killall <appId> - Stops all your running VMs of an app.'},
                 { type: 'response', content: '  ps - Lists running VM instances.'},
                 { type: 'response', content: 'Any other input is treated as a natural language prompt for the AI Agent.'},
             ]);
             break;
         case 'ps':
-            const instanceIds = Object.keys(activeInstances);
-            if (instanceIds.length === 0) {
-                 setHistory(prev => [...prev, { type: 'response', content: 'No active VM instances.'}]);
-            } else {
-                 setHistory(prev => [...prev, { type: 'response', content: 'Active VM Instances:'}, ...instanceIds.map(id => ({ type: 'response', content: `  - ${id}` } as HistoryItem))]);
-            }
+            publish('vm:list', {});
             break;
         case 'run':
             if (args.length < 1) {
-                setHistory(prev => [...prev, { type: 'error', content: 'Usage: run <base64_wasm>'}]);
+                setHistory(prev => [...prev, { type: 'error', content: 'Usage: run <appId|path|base64_wasm> [args...]'}]);
             } else {
-                publish('vm:create', { wasmBase64: args[0] });
+                const stages = args.join(' ').split('|').map(stage => toCreateRequest(stage.trim().split(' ').filter(Boolean)));
+                if (stages.some(stage => stage === null)) {
+                    setHistory(prev => [...prev, { type: 'error', content: 'Usage: run <a> [args...] | <b> [args...]'}]);
+                } else if (stages.length > 1) {
+                    publish('vm:pipeline', { stages });
+                } else {
+                    publish('vm:create', stages[0]);
+                }
             }
             break;
         case 'stdin':
@@ -175,6 +232,13 @@ export default function VmTerminalApp() {
                 publish('vm:kill', { instanceId: args[0] });
             }
             break;
+        case 'killall':
+            if (args.length < 1) {
+                setHistory(prev => [...prev, { type: 'error', content: 'Usage: killall <appId>'}]);
+            } else {
+                publish('vm:killall', { appId: args[0] });
+            }
+            break;
         default:
             setIsLoading(true);
             publish('ai:agent', { prompt: command });